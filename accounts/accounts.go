@@ -0,0 +1,495 @@
+// Package accounts creates, edits and deletes users together with their
+// partitions. It backs both the admin API and the `satufile users`
+// commands.
+package accounts
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/satufile/satufile/dedup"
+	"github.com/satufile/satufile/encryption"
+	"github.com/satufile/satufile/search"
+	"github.com/satufile/satufile/share"
+	"github.com/satufile/satufile/spaces"
+	"github.com/satufile/satufile/system/partition"
+	"github.com/satufile/satufile/trash"
+	"github.com/satufile/satufile/uploads"
+	"github.com/satufile/satufile/users"
+	"github.com/satufile/satufile/versions"
+	"github.com/satufile/satufile/vfs"
+)
+
+var (
+	// ErrInvalid wraps input that cannot be applied to a user
+	ErrInvalid = errors.New("invalid user")
+	// ErrLastAdmin is returned when a change would leave no admin
+	ErrLastAdmin = errors.New("at least one admin must remain")
+	// ErrQuotaBelowUsage is returned when shrinking a quota below what the
+	// partition already holds
+	ErrQuotaBelowUsage = errors.New("quota is below current usage")
+)
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{1,49}$`)
+
+// Data policies for Delete
+const (
+	DataArchive = "archive" // move the partition to the archive folder
+	DataRemove  = "remove"  // delete the partition
+)
+
+// PermissionNames returns the names accepted by ApplyPermissions
+func PermissionNames() []string {
+	return users.PermissionNames()
+}
+
+// HasPermission reports whether the named permission is granted in perm
+func HasPermission(perm users.Permissions, name string) bool {
+	field := perm.Field(name)
+	return field != nil && *field
+}
+
+// DefaultPermissions are given to new users unless overridden
+func DefaultPermissions() users.Permissions {
+	return users.Permissions{
+		Create:   true,
+		Rename:   true,
+		Modify:   true,
+		Delete:   true,
+		Share:    true,
+		Download: true,
+	}
+}
+
+// ApplyPermissions sets the named permissions on perm
+func ApplyPermissions(perm *users.Permissions, changes map[string]bool) error {
+	for name, value := range changes {
+		field := perm.Field(name)
+		if field == nil {
+			return fmt.Errorf("%w: unknown permission %q (valid: %s)", ErrInvalid, name, strings.Join(PermissionNames(), ", "))
+		}
+		*field = value
+	}
+	return nil
+}
+
+// NewUser describes a user to create
+type NewUser struct {
+	Username            string
+	Password            string
+	Email               string
+	Scope               string          // defaults to "/"
+	Permissions         map[string]bool // applied over DefaultPermissions
+	StorageAllocationGb int
+	MustChangePassword  bool   // ask the user for a new password at first login
+	Backend             string // storage backend of the partition; empty for the local disk
+	Encrypted           bool   // encrypt the partition at rest; needs a master key
+}
+
+// Changes are applied by Update; nil fields are left alone
+type Changes struct {
+	Email               *string
+	Password            *string
+	Scope               *string
+	Locale              *string
+	MustChangePassword  *bool
+	Permissions         map[string]bool
+	StorageAllocationGb *int
+}
+
+// ArchiveDir returns where deleted users' partitions are archived on a
+// server whose root directory is root
+func ArchiveDir(root string) string {
+	return filepath.Join(filepath.Dir(partition.BasePath(root)), "archive")
+}
+
+// backendArchiveDir is where partitions on other storage backends are
+// archived, on the same backend. Usernames start with a letter or digit,
+// so no partition can be named like it.
+const backendArchiveDir = "/.archive"
+
+// Manager creates and removes users and their partitions
+type Manager struct {
+	db         *gorm.DB
+	users      *users.Repository
+	storage    partition.StorageManager
+	archiveDir string
+	index      *search.Index // optional, forgets deleted users
+	spaces     *spaces.Store // optional, drops deleted users from spaces
+}
+
+// NewManager creates a manager provisioning partitions with storage and
+// archiving deleted users' data below archiveDir
+func NewManager(db *gorm.DB, userRepo *users.Repository, storage partition.StorageManager, archiveDir string) *Manager {
+	return &Manager{
+		db:         db,
+		users:      userRepo,
+		storage:    storage,
+		archiveDir: archiveDir,
+	}
+}
+
+// SetIndex makes Delete drop the user's search entries from index
+func (m *Manager) SetIndex(index *search.Index) {
+	m.index = index
+}
+
+// SetSpaces makes Delete remove the user's access to shared spaces and
+// the items they moved to the spaces' trash
+func (m *Manager) SetSpaces(store *spaces.Store) {
+	m.spaces = store
+}
+
+// Create validates u, provisions its partition and stores the user
+func (m *Manager) Create(u NewUser) (*users.User, error) {
+	if !usernamePattern.MatchString(u.Username) || strings.Contains(u.Username, "..") {
+		return nil, fmt.Errorf("%w: username must be 2-50 letters, digits, '.', '_' or '-'", ErrInvalid)
+	}
+	if _, err := m.users.GetByUsername(u.Username); err == nil {
+		return nil, users.ErrUserExists
+	}
+	// Email is unique, so it cannot be left empty for more than one user
+	if err := m.checkEmail(0, u.Email); err != nil {
+		return nil, err
+	}
+	if err := partition.ValidateQuota(u.StorageAllocationGb); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	scope, err := cleanScope(u.Scope)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := users.HashPassword(u.Password)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	perm := DefaultPermissions()
+	if err := ApplyPermissions(&perm, u.Permissions); err != nil {
+		return nil, err
+	}
+	if u.Backend == "local" {
+		u.Backend = ""
+	}
+	fsys, err := vfs.Get(u.Backend)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	var dataKey []byte
+	if u.Encrypted {
+		if dataKey, err = encryption.NewDataKey(); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+		}
+		fsys = encryption.FS(fsys, dataKey)
+	}
+
+	// Never hand someone else's files to a new user
+	storagePath := m.storage.GetStoragePath(u.Username)
+	if u.Backend != "" {
+		storagePath = partition.BackendPath(u.Username)
+	}
+	var owners int64
+	m.db.Model(&users.User{}).Unscoped().Where("storage_path = ? AND COALESCE(backend, '') = ?", storagePath, u.Backend).Count(&owners)
+	if owners > 0 {
+		return nil, fmt.Errorf("%w: partition %s belongs to another user", ErrInvalid, storagePath)
+	}
+	_, statErr := fsys.Stat(storagePath)
+	existed := statErr == nil
+
+	// Encrypted partitions are provisioned through the encryption, so
+	// even the README is not stored in plaintext
+	remove := fsys.RemoveAll
+	if u.Backend == "" && !u.Encrypted {
+		storagePath, err = m.storage.InitializeStorage(u.Username, u.StorageAllocationGb)
+		remove = m.storage.Remove
+	} else {
+		err = partition.Provision(fsys, storagePath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage: %w", err)
+	}
+
+	user := &users.User{
+		Username:            u.Username,
+		Password:            hash,
+		Email:               u.Email,
+		Scope:               scope,
+		Locale:              users.DefaultLocale,
+		ViewMode:            "list",
+		MustChangePassword:  u.MustChangePassword,
+		Perm:                perm,
+		SetupStep:           "complete",
+		StoragePath:         storagePath,
+		StorageAllocationGb: u.StorageAllocationGb,
+		Backend:             u.Backend,
+		DataKey:             dataKey,
+	}
+	// The scope is the user's root, so it has to exist
+	if err := fsys.MkdirAll(user.Root(), partition.DirPermissions); err != nil {
+		if !existed {
+			remove(storagePath)
+		}
+		return nil, fmt.Errorf("failed to create scope: %w", err)
+	}
+
+	saved := *user
+	if err := m.users.Create(user); err != nil {
+		if !existed {
+			remove(storagePath)
+		}
+		return nil, err
+	}
+
+	// gorm applies column defaults to false fields on create (setup flags,
+	// permissions), so write the intended values back
+	saved.ID, saved.CreatedAt = user.ID, user.CreatedAt
+	if err := m.users.Update(&saved); err != nil {
+		return nil, err
+	}
+	return &saved, nil
+}
+
+// Update applies c to user and saves it
+func (m *Manager) Update(user *users.User, c Changes) error {
+	updated := *user
+
+	if c.Email != nil {
+		if err := m.checkEmail(user.ID, *c.Email); err != nil {
+			return err
+		}
+		updated.Email = *c.Email
+	}
+	if c.Password != nil {
+		hash, err := users.HashPassword(*c.Password)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalid, err)
+		}
+		updated.Password = hash
+		updated.IsDefaultPassword = false
+	}
+	if c.Scope != nil {
+		scope, err := cleanScope(*c.Scope)
+		if err != nil {
+			return err
+		}
+		updated.Scope = scope
+	}
+	if c.Locale != nil {
+		if !users.IsValidLocale(*c.Locale) {
+			return fmt.Errorf("%w: unsupported locale %q", ErrInvalid, *c.Locale)
+		}
+		updated.Locale = *c.Locale
+	}
+	if c.MustChangePassword != nil {
+		updated.MustChangePassword = *c.MustChangePassword
+	}
+	if c.Permissions != nil {
+		if err := ApplyPermissions(&updated.Perm, c.Permissions); err != nil {
+			return err
+		}
+		if user.Perm.Admin && !updated.Perm.Admin {
+			if err := m.requireOtherAdmin(user.ID); err != nil {
+				return err
+			}
+		}
+	}
+	if c.StorageAllocationGb != nil {
+		if err := m.checkQuota(user, *c.StorageAllocationGb); err != nil {
+			return err
+		}
+		updated.StorageAllocationGb = *c.StorageAllocationGb
+		// Partitions the kernel limits change size with the allocation
+		if user.Backend == "" && user.StoragePath != "" && updated.StorageAllocationGb != user.StorageAllocationGb {
+			if err := m.storage.Resize(user.StoragePath, updated.StorageAllocationGb); err != nil {
+				return fmt.Errorf("failed to resize storage: %w", err)
+			}
+		}
+	}
+
+	scopeChanged := updated.Scope != user.Scope
+	if scopeChanged && updated.StoragePath != "" {
+		if err := updated.FS().MkdirAll(updated.Root(), partition.DirPermissions); err != nil {
+			return fmt.Errorf("failed to create scope: %w", err)
+		}
+	}
+
+	if err := m.users.Update(&updated); err != nil {
+		return err
+	}
+	*user = updated
+
+	// Search entries are relative to the root, so index the new one
+	if scopeChanged && m.index != nil {
+		if err := m.index.Forget(user.ID); err != nil {
+			log.Printf("Accounts: failed to reset search index of %s: %v", user.Username, err)
+		}
+		go func(id uint, fsys vfs.FS, root string) {
+			if err := m.index.Ensure(id, fsys, root); err != nil {
+				log.Printf("Accounts: failed to index %s: %v", root, err)
+			}
+		}(user.ID, user.FS(), user.Root())
+	}
+	return nil
+}
+
+// checkEmail validates an email for the user with id (0 for a new user)
+func (m *Manager) checkEmail(id uint, email string) error {
+	if !strings.Contains(email, "@") {
+		return fmt.Errorf("%w: a valid email is required", ErrInvalid)
+	}
+	if other, err := m.users.GetByEmail(email); err == nil && other.ID != id {
+		return fmt.Errorf("%w: email %s is already in use", ErrInvalid, email)
+	}
+	return nil
+}
+
+// checkQuota validates a new allocation for user
+func (m *Manager) checkQuota(user *users.User, gb int) error {
+	if err := partition.ValidateQuota(gb); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	if user.StoragePath == "" {
+		return nil
+	}
+	usedGb, err := partition.CalculateStorageUsage(user.FS(), user.StoragePath)
+	if err != nil {
+		return err
+	}
+	if usedGb > float64(gb) {
+		return fmt.Errorf("%w: %s uses %.2f GB", ErrQuotaBelowUsage, user.Username, usedGb)
+	}
+	return nil
+}
+
+// Delete removes user, archiving or removing their partition according to
+// data (DataArchive or DataRemove). It returns the archive location, if
+// any.
+func (m *Manager) Delete(user *users.User, data string) (string, error) {
+	if data != DataArchive && data != DataRemove {
+		return "", fmt.Errorf("%w: data must be %q or %q", ErrInvalid, DataArchive, DataRemove)
+	}
+	if user.EffectivePerm().Admin {
+		if err := m.requireOtherAdmin(user.ID); err != nil {
+			return "", err
+		}
+	}
+
+	var archived string
+	if user.StoragePath != "" {
+		fsys := user.FS()
+		if _, err := fsys.Stat(user.StoragePath); err == nil {
+			switch data {
+			case DataArchive:
+				archiveDir := m.archiveDir
+				if user.Backend != "" {
+					archiveDir = backendArchiveDir
+				}
+				if err := fsys.MkdirAll(archiveDir, 0750); err != nil {
+					return "", fmt.Errorf("failed to create archive folder: %w", err)
+				}
+				archived = filepath.Join(archiveDir, fmt.Sprintf("%s-%s", filepath.Base(user.StoragePath), time.Now().Format("20060102-150405")))
+				var err error
+				if user.Backend != "" {
+					err = fsys.Rename(user.StoragePath, archived)
+					archived = user.Backend + ":" + archived
+				} else {
+					// Loop partitions are archived as their image
+					archived, err = m.storage.Archive(user.StoragePath, archived)
+				}
+				if err != nil {
+					return "", fmt.Errorf("failed to archive storage: %w", err)
+				}
+			case DataRemove:
+				remove := fsys.RemoveAll
+				if user.Backend == "" {
+					remove = m.storage.Remove
+				}
+				if err := remove(user.StoragePath); err != nil {
+					return "", fmt.Errorf("failed to remove storage: %w", err)
+				}
+			}
+		}
+	}
+
+	// Trash items are removed with their rows; those of spaces live in the
+	// space's folder rather than the partition
+	if m.spaces != nil {
+		var items []trash.TrashItem
+		m.db.Where("user_id = ? AND space_id <> 0", user.ID).Find(&items)
+		for _, item := range items {
+			os.RemoveAll(filepath.Join(m.spaces.Dir(item.SpaceID), trash.ItemPath(item.ID)))
+		}
+	}
+
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		for _, model := range []interface{}{
+			&trash.TrashItem{},
+			&spaces.Entry{},
+			&users.UserRole{},
+			&users.GroupMember{},
+			&users.PermissionOverride{},
+			&versions.Version{},
+			&uploads.Session{},
+			&dedup.Chunk{},
+		} {
+			if !tx.Migrator().HasTable(model) {
+				continue
+			}
+			if err := tx.Where("user_id = ?", user.ID).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		// Their share links stop working with the files they point to
+		if tx.Migrator().HasTable(&share.Link{}) {
+			if err := tx.Where("owner_id = ?", user.ID).Delete(&share.Link{}).Error; err != nil {
+				return err
+			}
+		}
+		// The username becomes available again
+		return tx.Unscoped().Delete(&users.User{}, user.ID).Error
+	})
+	if err != nil {
+		return archived, err
+	}
+
+	if m.index != nil {
+		if err := m.index.Forget(user.ID); err != nil {
+			return archived, err
+		}
+	}
+	return archived, nil
+}
+
+// requireOtherAdmin fails unless a user other than id is an admin, by
+// their own flag or through a role
+func (m *Manager) requireOtherAdmin(id uint) error {
+	all, err := m.users.List()
+	if err != nil {
+		return err
+	}
+	for i := range all {
+		if all[i].ID != id && all[i].EffectivePerm().Admin {
+			return nil
+		}
+	}
+	return ErrLastAdmin
+}
+
+// cleanScope normalises a scope, the folder a user is confined to
+func cleanScope(scope string) (string, error) {
+	if scope == "" {
+		return "/", nil
+	}
+	clean := filepath.ToSlash(filepath.Clean("/" + scope))
+	if strings.Contains(scope, "..") {
+		return "", fmt.Errorf("%w: scope must not contain '..'", ErrInvalid)
+	}
+	return clean, nil
+}
@@ -29,6 +29,8 @@ type Claims struct {
 	UserID   uint   `json:"userId"`
 	Username string `json:"username"`
 	IsAdmin  bool   `json:"isAdmin"`
+	// Perm are the user's effective permissions when the token was issued
+	Perm users.Permissions `json:"perm"`
 	// OriginalIssuedAt tracks the very first login in a chain of renewals
 	OriginalIssuedAt int64 `json:"oia,omitempty"`
 	jwt.RegisteredClaims
@@ -53,7 +55,8 @@ func GenerateTokenWithOIA(user *users.User, expiration time.Duration, oia int64)
 	claims := &Claims{
 		UserID:           user.ID,
 		Username:         user.Username,
-		IsAdmin:          user.Perm.Admin,
+		IsAdmin:          user.EffectivePerm().Admin,
+		Perm:             user.EffectivePerm(),
 		OriginalIssuedAt: oia,
 		RegisteredClaims: jwt.RegisteredClaims{
 			Issuer:    DefaultIssuer,
@@ -3,8 +3,10 @@ package auth
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/satufile/satufile/users"
 )
@@ -19,6 +21,9 @@ const (
 	ClaimsContextKey ContextKey = "claims"
 )
 
+// DAVPrefix is the URL prefix the WebDAV server is mounted on
+const DAVPrefix = "/dav"
+
 // SetupWhitelist contains routes that bypass setup check
 var SetupWhitelist = map[string]bool{
 	"/api/setup/status":    true,
@@ -67,8 +72,63 @@ func extractToken(r *http.Request) string {
 	return strings.TrimSpace(token)
 }
 
-// authenticate handles the core authentication logic
+// ErrAccountLocked is returned when basic credentials target a locked account
+var ErrAccountLocked = errors.New("account is temporarily locked")
+
+// ErrBasicNotAllowed is returned for basic credentials outside WebDAV
+var ErrBasicNotAllowed = errors.New("basic authentication is only accepted for WebDAV")
+
+// authenticateBasic verifies HTTP Basic credentials (used by WebDAV clients)
+// with the same password check and lockout rules as the login endpoint
+func authenticateBasic(userRepo *users.Repository, r *http.Request, username, password string) (*users.User, *Claims, error) {
+	ip := r.RemoteAddr
+	if cfIP := r.Header.Get("CF-Connecting-IP"); cfIP != "" {
+		ip = cfIP
+	}
+
+	user, err := userRepo.GetByUsername(username)
+	if err != nil {
+		if errors.Is(err, users.ErrUserNotFound) {
+			userRepo.RecordLoginAttempt(username, ip, false)
+		}
+		return nil, nil, err
+	}
+
+	if user.LockedUntil != nil && user.LockedUntil.After(time.Now()) {
+		return nil, nil, ErrAccountLocked
+	}
+
+	if err := users.CheckPassword(password, user.Password); err != nil {
+		userRepo.RecordLoginAttempt(username, ip, false)
+		return nil, nil, err
+	}
+
+	// Only reset the failure counter; recording every successful basic
+	// request would flood the login history
+	if user.FailedAttempts > 0 {
+		userRepo.RecordLoginAttempt(username, ip, true)
+	}
+
+	claims := &Claims{
+		UserID:   user.ID,
+		Username: user.Username,
+		IsAdmin:  user.EffectivePerm().Admin,
+		Perm:     user.EffectivePerm(),
+	}
+	return user, claims, nil
+}
+
+// authenticate handles the core authentication logic. HTTP Basic is only
+// accepted by the WebDAV server, which is behind the login rate limit;
+// everything else needs a token.
 func authenticate(userRepo *users.Repository, r *http.Request) (*users.User, *Claims, error) {
+	if username, password, ok := r.BasicAuth(); ok {
+		if !isDAVRequest(r) {
+			return nil, nil, ErrBasicNotAllowed
+		}
+		return authenticateBasic(userRepo, r, username, password)
+	}
+
 	tokenString := extractToken(r)
 	if tokenString == "" {
 		return nil, nil, http.ErrNoCookie
@@ -117,6 +177,10 @@ func RequireAuth(userRepo *users.Repository) func(http.Handler) http.Handler {
 			user, claims, err := authenticate(userRepo, r)
 
 			if err != nil {
+				// WebDAV clients only send credentials after a Basic challenge
+				if isDAVRequest(r) {
+					w.Header().Set("WWW-Authenticate", `Basic realm="SatuFile", charset="UTF-8"`)
+				}
 				http.Error(w, "Unauthorized", http.StatusUnauthorized)
 				return
 			}
@@ -125,8 +189,8 @@ func RequireAuth(userRepo *users.Repository) func(http.Handler) http.Handler {
 			if user.ForceSetup || user.IsDefaultPassword {
 				// Check if route is whitelisted
 				if !isSetupWhitelisted(r) {
-					// For API requests, return 403 Forbidden with JSON
-					if strings.HasPrefix(r.URL.Path, "/api/") {
+					// For API and WebDAV requests, return 403 Forbidden with JSON
+					if strings.HasPrefix(r.URL.Path, "/api/") || isDAVRequest(r) {
 						w.Header().Set("Content-Type", "application/json")
 						w.WriteHeader(http.StatusForbidden)
 						json.NewEncoder(w).Encode(map[string]string{
@@ -168,6 +232,11 @@ func isSetupWhitelisted(r *http.Request) bool {
 	return false
 }
 
+// isDAVRequest checks if the request targets the WebDAV endpoint
+func isDAVRequest(r *http.Request) bool {
+	return r.URL.Path == DAVPrefix || strings.HasPrefix(r.URL.Path, DAVPrefix+"/")
+}
+
 // OptionalAuth is middleware that optionally authenticates
 func OptionalAuth(userRepo *users.Repository) func(http.Handler) http.Handler {
 	return Middleware(userRepo, false)
@@ -178,7 +247,7 @@ func RequireAdmin(userRepo *users.Repository) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return RequireAuth(userRepo)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			user := GetUserFromContext(r.Context())
-			if user == nil || !user.Perm.Admin {
+			if user == nil || !user.EffectivePerm().Admin {
 				http.Error(w, "Forbidden", http.StatusForbidden)
 				return
 			}
@@ -10,7 +10,7 @@ cd ..
 echo "Building Backend..."
 # Embed frontend into binary if we were using embed, but current main.go uses -r flag for root.
 # Assuming we want a single binary that serves the built frontend.
-go build -o satufile main.go
+go build -tags sqlite_fts5 -o satufile main.go
 
 echo "Build Complete!"
 echo "Run with: ./satufile"
@@ -0,0 +1,279 @@
+// Package checksum computes, verifies and persists file digests (SHA-256
+// and CRC32C). Digests are keyed by inode, so they survive renames and
+// moves and are shared by deduplicated hardlinks; a changed size or mtime
+// invalidates them.
+package checksum
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/satufile/satufile/files"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrMismatch means received data does not match the client's checksum
+var ErrMismatch = errors.New("checksum mismatch")
+
+// Sums holds lowercase hex digests; empty fields are unknown
+type Sums struct {
+	SHA256 string `json:"sha256,omitempty"`
+	CRC32C string `json:"crc32c,omitempty"`
+}
+
+// Empty reports whether no digest is set
+func (s Sums) Empty() bool {
+	return s.SHA256 == "" && s.CRC32C == ""
+}
+
+// Verify compares the digests set in expected against actual
+func (s Sums) Verify(actual Sums) error {
+	if s.SHA256 != "" && s.SHA256 != actual.SHA256 {
+		return fmt.Errorf("%w: sha256 is %s", ErrMismatch, actual.SHA256)
+	}
+	if s.CRC32C != "" && s.CRC32C != actual.CRC32C {
+		return fmt.Errorf("%w: crc32c is %s", ErrMismatch, actual.CRC32C)
+	}
+	return nil
+}
+
+// Validate checks that the set digests are well-formed hex and normalises
+// them to lowercase
+func (s *Sums) Validate() error {
+	s.SHA256 = strings.ToLower(s.SHA256)
+	s.CRC32C = strings.ToLower(s.CRC32C)
+	if s.SHA256 != "" && !isHex(s.SHA256, sha256.Size) {
+		return errors.New("sha256 must be 64 hex characters")
+	}
+	if s.CRC32C != "" && !isHex(s.CRC32C, crc32.Size) {
+		return errors.New("crc32c must be 8 hex characters")
+	}
+	return nil
+}
+
+func isHex(s string, size int) bool {
+	b, err := hex.DecodeString(s)
+	return err == nil && len(b) == size
+}
+
+// ETag returns a strong entity tag derived from the SHA-256
+func (s Sums) ETag() string {
+	if s.SHA256 == "" {
+		return ""
+	}
+	return `"` + s.SHA256 + `"`
+}
+
+// DigestHeader formats the digests for the RFC 9530 Repr-Digest header
+func (s Sums) DigestHeader() string {
+	var parts []string
+	if b, err := hex.DecodeString(s.SHA256); err == nil && s.SHA256 != "" {
+		parts = append(parts, "sha-256=:"+base64.StdEncoding.EncodeToString(b)+":")
+	}
+	if b, err := hex.DecodeString(s.CRC32C); err == nil && s.CRC32C != "" {
+		parts = append(parts, "crc32c=:"+base64.StdEncoding.EncodeToString(b)+":")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// LegacyDigestHeader formats the digests for the RFC 3230 Digest header
+func (s Sums) LegacyDigestHeader() string {
+	return strings.NewReplacer(":", "", "sha-256", "SHA-256").Replace(s.DigestHeader())
+}
+
+// ParseDigest reads a Content-Digest/Repr-Digest (RFC 9530,
+// "sha-256=:base64:") or Digest (RFC 3230, "SHA-256=base64") header.
+// Unknown algorithms are ignored. CRC32C may also be given as 8 hex digits.
+func ParseDigest(header string) (Sums, error) {
+	var sums Sums
+	for _, part := range strings.Split(header, ",") {
+		alg, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		value = strings.Trim(strings.TrimSpace(value), ":")
+
+		switch strings.ToLower(alg) {
+		case "sha-256":
+			b, err := base64.StdEncoding.DecodeString(value)
+			if err != nil || len(b) != sha256.Size {
+				return Sums{}, errors.New("invalid sha-256 digest")
+			}
+			sums.SHA256 = hex.EncodeToString(b)
+		case "crc32c":
+			if isHex(value, crc32.Size) {
+				sums.CRC32C = strings.ToLower(value)
+				continue
+			}
+			b, err := base64.StdEncoding.DecodeString(value)
+			if err != nil || len(b) != crc32.Size {
+				return Sums{}, errors.New("invalid crc32c digest")
+			}
+			sums.CRC32C = hex.EncodeToString(b)
+		}
+	}
+	return sums, nil
+}
+
+// NewCRC32C returns a CRC32 hash using the Castagnoli polynomial
+func NewCRC32C() hash.Hash32 {
+	return crc32.New(castagnoli)
+}
+
+// Hasher computes every supported digest of the data written to it
+type Hasher struct {
+	sha hash.Hash
+	crc hash.Hash32
+}
+
+// NewHasher returns an empty Hasher
+func NewHasher() *Hasher {
+	return &Hasher{sha: sha256.New(), crc: NewCRC32C()}
+}
+
+func (h *Hasher) Write(p []byte) (int, error) {
+	h.sha.Write(p)
+	h.crc.Write(p)
+	return len(p), nil
+}
+
+// Sums returns the digests of everything written so far
+func (h *Hasher) Sums() Sums {
+	var crc [4]byte
+	binary.BigEndian.PutUint32(crc[:], h.crc.Sum32())
+	return Sums{
+		SHA256: hex.EncodeToString(h.sha.Sum(nil)),
+		CRC32C: hex.EncodeToString(crc[:]),
+	}
+}
+
+// Compute reads the file at path and returns its digests
+func Compute(path string) (Sums, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Sums{}, err
+	}
+	defer f.Close()
+
+	h := NewHasher()
+	if _, err := io.Copy(h, f); err != nil {
+		return Sums{}, err
+	}
+	return h.Sums(), nil
+}
+
+// Record is a persisted digest of one inode
+type Record struct {
+	ID      uint   `gorm:"primaryKey"`
+	Dev     uint64 `gorm:"uniqueIndex:idx_checksum_inode"`
+	Ino     uint64 `gorm:"uniqueIndex:idx_checksum_inode"`
+	Size    int64
+	ModTime int64  // UnixNano
+	SHA256  string `gorm:"size:64"`
+	CRC32C  string `gorm:"size:8"`
+}
+
+// TableName specifies the table name for GORM
+func (Record) TableName() string {
+	return "file_checksums"
+}
+
+// Lookup returns the stored digests of the file at path, if still valid
+func Lookup(db *gorm.DB, path string) (Sums, bool) {
+	info, err := os.Stat(path)
+	if err != nil || db == nil {
+		return Sums{}, false
+	}
+	id, _, ok := files.LinkInfo(info)
+	if !ok {
+		return Sums{}, false
+	}
+
+	var rec Record
+	if err := db.Where("dev = ? AND ino = ?", id.Dev, id.Ino).First(&rec).Error; err != nil {
+		return Sums{}, false
+	}
+	if rec.Size != info.Size() || rec.ModTime != info.ModTime().UnixNano() {
+		return Sums{}, false
+	}
+	return Sums{SHA256: rec.SHA256, CRC32C: rec.CRC32C}, true
+}
+
+// Save stores the digests of the file at path
+func Save(db *gorm.DB, path string, sums Sums) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	id, _, ok := files.LinkInfo(info)
+	if !ok || db == nil {
+		return nil // nowhere to key the record
+	}
+
+	rec := Record{
+		Dev:     id.Dev,
+		Ino:     id.Ino,
+		Size:    info.Size(),
+		ModTime: info.ModTime().UnixNano(),
+		SHA256:  sums.SHA256,
+		CRC32C:  sums.CRC32C,
+	}
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "dev"}, {Name: "ino"}},
+		DoUpdates: clause.AssignmentColumns([]string{"size", "mod_time", "sha256", "crc32_c"}),
+	}).Create(&rec).Error
+}
+
+// hashing limits how many files Queue hashes at once
+var hashing = make(chan struct{}, 2)
+
+// queued holds the paths Queue is hashing or waiting to hash
+var queued sync.Map
+
+// Queue computes and stores the digests of the file at path in the
+// background, for requests that should not wait for a large file to be
+// read. Paths already queued are skipped.
+func Queue(db *gorm.DB, path string) {
+	if _, busy := queued.LoadOrStore(path, true); busy {
+		return
+	}
+	go func() {
+		defer queued.Delete(path)
+		hashing <- struct{}{}
+		defer func() { <-hashing }()
+
+		if _, ok := Lookup(db, path); ok {
+			return
+		}
+		if sums, err := Compute(path); err == nil {
+			Save(db, path, sums)
+		}
+	}()
+}
+
+// Get returns the file's digests, computing and storing them if needed
+func Get(db *gorm.DB, path string) (Sums, error) {
+	if sums, ok := Lookup(db, path); ok {
+		return sums, nil
+	}
+	sums, err := Compute(path)
+	if err != nil {
+		return Sums{}, err
+	}
+	Save(db, path, sums)
+	return sums, nil
+}
@@ -0,0 +1,203 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	"gorm.io/gorm"
+
+	"github.com/satufile/satufile/dedup"
+	"github.com/satufile/satufile/encryption"
+	"github.com/satufile/satufile/preview"
+	"github.com/satufile/satufile/storage"
+	"github.com/satufile/satufile/users"
+	"github.com/satufile/satufile/versions"
+	"github.com/satufile/satufile/vfs"
+)
+
+var encryptionRoot string
+
+var encryptionCmd = &cobra.Command{
+	Use:   "encryption",
+	Short: "Encrypt partitions at rest and manage the master key",
+	Long: `Encrypt user partitions at rest and manage the master key.
+Every encrypted user has a data key, stored in the database wrapped by the
+server's master key (master_key_file or SATUFILE_MASTER_KEY). Keep the
+master key apart from the database and its backups: without it, encrypted
+files cannot be read.`,
+}
+
+var encryptionKeygenCmd = &cobra.Command{
+	Use:     "keygen",
+	Short:   "Print a new random master key",
+	Example: `  satufile encryption keygen > /etc/satufile/master.key`,
+	Args:    cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		key, err := encryption.GenerateKey()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(base64.StdEncoding.EncodeToString(key))
+	},
+}
+
+var encryptionEncryptCmd = &cobra.Command{
+	Use:   "encrypt [username]",
+	Short: "Encrypt an existing partition in place",
+	Long: `Encrypt the files of an existing partition in place. Stop the server
+first: files are replaced one by one, and the partition is treated as
+encrypted from the start. The previous versions, deduplication pool and
+cached previews of the user are deleted, as they hold plaintext; the text
+of their documents leaves the search index when the server next starts.
+An interrupted run can simply be repeated.`,
+	Example: `  satufile encryption encrypt alice --root /srv/satufile`,
+	Args:    cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		master, done := openEncryption()
+		defer done()
+		if master == nil {
+			log.Fatal("No master key configured: set master_key_file or SATUFILE_MASTER_KEY")
+		}
+
+		db := storage.GetDB()
+		user := findUser(args[0])
+		if user.StoragePath == "" {
+			log.Fatalf("User '%s' has no partition", user.Username)
+		}
+
+		// The key is saved first, so a repeated run uses the same one
+		if user.DataKey == nil {
+			wrapped, err := encryption.NewDataKey()
+			if err != nil {
+				log.Fatal(err)
+			}
+			if err := db.Model(user).Update("data_key", wrapped).Error; err != nil {
+				log.Fatalf("Failed to save the data key: %v", err)
+			}
+			user.DataKey = wrapped
+		}
+		key, err := encryption.Unwrap(master, user.DataKey)
+		if err != nil {
+			log.Fatalf("Failed to open the data key of '%s': %v", user.Username, err)
+		}
+
+		base := vfs.Lookup(user.Backend)
+		if err := dropPlaintext(db, base, user); err != nil {
+			log.Fatal(err)
+		}
+
+		n, err := encryption.EncryptTree(base, key, user.StoragePath, func(name string) {
+			fmt.Printf("  %s\n", name)
+		})
+		if err != nil {
+			log.Fatalf("Failed after %d files: %v", n, err)
+		}
+		fmt.Printf("✓ Partition of '%s' encrypted (%d files)\n", user.Username, n)
+	},
+}
+
+var encryptionRotateCmd = &cobra.Command{
+	Use:   "rotate",
+	Short: "Rewrap every data key with a new master key",
+	Long: `Rewrap the data key of every encrypted user with a new master key.
+Files are not rewritten. Once done, point master_key_file (or
+SATUFILE_MASTER_KEY) at the new key and restart the server.`,
+	Example: `  satufile encryption keygen > /etc/satufile/master.key.new
+  satufile encryption rotate --new-key-file /etc/satufile/master.key.new`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		current, done := openEncryption()
+		defer done()
+		if current == nil {
+			log.Fatal("No master key configured: set master_key_file or SATUFILE_MASTER_KEY")
+		}
+		file, _ := cmd.Flags().GetString("new-key-file")
+		next, err := encryption.ReadKeyFile(file)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		rotated := 0
+		err = storage.GetDB().Transaction(func(tx *gorm.DB) error {
+			var list []users.User
+			if err := tx.Where("data_key IS NOT NULL").Find(&list).Error; err != nil {
+				return err
+			}
+			for _, u := range list {
+				wrapped, err := encryption.Rewrap(u.DataKey, current, next)
+				if err != nil {
+					return fmt.Errorf("user %s: %w", u.Username, err)
+				}
+				if err := tx.Model(&users.User{}).Where("id = ?", u.ID).Update("data_key", wrapped).Error; err != nil {
+					return err
+				}
+				rotated++
+			}
+			return nil
+		})
+		if err != nil {
+			log.Fatalf("Failed to rotate the master key, nothing was changed: %v", err)
+		}
+		fmt.Printf("✓ %d data keys rewrapped\n", rotated)
+		fmt.Printf("Now set master_key_file to %s and restart the server.\n", file)
+	},
+}
+
+// openEncryption connects to the database with the config's backends and
+// returns the master key, nil if none is configured
+func openEncryption() ([]byte, func()) {
+	if err := configureBackends(); err != nil {
+		log.Fatal(err)
+	}
+	master, err := loadMasterKey()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := encryption.SetMasterKey(master); err != nil {
+		log.Fatal(err)
+	}
+	return master, openDB()
+}
+
+// dropPlaintext deletes what the server keeps of a partition in
+// plaintext besides the files: previous versions, the deduplication pool
+// and cached previews
+func dropPlaintext(db *gorm.DB, base vfs.FS, user *users.User) error {
+	// The tables only exist once the server has used them
+	if db.Migrator().HasTable(&versions.Version{}) {
+		if err := db.Where("user_id = ?", user.ID).Delete(&versions.Version{}).Error; err != nil {
+			return fmt.Errorf("failed to delete versions: %w", err)
+		}
+	}
+	if db.Migrator().HasTable(&dedup.Chunk{}) {
+		if err := db.Where("user_id = ?", user.ID).Delete(&dedup.Chunk{}).Error; err != nil {
+			return fmt.Errorf("failed to delete the deduplication pool: %w", err)
+		}
+	}
+	if err := base.RemoveAll(filepath.Join(user.StoragePath, versions.Dir)); err != nil {
+		return fmt.Errorf("failed to delete versions: %w", err)
+	}
+	if err := base.RemoveAll(filepath.Join(user.StoragePath, dedup.Dir)); err != nil {
+		return fmt.Errorf("failed to delete the deduplication pool: %w", err)
+	}
+	root, err := filepath.Abs(encryptionRoot)
+	if err != nil {
+		return err
+	}
+	if err := preview.NewService(filepath.Join(root, "data", "cache", "previews")).Forget(user.ID); err != nil {
+		return fmt.Errorf("failed to delete cached previews: %w", err)
+	}
+	return nil
+}
+
+func init() {
+	encryptionCmd.PersistentFlags().StringVarP(&encryptionRoot, "root", "r", ".", "root directory of the server")
+	encryptionRotateCmd.Flags().String("new-key-file", "", "file holding the new master key (required)")
+	encryptionRotateCmd.MarkFlagRequired("new-key-file")
+
+	encryptionCmd.AddCommand(encryptionKeygenCmd, encryptionEncryptCmd, encryptionRotateCmd)
+	rootCmd.AddCommand(encryptionCmd)
+}
@@ -14,11 +14,7 @@ var listUsersCmd = &cobra.Command{
 	Short: "List all users and their setup status",
 	Run: func(cmd *cobra.Command, args []string) {
 		// Connect to database
-		cfg := storage.DefaultConfig()
-		if err := storage.Connect(cfg); err != nil {
-			log.Fatalf("Failed to connect to database: %v", err)
-		}
-		defer storage.Close()
+		defer openDB()()
 
 		// Get user repository
 		userRepo := users.NewRepository(storage.GetDB())
@@ -0,0 +1,130 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/spf13/cobra"
+
+	"github.com/satufile/satufile/accounts"
+	"github.com/satufile/satufile/storage"
+	"github.com/satufile/satufile/system/partition"
+	"github.com/satufile/satufile/users"
+	"github.com/satufile/satufile/vfs"
+)
+
+var partitionsRoot string
+
+var partitionsCmd = &cobra.Command{
+	Use:   "partitions",
+	Short: "Inspect, mount, resize and check user partitions",
+	Long: `Inspect, mount, resize and check the partitions on the local disk.
+With --quota-mode loop, each new partition is an ext4 image of its size,
+mounted over a loop device; with --quota-mode project, it is limited by an
+XFS or ext4 project quota. Either way the kernel enforces the limit. Both
+need root, and partitions where they cannot be set up use soft quota.`,
+}
+
+var partitionsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Show how each partition is limited and what it uses",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		defer openDB()()
+
+		allUsers, err := users.NewRepository(storage.GetDB()).List()
+		if err != nil {
+			log.Fatalf("Failed to get users: %v", err)
+		}
+
+		fmt.Printf("%-20s %-8s %-10s %-10s %s\n", "Username", "Mode", "Allocated", "Used", "Path")
+		fmt.Println("--------------------------------------------------------------------------------")
+		for _, u := range allUsers {
+			if u.StoragePath == "" || u.Backend != "" {
+				continue
+			}
+			mode := partition.ModeOf(u.StoragePath)
+			used := "?"
+			if mode != partition.QuotaSoft {
+				if n, _, err := partition.HardUsage(u.StoragePath); err == nil {
+					used = formatBytes(n)
+				} else if errors.Is(err, partition.ErrNotMounted) {
+					used = "unmounted"
+				}
+			} else {
+				used = formatBytes(partition.DiskUsage(vfs.Local, u.StoragePath))
+			}
+			fmt.Printf("%-20s %-8s %-10s %-10s %s\n", u.Username, mode, fmt.Sprintf("%d GB", u.StorageAllocationGb), used, u.StoragePath)
+		}
+	},
+}
+
+var partitionsMountCmd = &cobra.Command{
+	Use:   "mount",
+	Short: "Mount the loop partitions that are not mounted",
+	Long: `Mount the images of loop partitions, which are not mounted again after
+a reboot. The server does this when it starts.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		n, err := partition.NewManager(partition.BasePath(partitionsRoot)).Mount()
+		if err != nil {
+			log.Fatalf("Failed to mount partitions (%d mounted): %v", n, err)
+		}
+		fmt.Printf("✓ %d partitions mounted\n", n)
+	},
+}
+
+var partitionsResizeCmd = &cobra.Command{
+	Use:   "resize [username] [gb]",
+	Short: "Change the size of a user's partition",
+	Long: `Change the size of a user's partition and their allocation. Loop
+partitions grow while mounted but are unmounted to shrink, so stop the
+server first when shrinking. A partition cannot shrink below its usage.`,
+	Example: `  satufile partitions resize alice 50 --root /srv/satufile`,
+	Args:    cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		manager, done := openAccounts(partitionsRoot)
+		defer done()
+		user := findUser(args[0])
+
+		gb, err := strconv.Atoi(args[1])
+		if err != nil {
+			log.Fatalf("Invalid size %q", args[1])
+		}
+		if err := manager.Update(user, accounts.Changes{StorageAllocationGb: &gb}); err != nil {
+			log.Fatalf("Failed to resize: %v", err)
+		}
+		fmt.Printf("✓ Partition of '%s' is now %d GB (%s quota)\n", user.Username, gb, partition.ModeOf(user.StoragePath))
+	},
+}
+
+var partitionsFsckCmd = &cobra.Command{
+	Use:   "fsck [username]",
+	Short: "Check and repair the filesystem of a loop partition",
+	Long: `Check and repair the filesystem of a user's loop partition. The
+partition is unmounted meanwhile, so stop the server first.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		defer openDB()()
+		user := findUser(args[0])
+		if user.StoragePath == "" || user.Backend != "" {
+			log.Fatalf("User '%s' has no partition on the local disk", user.Username)
+		}
+
+		report, err := partition.NewManager(partition.BasePath(partitionsRoot)).Check(user.StoragePath)
+		fmt.Print(report)
+		if err != nil {
+			log.Fatalf("Check failed: %v", err)
+		}
+		fmt.Printf("✓ Partition of '%s' checked\n", user.Username)
+	},
+}
+
+func init() {
+	partitionsCmd.PersistentFlags().StringVarP(&partitionsRoot, "root", "r", ".", "root directory of the server")
+
+	partitionsCmd.AddCommand(partitionsListCmd, partitionsMountCmd, partitionsResizeCmd, partitionsFsckCmd)
+	rootCmd.AddCommand(partitionsCmd)
+}
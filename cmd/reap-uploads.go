@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/satufile/satufile/storage"
+	"github.com/satufile/satufile/uploads"
+	"github.com/spf13/cobra"
+)
+
+var reapUploadsCmd = &cobra.Command{
+	Use:   "reap-uploads",
+	Short: "Delete expired upload sessions and their temporary chunks",
+	Long: `Delete expired upload sessions and the chunks they left on disk.
+Active sessions whose chunk folder has disappeared are marked failed, and
+chunk folders without a session (e.g. after a crash) are removed once
+they have not changed for an hour.
+The server does this on startup and every --upload-reap-interval.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		// Connect to database
+		defer openDB()()
+
+		uploadsStorage, err := uploads.NewStorage(storage.GetDB())
+		if err != nil {
+			log.Fatalf("Failed to open upload sessions: %v", err)
+		}
+
+		result, err := uploads.Reap(uploadsStorage, uploads.TempBase())
+		if err != nil {
+			log.Fatalf("Failed to reap uploads: %v", err)
+		}
+
+		fmt.Printf("Expired sessions deleted:  %d\n", result.Expired)
+		fmt.Printf("Sessions marked failed:    %d\n", result.Failed)
+		fmt.Printf("Orphaned chunk folders:    %d\n", result.Orphans)
+		fmt.Printf("Reclaimed:                 %s\n", formatBytes(result.ReclaimedBytes))
+	},
+}
+
+// formatBytes renders a byte count for humans
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func init() {
+	rootCmd.AddCommand(reapUploadsCmd)
+}
@@ -20,11 +20,7 @@ will be prompted to change password and configure storage.`,
 		username := args[0]
 
 		// Connect to database
-		cfg := storage.DefaultConfig()
-		if err := storage.Connect(cfg); err != nil {
-			log.Fatalf("Failed to connect to database: %v", err)
-		}
-		defer storage.Close()
+		defer openDB()()
 
 		// Get user repository
 		userRepo := users.NewRepository(storage.GetDB())
@@ -32,7 +28,7 @@ will be prompted to change password and configure storage.`,
 		// Find user
 		user, err := userRepo.GetByUsername(username)
 		if err != nil {
-			log.Fatalf("User not found: %s", username)
+			log.Fatalf("Failed to load user '%s': %v", username, err)
 		}
 
 		// Reset setup flags
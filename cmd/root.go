@@ -6,15 +6,29 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
 	"github.com/satufile/satufile/auth"
+	"github.com/satufile/satufile/dedup"
+	"github.com/satufile/satufile/encryption"
+	"github.com/satufile/satufile/files"
 	fbhttp "github.com/satufile/satufile/http"
+	"github.com/satufile/satufile/preview"
+	"github.com/satufile/satufile/routes/api"
+	"github.com/satufile/satufile/search"
 	"github.com/satufile/satufile/settings"
+	"github.com/satufile/satufile/share"
+	"github.com/satufile/satufile/spaces"
 	"github.com/satufile/satufile/storage"
+	"github.com/satufile/satufile/system/partition"
+	"github.com/satufile/satufile/trash"
+	"github.com/satufile/satufile/uploads"
 	"github.com/satufile/satufile/users"
+	"github.com/satufile/satufile/versions"
+	"github.com/satufile/satufile/vfs"
 )
 
 // CoreFolders that are auto-created on startup
@@ -37,6 +51,67 @@ func createCoreFolders(root string) error {
 	return nil
 }
 
+// moveAsideSpaces renames the folders named like the spaces mount point
+// that users made before spaces existed, keeping their share links and
+// versions with them
+func moveAsideSpaces(userRepo *users.Repository, links share.StorageBackend) {
+	allUsers, err := userRepo.List()
+	if err != nil {
+		log.Printf("Warning: failed to list users: %v", err)
+		return
+	}
+	for _, u := range allUsers {
+		if u.Root() == "" {
+			continue
+		}
+		moved, err := spaces.MoveAside(u.FS(), u.Root())
+		if err != nil {
+			log.Printf("Warning: failed to rename the %s folder of %s: %v", spaces.MountDir, u.Username, err)
+			continue
+		}
+		if moved == "" {
+			continue
+		}
+		from, to := "/"+spaces.MountDir, "/"+moved
+		if err := share.RelocateLinks(links, u.ID, false, from, to); err != nil {
+			log.Printf("Warning: failed to relocate share links of %s: %v", u.Username, err)
+		}
+		if db := storage.GetDB(); db.Migrator().HasTable(&versions.Version{}) {
+			if err := versions.Relocate(db, u.ID, from, to); err != nil {
+				log.Printf("Warning: failed to relocate versions of %s: %v", u.Username, err)
+			}
+		}
+		log.Printf("Renamed %s of %s to %s, as shared spaces are mounted there", from, u.Username, to)
+	}
+}
+
+// clearPartials removes the files that writes in progress at the last
+// shutdown left in the partial folders of partitions and spaces
+func clearPartials(userRepo *users.Repository, spaceStore *spaces.Store) {
+	allUsers, err := userRepo.List()
+	if err != nil {
+		log.Printf("Warning: failed to list users: %v", err)
+	}
+	for _, u := range allUsers {
+		if u.Root() == "" {
+			continue
+		}
+		if err := u.FS().RemoveAll(filepath.Join(u.Root(), files.PartialDir)); err != nil {
+			log.Printf("Warning: failed to clear unfinished uploads of %s: %v", u.Username, err)
+		}
+	}
+
+	spaceList, err := spaceStore.List()
+	if err != nil {
+		log.Printf("Warning: failed to list spaces: %v", err)
+	}
+	for _, sp := range spaceList {
+		if err := os.RemoveAll(filepath.Join(spaceStore.Dir(sp.ID), files.PartialDir)); err != nil {
+			log.Printf("Warning: failed to clear unfinished uploads of space %s: %v", sp.Name, err)
+		}
+	}
+}
+
 var (
 	cfgFile string
 	rootCmd = &cobra.Command{
@@ -56,12 +131,40 @@ func init() {
 	rootCmd.Flags().StringP("root", "r", ".", "root directory to serve")
 	rootCmd.Flags().StringP("database", "d", "satufile.db", "database file path")
 	rootCmd.Flags().String("jwt-secret", "", "JWT secret key (overrides environment variable)")
+	rootCmd.Flags().Duration("upload-reap-interval", time.Hour, "how often expired upload sessions are cleaned up")
+	rootCmd.Flags().Bool("dedup", false, "store identical uploads once per user (hardlinks)")
+	rootCmd.Flags().Bool("content-search", true, "index document text for full-text search (needs -tags sqlite_fts5)")
+	rootCmd.Flags().Float64("content-index-rate", 10, "files per second extracted for content search")
+	rootCmd.Flags().Bool("thumbnails", true, "generate image previews for /api/preview")
+	rootCmd.Flags().Int("versions", 10, "previous versions kept per overwritten file (0 disables)")
+	rootCmd.Flags().Int("version-retention", 30, "days to keep previous versions (0 keeps them until the count limit)")
+	rootCmd.Flags().Int("trash-retention", 0, "days to keep items in the trash (0 keeps them forever)")
+	rootCmd.Flags().Duration("trash-purge-interval", time.Hour, "how often expired trash items are purged")
+	rootCmd.Flags().Float64("trash-quota-threshold", trash.DefaultQuotaThreshold, "share of a user's quota above which the oldest trash items are purged (0 disables)")
+	rootCmd.Flags().String("master-key-file", "", "file holding the master key of encrypted partitions")
+	rootCmd.Flags().StringSlice("origin", nil, "origins the web app is also served from, e.g. https://files.example.com behind a proxy that rewrites Host")
+	rootCmd.Flags().Bool("dev-origins", false, "accept WebSocket connections from localhost origins (frontend development server)")
+	rootCmd.Flags().String("quota-mode", string(partition.QuotaSoft), "how new partitions are limited: soft, loop (ext4 images) or project (XFS/ext4 project quotas)")
 
 	viper.BindPFlag("address", rootCmd.Flags().Lookup("address"))
 	viper.BindPFlag("port", rootCmd.Flags().Lookup("port"))
 	viper.BindPFlag("root", rootCmd.Flags().Lookup("root"))
 	viper.BindPFlag("database", rootCmd.Flags().Lookup("database"))
 	viper.BindPFlag("jwt_secret", rootCmd.Flags().Lookup("jwt-secret"))
+	viper.BindPFlag("upload_reap_interval", rootCmd.Flags().Lookup("upload-reap-interval"))
+	viper.BindPFlag("dedup", rootCmd.Flags().Lookup("dedup"))
+	viper.BindPFlag("content_search", rootCmd.Flags().Lookup("content-search"))
+	viper.BindPFlag("content_index_rate", rootCmd.Flags().Lookup("content-index-rate"))
+	viper.BindPFlag("thumbnails", rootCmd.Flags().Lookup("thumbnails"))
+	viper.BindPFlag("versions", rootCmd.Flags().Lookup("versions"))
+	viper.BindPFlag("version_retention", rootCmd.Flags().Lookup("version-retention"))
+	viper.BindPFlag("trash_retention", rootCmd.Flags().Lookup("trash-retention"))
+	viper.BindPFlag("trash_purge_interval", rootCmd.Flags().Lookup("trash-purge-interval"))
+	viper.BindPFlag("trash_quota_threshold", rootCmd.Flags().Lookup("trash-quota-threshold"))
+	viper.BindPFlag("master_key_file", rootCmd.Flags().Lookup("master-key-file"))
+	viper.BindPFlag("quota_mode", rootCmd.Flags().Lookup("quota-mode"))
+	viper.BindPFlag("origins", rootCmd.Flags().Lookup("origin"))
+	viper.BindPFlag("dev_origins", rootCmd.Flags().Lookup("dev-origins"))
 }
 
 func initConfig() {
@@ -86,6 +189,64 @@ func initConfig() {
 	}
 }
 
+// configureBackends sets up the storage backends of the config file's
+// backends section, e.g.
+//
+//	backends:
+//	  archive:
+//	    type: s3
+//	    endpoint: https://s3.eu-central-1.amazonaws.com
+//	    bucket: satufile
+//	    access_key: ...
+//	    secret_key: ...
+//
+// Users whose partition is on a backend name it in their backend field.
+func configureBackends() error {
+	var configs map[string]vfs.Config
+	if err := viper.UnmarshalKey("backends", &configs); err != nil {
+		return fmt.Errorf("invalid backends: %w", err)
+	}
+	return vfs.Configure(configs)
+}
+
+// configureEncryption sets the master key that wraps the data keys of
+// encrypted partitions. Without one, encrypted partitions are unavailable.
+func configureEncryption() error {
+	key, err := loadMasterKey()
+	if err != nil {
+		return err
+	}
+	return encryption.SetMasterKey(key)
+}
+
+// loadMasterKey reads the master key from master_key_file or, base64 or
+// hex encoded, from master_key (SATUFILE_MASTER_KEY); nil if neither is set
+func loadMasterKey() ([]byte, error) {
+	var key []byte
+	var err error
+	if file := viper.GetString("master_key_file"); file != "" {
+		key, err = encryption.ReadKeyFile(file)
+	} else if text := viper.GetString("master_key"); text != "" {
+		key, err = encryption.ParseKey([]byte(text))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid master key: %w", err)
+	}
+	return key, nil
+}
+
+// configureQuota sets how new partitions are limited. The kernel enforces
+// the loop and project modes; partitions where they cannot be set up fall
+// back to soft quota.
+func configureQuota() error {
+	mode, err := partition.ParseQuotaMode(viper.GetString("quota_mode"))
+	if err != nil {
+		return err
+	}
+	partition.SetQuotaMode(mode)
+	return nil
+}
+
 func runServer(cmd *cobra.Command, args []string) error {
 	cfg := &settings.Config{
 		Address: viper.GetString("address"),
@@ -98,6 +259,23 @@ func runServer(cmd *cobra.Command, args []string) error {
 		log.Printf("Warning: %v", err)
 	}
 
+	if err := configureBackends(); err != nil {
+		return err
+	}
+	if err := configureEncryption(); err != nil {
+		return err
+	}
+	if err := configureQuota(); err != nil {
+		return err
+	}
+
+	// Loop partitions are not mounted again after a reboot
+	if n, err := partition.NewManager(partition.BasePath(cfg.Root)).Mount(); err != nil {
+		log.Printf("Warning: failed to mount loop partitions: %v", err)
+	} else if n > 0 {
+		log.Printf("Mounted %d loop partitions", n)
+	}
+
 	// Initialize database
 	dbCfg := &storage.Config{
 		Driver: "sqlite",
@@ -151,12 +329,117 @@ func runServer(cmd *cobra.Command, args []string) error {
 		}
 	}
 
+	// Assign legacy trash items to the user whose partition holds them
+	if allUsers, err := userRepo.List(); err == nil {
+		partitions := make(map[uint]string, len(allUsers))
+		for _, u := range allUsers {
+			partitions[u.ID] = u.StoragePath
+		}
+		assigned, orphaned, err := trash.AssignOwners(storage.GetDB(), partitions)
+		if err != nil {
+			log.Printf("Warning: failed to assign trash owners: %v", err)
+		} else if assigned > 0 || orphaned > 0 {
+			log.Printf("Trash migration: %d items assigned, %d orphaned", assigned, orphaned)
+		}
+	}
+
+	// Clean up uploads abandoned before the last shutdown, then keep reaping
+	if result, err := uploads.Reap(storageBackend.Uploads, uploads.TempBase()); err != nil {
+		log.Printf("Warning: upload reaper failed: %v", err)
+	} else if result.Expired > 0 || result.Failed > 0 || result.Orphans > 0 {
+		log.Printf("Upload reaper: %d expired, %d failed, %d orphaned, %d bytes reclaimed",
+			result.Expired, result.Failed, result.Orphans, result.ReclaimedBytes)
+	}
+	if interval := viper.GetDuration("upload_reap_interval"); interval > 0 {
+		stop := make(chan struct{})
+		defer close(stop)
+		go uploads.RunReaper(storageBackend.Uploads, uploads.TempBase(), interval, stop)
+	}
+
+	// Shared spaces, kept next to the partitions
+	spaceStore, err := spaces.NewStore(storage.GetDB(), spaces.BaseDir(cfg.Root))
+	if err != nil {
+		return fmt.Errorf("failed to initialize shared spaces: %w", err)
+	}
+	spaceStore.SetGroups(userRepo.GroupIDs)
+	moveAsideSpaces(userRepo, storageBackend.Share)
+	clearPartials(userRepo, spaceStore)
+
+	// Start the trash janitor
+	janitor := trash.NewJanitor(storage.GetDB(), userRepo, trash.Policy{
+		Retention:      time.Duration(viper.GetInt("trash_retention")) * 24 * time.Hour,
+		QuotaThreshold: viper.GetFloat64("trash_quota_threshold"),
+	})
+	janitor.SetSpaceDirs(spaceStore.Dir)
+	if interval := viper.GetDuration("trash_purge_interval"); interval > 0 {
+		stop := make(chan struct{})
+		defer close(stop)
+		go janitor.Run(interval, stop)
+	}
+
+	// Optional upload deduplication
+	var dedupStore *dedup.Store
+	if viper.GetBool("dedup") {
+		dedupStore, err = dedup.NewStore(storage.GetDB(), api.DefaultChunkSize)
+		if err != nil {
+			return fmt.Errorf("failed to initialize deduplication: %w", err)
+		}
+		stop := make(chan struct{})
+		defer close(stop)
+		go dedupStore.Run(userRepo, time.Hour, stop)
+		log.Println("Upload deduplication enabled")
+	}
+
+	// Search index, rebuilt in the background so startup is not delayed
+	index, err := search.NewIndex(storage.GetDB())
+	if err != nil {
+		return fmt.Errorf("failed to initialize search index: %w", err)
+	}
+	if viper.GetBool("content_search") {
+		content, err := search.NewContent(storage.GetDB(), viper.GetFloat64("content_index_rate"))
+		if err != nil {
+			log.Printf("Warning: content search disabled: %v", err)
+		} else {
+			index.SetContent(content)
+			stop := make(chan struct{})
+			defer close(stop)
+			go content.Run(stop)
+		}
+	}
+	go index.Build(userRepo)
+
+	// Image previews, cached next to the partitions
+	server := settings.Server{Root: cfg.Root, EnableThumbnails: viper.GetBool("thumbnails")}
+	var previews *preview.Service
+	if server.EnableThumbnails {
+		absRoot, err := filepath.Abs(server.Root)
+		if err != nil {
+			absRoot = server.Root
+		}
+		previews = preview.NewService(filepath.Join(absRoot, "data", "cache", "previews"))
+	}
+
+	// File versions; listing and restoring keeps working with --versions 0
+	versionStore, err := versions.NewStore(storage.GetDB(), versions.Policy{
+		Count:  viper.GetInt("versions"),
+		MaxAge: time.Duration(viper.GetInt("version_retention")) * 24 * time.Hour,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to initialize file versions: %w", err)
+	}
+	if viper.GetInt("versions") > 0 || viper.GetInt("version_retention") > 0 {
+		stop := make(chan struct{})
+		defer close(stop)
+		go versionStore.Run(userRepo, time.Hour, stop)
+	}
+
 	// Initialize WebSocket Hub
+	fbhttp.SetAllowedOrigins(viper.GetStringSlice("origins"), viper.GetBool("dev_origins"))
 	hub := fbhttp.NewHub()
 	go hub.Run()
 
 	// Initialize FS Watcher
-	watcher, err := fbhttp.NewWatcher(cfg.Root, hub)
+	watcher, err := fbhttp.NewWatcher(fbhttp.UserRoots(userRepo), hub, index)
 	if err != nil {
 		log.Printf("Warning: failed to initialize FS watcher: %v", err)
 	} else {
@@ -165,7 +448,7 @@ func runServer(cmd *cobra.Command, args []string) error {
 	}
 
 	// Create HTTP handler
-	handler := fbhttp.NewHandler(cfg, userRepo, storageBackend, hub)
+	handler := fbhttp.NewHandler(cfg, userRepo, storageBackend, hub, janitor, dedupStore, index, previews, versionStore, spaceStore)
 
 	addr := fmt.Sprintf("%s:%d", cfg.Address, cfg.Port)
 	log.Printf("Starting SatuFile server on http://%s", addr)
@@ -0,0 +1,314 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/satufile/satufile/accounts"
+	"github.com/satufile/satufile/search"
+	"github.com/satufile/satufile/spaces"
+	"github.com/satufile/satufile/storage"
+	"github.com/satufile/satufile/system/partition"
+	"github.com/satufile/satufile/users"
+)
+
+var usersRoot string
+
+var usersCmd = &cobra.Command{
+	Use:   "users",
+	Short: "Create, edit and delete users",
+	Long: `Create, edit and delete users and their storage partitions.
+Run with the same --root as the server so partitions are created in,
+and archived from, the server's data folder.`,
+}
+
+var usersAddCmd = &cobra.Command{
+	Use:   "add [username]",
+	Short: "Create a user and provision their partition",
+	Example: `  satufile users add alice --email alice@example.com --password 'S3cret!pass' --quota 20
+  satufile users add bob --email bob@example.com --password 'S3cret!pass' --perm delete=false,share=false
+  satufile users add carol --email carol@example.com --password 'S3cret!pass' --backend archive
+  satufile users add dave --email dave@example.com --password 'S3cret!pass' --encrypt`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		manager, done := openAccounts(usersRoot)
+		defer done()
+
+		flags := cmd.Flags()
+		password, _ := flags.GetString("password")
+		email, _ := flags.GetString("email")
+		scope, _ := flags.GetString("scope")
+		quota, _ := flags.GetInt("quota")
+		admin, _ := flags.GetBool("admin")
+		mustChange, _ := flags.GetBool("must-change-password")
+		permArgs, _ := flags.GetStringSlice("perm")
+		backend, _ := flags.GetString("backend")
+		encrypt, _ := flags.GetBool("encrypt")
+
+		perms, err := parsePermissions(permArgs)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if admin {
+			perms["admin"] = true
+		}
+
+		user, err := manager.Create(accounts.NewUser{
+			Username:            args[0],
+			Password:            password,
+			Email:               email,
+			Scope:               scope,
+			Permissions:         perms,
+			StorageAllocationGb: quota,
+			MustChangePassword:  mustChange,
+			Backend:             backend,
+			Encrypted:           encrypt,
+		})
+		if err != nil {
+			log.Fatalf("Failed to create user: %v", err)
+		}
+
+		fmt.Printf("✓ User '%s' created (ID %d)\n", user.Username, user.ID)
+		printUser(user)
+	},
+}
+
+var usersEditCmd = &cobra.Command{
+	Use:   "edit [username]",
+	Short: "Change a user's email, password, scope or locale",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		manager, done := openAccounts(usersRoot)
+		defer done()
+		user := findUser(args[0])
+
+		var changes accounts.Changes
+		flags := cmd.Flags()
+		if flags.Changed("email") {
+			v, _ := flags.GetString("email")
+			changes.Email = &v
+		}
+		if flags.Changed("password") {
+			v, _ := flags.GetString("password")
+			changes.Password = &v
+		}
+		if flags.Changed("scope") {
+			v, _ := flags.GetString("scope")
+			changes.Scope = &v
+		}
+		if flags.Changed("locale") {
+			v, _ := flags.GetString("locale")
+			changes.Locale = &v
+		}
+		if flags.Changed("must-change-password") {
+			v, _ := flags.GetBool("must-change-password")
+			changes.MustChangePassword = &v
+		}
+
+		if err := manager.Update(user, changes); err != nil {
+			log.Fatalf("Failed to update user: %v", err)
+		}
+		fmt.Printf("✓ User '%s' updated\n", user.Username)
+		printUser(user)
+	},
+}
+
+var usersDeleteCmd = &cobra.Command{
+	Use:   "delete [username]",
+	Short: "Delete a user, archiving or removing their files",
+	Long: `Delete a user. Their partition is moved to data/archive unless
+--data remove is given, which deletes it for good.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		manager, done := openAccounts(usersRoot)
+		defer done()
+		user := findUser(args[0])
+
+		data, _ := cmd.Flags().GetString("data")
+		archived, err := manager.Delete(user, data)
+		if err != nil {
+			log.Fatalf("Failed to delete user: %v", err)
+		}
+
+		fmt.Printf("✓ User '%s' deleted\n", user.Username)
+		if archived != "" {
+			fmt.Printf("  Files archived to %s\n", archived)
+		} else if data == accounts.DataRemove {
+			fmt.Println("  Files removed")
+		}
+	},
+}
+
+var usersSetQuotaCmd = &cobra.Command{
+	Use:   "set-quota [username] [gb]",
+	Short: "Set a user's storage allocation in GB",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		manager, done := openAccounts(usersRoot)
+		defer done()
+		user := findUser(args[0])
+
+		gb, err := strconv.Atoi(args[1])
+		if err != nil {
+			log.Fatalf("Invalid size %q", args[1])
+		}
+		if err := manager.Update(user, accounts.Changes{StorageAllocationGb: &gb}); err != nil {
+			log.Fatalf("Failed to set quota: %v", err)
+		}
+		fmt.Printf("✓ User '%s' now has %d GB\n", user.Username, gb)
+	},
+}
+
+var usersSetPermCmd = &cobra.Command{
+	Use:   "set-perm [username] [permission=true|false]...",
+	Short: "Grant or revoke permissions",
+	Long: fmt.Sprintf(`Grant or revoke permissions. Valid permissions: %s.`,
+		strings.Join(accounts.PermissionNames(), ", ")),
+	Example: `  satufile users set-perm bob delete=false share=false
+  satufile users set-perm alice admin=true`,
+	Args: cobra.MinimumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		manager, done := openAccounts(usersRoot)
+		defer done()
+		user := findUser(args[0])
+
+		perms, err := parsePermissions(args[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := manager.Update(user, accounts.Changes{Permissions: perms}); err != nil {
+			log.Fatalf("Failed to set permissions: %v", err)
+		}
+		fmt.Printf("✓ Permissions of '%s' updated\n", user.Username)
+		printUser(user)
+	},
+}
+
+// openAccounts connects to the database and returns an account manager
+// for the server rooted at root, and a function closing the database
+func openAccounts(root string) (*accounts.Manager, func()) {
+	if err := configureBackends(); err != nil {
+		log.Fatal(err)
+	}
+	if err := configureEncryption(); err != nil {
+		log.Fatal(err)
+	}
+	if err := configureQuota(); err != nil {
+		log.Fatal(err)
+	}
+	done := openDB()
+
+	db := storage.GetDB()
+	userRepo := users.NewRepository(db)
+	manager := accounts.NewManager(db, userRepo, partition.NewManager(partition.BasePath(root)), accounts.ArchiveDir(root))
+
+	// Drop deleted users from the search index as the server would
+	if index, err := search.NewIndex(db); err == nil {
+		if content, err := search.NewContent(db, 0); err == nil {
+			index.SetContent(content)
+		}
+		manager.SetIndex(index)
+	}
+	if store, err := spaces.NewStore(db, spaces.BaseDir(root)); err == nil {
+		store.SetGroups(userRepo.GroupIDs)
+		manager.SetSpaces(store)
+	}
+	return manager, done
+}
+
+// openDB connects to the database and brings the user tables up to date
+// as the server does on start, since loading a user reads its roles and
+// groups, which databases the server has not opened since an upgrade
+// lack. It returns a function closing the database.
+func openDB() func() {
+	if err := storage.Connect(storage.DefaultConfig()); err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+	if err := users.NewRepository(storage.GetDB()).Migrate(); err != nil {
+		log.Fatalf("Failed to migrate users: %v", err)
+	}
+	return func() { storage.Close() }
+}
+
+// findUser loads a user by name or exits
+func findUser(username string) *users.User {
+	user, err := users.NewRepository(storage.GetDB()).GetByUsername(username)
+	if err != nil {
+		log.Fatalf("Failed to load user '%s': %v", username, err)
+	}
+	return user
+}
+
+// parsePermissions parses name=bool pairs, separately or comma-separated
+func parsePermissions(args []string) (map[string]bool, error) {
+	perms := make(map[string]bool)
+	for _, arg := range args {
+		for _, pair := range strings.Split(arg, ",") {
+			name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok {
+				return nil, fmt.Errorf("invalid permission %q, expected name=true|false", pair)
+			}
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value for %s: %q", name, value)
+			}
+			perms[name] = b
+		}
+	}
+	return perms, nil
+}
+
+// printUser shows the fields the users commands manage
+func printUser(user *users.User) {
+	var granted []string
+	for _, name := range accounts.PermissionNames() {
+		if accounts.HasPermission(user.EffectivePerm(), name) {
+			granted = append(granted, name)
+		}
+	}
+	fmt.Printf("  - email: %s\n", user.Email)
+	fmt.Printf("  - scope: %s\n", user.Scope)
+	if user.Backend != "" {
+		fmt.Printf("  - storage: %s:%s (%d GB)\n", user.Backend, user.StoragePath, user.StorageAllocationGb)
+	} else {
+		fmt.Printf("  - storage: %s (%d GB)\n", user.StoragePath, user.StorageAllocationGb)
+	}
+	if user.DataKey != nil {
+		fmt.Println("  - encrypted at rest")
+	}
+	fmt.Printf("  - permissions: %s\n", strings.Join(granted, ", "))
+	if len(user.Roles) > 0 || len(user.Groups) > 0 {
+		fmt.Printf("  - roles: %s; groups: %s\n", strings.Join(user.Roles, ", "), strings.Join(user.Groups, ", "))
+	}
+}
+
+func init() {
+	usersCmd.PersistentFlags().StringVarP(&usersRoot, "root", "r", ".", "root directory of the server")
+
+	usersAddCmd.Flags().String("password", "", "initial password (required)")
+	usersAddCmd.Flags().String("email", "", "email address (required)")
+	usersAddCmd.Flags().String("scope", "/", "folder the user is confined to")
+	usersAddCmd.Flags().Int("quota", 10, "storage allocation in GB")
+	usersAddCmd.Flags().Bool("admin", false, "grant admin rights")
+	usersAddCmd.Flags().StringSlice("perm", nil, "permissions over the defaults, e.g. delete=false,share=false")
+	usersAddCmd.Flags().Bool("must-change-password", true, "ask for a new password at first login")
+	usersAddCmd.Flags().String("backend", "", "storage backend of the partition, from the config file (default local)")
+	usersAddCmd.Flags().Bool("encrypt", false, "encrypt the partition at rest (needs a master key)")
+	usersAddCmd.MarkFlagRequired("password")
+	usersAddCmd.MarkFlagRequired("email")
+
+	usersEditCmd.Flags().String("email", "", "new email address")
+	usersEditCmd.Flags().String("password", "", "new password")
+	usersEditCmd.Flags().String("scope", "", "new scope")
+	usersEditCmd.Flags().String("locale", "", "new locale")
+	usersEditCmd.Flags().Bool("must-change-password", false, "ask for a new password at next login")
+
+	usersDeleteCmd.Flags().String("data", accounts.DataArchive, "what to do with the user's files: archive or remove")
+
+	usersCmd.AddCommand(usersAddCmd, usersEditCmd, usersDeleteCmd, usersSetQuotaCmd, usersSetPermCmd)
+	rootCmd.AddCommand(usersCmd)
+}
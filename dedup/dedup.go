@@ -0,0 +1,282 @@
+// Package dedup stores identical uploads once per partition. Completed
+// uploads are hardlinked into a content-addressed pool at .dedup/objects,
+// and their chunk hashes are indexed so clients can skip re-sending data
+// the user already has.
+package dedup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/satufile/satufile/files"
+	"github.com/satufile/satufile/users"
+)
+
+// Dir is the pool folder at the root of each partition
+const Dir = ".dedup"
+
+var hashPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// ValidHash reports whether h is a lowercase hex SHA-256 digest
+func ValidHash(h string) bool {
+	return hashPattern.MatchString(h)
+}
+
+// Chunk indexes one chunk of a pooled object
+type Chunk struct {
+	ID     uint   `gorm:"primaryKey"`
+	UserID uint   `gorm:"index:idx_dedup_chunk"`
+	Hash   string `gorm:"size:64;index:idx_dedup_chunk"`
+	Object string `gorm:"size:64;index"` // SHA-256 of the whole file
+	Offset int64
+	Size   int64
+}
+
+// TableName specifies the table name for GORM
+func (Chunk) TableName() string {
+	return "dedup_chunks"
+}
+
+// Store manages the per-partition pools and the chunk index
+type Store struct {
+	db        *gorm.DB
+	chunkSize int64
+}
+
+// NewStore creates a store indexing chunks of chunkSize bytes
+func NewStore(db *gorm.DB, chunkSize int64) (*Store, error) {
+	if err := db.AutoMigrate(&Chunk{}); err != nil {
+		return nil, err
+	}
+	return &Store{db: db, chunkSize: chunkSize}, nil
+}
+
+// ChunkSize returns the size of indexed chunks
+func (s *Store) ChunkSize() int64 {
+	return s.chunkSize
+}
+
+// NewHasher returns a writer computing the file and chunk hashes of
+// everything written to it
+func (s *Store) NewHasher() *Hasher {
+	return &Hasher{
+		chunkSize: s.chunkSize,
+		file:      sha256.New(),
+		chunk:     sha256.New(),
+	}
+}
+
+// Hasher computes the SHA-256 of a stream and of each chunk of it
+type Hasher struct {
+	chunkSize int64
+	file      hash.Hash
+	chunk     hash.Hash
+	inChunk   int64
+	chunks    []string
+}
+
+func (h *Hasher) Write(p []byte) (int, error) {
+	n := len(p)
+	h.file.Write(p)
+	for len(p) > 0 {
+		room := h.chunkSize - h.inChunk
+		if int64(len(p)) < room {
+			room = int64(len(p))
+		}
+		h.chunk.Write(p[:room])
+		h.inChunk += room
+		p = p[room:]
+		if h.inChunk == h.chunkSize {
+			h.chunks = append(h.chunks, hex.EncodeToString(h.chunk.Sum(nil)))
+			h.chunk.Reset()
+			h.inChunk = 0
+		}
+	}
+	return n, nil
+}
+
+// Sum returns the file hash and the hashes of its chunks in order
+func (h *Hasher) Sum() (string, []string) {
+	chunks := h.chunks
+	if h.inChunk > 0 {
+		chunks = append(chunks, hex.EncodeToString(h.chunk.Sum(nil)))
+	}
+	return hex.EncodeToString(h.file.Sum(nil)), chunks
+}
+
+func objectPath(root, sum string) string {
+	return filepath.Join(root, Dir, "objects", sum[:2], sum)
+}
+
+// Add pools the fully written file at fullPath. If the partition already
+// holds identical content, fullPath is replaced by a hardlink to it and
+// Add reports true.
+func (s *Store) Add(userID uint, root, fullPath string, h *Hasher) (bool, error) {
+	sum, chunks := h.Sum()
+	obj := objectPath(root, sum)
+
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return false, err
+	}
+
+	if objInfo, err := os.Stat(obj); err == nil && objInfo.Size() == info.Size() {
+		if os.SameFile(info, objInfo) {
+			return true, nil
+		}
+		// Link next to the target, then swap it in atomically
+		tmp := filepath.Join(filepath.Dir(fullPath), ".dedup-"+filepath.Base(fullPath))
+		os.Remove(tmp)
+		if err := os.Link(obj, tmp); err != nil {
+			return false, err
+		}
+		if err := os.Rename(tmp, fullPath); err != nil {
+			os.Remove(tmp)
+			return false, err
+		}
+		return true, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(obj), 0755); err != nil {
+		return false, err
+	}
+	os.Remove(obj) // stale object with a different size
+	if err := os.Link(fullPath, obj); err != nil {
+		return false, err
+	}
+
+	rows := make([]Chunk, 0, len(chunks))
+	for i, c := range chunks {
+		offset := int64(i) * s.chunkSize
+		size := s.chunkSize
+		if offset+size > info.Size() {
+			size = info.Size() - offset
+		}
+		rows = append(rows, Chunk{UserID: userID, Hash: c, Object: sum, Offset: offset, Size: size})
+	}
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ? AND object = ?", userID, sum).Delete(&Chunk{}).Error; err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			return nil
+		}
+		return tx.CreateInBatches(rows, 500).Error
+	})
+	return false, err
+}
+
+// ErrNoChunk means the user's partition holds no chunk with that hash
+var ErrNoChunk = errors.New("chunk not found")
+
+// CopyChunk writes the user's chunk with the given hash to dst, verifying
+// the data still matches the hash, and returns its size
+func (s *Store) CopyChunk(userID uint, root, sum, dst string) (int64, error) {
+	var rows []Chunk
+	if err := s.db.Where("user_id = ? AND hash = ?", userID, sum).Find(&rows).Error; err != nil {
+		return 0, err
+	}
+
+	for _, row := range rows {
+		src, err := os.Open(objectPath(root, row.Object))
+		if err != nil {
+			// Pool object is gone; its index entries are stale
+			s.db.Where("user_id = ? AND object = ?", userID, row.Object).Delete(&Chunk{})
+			continue
+		}
+
+		out, err := os.Create(dst)
+		if err != nil {
+			src.Close()
+			return 0, err
+		}
+		h := sha256.New()
+		n, err := io.Copy(io.MultiWriter(out, h), io.NewSectionReader(src, row.Offset, row.Size))
+		src.Close()
+		out.Close()
+		if err != nil {
+			os.Remove(dst)
+			return 0, err
+		}
+		if hex.EncodeToString(h.Sum(nil)) == sum {
+			return n, nil
+		}
+		os.Remove(dst)
+	}
+	return 0, ErrNoChunk
+}
+
+// Collect removes pool objects no longer linked from anywhere in the
+// partition, together with their chunk index entries
+func (s *Store) Collect(userID uint, root string) (removed int, freed int64, err error) {
+	objects := filepath.Join(root, Dir, "objects")
+	err = filepath.Walk(objects, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if _, nlink, ok := files.LinkInfo(info); !ok || nlink > 1 {
+			return nil
+		}
+
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		if err := s.db.Where("user_id = ? AND object = ?", userID, info.Name()).Delete(&Chunk{}).Error; err != nil {
+			return err
+		}
+		removed++
+		freed += info.Size()
+		return nil
+	})
+	return removed, freed, err
+}
+
+// Run collects unused objects of every user each interval until stop is
+// closed
+func (s *Store) Run(userRepo *users.Repository, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			allUsers, err := userRepo.List()
+			if err != nil {
+				log.Printf("Dedup: failed to list users: %v", err)
+				continue
+			}
+			for _, u := range allUsers {
+				// The pool lives on the local disk; remote and encrypted
+				// partitions are never deduplicated
+				if u.StoragePath == "" || u.Backend != "" || u.DataKey != nil {
+					continue
+				}
+				removed, freed, err := s.Collect(u.ID, u.StoragePath)
+				if err != nil {
+					log.Printf("Dedup: user %s: %v", u.Username, err)
+				}
+				if removed > 0 {
+					log.Printf("Dedup: removed %d unused objects of user %s (%d bytes)", removed, u.Username, freed)
+				}
+			}
+		case <-stop:
+			return
+		}
+	}
+}
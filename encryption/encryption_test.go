@@ -0,0 +1,229 @@
+package encryption
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/satufile/satufile/vfs"
+	"github.com/satufile/satufile/vfs/s3test"
+)
+
+func testKey(t *testing.T) []byte {
+	t.Helper()
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// testBases returns the filesystems to encrypt on, with a root each
+func testBases(t *testing.T) map[string]vfs.FS {
+	server := s3test.NewServer("bucket")
+	t.Cleanup(server.Close)
+	s3, err := vfs.NewS3(vfs.S3Config{Endpoint: server.URL, Bucket: "bucket", AccessKey: s3test.AccessKey, SecretKey: s3test.SecretKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]vfs.FS{"local": vfs.Local, "s3": s3}
+}
+
+func testRoot(t *testing.T, base vfs.FS) string {
+	if vfs.IsLocal(base) {
+		return t.TempDir()
+	}
+	return "/root"
+}
+
+func TestRoundTrip(t *testing.T) {
+	for name, base := range testBases(t) {
+		t.Run(name, func(t *testing.T) {
+			root := testRoot(t, base)
+			base.MkdirAll(root, 0755)
+			fsys, err := New(base, testKey(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Empty, within a segment, exactly a segment and across several
+			for _, size := range []int{0, 1, 1000, segmentSize, segmentSize + 1, 3*segmentSize + 17} {
+				data := make([]byte, size)
+				for i := range data {
+					data[i] = byte(i * 7)
+				}
+				file := root + "/f.bin"
+				if err := vfs.WriteFile(fsys, file, data); err != nil {
+					t.Fatal(err)
+				}
+
+				raw, _ := vfs.ReadFile(base, file)
+				if size > 16 && bytes.Contains(raw, data[:16]) {
+					t.Errorf("%d: plaintext found on the base filesystem", size)
+				}
+				if info, err := fsys.Stat(file); err != nil || info.Size() != int64(size) {
+					t.Errorf("%d: expected the plaintext size, got %v %v", size, info, err)
+				}
+				if entries, _ := fsys.ReadDir(root); len(entries) != 1 {
+					t.Fatalf("%d: unexpected entries %v", size, entries)
+				} else if info, _ := entries[0].Info(); info.Size() != int64(size) {
+					t.Errorf("%d: expected the plaintext size in listings, got %d", size, info.Size())
+				}
+				if got, err := vfs.ReadFile(fsys, file); err != nil || !bytes.Equal(got, data) {
+					t.Errorf("%d: round trip failed: %d bytes %v", size, len(got), err)
+				}
+
+				// Ranges are read from the segments that hold them
+				if size > 10 {
+					f, _ := fsys.Open(file)
+					offset := int64(size) - 10
+					f.Seek(offset, io.SeekStart)
+					got, err := io.ReadAll(f)
+					f.Close()
+					if err != nil || !bytes.Equal(got, data[offset:]) {
+						t.Errorf("%d: ranged read failed: %v", size, err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestTampering(t *testing.T) {
+	dir := t.TempDir()
+	key := testKey(t)
+	fsys, _ := New(vfs.Local, key)
+	file := filepath.Join(dir, "f.bin")
+	data := bytes.Repeat([]byte("x"), 2*segmentSize+100)
+	vfs.WriteFile(fsys, file, data)
+	raw, _ := os.ReadFile(file)
+
+	cases := map[string][]byte{
+		// A flipped bit anywhere in a segment
+		"modified": func() []byte {
+			b := bytes.Clone(raw)
+			b[headerSize+segmentSize+50] ^= 1
+			return b
+		}(),
+		// Whole segments dropped from the end
+		"truncated": raw[:headerSize+2*(segmentSize+tagSize)],
+		// Segments swapped
+		"reordered": func() []byte {
+			b := bytes.Clone(raw[:headerSize])
+			seg := segmentSize + tagSize
+			b = append(b, raw[headerSize+seg:headerSize+2*seg]...)
+			b = append(b, raw[headerSize:headerSize+seg]...)
+			return append(b, raw[headerSize+2*seg:]...)
+		}(),
+	}
+	for name, content := range cases {
+		os.WriteFile(file, content, 0644)
+		if _, err := vfs.ReadFile(fsys, file); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("%s: expected ErrCorrupt, got %v", name, err)
+		}
+	}
+
+	// Another key cannot read the file, and plaintext is not accepted
+	os.WriteFile(file, raw, 0644)
+	other, _ := New(vfs.Local, testKey(t))
+	if _, err := vfs.ReadFile(other, file); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Expected another key to fail, got %v", err)
+	}
+	os.WriteFile(file, []byte("plain"), 0644)
+	if _, err := fsys.Open(file); !errors.Is(err, ErrNotEncrypted) {
+		t.Errorf("Expected ErrNotEncrypted, got %v", err)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	defer SetMasterKey(nil)
+	if _, err := NewDataKey(); !errors.Is(err, ErrNoMasterKey) {
+		t.Fatalf("Expected ErrNoMasterKey, got %v", err)
+	}
+	if fsys := FS(vfs.Local, []byte("wrapped")); vfs.IsLocal(fsys) {
+		t.Fatal("Expected no filesystem without a master key")
+	}
+
+	master := testKey(t)
+	if err := SetMasterKey(master); err != nil {
+		t.Fatal(err)
+	}
+	wrapped, err := NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	file := filepath.Join(dir, "a.txt")
+	if err := vfs.WriteFile(FS(vfs.Local, wrapped), file, []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotation keeps the data key, so files stay readable
+	next := testKey(t)
+	rotated, err := Rewrap(wrapped, master, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Rewrap(rotated, master, next); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("Expected the old master key to be refused, got %v", err)
+	}
+	SetMasterKey(next)
+	if data, err := vfs.ReadFile(FS(vfs.Local, rotated), file); err != nil || string(data) != "secret" {
+		t.Errorf("Expected the file after rotation, got %q %v", data, err)
+	}
+	if _, err := vfs.ReadFile(FS(vfs.Local, wrapped), file); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("Expected the stale wrapped key to fail, got %v", err)
+	}
+
+	for _, text := range []string{"  " + "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=\n", "3031323334353637383961626364656630313233343536373839616263646566"} {
+		if key, err := ParseKey([]byte(text)); err != nil || string(key) != "0123456789abcdef0123456789abcdef" {
+			t.Errorf("ParseKey(%q) = %q, %v", text, key, err)
+		}
+	}
+	if _, err := ParseKey([]byte("short")); err == nil {
+		t.Error("Expected a short key to be refused")
+	}
+}
+
+func TestEncryptTree(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "Documents"), 0755)
+	old := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	files := map[string]string{"README.txt": "readme", "Documents/a.txt": "alpha", "Documents/empty.txt": ""}
+	for name, content := range files {
+		full := filepath.Join(root, name)
+		os.WriteFile(full, []byte(content), 0600)
+		os.Chtimes(full, old, old)
+	}
+	// An interrupted run left a partial file
+	os.WriteFile(filepath.Join(root, "Documents", ".a.txt"+tempSuffix), []byte("partial"), 0644)
+
+	key := testKey(t)
+	n, err := EncryptTree(vfs.Local, key, root, nil)
+	if err != nil || n != 3 {
+		t.Fatalf("Expected 3 files encrypted, got %d %v", n, err)
+	}
+	fsys, _ := New(vfs.Local, key)
+	for name, content := range files {
+		full := filepath.Join(root, name)
+		if data, err := vfs.ReadFile(fsys, full); err != nil || string(data) != content {
+			t.Errorf("%s: expected %q, got %q %v", name, content, data, err)
+		}
+		info, _ := os.Stat(full)
+		if !info.ModTime().Equal(old) || info.Mode().Perm() != 0600 {
+			t.Errorf("%s: expected the time and mode kept, got %v %v", name, info.ModTime(), info.Mode())
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "Documents", ".a.txt"+tempSuffix)); !os.IsNotExist(err) {
+		t.Errorf("Expected the partial file removed, got %v", err)
+	}
+
+	// Running again changes nothing
+	if n, err := EncryptTree(vfs.Local, key, root, nil); err != nil || n != 0 {
+		t.Errorf("Expected nothing left to encrypt, got %d %v", n, err)
+	}
+}
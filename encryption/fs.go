@@ -0,0 +1,218 @@
+package encryption
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/satufile/satufile/vfs"
+)
+
+// layer stores the files of base encrypted with a data key. Names,
+// directories and modification times are kept as they are. It is a
+// comparable value, so two layers over the same partition are equal.
+type layer struct {
+	base vfs.FS
+	key  [KeySize]byte
+}
+
+// New returns base with its files encrypted with dataKey
+func New(base vfs.FS, dataKey []byte) (vfs.FS, error) {
+	if len(dataKey) != KeySize {
+		return nil, fmt.Errorf("data key must be %d bytes, got %d", KeySize, len(dataKey))
+	}
+	l := layer{base: base}
+	copy(l.key[:], dataKey)
+	return l, nil
+}
+
+// FS returns base encrypted with a data key wrapped by the master key.
+// Without a master key, or with the wrong one, every operation fails.
+func FS(base vfs.FS, wrapped []byte) vfs.FS {
+	m := masterKey()
+	if m == nil {
+		return vfs.Unavailable(ErrNoMasterKey)
+	}
+	key, err := Unwrap(m, wrapped)
+	if err != nil {
+		return vfs.Unavailable(err)
+	}
+	fsys, err := New(base, key)
+	if err != nil {
+		return vfs.Unavailable(err)
+	}
+	return fsys
+}
+
+func (l layer) Base() vfs.FS { return l.base }
+
+func (l layer) Over(base vfs.FS) vfs.FS { return layer{base: base, key: l.key} }
+
+func (l layer) Stat(name string) (fs.FileInfo, error) {
+	info, err := l.base.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return plainInfo{info}, nil
+}
+
+func (l layer) Lstat(name string) (fs.FileInfo, error) {
+	info, err := l.base.Lstat(name)
+	if err != nil {
+		return nil, err
+	}
+	return plainInfo{info}, nil
+}
+
+func (l layer) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := l.base.ReadDir(name)
+	for i, entry := range entries {
+		entries[i] = plainEntry{entry}
+	}
+	return entries, err
+}
+
+func (l layer) Open(name string) (vfs.File, error) {
+	f, err := l.base.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		return f, nil
+	}
+	r, err := newReader(f, l.key[:], info.Size())
+	if err != nil {
+		f.Close()
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return r, nil
+}
+
+func (l layer) Create(name string) (io.WriteCloser, error) {
+	w, err := l.base.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	ew, err := newWriter(w, l.key[:])
+	if err != nil {
+		w.Close()
+		return nil, &fs.PathError{Op: "create", Path: name, Err: err}
+	}
+	return ew, nil
+}
+
+func (l layer) MkdirAll(name string, perm fs.FileMode) error { return l.base.MkdirAll(name, perm) }
+func (l layer) Remove(name string) error                     { return l.base.Remove(name) }
+func (l layer) RemoveAll(name string) error                  { return l.base.RemoveAll(name) }
+func (l layer) Rename(oldname, newname string) error         { return l.base.Rename(oldname, newname) }
+
+func (l layer) Chtimes(name string, atime, mtime time.Time) error {
+	return vfs.Chtimes(l.base, name, atime, mtime)
+}
+
+// plainEntry is a directory entry of an encrypted file
+type plainEntry struct{ fs.DirEntry }
+
+func (e plainEntry) Info() (fs.FileInfo, error) {
+	info, err := e.DirEntry.Info()
+	if err != nil {
+		return nil, err
+	}
+	return plainInfo{info}, nil
+}
+
+// tempSuffix marks files EncryptTree is still writing
+const tempSuffix = ".encrypting"
+
+// EncryptTree encrypts the files below root on base in place with
+// dataKey, keeping their modification times. Files already encrypted with
+// the key are skipped. Each file is written next to the original and
+// renamed over it, so an interrupted run leaves every file whole and can
+// simply be repeated. progress, if set, is called with each file
+// encrypted.
+func EncryptTree(base vfs.FS, dataKey []byte, root string, progress func(name string)) (int, error) {
+	enc, err := New(base, dataKey)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	err = vfs.WalkDir(base, root, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		// Left behind by an interrupted run
+		if strings.HasSuffix(name, tempSuffix) {
+			return base.Remove(name)
+		}
+		if sealed(enc, name) {
+			return nil
+		}
+		if err := encryptFile(base, enc, name); err != nil {
+			return err
+		}
+		n++
+		if progress != nil {
+			progress(name)
+		}
+		return nil
+	})
+	return n, err
+}
+
+// sealed reports whether a file can be decrypted with enc's key
+func sealed(enc vfs.FS, name string) bool {
+	f, err := enc.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	_, err = f.Read(make([]byte, 1))
+	return err == nil || err == io.EOF
+}
+
+func encryptFile(base, enc vfs.FS, name string) error {
+	info, err := base.Stat(name)
+	if err != nil {
+		return err
+	}
+	src, err := base.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := path.Join(path.Dir(name), "."+path.Base(name)+tempSuffix)
+	dst, err := enc.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		base.Remove(tmp)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		base.Remove(tmp)
+		return err
+	}
+	if vfs.IsLocal(base) {
+		os.Chmod(tmp, info.Mode().Perm())
+	}
+	if err := vfs.Chtimes(base, tmp, info.ModTime(), info.ModTime()); err != nil {
+		base.Remove(tmp)
+		return err
+	}
+	return base.Rename(tmp, name)
+}
@@ -0,0 +1,163 @@
+// Package encryption encrypts user partitions at rest. Every encrypted
+// user has a random data key, stored wrapped by a key derived from the
+// server's master key. Files are sealed in AES-GCM segments so any range
+// can be read without decrypting the whole file.
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// KeySize is the size of master and data keys in bytes
+const KeySize = 32
+
+var (
+	// ErrNoMasterKey means encryption is used without a master key
+	ErrNoMasterKey = errors.New("no master key configured")
+	// ErrWrongKey means a data key was wrapped with another master key
+	ErrWrongKey = errors.New("data key does not match the master key")
+)
+
+var (
+	mu     sync.RWMutex
+	master []byte
+)
+
+// SetMasterKey sets the server's master key; nil turns encryption off
+func SetMasterKey(key []byte) error {
+	if key != nil && len(key) != KeySize {
+		return fmt.Errorf("master key must be %d bytes, got %d", KeySize, len(key))
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	master = key
+	return nil
+}
+
+// Enabled reports whether a master key is configured
+func Enabled() bool {
+	return masterKey() != nil
+}
+
+func masterKey() []byte {
+	mu.RLock()
+	defer mu.RUnlock()
+	return master
+}
+
+// GenerateKey returns a new random key
+func GenerateKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// ParseKey decodes a key given as base64 or hex text, or as raw bytes
+func ParseKey(data []byte) ([]byte, error) {
+	if len(data) == KeySize {
+		return data, nil
+	}
+	text := strings.TrimSpace(string(data))
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == KeySize {
+		return key, nil
+	}
+	if key, err := hex.DecodeString(text); err == nil && len(key) == KeySize {
+		return key, nil
+	}
+	return nil, fmt.Errorf("key must be %d bytes, base64 or hex encoded", KeySize)
+}
+
+// ReadKeyFile reads a key in any format ParseKey accepts
+func ReadKeyFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ParseKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return key, nil
+}
+
+// wrapVersion prefixes wrapped keys, so the format can change later
+const wrapVersion = 1
+
+// keyWrapping returns the cipher data keys are wrapped with, keyed by a
+// key derived from master
+func keyWrapping(master []byte) (cipher.AEAD, error) {
+	kek, err := hkdf.Key(sha256.New, master, nil, "satufile data key wrapping v1", KeySize)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// NewDataKey returns a new data key wrapped with the master key
+func NewDataKey() ([]byte, error) {
+	m := masterKey()
+	if m == nil {
+		return nil, ErrNoMasterKey
+	}
+	key, err := GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	return Wrap(m, key)
+}
+
+// Wrap seals a data key with a master key
+func Wrap(master, dataKey []byte) ([]byte, error) {
+	aead, err := keyWrapping(master)
+	if err != nil {
+		return nil, err
+	}
+	wrapped := make([]byte, 1+aead.NonceSize(), 1+aead.NonceSize()+len(dataKey)+aead.Overhead())
+	wrapped[0] = wrapVersion
+	if _, err := rand.Read(wrapped[1:]); err != nil {
+		return nil, err
+	}
+	return aead.Seal(wrapped, wrapped[1:], dataKey, wrapped[:1]), nil
+}
+
+// Unwrap opens a data key sealed by Wrap
+func Unwrap(master, wrapped []byte) ([]byte, error) {
+	aead, err := keyWrapping(master)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < 1+aead.NonceSize() || wrapped[0] != wrapVersion {
+		return nil, ErrWrongKey
+	}
+	key, err := aead.Open(nil, wrapped[1:1+aead.NonceSize()], wrapped[1+aead.NonceSize():], wrapped[:1])
+	if err != nil || len(key) != KeySize {
+		return nil, ErrWrongKey
+	}
+	return key, nil
+}
+
+// Rewrap moves a wrapped data key from one master key to another
+func Rewrap(wrapped, from, to []byte) ([]byte, error) {
+	key, err := Unwrap(from, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	return Wrap(to, key)
+}
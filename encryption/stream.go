@@ -0,0 +1,262 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+
+	"github.com/satufile/satufile/vfs"
+)
+
+// An encrypted file is a header followed by segments of up to
+// segmentSize bytes of plaintext, each sealed with AES-256-GCM. The
+// header holds a random salt that derives the file's own key from the
+// data key. A segment's nonce is its index and whether it is the last
+// one, so segments cannot be reordered and a file cannot be truncated
+// without the change being detected.
+const (
+	magic       = "SATUENC1"
+	saltSize    = 32
+	headerSize  = len(magic) + saltSize
+	segmentSize = 64 << 10
+	tagSize     = 16
+)
+
+var (
+	// ErrNotEncrypted means a file in an encrypted partition is not
+	// encrypted
+	ErrNotEncrypted = errors.New("file is not encrypted")
+	// ErrCorrupt means an encrypted file was damaged or modified
+	ErrCorrupt = errors.New("encrypted file is damaged or was modified")
+
+	errClosed = errors.New("write to closed file")
+)
+
+// fileCipher returns the cipher of a file with the given salt
+func fileCipher(dataKey, salt []byte) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, dataKey, salt, "satufile file key v1", KeySize)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func segmentNonce(index int64, final bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, uint64(index))
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// PlainSize returns the plaintext size of an encrypted file of size bytes
+func PlainSize(size int64) int64 {
+	sealed := size - int64(headerSize)
+	if sealed < tagSize {
+		return 0
+	}
+	segments := (sealed + segmentSize + tagSize - 1) / (segmentSize + tagSize)
+	return sealed - segments*tagSize
+}
+
+// writer encrypts what is written to it segment by segment
+type writer struct {
+	w     io.WriteCloser
+	aead  cipher.AEAD
+	buf   []byte // plaintext of the current segment
+	index int64
+	err   error
+}
+
+func newWriter(w io.WriteCloser, dataKey []byte) (*writer, error) {
+	header := make([]byte, headerSize)
+	copy(header, magic)
+	if _, err := rand.Read(header[len(magic):]); err != nil {
+		return nil, err
+	}
+	aead, err := fileCipher(dataKey, header[len(magic):])
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &writer{w: w, aead: aead, buf: make([]byte, 0, segmentSize+tagSize)}, nil
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n := 0
+	for len(p) > 0 {
+		// A full segment is sealed once more data follows, so the last
+		// one is always sealed on Close
+		if len(w.buf) == segmentSize {
+			if err := w.seal(false); err != nil {
+				return n, err
+			}
+		}
+		k := min(segmentSize-len(w.buf), len(p))
+		w.buf = append(w.buf, p[:k]...)
+		p = p[k:]
+		n += k
+	}
+	return n, nil
+}
+
+func (w *writer) seal(final bool) error {
+	sealed := w.aead.Seal(w.buf[:0], segmentNonce(w.index, final), w.buf, nil)
+	if _, err := w.w.Write(sealed); err != nil {
+		w.err = err
+		return err
+	}
+	w.buf = w.buf[:0]
+	w.index++
+	return nil
+}
+
+func (w *writer) Close() error {
+	if w.err != nil {
+		w.w.Close()
+		if w.err == errClosed {
+			return nil
+		}
+		return w.err
+	}
+	if err := w.seal(true); err != nil {
+		w.w.Close()
+		return err
+	}
+	w.err = errClosed
+	return w.w.Close()
+}
+
+// reader decrypts an encrypted file, reading only the segments that
+// cover what is asked for
+type reader struct {
+	f        vfs.File
+	aead     cipher.AEAD
+	size     int64 // of the plaintext
+	segments int64
+	pos      int64
+
+	index int64 // of the segment in plain, -1 for none
+	plain []byte
+	buf   []byte
+}
+
+// newReader reads the header of f, which is sealed bytes long
+func newReader(f vfs.File, dataKey []byte, sealed int64) (*reader, error) {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(f, header); err != nil || string(header[:len(magic)]) != magic {
+		return nil, ErrNotEncrypted
+	}
+	aead, err := fileCipher(dataKey, header[len(magic):])
+	if err != nil {
+		return nil, err
+	}
+	if sealed-int64(headerSize) < tagSize {
+		return nil, ErrCorrupt
+	}
+	r := &reader{
+		f:        f,
+		aead:     aead,
+		size:     PlainSize(sealed),
+		segments: (sealed - int64(headerSize) + segmentSize + tagSize - 1) / (segmentSize + tagSize),
+		index:    -1,
+		buf:      make([]byte, segmentSize+tagSize),
+	}
+	// Reads of an empty file never reach its only segment, so check it now
+	if r.size == 0 {
+		if err := r.load(0); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (r *reader) load(index int64) error {
+	r.index = -1
+	if _, err := r.f.Seek(int64(headerSize)+index*(segmentSize+tagSize), io.SeekStart); err != nil {
+		return err
+	}
+	n, err := io.ReadFull(r.f, r.buf)
+	if err != nil && (err != io.ErrUnexpectedEOF || index != r.segments-1) {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrCorrupt
+		}
+		return err
+	}
+	plain, err := r.aead.Open(r.plain[:0], segmentNonce(index, index == r.segments-1), r.buf[:n], nil)
+	if err != nil {
+		return ErrCorrupt
+	}
+	r.plain, r.index = plain, index
+	return nil
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	index := r.pos / segmentSize
+	if index != r.index {
+		if err := r.load(index); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plain[r.pos-index*segmentSize:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return r.pos, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return r.pos, errors.New("negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *reader) Close() error {
+	return r.f.Close()
+}
+
+func (r *reader) Stat() (fs.FileInfo, error) {
+	info, err := r.f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return plainInfo{info}, nil
+}
+
+// plainInfo describes an encrypted file by its plaintext size
+type plainInfo struct{ fs.FileInfo }
+
+func (i plainInfo) Size() int64 {
+	if !i.Mode().IsRegular() {
+		return i.FileInfo.Size()
+	}
+	return PlainSize(i.FileInfo.Size())
+}
@@ -0,0 +1,85 @@
+package files
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/satufile/satufile/vfs"
+)
+
+// Copy copies a file or directory tree from src on srcFS to dst on dstFS
+func Copy(srcFS vfs.FS, src string, dstFS vfs.FS, dst string) error {
+	info, err := srcFS.Stat(src)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return CopyDir(srcFS, src, dstFS, dst)
+	}
+	return CopyFile(srcFS, src, dstFS, dst)
+}
+
+// CopyFile copies a single file, preserving its modification time and, on
+// the local disk, its mode
+func CopyFile(srcFS vfs.FS, src string, dstFS vfs.FS, dst string) error {
+	in, err := srcFS.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := dstFS.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	if vfs.IsLocal(dstFS) {
+		if err := os.Chmod(dst, info.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+	return vfs.Chtimes(dstFS, dst, info.ModTime(), info.ModTime())
+}
+
+// CopyDir recursively copies a directory tree
+func CopyDir(srcFS vfs.FS, src string, dstFS vfs.FS, dst string) error {
+	return vfs.WalkDir(srcFS, src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, relPath)
+
+		if info.IsDir() {
+			return dstFS.MkdirAll(target, info.Mode().Perm())
+		}
+		if !info.Mode().IsRegular() {
+			// Skip symlinks, sockets and devices
+			return nil
+		}
+		return CopyFile(srcFS, path, dstFS, target)
+	})
+}
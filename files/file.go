@@ -3,10 +3,11 @@ package files
 import (
 	"io/fs"
 	"mime"
-	"os"
 	"path/filepath"
 	"strings"
 	"time"
+
+	"github.com/satufile/satufile/vfs"
 )
 
 // FileInfo describes a file or directory
@@ -20,6 +21,8 @@ type FileInfo struct {
 	IsDir     bool        `json:"isDir"`
 	Type      string      `json:"type"`
 	IsShared  bool        `json:"isShared"`
+	SHA256    string      `json:"sha256,omitempty"` // Content digests (hex),
+	CRC32C    string      `json:"crc32c,omitempty"` // set for single files
 }
 
 // Listing contains directory contents
@@ -35,10 +38,10 @@ type Sorting struct {
 	Asc bool   `json:"asc"` // ascending
 }
 
-// NewFileInfo creates a FileInfo from a path
-func NewFileInfo(root, path string) (*FileInfo, error) {
+// NewFileInfo creates a FileInfo from a path below root on fsys
+func NewFileInfo(fsys vfs.FS, root, path string) (*FileInfo, error) {
 	fullPath := filepath.Join(root, path)
-	info, err := os.Stat(fullPath)
+	info, err := fsys.Stat(fullPath)
 	if err != nil {
 		return nil, err
 	}
@@ -60,10 +63,10 @@ func NewFileInfo(root, path string) (*FileInfo, error) {
 	return file, nil
 }
 
-// ReadDir reads directory contents
-func ReadDir(root, path string, hideDotfiles bool) (*Listing, error) {
+// ReadDir reads the contents of a directory below root on fsys
+func ReadDir(fsys vfs.FS, root, path string, hideDotfiles bool) (*Listing, error) {
 	fullPath := filepath.Join(root, path)
-	entries, err := os.ReadDir(fullPath)
+	entries, err := fsys.ReadDir(fullPath)
 	if err != nil {
 		return nil, err
 	}
@@ -82,6 +85,11 @@ func ReadDir(root, path string, hideDotfiles bool) (*Listing, error) {
 			continue
 		}
 
+		// Reserved folders are reached through their own APIs
+		if (path == "/" || path == "") && IsReserved(name) {
+			continue
+		}
+
 		info, err := entry.Info()
 		if err != nil {
 			continue
@@ -115,6 +123,12 @@ func ReadDir(root, path string, hideDotfiles bool) (*Listing, error) {
 	return listing, nil
 }
 
+// DetectType returns the file type (image, video, audio, text, pdf or
+// blob) for an extension such as ".jpg"
+func DetectType(ext string) string {
+	return detectType(ext)
+}
+
 // detectType detects file type from extension
 func detectType(ext string) string {
 	if ext == "" {
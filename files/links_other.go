@@ -0,0 +1,16 @@
+//go:build !unix
+
+package files
+
+import "os"
+
+// FileID identifies an inode, so hardlinked files can be told apart
+type FileID struct {
+	Dev uint64
+	Ino uint64
+}
+
+// LinkInfo is not supported on this platform; every file counts as unique
+func LinkInfo(info os.FileInfo) (id FileID, nlink uint64, ok bool) {
+	return FileID{}, 0, false
+}
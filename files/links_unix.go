@@ -0,0 +1,23 @@
+//go:build unix
+
+package files
+
+import (
+	"os"
+	"syscall"
+)
+
+// FileID identifies an inode, so hardlinked files can be told apart
+type FileID struct {
+	Dev uint64
+	Ino uint64
+}
+
+// LinkInfo returns the inode and hard link count of a file
+func LinkInfo(info os.FileInfo) (id FileID, nlink uint64, ok bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return FileID{}, 0, false
+	}
+	return FileID{Dev: uint64(st.Dev), Ino: uint64(st.Ino)}, uint64(st.Nlink), true
+}
@@ -0,0 +1,34 @@
+package files
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// PartialDir holds files while they are written, on the same filesystem
+// as their destination so they can be renamed into place
+const PartialDir = ".partial"
+
+// ReservedDirs are system folders at the root of every partition. They
+// are hidden from listings and search and cannot be targeted by file
+// operations.
+var ReservedDirs = []string{
+	".trash",     // soft-deleted items
+	".dedup",     // deduplicated upload pool
+	".versions",  // previous contents of overwritten files
+	PartialDir,   // uploads not yet complete
+	"lost+found", // ext4's recovery folder in loop partitions
+	"Spaces",     // where shared spaces are mounted (spaces.MountDir)
+}
+
+// IsReserved reports whether path (relative to the partition root) is a
+// reserved folder or lies inside one
+func IsReserved(path string) bool {
+	first := strings.SplitN(strings.TrimPrefix(filepath.ToSlash(filepath.Clean("/"+path)), "/"), "/", 2)[0]
+	for _, dir := range ReservedDirs {
+		if first == dir {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,199 @@
+package files
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/satufile/satufile/vfs"
+)
+
+// ConflictPolicy decides what happens when a transfer target already exists
+type ConflictPolicy string
+
+const (
+	// ConflictFail aborts the transfer (default)
+	ConflictFail ConflictPolicy = ""
+	// ConflictOverwrite replaces existing files; directories are merged
+	ConflictOverwrite ConflictPolicy = "overwrite"
+	// ConflictSkip keeps existing files; directories are merged
+	ConflictSkip ConflictPolicy = "skip"
+	// ConflictRename transfers to a free name such as "report (1).pdf"
+	ConflictRename ConflictPolicy = "rename"
+)
+
+var (
+	ErrTargetExists    = errors.New("a file or folder with that name already exists")
+	ErrInvalidPolicy   = errors.New("invalid conflict policy")
+	ErrTargetInsideSrc = errors.New("cannot copy or move a folder into itself")
+)
+
+// TransferOptions configures Transfer
+type TransferOptions struct {
+	Move   bool
+	Policy ConflictPolicy
+	// Remove disposes of targets replaced under ConflictOverwrite.
+	// Defaults to DstFS.RemoveAll.
+	Remove func(fullPath string) error
+	// SrcFS and DstFS are the filesystems src and dst are on; both
+	// default to the local disk
+	SrcFS, DstFS vfs.FS
+}
+
+// TransferResult summarises a copy or move
+type TransferResult struct {
+	// Destination is the final target path (differs from the requested one
+	// under ConflictRename)
+	Destination string
+	// Skipped lists source paths left untouched under ConflictSkip
+	Skipped []string
+}
+
+// ValidPolicy reports whether p is a known conflict policy
+func ValidPolicy(p ConflictPolicy) bool {
+	switch p {
+	case ConflictFail, ConflictOverwrite, ConflictSkip, ConflictRename:
+		return true
+	}
+	return false
+}
+
+// Transfer copies or moves src to dst (both absolute paths on their
+// filesystems), recursing into directories and resolving conflicts with
+// opts.Policy
+func Transfer(src, dst string, opts TransferOptions) (*TransferResult, error) {
+	if !ValidPolicy(opts.Policy) {
+		return nil, ErrInvalidPolicy
+	}
+	if opts.SrcFS == nil {
+		opts.SrcFS = vfs.Local
+	}
+	if opts.DstFS == nil {
+		opts.DstFS = vfs.Local
+	}
+	if opts.Remove == nil {
+		opts.Remove = opts.DstFS.RemoveAll
+	}
+
+	src = filepath.Clean(src)
+	dst = filepath.Clean(dst)
+	if opts.SrcFS == opts.DstFS && (dst == src || strings.HasPrefix(dst, src+string(os.PathSeparator))) {
+		return nil, ErrTargetInsideSrc
+	}
+
+	if _, err := opts.SrcFS.Stat(src); err != nil {
+		return nil, err
+	}
+
+	result := &TransferResult{Destination: dst}
+
+	if _, err := opts.DstFS.Lstat(dst); err == nil {
+		switch opts.Policy {
+		case ConflictFail:
+			return nil, ErrTargetExists
+		case ConflictRename:
+			result.Destination = AvailableName(opts.DstFS, dst)
+		default:
+			if err := merge(src, dst, opts, result); err != nil {
+				return nil, err
+			}
+			return result, nil
+		}
+	}
+
+	if err := transferOne(src, result.Destination, opts); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// merge transfers src onto an existing dst. Two directories are merged
+// entry by entry; anything else is overwritten or skipped.
+func merge(src, dst string, opts TransferOptions, result *TransferResult) error {
+	srcInfo, err := opts.SrcFS.Stat(src)
+	if err != nil {
+		return err
+	}
+	dstInfo, err := opts.DstFS.Stat(dst)
+	if err != nil {
+		return err
+	}
+
+	if !srcInfo.IsDir() || !dstInfo.IsDir() {
+		if opts.Policy == ConflictSkip {
+			result.Skipped = append(result.Skipped, src)
+			return nil
+		}
+		if err := opts.Remove(dst); err != nil {
+			return fmt.Errorf("failed to replace %s: %w", filepath.Base(dst), err)
+		}
+		return transferOne(src, dst, opts)
+	}
+
+	entries, err := opts.SrcFS.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		s := filepath.Join(src, entry.Name())
+		d := filepath.Join(dst, entry.Name())
+		if _, err := opts.DstFS.Lstat(d); err == nil {
+			if err := merge(s, d, opts, result); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := transferOne(s, d, opts); err != nil {
+			return err
+		}
+	}
+
+	if opts.Move {
+		// Only succeeds once nothing was skipped below src
+		opts.SrcFS.Remove(src)
+	}
+	return nil
+}
+
+// transferOne copies or moves src to a dst that does not exist yet
+func transferOne(src, dst string, opts TransferOptions) error {
+	if !opts.Move {
+		return Copy(opts.SrcFS, src, opts.DstFS, dst)
+	}
+
+	var err error
+	if opts.SrcFS == opts.DstFS {
+		err = opts.SrcFS.Rename(src, dst)
+	}
+	if opts.SrcFS != opts.DstFS || errors.Is(err, syscall.EXDEV) {
+		// Different filesystems: fall back to copy and delete
+		if err := Copy(opts.SrcFS, src, opts.DstFS, dst); err != nil {
+			return err
+		}
+		return opts.SrcFS.RemoveAll(src)
+	}
+	return err
+}
+
+// AvailableName returns path, or the first "name (n).ext" variant of it
+// that does not exist on fsys yet
+func AvailableName(fsys vfs.FS, path string) string {
+	if _, err := fsys.Lstat(path); os.IsNotExist(err) {
+		return path
+	}
+
+	dir := filepath.Dir(path)
+	base := filepath.Base(path)
+	ext := filepath.Ext(base)
+	name := strings.TrimSuffix(base, ext)
+
+	for i := 1; ; i++ {
+		candidate := filepath.Join(dir, fmt.Sprintf("%s (%d)%s", name, i, ext))
+		if _, err := fsys.Lstat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+	}
+}
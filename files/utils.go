@@ -1,8 +1,10 @@
 package files
 
+import "github.com/satufile/satufile/vfs"
+
 // GetFileInfo gets file info for a given path
 func GetFileInfo(storage interface{}, path string) (*FileInfo, error) {
 	// In a real implementation, this would use the storage backend
 	// For now, we'll use the existing NewFileInfo function
-	return NewFileInfo("", path)
+	return NewFileInfo(vfs.Local, "", path)
 }
@@ -1,4 +1,5 @@
 import { useEffect, useRef, useState, useCallback } from 'react';
+import { api } from '../api/client';
 
 export interface WebSocketMessage {
   type: string;
@@ -10,10 +11,13 @@ export const useWebSocket = (url: string) => {
   const [lastMessage, setLastMessage] = useState<WebSocketMessage | null>(null);
   const socketRef = useRef<WebSocket | null>(null);
   const reconnectTimeoutRef = useRef<number>(0);
+  // Bumped on cleanup so a connect still waiting for its ticket gives up
+  const generationRef = useRef(0);
   const [reconnectAttempts, setReconnectAttempts] = useState(0);
 
-  const connect = useCallback(() => {
+  const connect = useCallback(async () => {
     if (socketRef.current?.readyState === WebSocket.OPEN) return;
+    const generation = generationRef.current;
 
     // Use full URL if provided, otherwise derive from window.location
     let wsUrl = url;
@@ -23,6 +27,23 @@ export const useWebSocket = (url: string) => {
       wsUrl = `${protocol}//${host}${url}`;
     }
 
+    // Browsers cannot send headers with the upgrade, so authenticate with
+    // a single-use ticket rather than the session token
+    let ticket: string;
+    try {
+      ({ ticket } = await api.post<{ ticket: string }>('/ws/ticket'));
+    } catch (err) {
+      if (generation !== generationRef.current) return;
+      console.error('WebSocket ticket failed:', err);
+      const timeout = Math.min(1000 * Math.pow(2, reconnectAttempts), 30000);
+      reconnectTimeoutRef.current = window.setTimeout(() => {
+        setReconnectAttempts(prev => prev + 1);
+      }, timeout);
+      return;
+    }
+    if (generation !== generationRef.current) return;
+    wsUrl += `${wsUrl.includes('?') ? '&' : '?'}ticket=${encodeURIComponent(ticket)}`;
+
     const socket = new WebSocket(wsUrl);
 
     socket.onopen = () => {
@@ -65,6 +86,7 @@ export const useWebSocket = (url: string) => {
   useEffect(() => {
     connect();
     return () => {
+      generationRef.current++;
       if (reconnectTimeoutRef.current) {
         window.clearTimeout(reconnectTimeoutRef.current);
       }
@@ -1,6 +1,7 @@
 package http
 
 import (
+	"context"
 	"io/fs"
 	"net/http"
 	"os"
@@ -8,15 +9,22 @@ import (
 
 	"github.com/gorilla/mux"
 
+	"github.com/satufile/satufile/auth"
+	"github.com/satufile/satufile/dedup"
 	"github.com/satufile/satufile/middleware"
+	"github.com/satufile/satufile/preview"
 	"github.com/satufile/satufile/routes"
+	"github.com/satufile/satufile/search"
 	"github.com/satufile/satufile/settings"
+	"github.com/satufile/satufile/spaces"
 	"github.com/satufile/satufile/storage"
+	"github.com/satufile/satufile/trash"
 	"github.com/satufile/satufile/users"
+	"github.com/satufile/satufile/versions"
 )
 
 // NewHandler creates a main HTTP handler with all routes
-func NewHandler(cfg *settings.Config, userRepo *users.Repository, storageBackend *storage.Storage, hub *Hub) http.Handler {
+func NewHandler(cfg *settings.Config, userRepo *users.Repository, storageBackend *storage.Storage, hub *Hub, janitor *trash.Janitor, dedupStore *dedup.Store, index *search.Index, previews *preview.Service, versionStore *versions.Store, spaceStore *spaces.Store) http.Handler {
 	r := mux.NewRouter()
 
 	// Global middleware
@@ -25,12 +33,11 @@ func NewHandler(cfg *settings.Config, userRepo *users.Repository, storageBackend
 	r.Use(middleware.GlobalRateLimit)
 
 	// WebSocket endpoint
-	r.HandleFunc("/api/ws", func(w http.ResponseWriter, r *http.Request) {
-		ServeWs(hub, w, r)
-	})
+	r.Handle("/api/ws", wsHandler(userRepo, hub))
+	r.Handle("/api/ws/ticket", auth.RequireAuth(userRepo)(http.HandlerFunc(wsTicketPost))).Methods("POST")
 
 	// Register file-based routes
-	routes.RegisterRoutes(r, userRepo, cfg.Root, storageBackend.Share, storageBackend.Uploads)
+	routes.RegisterRoutes(r, userRepo, cfg.Root, storageBackend.Share, storageBackend.Uploads, hub, janitor, dedupStore, index, previews, versionStore, spaceStore)
 
 	// Static files (frontend) - SPA handler
 	r.PathPrefix("/").Handler(spaHandler("frontend/dist"))
@@ -39,7 +46,7 @@ func NewHandler(cfg *settings.Config, userRepo *users.Repository, storageBackend
 }
 
 // NewHandlerWithAssets creates handler with embedded frontend assets
-func NewHandlerWithAssets(cfg *settings.Config, userRepo *users.Repository, storageBackend *storage.Storage, assets fs.FS, hub *Hub) http.Handler {
+func NewHandlerWithAssets(cfg *settings.Config, userRepo *users.Repository, storageBackend *storage.Storage, assets fs.FS, hub *Hub, janitor *trash.Janitor, dedupStore *dedup.Store, index *search.Index, previews *preview.Service, versionStore *versions.Store, spaceStore *spaces.Store) http.Handler {
 	r := mux.NewRouter()
 
 	r.Use(middleware.SecurityHeaders)
@@ -47,12 +54,11 @@ func NewHandlerWithAssets(cfg *settings.Config, userRepo *users.Repository, stor
 	r.Use(middleware.GlobalRateLimit)
 
 	// WebSocket endpoint
-	r.HandleFunc("/api/ws", func(w http.ResponseWriter, r *http.Request) {
-		ServeWs(hub, w, r)
-	})
+	r.Handle("/api/ws", wsHandler(userRepo, hub))
+	r.Handle("/api/ws/ticket", auth.RequireAuth(userRepo)(http.HandlerFunc(wsTicketPost))).Methods("POST")
 
 	// Register file-based routes
-	routes.RegisterRoutes(r, userRepo, cfg.Root, storageBackend.Share, storageBackend.Uploads)
+	routes.RegisterRoutes(r, userRepo, cfg.Root, storageBackend.Share, storageBackend.Uploads, hub, janitor, dedupStore, index, previews, versionStore, spaceStore)
 
 	// Serve embedded frontend assets
 	r.PathPrefix("/").Handler(http.FileServer(http.FS(assets)))
@@ -60,6 +66,35 @@ func NewHandlerWithAssets(cfg *settings.Config, userRepo *users.Repository, stor
 	return r
 }
 
+// wsHandler authenticates WebSocket connections like the API. Browsers
+// cannot set headers on them, so they redeem a ticket from
+// POST /api/ws/ticket in the "ticket" query parameter instead.
+func wsHandler(userRepo *users.Repository, hub *Hub) http.Handler {
+	serve := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ServeWs(hub, w, r)
+	})
+	authenticated := auth.RequireAuth(userRepo)(serve)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ticket := r.URL.Query().Get("ticket")
+		if ticket == "" {
+			authenticated.ServeHTTP(w, r)
+			return
+		}
+
+		userID, ok := redeemWsTicket(ticket)
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		user, err := userRepo.GetByID(userID)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		serve.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), auth.UserContextKey, user)))
+	})
+}
+
 // spaHandler serves static files and falls back to index.html for SPA routing
 func spaHandler(staticPath string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -3,26 +3,95 @@ package http
 import (
 	"encoding/json"
 	"log"
+	"net"
 	"net/http"
-	"sync"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/gorilla/websocket"
+
+	"github.com/satufile/satufile/auth"
+	"github.com/satufile/satufile/routes/api"
+)
+
+const (
+	// Time allowed to write a message to the peer
+	writeWait = 10 * time.Second
+	// Time allowed to read the next pong from the peer; clients that stay
+	// silent longer are dropped
+	pongWait = 60 * time.Second
+	// Send pings to the peer with this period, less than pongWait
+	pingPeriod = (pongWait * 9) / 10
+	// Largest message a client may send, enough for a subscription
+	maxMessageSize = 4096
 )
 
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Allow all origins for now
-	},
+	CheckOrigin:     checkOrigin,
+}
+
+// Origins WebSocket connections are admitted from besides the server's
+// own, see SetAllowedOrigins
+var (
+	allowedOrigins       = map[string]bool{}
+	allowLoopbackOrigins bool
+)
+
+// SetAllowedOrigins admits WebSocket connections from origins, such as the
+// public address of a reverse proxy that rewrites Host. loopback also
+// admits any localhost origin, for the frontend development server.
+func SetAllowedOrigins(origins []string, loopback bool) {
+	allowedOrigins = map[string]bool{}
+	for _, origin := range origins {
+		if u, err := url.Parse(origin); err == nil && u.Host != "" {
+			allowedOrigins[strings.ToLower(u.Scheme+"://"+u.Host)] = true
+		}
+	}
+	allowLoopbackOrigins = loopback
+}
+
+// checkOrigin admits connections from the server's own origin and those
+// set with SetAllowedOrigins. Requests without an Origin are refused, so
+// clients outside browsers have to send one as well.
+func checkOrigin(r *http.Request) bool {
+	u, err := url.Parse(r.Header.Get("Origin"))
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) || allowedOrigins[strings.ToLower(u.Scheme+"://"+u.Host)] {
+		return true
+	}
+	if !allowLoopbackOrigins {
+		return false
+	}
+	host := u.Hostname()
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
 }
 
 // Event represents a WebSocket message
 type Event struct {
 	Type    string      `json:"type"`
+	Topic   string      `json:"topic,omitempty"`
 	Payload interface{} `json:"payload"`
 }
 
+// clientMessage is what clients send: {"type": "subscribe" or
+// "unsubscribe", "payload": {"topics": [...]}}
+type clientMessage struct {
+	Type    string `json:"type"`
+	Payload struct {
+		Topics []string `json:"topics"`
+	} `json:"payload"`
+}
+
 // Client is a middleman between the websocket connection and the hub.
 type Client struct {
 	hub *Hub
@@ -30,27 +99,63 @@ type Client struct {
 	conn *websocket.Conn
 	// Buffered channel of outbound messages.
 	send chan []byte
+	// The user the connection authenticated as.
+	userID uint
+	// Topics the client subscribed to; nil until its first subscription,
+	// which makes it receive every topic. Owned by the hub's Run loop.
+	topics map[string]bool
+}
+
+// wants reports whether the client receives events of the topics
+func (c *Client) wants(topics []string) bool {
+	if len(topics) == 0 || c.topics == nil {
+		return true
+	}
+	for _, topic := range topics {
+		if c.topics[topic] {
+			return true
+		}
+	}
+	return false
 }
 
-// Hub maintains the set of active clients and broadcasts messages to the clients.
+// delivery is an event for the clients of one user that want any of its
+// topics, or for all of them if it has none
+type delivery struct {
+	userID  uint
+	topics  []string
+	message []byte
+}
+
+// subscription changes the topics of a client
+type subscription struct {
+	client    *Client
+	subscribe bool
+	topics    []string
+}
+
+// Hub maintains the set of active clients and delivers events to the
+// clients of the user they belong to.
 type Hub struct {
-	// Registered clients.
-	clients map[*Client]bool
-	// Inbound messages from the clients.
-	broadcast chan []byte
+	// Registered clients by user.
+	clients map[uint]map[*Client]bool
+	// Outbound events.
+	deliver chan delivery
+	// Subscription changes from the clients.
+	subscribe chan subscription
 	// Register requests from the clients.
 	register chan *Client
 	// Unregister requests from clients.
 	unregister chan *Client
-	mu         sync.Mutex
 }
 
 func NewHub() *Hub {
 	return &Hub{
-		broadcast:  make(chan []byte),
+		deliver:    make(chan delivery, 256),
+		subscribe:  make(chan subscription),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
-		clients:    make(map[*Client]bool),
+		clients:    make(map[uint]map[*Client]bool),
 	}
 }
 
@@ -58,63 +163,153 @@ func (h *Hub) Run() {
 	for {
 		select {
 		case client := <-h.register:
-			h.mu.Lock()
-			h.clients[client] = true
-			h.mu.Unlock()
+			if h.clients[client.userID] == nil {
+				h.clients[client.userID] = make(map[*Client]bool)
+			}
+			h.clients[client.userID][client] = true
 		case client := <-h.unregister:
-			h.mu.Lock()
-			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				close(client.send)
+			h.remove(client)
+		case s := <-h.subscribe:
+			if !h.clients[s.client.userID][s.client] {
+				continue
 			}
-			h.mu.Unlock()
-		case message := <-h.broadcast:
-			h.mu.Lock()
-			for client := range h.clients {
-				select {
-				case client.send <- message:
-				default:
-					close(client.send)
-					delete(h.clients, client)
+			h.applySubscription(s)
+		case d := <-h.deliver:
+			for client := range h.clients[d.userID] {
+				if client.wants(d.topics) {
+					h.push(client, d.message)
 				}
 			}
-			h.mu.Unlock()
 		}
 	}
 }
 
-func (h *Hub) Broadcast(event Event) {
+// remove drops a client, closing its send channel once
+func (h *Hub) remove(client *Client) {
+	clients := h.clients[client.userID]
+	if _, ok := clients[client]; !ok {
+		return
+	}
+	delete(clients, client)
+	if len(clients) == 0 {
+		delete(h.clients, client.userID)
+	}
+	close(client.send)
+}
+
+// push queues a message for a client, dropping clients that cannot keep up
+func (h *Hub) push(client *Client, message []byte) {
+	select {
+	case client.send <- message:
+	default:
+		h.remove(client)
+	}
+}
+
+// applySubscription changes a client's topics and tells it the result
+func (h *Hub) applySubscription(s subscription) {
+	client := s.client
+	if client.topics == nil {
+		client.topics = make(map[string]bool)
+	}
+	for _, topic := range s.topics {
+		if s.subscribe {
+			client.topics[topic] = true
+		} else {
+			delete(client.topics, topic)
+		}
+	}
+
+	topics := make([]string, 0, len(client.topics))
+	for topic := range client.topics {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	message, err := json.Marshal(Event{Type: "SUBSCRIPTIONS", Payload: map[string][]string{"topics": topics}})
+	if err != nil {
+		return
+	}
+	h.push(client, message)
+}
+
+// Send delivers an event to the clients of a user
+func (h *Hub) Send(userID uint, event Event) {
+	var topics []string
+	if event.Topic != "" {
+		topics = []string{event.Topic}
+	}
+	h.sendTopics(userID, event, topics)
+}
+
+// sendTopics delivers an event to the clients of a user that want any of
+// topics, for events that concern several (a move between folders)
+func (h *Hub) sendTopics(userID uint, event Event, topics []string) {
 	message, err := json.Marshal(event)
 	if err != nil {
 		log.Printf("Error marshalling event: %v", err)
 		return
 	}
-	h.broadcast <- message
+	h.deliver <- delivery{userID: userID, topics: topics, message: message}
+}
+
+// Publish sends an event to a user's clients that want its topic
+func (h *Hub) Publish(userID uint, topic, eventType string, payload interface{}) {
+	h.Send(userID, Event{
+		Type:    eventType,
+		Topic:   topic,
+		Payload: payload,
+	})
 }
 
+// readPump handles subscriptions and pongs until the connection fails or
+// the client stops answering pings
 func (c *Client) readPump() {
 	defer func() {
 		c.hub.unregister <- c
 		c.conn.Close()
 	}()
+	c.conn.SetReadLimit(maxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
 	for {
-		_, _, err := c.conn.ReadMessage()
+		_, data, err := c.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, 1006) { // 1006 is Abnormal Closure
 				log.Printf("error: %v", err)
 			}
 			break
 		}
+
+		var msg clientMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			continue
+		}
+		if msg.Type != "subscribe" && msg.Type != "unsubscribe" {
+			continue
+		}
+		var topics []string
+		for _, topic := range msg.Payload.Topics {
+			if normalized, ok := api.NormalizeTopic(topic); ok {
+				topics = append(topics, normalized)
+			}
+		}
+		c.hub.subscribe <- subscription{client: c, subscribe: msg.Type == "subscribe", topics: topics}
 	}
 }
 
+// writePump sends queued messages and pings the client every pingPeriod
 func (c *Client) writePump() {
+	ticker := time.NewTicker(pingPeriod)
 	defer func() {
+		ticker.Stop()
 		c.conn.Close()
 	}()
 	for {
 		select {
 		case message, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
 				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
 				return
@@ -129,17 +324,30 @@ func (c *Client) writePump() {
 			if err := w.Close(); err != nil {
 				return
 			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
 		}
 	}
 }
 
+// ServeWs upgrades an authenticated request and registers the connection
+// for the user's events
 func ServeWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	user := auth.GetUserFromContext(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("Upgrade error: %v", err)
 		return
 	}
-	client := &Client{hub: hub, conn: conn, send: make(chan []byte, 256)}
+	client := &Client{hub: hub, conn: conn, send: make(chan []byte, 256), userID: user.ID}
 	client.hub.register <- client
 
 	go client.writePump()
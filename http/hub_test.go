@@ -0,0 +1,162 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"github.com/satufile/satufile/auth"
+	"github.com/satufile/satufile/routes/api"
+	"github.com/satufile/satufile/users"
+)
+
+func TestHubDeliversPerUser(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Connections are served concurrently; one connection keeps them on
+	// the same in-memory database
+	sqlDB, _ := db.DB()
+	sqlDB.SetMaxOpenConns(1)
+
+	userRepo := users.NewRepository(db)
+	if err := userRepo.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	auth.SetSecretKey("test-secret-key")
+	tokens := map[string]string{}
+	ids := map[string]uint{}
+	for _, name := range []string{"alice", "bob"} {
+		user := &users.User{Username: name, Email: name + "@example.com", Password: "x", StoragePath: t.TempDir()}
+		if err := userRepo.Create(user); err != nil {
+			t.Fatal(err)
+		}
+		db.Model(user).Updates(map[string]interface{}{"force_setup": false, "is_default_password": false})
+		tokens[name], _ = auth.GenerateToken(user, time.Hour)
+		ids[name] = user.ID
+	}
+
+	hub := NewHub()
+	go hub.Run()
+	mux := http.NewServeMux()
+	mux.Handle("/api/ws", wsHandler(userRepo, hub))
+	mux.Handle("/api/ws/ticket", auth.RequireAuth(userRepo)(http.HandlerFunc(wsTicketPost)))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/ws"
+
+	ticket := func(token string) string {
+		t.Helper()
+		req, _ := http.NewRequest("POST", server.URL+"/api/ws/ticket", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("Getting a ticket failed: %v %v", err, resp)
+		}
+		defer resp.Body.Close()
+		var body struct {
+			Ticket string `json:"ticket"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		return body.Ticket
+	}
+	dialTicket := func(ticket string, header http.Header) (*websocket.Conn, *http.Response, error) {
+		if header == nil {
+			header = http.Header{"Origin": {server.URL}}
+		}
+		return websocket.DefaultDialer.Dial(wsURL+"?ticket="+ticket, header)
+	}
+	dial := func(token string, header http.Header) (*websocket.Conn, *http.Response, error) {
+		return dialTicket(ticket(token), header)
+	}
+	read := func(conn *websocket.Conn) (Event, bool) {
+		var event Event
+		conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		if err := conn.ReadJSON(&event); err != nil {
+			return event, false
+		}
+		return event, true
+	}
+
+	// Anonymous and cross-site connections are refused, and so are
+	// session tokens in the URL and used tickets
+	if _, resp, err := dialTicket("", nil); err == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a ticket, got %v", err)
+	}
+	if _, resp, err := websocket.DefaultDialer.Dial(wsURL+"?token="+tokens["alice"], http.Header{"Origin": {server.URL}}); err == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a token in the URL, got %v", err)
+	}
+	used := ticket(tokens["bob"])
+	if conn, _, err := dialTicket(used, nil); err != nil {
+		t.Fatalf("Expected the ticket to open a connection: %v", err)
+	} else {
+		conn.Close()
+	}
+	if _, resp, err := dialTicket(used, nil); err == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a used ticket, got %v", err)
+	}
+	if conn, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Authorization": {"Bearer " + tokens["bob"]}, "Origin": {server.URL}}); err != nil {
+		t.Errorf("Expected clients that can set headers to use the token: %v", err)
+	} else {
+		conn.Close()
+	}
+	for _, origin := range []string{"https://evil.example", "http://localhost:5173", ""} {
+		if _, resp, err := dial(tokens["alice"], http.Header{"Origin": {origin}}); err == nil || resp.StatusCode != http.StatusForbidden {
+			t.Errorf("Expected 403 from origin %q, got %v", origin, err)
+		}
+	}
+	SetAllowedOrigins([]string{"https://files.example.com/"}, true)
+	for _, origin := range []string{"https://files.example.com", "http://localhost:5173", "http://127.0.0.1:5173"} {
+		if conn, _, err := dial(tokens["alice"], http.Header{"Origin": {origin}}); err != nil {
+			t.Errorf("Expected origin %q allowed once configured: %v", origin, err)
+		} else {
+			conn.Close()
+		}
+	}
+	SetAllowedOrigins(nil, false)
+
+	alice, _, err := dial(tokens["alice"], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	bob, _, err := dial(tokens["bob"], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+
+	// Events reach their user only; without subscriptions every topic does
+	time.Sleep(50 * time.Millisecond) // let the hub register both
+	hub.Publish(ids["alice"], api.DirTopic("/Documents"), "FS_EVENT", map[string]string{"path": "/Documents/a.txt"})
+	if event, ok := read(alice); !ok || event.Type != "FS_EVENT" || event.Topic != "dir:/Documents" {
+		t.Errorf("Expected alice to get her event, got %+v %v", event, ok)
+	}
+	if event, ok := read(bob); ok {
+		t.Errorf("Expected bob to get nothing, got %+v", event)
+	}
+
+	// Subscribing narrows the topics; events without a topic still arrive
+	alice.WriteJSON(map[string]interface{}{"type": "subscribe", "payload": map[string]interface{}{"topics": []string{"trash", "dir:/Photos/", "bogus"}}})
+	if event, ok := read(alice); !ok || event.Type != "SUBSCRIPTIONS" {
+		t.Fatalf("Expected the subscriptions, got %+v %v", event, ok)
+	} else if topics := event.Payload.(map[string]interface{})["topics"].([]interface{}); len(topics) != 2 || topics[0] != "dir:/Photos" || topics[1] != "trash" {
+		t.Errorf("Unexpected subscriptions: %v", topics)
+	}
+	hub.Publish(ids["alice"], api.DirTopic("/Documents"), "FS_EVENT", nil)
+	hub.Publish(ids["alice"], api.TopicTrash, "TRASH_ADDED", nil)
+	hub.Publish(ids["alice"], "", "BATCH_COMPLETE", nil)
+	for _, want := range []string{"TRASH_ADDED", "BATCH_COMPLETE"} {
+		if event, ok := read(alice); !ok || event.Type != want {
+			t.Errorf("Expected %s, got %+v %v", want, event, ok)
+		}
+	}
+}
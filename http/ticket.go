@@ -0,0 +1,81 @@
+package http
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/satufile/satufile/auth"
+)
+
+// wsTicketTTL is how long a WebSocket ticket can be redeemed
+const wsTicketTTL = 30 * time.Second
+
+// wsTicket lets one WebSocket connection authenticate as a user. Browsers
+// cannot set headers on the upgrade request, and a ticket in its URL is
+// harmless once used, unlike the session token.
+type wsTicket struct {
+	userID  uint
+	expires time.Time
+}
+
+var (
+	wsTickets   = make(map[string]wsTicket)
+	wsTicketsMu sync.Mutex
+)
+
+// issueWsTicket returns a new ticket for userID and drops expired ones
+func issueWsTicket(userID uint) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b)
+
+	wsTicketsMu.Lock()
+	defer wsTicketsMu.Unlock()
+
+	now := time.Now()
+	for t, ticket := range wsTickets {
+		if now.After(ticket.expires) {
+			delete(wsTickets, t)
+		}
+	}
+	wsTickets[id] = wsTicket{userID: userID, expires: now.Add(wsTicketTTL)}
+	return id, nil
+}
+
+// redeemWsTicket returns the user of an unexpired ticket, which cannot be
+// used again
+func redeemWsTicket(id string) (uint, bool) {
+	wsTicketsMu.Lock()
+	defer wsTicketsMu.Unlock()
+
+	ticket, ok := wsTickets[id]
+	delete(wsTickets, id)
+	if !ok || time.Now().After(ticket.expires) {
+		return 0, false
+	}
+	return ticket.userID, true
+}
+
+// wsTicketPost handles POST /api/ws/ticket - answers {"ticket"} for
+// opening /api/ws?ticket=...
+func wsTicketPost(w http.ResponseWriter, r *http.Request) {
+	user := auth.GetUserFromContext(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	ticket, err := issueWsTicket(user.ID)
+	if err != nil {
+		http.Error(w, "Failed to issue ticket", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"ticket": ticket})
+}
@@ -1,43 +1,143 @@
 package http
 
 import (
+	"errors"
+	"io/fs"
 	"log"
+	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
+
+	"github.com/satufile/satufile/files"
+	"github.com/satufile/satufile/routes/api"
+	"github.com/satufile/satufile/search"
+	"github.com/satufile/satufile/users"
+)
+
+const (
+	// Changes to a path are held until it has been quiet this long, so a
+	// file being written produces one event rather than hundreds
+	debounce = 200 * time.Millisecond
+	// How long a rename waits for the create that completes the move
+	renameWindow = 50 * time.Millisecond
+	// How often the list of user partitions is reloaded
+	rootsRefresh = 30 * time.Second
+	// How often partitions are scanned once they could not be watched
+	pollInterval = 10 * time.Second
 )
 
+// Roots lists the partition root of every user whose files are watched
+type Roots func() (map[uint]string, error)
+
+// UserRoots lists the roots of the users in userRepo that have storage on
+// the local disk; remote backends cannot be watched
+func UserRoots(userRepo *users.Repository) Roots {
+	return func() (map[uint]string, error) {
+		list, err := userRepo.List()
+		if err != nil {
+			return nil, err
+		}
+		roots := make(map[uint]string, len(list))
+		for _, u := range list {
+			if u.StoragePath != "" && u.Backend == "" {
+				roots[u.ID] = filepath.Clean(u.Root())
+			}
+		}
+		return roots, nil
+	}
+}
+
+// change is what happened to a path since its last event was sent
+type change struct {
+	userID uint
+	rel    string
+	// Where the path was moved from, as an absolute and a user path
+	fromPath string
+	from     string
+	// Whether the path did not exist before the change
+	created bool
+	last    time.Time
+}
+
+// rename is a Rename event waiting for the Create that ends the move
+type rename struct {
+	userID uint
+	path   string
+	rel    string
+	at     time.Time
+}
+
+// entryState is what polling compares between two scans
+type entryState struct {
+	size  int64
+	mod   time.Time
+	isDir bool
+}
+
+// snapshot maps the absolute paths of a partition to their state
+type snapshot map[string]entryState
+
+// Watcher follows the partitions of all users recursively and tells each
+// user's clients about changes to their files with FS_EVENT messages.
+// Partitions that cannot get inotify watches (the system limit was
+// reached) are scanned every pollInterval instead.
+//
+// All state is owned by the Watch loop.
 type Watcher struct {
 	watcher *fsnotify.Watcher
 	hub     *Hub
-	root    string
+	index   *search.Index // optional, kept in sync with every change
+	roots   Roots
+
+	// add places a watch on a directory
+	add       func(path string) error
+	pollEvery time.Duration
+
+	users   map[uint]string    // partition roots by user
+	watched map[string]bool    // directories with a watch
+	polled  map[uint]snapshot  // partitions followed by polling
+	pending map[string]*change // changes waiting out the debounce
+	renamed *rename            // the rename waiting for its create
+	moved   *rename            // the last completed move, see handle
 }
 
-func NewWatcher(root string, hub *Hub) (*Watcher, error) {
+func NewWatcher(roots Roots, hub *Hub, index *search.Index) (*Watcher, error) {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return nil, err
 	}
 
 	return &Watcher{
-		watcher: watcher,
-		hub:     hub,
-		root:    root,
+		watcher:   watcher,
+		hub:       hub,
+		index:     index,
+		roots:     roots,
+		add:       watcher.Add,
+		pollEvery: pollInterval,
+		users:     make(map[uint]string),
+		watched:   make(map[string]bool),
+		polled:    make(map[uint]snapshot),
+		pending:   make(map[string]*change),
 	}, nil
 }
 
+// Watch follows the partitions until the watcher is closed
 func (w *Watcher) Watch() {
-	// Add root and all subdirectories
-	err := w.addRecursive(w.root)
-	if err != nil {
-		log.Printf("Error adding root to watcher: %v", err)
-	}
+	w.refreshRoots()
 
-	// Debounce timer to avoid spamming multiple events for one operation
-	var lastEvent time.Time
-	var lastPath string
+	flush := time.NewTicker(debounce / 2)
+	refresh := time.NewTicker(rootsRefresh)
+	poll := time.NewTicker(w.pollEvery)
+	defer func() {
+		flush.Stop()
+		refresh.Stop()
+		poll.Stop()
+	}()
 
 	for {
 		select {
@@ -45,65 +145,351 @@ func (w *Watcher) Watch() {
 			if !ok {
 				return
 			}
+			w.handle(event, time.Now())
 
-			// Simple debouncing: skip if same path and within 100ms
-			if event.Name == lastPath && time.Since(lastEvent) < 100*time.Millisecond {
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				w.rescan()
 				continue
 			}
-			lastEvent = time.Now()
-			lastPath = event.Name
-
-			relPath := strings.TrimPrefix(event.Name, w.root)
-			if relPath == "" {
-				relPath = "/"
-			} else {
-				relPath = filepath.ToSlash(relPath)
+			log.Printf("Watcher error: %v", err)
+
+		case now := <-flush.C:
+			w.flush(now)
+
+		case <-refresh.C:
+			w.refreshRoots()
+
+		case <-poll.C:
+			w.poll(time.Now())
+		}
+	}
+}
+
+func (w *Watcher) Close() error {
+	return w.watcher.Close()
+}
+
+// refreshRoots starts following new partitions and stops following those
+// of deleted users
+func (w *Watcher) refreshRoots() {
+	roots, err := w.roots()
+	if err != nil {
+		log.Printf("Watcher: failed to load users: %v", err)
+		return
+	}
+
+	for userID, root := range w.users {
+		if roots[userID] != root {
+			delete(w.users, userID)
+			delete(w.polled, userID)
+		}
+	}
+	// Drop the watches no remaining partition holds
+	for dir := range w.watched {
+		if _, _, ok := w.ownerOf(dir); !ok {
+			w.unwatch(dir)
+		}
+	}
+
+	for userID, root := range roots {
+		if _, ok := w.users[userID]; ok {
+			continue
+		}
+		// Partitions are created on first use; try again next time
+		if _, err := os.Stat(root); err != nil {
+			continue
+		}
+		w.users[userID] = root
+		w.addTree(userID, root, time.Time{})
+	}
+}
+
+// ownerOf maps an absolute path to the user whose files it is and the path
+// that user sees it at; ok is false for paths outside every partition
+func (w *Watcher) ownerOf(p string) (userID uint, rel string, ok bool) {
+	// The deepest root wins should one user's files hold another's
+	var ownerRoot string
+	for id, root := range w.users {
+		if (p == root || strings.HasPrefix(p, root+string(filepath.Separator))) && len(root) > len(ownerRoot) {
+			userID, ownerRoot = id, root
+		}
+	}
+	if ownerRoot == "" {
+		return 0, "", false
+	}
+	return userID, "/" + filepath.ToSlash(strings.TrimPrefix(strings.TrimPrefix(p, ownerRoot), string(filepath.Separator))), true
+}
+
+// addTree watches dir and every directory below it, except reserved ones.
+// Unless created is zero, everything found below dir is recorded as
+// created then: it appeared before its watch could report it.
+func (w *Watcher) addTree(userID uint, dir string, created time.Time) {
+	if _, ok := w.polled[userID]; ok {
+		return
+	}
+
+	filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		owner, rel, ok := w.ownerOf(p)
+		if !ok || files.IsReserved(rel) {
+			if d.IsDir() {
+				return filepath.SkipDir
 			}
+			return nil
+		}
+		if !created.IsZero() && p != dir {
+			w.record(p, owner, rel, true, created)
+		}
+		if !d.IsDir() || w.watched[p] {
+			return nil
+		}
 
-			op := ""
-			switch {
-			case event.Op&fsnotify.Create == fsnotify.Create:
-				op = "CREATE"
-				// Add new directories to watcher
-				w.addRecursive(event.Name)
-			case event.Op&fsnotify.Write == fsnotify.Write:
-				op = "WRITE"
-			case event.Op&fsnotify.Remove == fsnotify.Remove:
-				op = "DELETE"
-			case event.Op&fsnotify.Rename == fsnotify.Rename:
-				op = "RENAME"
+		if err := w.add(p); err != nil {
+			if isWatchLimit(err) {
+				w.startPolling(owner, err)
+				return filepath.SkipAll
 			}
+			log.Printf("Watcher: cannot watch %s: %v", p, err)
+			return filepath.SkipDir
+		}
+		w.watched[p] = true
+		return nil
+	})
+}
+
+// isWatchLimit reports whether adding a watch failed because the system
+// ran out of inotify watches or instances
+func isWatchLimit(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EMFILE)
+}
+
+// unwatch removes the watches on dir and every directory below it
+func (w *Watcher) unwatch(dir string) {
+	for p := range w.watched {
+		if p == dir || strings.HasPrefix(p, dir+string(filepath.Separator)) {
+			w.watcher.Remove(p)
+			delete(w.watched, p)
+		}
+	}
+}
 
-			if op != "" {
-				w.hub.Broadcast(Event{
-					Type: "FS_EVENT",
-					Payload: map[string]string{
-						"op":   op,
-						"path": relPath,
-					},
-				})
+// startPolling gives up on watches for a user's partition and follows it
+// by comparing scans instead
+func (w *Watcher) startPolling(userID uint, reason error) {
+	root := w.users[userID]
+	log.Printf("Watcher: polling %s every %s: %v", root, w.pollEvery, reason)
+	for p := range w.watched {
+		if owner, _, _ := w.ownerOf(p); owner == userID {
+			w.watcher.Remove(p)
+			delete(w.watched, p)
+		}
+	}
+	w.polled[userID] = w.scan(userID)
+}
+
+// scan records the state of everything in a user's partition
+func (w *Watcher) scan(userID uint) snapshot {
+	snap := make(snapshot)
+	root := w.users[userID]
+	filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == root {
+			return nil
+		}
+		owner, rel, _ := w.ownerOf(p)
+		if owner != userID || files.IsReserved(rel) {
+			if d.IsDir() {
+				return filepath.SkipDir
 			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		// Directories change with their contents, which are reported on
+		// their own
+		if d.IsDir() {
+			snap[p] = entryState{isDir: true}
+		} else {
+			snap[p] = entryState{size: info.Size(), mod: info.ModTime()}
+		}
+		return nil
+	})
+	return snap
+}
 
-		case err, ok := <-w.watcher.Errors:
-			if !ok {
-				return
+// poll records what changed in the polled partitions since their last scan
+func (w *Watcher) poll(now time.Time) {
+	for userID, prev := range w.polled {
+		next := w.scan(userID)
+		for p, state := range next {
+			old, existed := prev[p]
+			if existed && old == state {
+				continue
+			}
+			_, rel, _ := w.ownerOf(p)
+			w.record(p, userID, rel, !existed, now)
+		}
+		for p := range prev {
+			if _, ok := next[p]; !ok {
+				_, rel, _ := w.ownerOf(p)
+				w.record(p, userID, rel, false, now)
 			}
-			log.Printf("Watcher error: %v", err)
 		}
+		w.polled[userID] = next
 	}
 }
 
-func (w *Watcher) addRecursive(path string) error {
-	// Simplified recursive add: for now just add the directory itself
-	// Real implementation would walk the tree, but for performance and simplicity 
-	// in a home server environment, we might want to be careful with depth.
-	// We'll add the directory if it's indeed a directory.
-	
-	// Implementation note: fsnotify doesn't watch recursively by default on all platforms.
-	// For this prototype, we'll focus on the root and new folders.
-	return w.watcher.Add(path)
+// handle records a filesystem event and keeps the watches in step with
+// the directories it creates and removes
+func (w *Watcher) handle(event fsnotify.Event, now time.Time) {
+	userID, rel, ok := w.ownerOf(event.Name)
+	if !ok || files.IsReserved(rel) {
+		return
+	}
+
+	// A rename is only known to be a move within the partition once the
+	// create for its new name arrives; otherwise the path went away
+	if held := w.renamed; held != nil {
+		w.renamed = nil
+		if event.Has(fsnotify.Create) && held.userID == userID && now.Sub(held.at) < renameWindow {
+			w.move(held, event.Name, rel, now)
+			return
+		}
+		w.unwatch(held.path)
+		w.record(held.path, held.userID, held.rel, false, held.at)
+	}
+
+	switch {
+	case event.Has(fsnotify.Rename):
+		// A moved directory also reports the move of itself after the pair
+		if m := w.moved; m != nil && m.path == event.Name && now.Sub(m.at) < debounce {
+			return
+		}
+		w.renamed = &rename{userID: userID, path: event.Name, rel: rel, at: now}
+	case event.Has(fsnotify.Create):
+		w.record(event.Name, userID, rel, true, now)
+		if info, err := os.Lstat(event.Name); err == nil && info.IsDir() {
+			w.addTree(userID, event.Name, now)
+		}
+	case event.Has(fsnotify.Remove):
+		w.unwatch(event.Name)
+		w.record(event.Name, userID, rel, false, now)
+	case event.Has(fsnotify.Write):
+		w.record(event.Name, userID, rel, false, now)
+	}
 }
 
-func (w *Watcher) Close() error {
-	return w.watcher.Close()
+// move records that held was renamed to p
+func (w *Watcher) move(held *rename, p, rel string, now time.Time) {
+	w.moved = &rename{path: held.path, at: now}
+
+	c := &change{userID: held.userID, rel: rel, fromPath: held.path, from: held.rel, last: now}
+	if prev := w.pending[held.path]; prev != nil {
+		// Something created and moved within the window is just created;
+		// something moved twice still comes from where it was first
+		delete(w.pending, held.path)
+		if prev.created {
+			c.fromPath, c.from, c.created = "", "", true
+		} else if prev.from != "" {
+			c.fromPath, c.from = prev.fromPath, prev.from
+		}
+	}
+	w.pending[p] = c
+
+	// The watches below the old name report stale paths
+	w.unwatch(held.path)
+	if info, err := os.Lstat(p); err == nil && info.IsDir() {
+		w.addTree(held.userID, p, time.Time{})
+	}
+}
+
+// record notes a change to a path, merging it with pending ones
+func (w *Watcher) record(p string, userID uint, rel string, created bool, now time.Time) {
+	if c, ok := w.pending[p]; ok {
+		c.created = c.created || created
+		c.last = now
+		return
+	}
+	w.pending[p] = &change{userID: userID, rel: rel, created: created, last: now}
+}
+
+// flush sends the changes that have been quiet for the debounce window,
+// deciding what happened from what is on disk now
+func (w *Watcher) flush(now time.Time) {
+	if held := w.renamed; held != nil && now.Sub(held.at) >= renameWindow {
+		w.renamed = nil
+		w.unwatch(held.path)
+		w.record(held.path, held.userID, held.rel, false, held.at)
+	}
+
+	for p, c := range w.pending {
+		if now.Sub(c.last) < debounce {
+			continue
+		}
+		delete(w.pending, p)
+		w.send(p, c)
+	}
+}
+
+// send updates the search index and tells the user's clients about a change
+func (w *Watcher) send(p string, c *change) {
+	if w.index != nil {
+		w.index.Update(p)
+		if c.fromPath != "" {
+			w.index.Update(c.fromPath)
+		}
+	}
+
+	_, err := os.Lstat(p)
+	exists := err == nil
+	payload := map[string]string{"path": c.rel}
+	topics := []string{api.DirTopic(path.Dir(c.rel))}
+	switch {
+	case exists && c.from != "":
+		payload["op"] = "RENAME"
+		payload["from"] = c.from
+		if from := api.DirTopic(path.Dir(c.from)); from != topics[0] {
+			topics = append(topics, from)
+		}
+	case exists && c.created:
+		payload["op"] = "CREATE"
+	case exists:
+		payload["op"] = "WRITE"
+	case c.created:
+		// Came and went within the window
+		return
+	case c.from != "":
+		// Moved and then removed: gone from where the user last saw it
+		payload["op"] = "DELETE"
+		payload["path"] = c.from
+		topics = []string{api.DirTopic(path.Dir(c.from))}
+	default:
+		payload["op"] = "DELETE"
+	}
+
+	w.hub.sendTopics(c.userID, Event{Type: "FS_EVENT", Topic: topics[0], Payload: payload}, topics)
+}
+
+// rescan recovers from lost events: the kernel queue overflowed, so every
+// partition is re-watched and re-indexed and clients are told to reload
+func (w *Watcher) rescan() {
+	log.Printf("Watcher: event queue overflowed, rescanning")
+	for userID, root := range w.users {
+		if _, ok := w.polled[userID]; ok {
+			w.polled[userID] = w.scan(userID)
+		} else {
+			w.addTree(userID, root, time.Time{})
+		}
+		if w.index != nil {
+			go w.index.Refresh(userID, root)
+		}
+		w.hub.Send(userID, Event{Type: "FS_EVENT", Payload: map[string]string{"op": "RESCAN", "path": "/"}})
+	}
 }
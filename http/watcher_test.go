@@ -0,0 +1,198 @@
+package http
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"github.com/satufile/satufile/users"
+)
+
+// watchedEvents collects the FS_EVENT payloads a user's client receives
+func watchedEvents(t *testing.T, hub *Hub, userID uint) func() []map[string]string {
+	t.Helper()
+	client := &Client{hub: hub, send: make(chan []byte, 256), userID: userID}
+	hub.register <- client
+
+	// Returns what arrived until nothing did for a while
+	return func() []map[string]string {
+		var events []map[string]string
+		for {
+			select {
+			case message := <-client.send:
+				var event struct {
+					Type    string
+					Payload map[string]string
+				}
+				if err := json.Unmarshal(message, &event); err != nil || event.Type != "FS_EVENT" {
+					t.Fatalf("Unexpected message %s", message)
+				}
+				events = append(events, event.Payload)
+			case <-time.After(3 * debounce):
+				return events
+			}
+		}
+	}
+}
+
+// startWatcher follows root as the partition of user 1
+func startWatcher(t *testing.T, root string, setup func(*Watcher)) (*Hub, *Watcher) {
+	t.Helper()
+	hub := NewHub()
+	go hub.Run()
+	w, err := NewWatcher(func() (map[uint]string, error) {
+		return map[uint]string{1: root}, nil
+	}, hub, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if setup != nil {
+		setup(w)
+	}
+	go w.Watch()
+	t.Cleanup(func() { w.Close() })
+	time.Sleep(50 * time.Millisecond) // let the watches be placed
+	return hub, w
+}
+
+func hasEvent(events []map[string]string, op, path string) bool {
+	for _, e := range events {
+		if e["op"] == op && e["path"] == path {
+			return true
+		}
+	}
+	return false
+}
+
+func TestWatcherRecursive(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "Documents", "old"), 0755)
+	os.MkdirAll(filepath.Join(root, ".trash"), 0755)
+	hub, _ := startWatcher(t, root, nil)
+	collect := watchedEvents(t, hub, 1)
+
+	// Nested directories, existing or new, are followed; a file written in
+	// several steps is announced once
+	os.MkdirAll(filepath.Join(root, "Documents", "new", "deep"), 0755)
+	f, _ := os.Create(filepath.Join(root, "Documents", "new", "deep", "a.txt"))
+	for i := 0; i < 20; i++ {
+		f.WriteString("line\n")
+	}
+	f.Close()
+	os.WriteFile(filepath.Join(root, "Documents", "old", "b.txt"), []byte("b"), 0644)
+	os.WriteFile(filepath.Join(root, ".trash", "hidden.txt"), []byte("x"), 0644)
+
+	events := collect()
+	for _, want := range []string{"/Documents/new", "/Documents/new/deep", "/Documents/new/deep/a.txt", "/Documents/old/b.txt"} {
+		if !hasEvent(events, "CREATE", want) {
+			t.Errorf("Expected a CREATE of %s, got %v", want, events)
+		}
+	}
+	if len(events) != 4 {
+		t.Errorf("Expected one event per path, got %v", events)
+	}
+
+	os.WriteFile(filepath.Join(root, "Documents", "old", "b.txt"), []byte("bb"), 0644)
+	if events := collect(); len(events) != 1 || !hasEvent(events, "WRITE", "/Documents/old/b.txt") {
+		t.Errorf("Expected a single WRITE, got %v", events)
+	}
+
+	// Moves come as one event naming both paths, and watches follow them
+	os.Rename(filepath.Join(root, "Documents", "old", "b.txt"), filepath.Join(root, "b.txt"))
+	os.Rename(filepath.Join(root, "Documents", "new"), filepath.Join(root, "moved"))
+	events = collect()
+	if len(events) != 2 || !hasEvent(events, "RENAME", "/b.txt") || !hasEvent(events, "RENAME", "/moved") {
+		t.Fatalf("Expected two RENAMEs, got %v", events)
+	}
+	for _, e := range events {
+		if e["path"] == "/moved" && e["from"] != "/Documents/new" {
+			t.Errorf("Expected the move from /Documents/new, got %v", e)
+		}
+	}
+
+	os.WriteFile(filepath.Join(root, "moved", "deep", "c.txt"), []byte("c"), 0644)
+	if events := collect(); len(events) != 1 || !hasEvent(events, "CREATE", "/moved/deep/c.txt") {
+		t.Errorf("Expected the moved directory to be watched, got %v", events)
+	}
+
+	// Moving out of the partition removes
+	os.Rename(filepath.Join(root, "b.txt"), filepath.Join(t.TempDir(), "b.txt"))
+	os.RemoveAll(filepath.Join(root, "moved"))
+	events = collect()
+	if !hasEvent(events, "DELETE", "/b.txt") || !hasEvent(events, "DELETE", "/moved") {
+		t.Errorf("Expected DELETEs, got %v", events)
+	}
+
+	// Created and removed within the window is nothing at all
+	os.WriteFile(filepath.Join(root, "tmp.txt"), []byte("t"), 0644)
+	os.Remove(filepath.Join(root, "tmp.txt"))
+	if events := collect(); len(events) != 0 {
+		t.Errorf("Expected no events, got %v", events)
+	}
+}
+
+func TestWatcherPolling(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "Photos"), 0755)
+	hub, _ := startWatcher(t, root, func(w *Watcher) {
+		w.add = func(string) error { return syscall.ENOSPC }
+		w.pollEvery = 50 * time.Millisecond
+	})
+	collect := watchedEvents(t, hub, 1)
+
+	os.WriteFile(filepath.Join(root, "Photos", "a.jpg"), []byte("a"), 0644)
+	if events := collect(); len(events) != 1 || !hasEvent(events, "CREATE", "/Photos/a.jpg") {
+		t.Errorf("Expected a CREATE, got %v", events)
+	}
+	os.WriteFile(filepath.Join(root, "Photos", "a.jpg"), []byte("changed"), 0644)
+	if events := collect(); len(events) != 1 || !hasEvent(events, "WRITE", "/Photos/a.jpg") {
+		t.Errorf("Expected a WRITE, got %v", events)
+	}
+	os.Remove(filepath.Join(root, "Photos", "a.jpg"))
+	if events := collect(); len(events) != 1 || !hasEvent(events, "DELETE", "/Photos/a.jpg") {
+		t.Errorf("Expected a DELETE, got %v", events)
+	}
+}
+
+func TestWatcherOwner(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	userRepo := users.NewRepository(db)
+	userRepo.Migrate()
+	base := t.TempDir()
+	alice := &users.User{Username: "alice", Email: "a@example.com", Password: "x", StoragePath: base + "/alice"}
+	bob := &users.User{Username: "bob", Email: "b@example.com", Password: "x", StoragePath: base + "/alice/nested"}
+	carol := &users.User{Username: "carol", Email: "c@example.com", Password: "x"}
+	userRepo.Create(alice)
+	userRepo.Create(bob)
+	userRepo.Create(carol)
+
+	roots, err := UserRoots(userRepo)()
+	if err != nil || len(roots) != 2 {
+		t.Fatalf("Expected the roots of alice and bob, got %v %v", roots, err)
+	}
+
+	w := &Watcher{users: roots}
+	for path, want := range map[string]struct {
+		id  uint
+		rel string
+	}{
+		base + "/alice/a.txt":        {alice.ID, "/a.txt"},
+		base + "/alice":              {alice.ID, "/"},
+		base + "/alice/nested/b.txt": {bob.ID, "/b.txt"},
+		base + "/alicex/c.txt":       {},
+	} {
+		id, rel, ok := w.ownerOf(path)
+		if id != want.id || rel != want.rel || ok != (want.id != 0) {
+			t.Errorf("ownerOf(%s) = %d %q %v, want %d %q", path, id, rel, ok, want.id, want.rel)
+		}
+	}
+}
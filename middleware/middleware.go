@@ -94,6 +94,50 @@ func LoginRateLimit(next http.Handler) http.Handler {
 	})
 }
 
+// FailedLoginRateLimit puts endpoints that take a password on every
+// request, like WebDAV with HTTP Basic, behind the login limiter. Only
+// rejected passwords use up attempts, so clients that send them with each
+// request keep working while guessing is throttled like the login endpoint.
+func FailedLoginRateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, _, ok := r.BasicAuth(); !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+
+		if cfIP := r.Header.Get("CF-Connecting-IP"); cfIP != "" {
+			ip = cfIP
+		} else if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			ip = forwarded
+		}
+
+		limiter := getLoginVisitor(ip)
+		if limiter.Tokens() < 1 {
+			http.Error(w, "Too many login attempts. Please try again later.", http.StatusTooManyRequests)
+			return
+		}
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+		if sw.status == http.StatusUnauthorized {
+			limiter.Allow()
+		}
+	})
+}
+
+// statusWriter remembers the status code written through it
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
 // SecurityHeaders adds strict security headers to the response
 func SecurityHeaders(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -121,10 +165,17 @@ func CORSMiddleware(next http.Handler) http.Handler {
 		// Allow credentials requires specific origin, not wildcard
 		w.Header().Set("Access-Control-Allow-Origin", origin)
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Auth")
-
-		if r.Method == "OPTIONS" {
+		w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Auth, X-Chunk-Hash, "+
+			"Content-Digest, Repr-Digest, Digest, Tus-Resumable, Upload-Length, Upload-Metadata, Upload-Offset, Upload-Checksum")
+		// Let browser clients read the tus protocol and digest headers
+		w.Header().Set("Access-Control-Expose-Headers", "Location, Tus-Resumable, Tus-Version, Tus-Extension, "+
+			"Tus-Checksum-Algorithm, Upload-Offset, Upload-Length, Upload-Metadata, Upload-Expires, "+
+			"ETag, Digest, Repr-Digest")
+
+		// Only answer CORS preflights here; plain OPTIONS requests are used by
+		// WebDAV clients to discover capabilities and must reach the handler
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
 			w.WriteHeader(http.StatusOK)
 			return
 		}
@@ -0,0 +1,126 @@
+package preview
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+)
+
+var errNoOrientation = errors.New("no EXIF orientation")
+
+// readOrientation returns the EXIF orientation (1-8) of a JPEG stream
+func readOrientation(r io.Reader) (int, error) {
+	br := bufio.NewReader(r)
+	var soi [2]byte
+	if _, err := io.ReadFull(br, soi[:]); err != nil || soi != [2]byte{0xff, 0xd8} {
+		return 0, errNoOrientation
+	}
+
+	for {
+		var marker [4]byte
+		if _, err := io.ReadFull(br, marker[:]); err != nil || marker[0] != 0xff {
+			return 0, errNoOrientation
+		}
+		length := int(binary.BigEndian.Uint16(marker[2:])) - 2
+		if length < 0 {
+			return 0, errNoOrientation
+		}
+		// Metadata comes before the image data
+		if marker[1] == 0xda || marker[1] == 0xd9 {
+			return 0, errNoOrientation
+		}
+		if marker[1] != 0xe1 {
+			if _, err := br.Discard(length); err != nil {
+				return 0, errNoOrientation
+			}
+			continue
+		}
+
+		seg := make([]byte, length)
+		if _, err := io.ReadFull(br, seg); err != nil {
+			return 0, errNoOrientation
+		}
+		if o, ok := exifOrientation(seg); ok {
+			return o, nil
+		}
+	}
+}
+
+// exifOrientation reads tag 0x0112 from IFD0 of an APP1 Exif segment
+func exifOrientation(seg []byte) (int, bool) {
+	if len(seg) < 14 || string(seg[:6]) != "Exif\x00\x00" {
+		return 0, false
+	}
+	tiff := seg[6:]
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0, false
+	}
+
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd+2 > len(tiff) {
+		return 0, false
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < count; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0, false
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			o := int(order.Uint16(tiff[entry+8:]))
+			if o >= 1 && o <= 8 {
+				return o, true
+			}
+			return 0, false
+		}
+	}
+	return 0, false
+}
+
+// orient applies an EXIF orientation so the image displays upright
+func orient(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	ow, oh := w, h
+	if orientation >= 5 {
+		ow, oh = h, w // 90° rotations swap the dimensions
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, ow, oh))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirrored horizontally
+				dx, dy = w-1-x, y
+			case 3: // rotated 180°
+				dx, dy = w-1-x, h-1-y
+			case 4: // mirrored vertically
+				dx, dy = x, h-1-y
+			case 5: // mirrored, rotated 90° counter-clockwise
+				dx, dy = y, x
+			case 6: // rotated 90° clockwise
+				dx, dy = h-1-y, x
+			case 7: // mirrored, rotated 90° clockwise
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotated 90° counter-clockwise
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
@@ -0,0 +1,255 @@
+// Package preview generates and caches resized JPEG previews of images.
+// Cached previews live outside the partitions on the local disk, mirror
+// the source paths so whole folders can be dropped at once, and are
+// regenerated when the source's modification time changes. Previews of
+// encrypted partitions are cached encrypted the same way.
+//
+// Previews are JPEG whatever the client accepts. WebP sources are read,
+// but neither the standard library nor golang.org/x/image can write WebP,
+// and a lossless encoder would produce larger files than the JPEGs.
+package preview
+
+import (
+	"errors"
+	"image"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	// Registered source formats
+	_ "image/gif"
+	_ "image/png"
+
+	_ "golang.org/x/image/bmp"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+
+	"github.com/satufile/satufile/vfs"
+)
+
+// Sizes maps preview size names to the maximum width and height in pixels
+var Sizes = map[string]int{
+	"small":  256,
+	"medium": 640,
+	"large":  1280,
+}
+
+// MaxPixels is the largest source image (width × height) that is decoded
+const MaxPixels = 64 << 20
+
+// Quality is the JPEG quality of generated previews
+const Quality = 82
+
+var (
+	// ErrUnsupported means the file is not an image we can decode
+	ErrUnsupported = errors.New("unsupported image format")
+	// ErrTooLarge means the image exceeds MaxPixels
+	ErrTooLarge = errors.New("image too large to preview")
+	// ErrInvalidSize means the size name is not in Sizes
+	ErrInvalidSize = errors.New("invalid preview size")
+)
+
+// extensions lists the source formats with a registered decoder
+var extensions = map[string]bool{
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".bmp": true,
+}
+
+// Supported reports whether previews can be generated for name
+func Supported(name string) bool {
+	return extensions[strings.ToLower(filepath.Ext(name))]
+}
+
+// Service generates previews into a cache directory
+type Service struct {
+	dir string
+	sem chan struct{} // bounds concurrent generations
+
+	mu       sync.Mutex
+	inflight map[string]*sync.Mutex
+}
+
+// NewService caches previews below dir
+func NewService(dir string) *Service {
+	return &Service{
+		dir:      dir,
+		sem:      make(chan struct{}, runtime.NumCPU()),
+		inflight: make(map[string]*sync.Mutex),
+	}
+}
+
+// cachePath returns where the preview of a partition-relative path is kept.
+// Each file gets a "<name>@" folder holding one JPEG per size, so removing
+// a folder's mirror removes the previews of everything inside it.
+func (s *Service) cachePath(userID uint, rel, size string) string {
+	return filepath.Join(s.base(userID, rel)+"@", size+".jpg")
+}
+
+func (s *Service) base(userID uint, rel string) string {
+	return filepath.Join(s.dir, strconv.FormatUint(uint64(userID), 10), filepath.FromSlash(filepath.Clean("/"+rel)))
+}
+
+// Get opens an up-to-date preview of root/rel on fsys, generating it if
+// needed
+func (s *Service) Get(fsys vfs.FS, userID uint, root, rel, size string) (vfs.File, error) {
+	maxDim, ok := Sizes[size]
+	if !ok {
+		return nil, ErrInvalidSize
+	}
+	if !Supported(rel) {
+		return nil, ErrUnsupported
+	}
+
+	src := filepath.Join(root, filepath.FromSlash(rel))
+	info, err := fsys.Stat(src)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, ErrUnsupported
+	}
+
+	cache := vfs.Like(fsys, vfs.Local)
+	cached := s.cachePath(userID, rel, size)
+	if fresh(cache, cached, info) {
+		return cache.Open(cached)
+	}
+
+	// One generation per preview at a time; the others wait for it
+	unlock := s.lock(cached)
+	defer unlock()
+	if fresh(cache, cached, info) {
+		return cache.Open(cached)
+	}
+
+	s.sem <- struct{}{}
+	defer func() { <-s.sem }()
+
+	if err := generate(fsys, src, cache, cached, maxDim); err != nil {
+		return nil, err
+	}
+	// The cached copy carries the source's mtime to detect changes
+	if err := vfs.Chtimes(cache, cached, info.ModTime(), info.ModTime()); err != nil {
+		return nil, err
+	}
+	return cache.Open(cached)
+}
+
+// fresh reports whether the cached preview matches the source version
+func fresh(cache vfs.FS, cached string, src os.FileInfo) bool {
+	info, err := cache.Stat(cached)
+	return err == nil && info.ModTime().Equal(src.ModTime())
+}
+
+func (s *Service) lock(key string) func() {
+	s.mu.Lock()
+	m, ok := s.inflight[key]
+	if !ok {
+		m = &sync.Mutex{}
+		s.inflight[key] = m
+	}
+	s.mu.Unlock()
+
+	m.Lock()
+	return func() {
+		m.Unlock()
+		s.mu.Lock()
+		delete(s.inflight, key)
+		s.mu.Unlock()
+	}
+}
+
+// Remove drops the cached previews of rel and, for folders, of
+// everything inside it
+func (s *Service) Remove(userID uint, rel string) {
+	base := s.base(userID, rel)
+	if base == filepath.Join(s.dir, strconv.FormatUint(uint64(userID), 10)) {
+		return // never drop a whole user's cache by accident
+	}
+	os.RemoveAll(base + "@")
+	os.RemoveAll(base)
+}
+
+// Forget drops all cached previews of a user
+func (s *Service) Forget(userID uint) error {
+	return os.RemoveAll(filepath.Join(s.dir, strconv.FormatUint(uint64(userID), 10)))
+}
+
+// generate writes a JPEG preview of src fitting in maxDim × maxDim
+func generate(fsys vfs.FS, src string, cache vfs.FS, dst string, maxDim int) error {
+	f, err := fsys.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return ErrUnsupported
+	}
+	if cfg.Width*cfg.Height > MaxPixels {
+		return ErrTooLarge
+	}
+
+	orientation := 1
+	if _, err := f.Seek(0, 0); err != nil {
+		return err
+	}
+	if o, err := readOrientation(f); err == nil {
+		orientation = o
+	}
+
+	if _, err := f.Seek(0, 0); err != nil {
+		return err
+	}
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return ErrUnsupported
+	}
+	// The bounding box is square, so scaling before rotating gives the same
+	// result with far fewer pixels to move
+	out := orient(resize(img, maxDim), orientation)
+
+	if err := cache.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	tmp := dst + ".tmp"
+	w, err := cache.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := jpeg.Encode(w, out, &jpeg.Options{Quality: Quality}); err != nil {
+		w.Close()
+		cache.Remove(tmp)
+		return err
+	}
+	if err := w.Close(); err != nil {
+		cache.Remove(tmp)
+		return err
+	}
+	return cache.Rename(tmp, dst)
+}
+
+// resize scales img to fit in maxDim × maxDim, never enlarging it, onto
+// a white background (JPEG has no transparency)
+func resize(img image.Image, maxDim int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > maxDim || h > maxDim {
+		if w >= h {
+			h = max(1, h*maxDim/w)
+			w = maxDim
+		} else {
+			w = max(1, w*maxDim/h)
+			h = maxDim
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Over, nil)
+	return dst
+}
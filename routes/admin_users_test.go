@@ -0,0 +1,172 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/satufile/satufile/accounts"
+	"github.com/satufile/satufile/system/partition"
+	"github.com/satufile/satufile/users"
+)
+
+func TestAdminUsers(t *testing.T) {
+	env := setupTestEnv(t)
+	root := t.TempDir()
+	env.Deps.Accounts = accounts.NewManager(env.DB, env.UserRepo, partition.NewManager(partition.BasePath(root)), accounts.ArchiveDir(root))
+
+	admin, adminToken := env.createReadyUser(t, "root")
+	env.DB.Model(admin).Update("admin", true)
+	_, userToken := env.createReadyUser(t, "mallory")
+
+	create := func(body map[string]interface{}) (*users.UserInfo, int) {
+		t.Helper()
+		w := env.makeRequestWithBadHeader("POST", "/api/admin/users", body, "Bearer "+adminToken)
+		if w.Code != http.StatusCreated {
+			return nil, w.Code
+		}
+		var info users.UserInfo
+		json.NewDecoder(w.Body).Decode(&info)
+		return &info, w.Code
+	}
+
+	info, code := create(map[string]interface{}{
+		"username":            "alice",
+		"password":            "Str0ng!Password",
+		"email":               "alice@example.com",
+		"scope":               "/Projects",
+		"storageAllocationGb": 5,
+		"perm":                map[string]bool{"delete": false},
+	})
+	if code != http.StatusCreated {
+		t.Fatalf("Create failed: %d", code)
+	}
+
+	alice, err := env.UserRepo.GetByID(info.ID)
+	if err != nil {
+		t.Fatalf("Created user not found: %v", err)
+	}
+	if alice.Perm.Delete || !alice.Perm.Create || alice.Perm.Admin {
+		t.Errorf("Unexpected permissions: %+v", alice.Perm)
+	}
+	if alice.Scope != "/Projects" || alice.StorageAllocationGb != 5 {
+		t.Errorf("Unexpected scope or quota: %q %d", alice.Scope, alice.StorageAllocationGb)
+	}
+	if alice.ForceSetup || !alice.MustChangePassword || alice.SetupStep != "complete" {
+		t.Errorf("Unexpected setup state: force=%v mustChange=%v step=%q", alice.ForceSetup, alice.MustChangePassword, alice.SetupStep)
+	}
+	if _, err := os.Stat(filepath.Join(alice.StoragePath, "README.txt")); err != nil {
+		t.Errorf("Partition was not provisioned: %v", err)
+	}
+
+	t.Run("Duplicate", func(t *testing.T) {
+		_, code := create(map[string]interface{}{
+			"username": "alice", "password": "Str0ng!Password", "email": "other@example.com",
+		})
+		if code != http.StatusConflict {
+			t.Errorf("Expected 409, got %d", code)
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		_, code := create(map[string]interface{}{
+			"username": "../bob", "password": "Str0ng!Password", "email": "bob@example.com",
+		})
+		if code != http.StatusBadRequest {
+			t.Errorf("Expected 400, got %d", code)
+		}
+	})
+
+	t.Run("NonAdmin", func(t *testing.T) {
+		w := env.requestAs(userToken, "GET", "/api/admin/users")
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected 403, got %d", w.Code)
+		}
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		w := env.makeRequestWithBadHeader("PUT", fmt.Sprintf("/api/admin/users/%d", alice.ID), map[string]interface{}{
+			"perm":                map[string]bool{"delete": true, "share": false},
+			"storageAllocationGb": 8,
+		}, "Bearer "+adminToken)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Update failed: %d %s", w.Code, w.Body.String())
+		}
+		updated, _ := env.UserRepo.GetByID(alice.ID)
+		if !updated.Perm.Delete || updated.Perm.Share || updated.StorageAllocationGb != 8 {
+			t.Errorf("Update not applied: %+v %d", updated.Perm, updated.StorageAllocationGb)
+		}
+
+		w = env.makeRequestWithBadHeader("PUT", fmt.Sprintf("/api/admin/users/%d", alice.ID), map[string]interface{}{
+			"perm": map[string]bool{"fly": true},
+		}, "Bearer "+adminToken)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for unknown permission, got %d", w.Code)
+		}
+	})
+
+	t.Run("LastAdmin", func(t *testing.T) {
+		w := env.makeRequestWithBadHeader("PUT", fmt.Sprintf("/api/admin/users/%d", admin.ID), map[string]interface{}{
+			"perm": map[string]bool{"admin": false},
+		}, "Bearer "+adminToken)
+		if w.Code != http.StatusConflict {
+			t.Errorf("Expected 409 when demoting the last admin, got %d", w.Code)
+		}
+
+		w = env.requestAs(adminToken, "DELETE", fmt.Sprintf("/api/admin/users/%d", admin.ID))
+		if w.Code != http.StatusConflict {
+			t.Errorf("Expected 409 when deleting yourself, got %d", w.Code)
+		}
+	})
+
+	t.Run("DeleteArchive", func(t *testing.T) {
+		os.WriteFile(filepath.Join(alice.StoragePath, "Documents", "keep.txt"), []byte("data"), 0644)
+
+		w := env.requestAs(adminToken, "DELETE", fmt.Sprintf("/api/admin/users/%d", alice.ID))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Delete failed: %d %s", w.Code, w.Body.String())
+		}
+		var out map[string]string
+		json.NewDecoder(w.Body).Decode(&out)
+		if out["data"] != accounts.DataArchive || out["archive"] == "" {
+			t.Fatalf("Unexpected response: %v", out)
+		}
+		if _, err := os.Stat(alice.StoragePath); !os.IsNotExist(err) {
+			t.Errorf("Partition should have been moved")
+		}
+		if data, err := os.ReadFile(filepath.Join(out["archive"], "Documents", "keep.txt")); err != nil || string(data) != "data" {
+			t.Errorf("Archive is missing the user's files: %v", err)
+		}
+		if _, err := env.UserRepo.GetByID(alice.ID); err == nil {
+			t.Errorf("User should be gone")
+		}
+
+		// The name can be used again
+		if _, code := create(map[string]interface{}{
+			"username": "alice", "password": "Str0ng!Password", "email": "alice@example.com", "storageAllocationGb": 1,
+		}); code != http.StatusCreated {
+			t.Errorf("Expected to recreate alice, got %d", code)
+		}
+	})
+
+	t.Run("DeleteRemove", func(t *testing.T) {
+		bob, code := create(map[string]interface{}{
+			"username": "bob", "password": "Str0ng!Password", "email": "bob@example.com", "storageAllocationGb": 1,
+		})
+		if code != http.StatusCreated {
+			t.Fatalf("Create failed: %d", code)
+		}
+		path := filepath.Join(partition.BasePath(root), "bob")
+
+		w := env.requestAs(adminToken, "DELETE", fmt.Sprintf("/api/admin/users/%d?data=remove", bob.ID))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Delete failed: %d %s", w.Code, w.Body.String())
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("Partition should have been removed")
+		}
+	})
+}
@@ -0,0 +1,328 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"github.com/satufile/satufile/accounts"
+	"github.com/satufile/satufile/users"
+)
+
+// RoleRequest is the request body for POST and PUT /api/admin/roles;
+// omitted fields are left alone on PUT
+type RoleRequest struct {
+	Name        *string         `json:"name,omitempty"`
+	Description *string         `json:"description,omitempty"`
+	Perm        map[string]bool `json:"perm,omitempty"` // over none on POST, over the current ones on PUT
+}
+
+// GroupRequest is the request body for POST and PUT /api/admin/groups;
+// omitted fields are left alone on PUT
+type GroupRequest struct {
+	Name        *string `json:"name,omitempty"`
+	Description *string `json:"description,omitempty"`
+	Roles       *[]uint `json:"roles,omitempty"` // replaces the group's roles
+}
+
+// AccessRequest is the request body for PUT /api/admin/users/{id}/access;
+// omitted fields are left alone
+type AccessRequest struct {
+	Roles     *[]uint          `json:"roles,omitempty"`
+	Overrides *map[string]bool `json:"overrides,omitempty"`
+}
+
+// AccessInfo is what a user's permissions are made of and what they
+// resolve to
+type AccessInfo struct {
+	users.Access
+	EffectivePerm users.Permissions `json:"effectivePerm"`
+}
+
+// writeRoleError maps role and group errors to HTTP responses
+func writeRoleError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, users.ErrRoleNotFound), errors.Is(err, users.ErrGroupNotFound), errors.Is(err, users.ErrUserNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, users.ErrNameTaken):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, users.ErrInvalidName), errors.Is(err, users.ErrUnknownPermission), errors.Is(err, accounts.ErrInvalid):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// varID parses the mux variable name as an ID, 0 if it is not one
+func varID(r *http.Request, name string) uint {
+	id, err := strconv.ParseUint(mux.Vars(r)[name], 10, 32)
+	if err != nil {
+		return 0
+	}
+	return uint(id)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// AdminRolesGet handles GET /api/admin/roles
+func AdminRolesGet(deps *Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		roles, err := deps.UserRepo.ListRoles()
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, roles)
+	}
+}
+
+// AdminRolePost handles POST /api/admin/roles - creates a role from
+// {"name", "description", "perm"}
+func AdminRolePost(deps *Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req RoleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		role := &users.Role{Name: *req.Name}
+		if err := applyRoleRequest(role, req); err != nil {
+			writeRoleError(w, err)
+			return
+		}
+		if err := deps.UserRepo.SaveRole(role); err != nil {
+			writeRoleError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, role)
+	}
+}
+
+// AdminRolePut handles PUT /api/admin/roles/{id}; members get the new
+// permissions with their next request
+func AdminRolePut(deps *Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		role, err := deps.UserRepo.GetRole(varID(r, "id"))
+		if err != nil {
+			writeRoleError(w, err)
+			return
+		}
+
+		var req RoleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := applyRoleRequest(role, req); err != nil {
+			writeRoleError(w, err)
+			return
+		}
+		if err := deps.UserRepo.SaveRole(role); err != nil {
+			writeRoleError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, role)
+	}
+}
+
+func applyRoleRequest(role *users.Role, req RoleRequest) error {
+	if req.Name != nil {
+		role.Name = *req.Name
+	}
+	if req.Description != nil {
+		role.Description = *req.Description
+	}
+	return accounts.ApplyPermissions(&role.Perm, req.Perm)
+}
+
+// AdminRoleDelete handles DELETE /api/admin/roles/{id}
+func AdminRoleDelete(deps *Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := deps.UserRepo.DeleteRole(varID(r, "id")); err != nil {
+			writeRoleError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// AdminGroupsGet handles GET /api/admin/groups
+func AdminGroupsGet(deps *Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		groups, err := deps.UserRepo.ListGroups()
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, groups)
+	}
+}
+
+// AdminGroupPost handles POST /api/admin/groups - creates a group from
+// {"name", "description", "roles"}
+func AdminGroupPost(deps *Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req GroupRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		group := &users.Group{}
+		applyGroupRequest(group, req)
+		if err := deps.UserRepo.SaveGroup(group); err != nil {
+			writeRoleError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, group)
+	}
+}
+
+// AdminGroupPut handles PUT /api/admin/groups/{id}
+func AdminGroupPut(deps *Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		group, err := deps.UserRepo.GetGroup(varID(r, "id"))
+		if err != nil {
+			writeRoleError(w, err)
+			return
+		}
+
+		var req GroupRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		applyGroupRequest(group, req)
+		if err := deps.UserRepo.SaveGroup(group); err != nil {
+			writeRoleError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, group)
+	}
+}
+
+func applyGroupRequest(group *users.Group, req GroupRequest) {
+	if req.Name != nil {
+		group.Name = *req.Name
+	}
+	if req.Description != nil {
+		group.Description = *req.Description
+	}
+	if req.Roles != nil {
+		group.Roles = *req.Roles
+	}
+}
+
+// AdminGroupDelete handles DELETE /api/admin/groups/{id}
+func AdminGroupDelete(deps *Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := deps.UserRepo.DeleteGroup(varID(r, "id")); err != nil {
+			writeRoleError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// AdminGroupMemberPut handles PUT /api/admin/groups/{id}/members/{userId}
+// - adds a user to a group
+func AdminGroupMemberPut(deps *Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		changeMembership(deps, w, r, deps.UserRepo.AddMember)
+	}
+}
+
+// AdminGroupMemberDelete handles DELETE
+// /api/admin/groups/{id}/members/{userId} - removes a user from a group
+func AdminGroupMemberDelete(deps *Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		changeMembership(deps, w, r, deps.UserRepo.RemoveMember)
+	}
+}
+
+// changeMembership applies change to the group and user of the request
+// and answers with the group
+func changeMembership(deps *Deps, w http.ResponseWriter, r *http.Request, change func(groupID, userID uint) error) {
+	groupID := varID(r, "id")
+	if err := change(groupID, varID(r, "userId")); err != nil {
+		writeRoleError(w, err)
+		return
+	}
+	group, err := deps.UserRepo.GetGroup(groupID)
+	if err != nil {
+		writeRoleError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, group)
+}
+
+// AdminUserAccessGet handles GET /api/admin/users/{id}/access - the roles,
+// groups and overrides of a user and the permissions they resolve to
+func AdminUserAccessGet(deps *Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := targetUser(deps, r)
+		if err != nil {
+			writeRoleError(w, err)
+			return
+		}
+		writeAccess(deps, w, user.ID)
+	}
+}
+
+// AdminUserAccessPut handles PUT /api/admin/users/{id}/access - replaces
+// the roles given to a user directly and their overrides
+func AdminUserAccessPut(deps *Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := targetUser(deps, r)
+		if err != nil {
+			writeRoleError(w, err)
+			return
+		}
+
+		var req AccessRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		current, err := deps.UserRepo.GetAccess(user.ID)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if req.Roles != nil {
+			current.Roles = *req.Roles
+		}
+		if req.Overrides != nil {
+			current.Overrides = *req.Overrides
+		}
+		if err := deps.UserRepo.SetAccess(user.ID, current.Roles, current.Overrides); err != nil {
+			writeRoleError(w, err)
+			return
+		}
+		writeAccess(deps, w, user.ID)
+	}
+}
+
+// writeAccess answers with the access of the user with id
+func writeAccess(deps *Deps, w http.ResponseWriter, id uint) {
+	access, err := deps.UserRepo.GetAccess(id)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	user, err := deps.UserRepo.GetByID(id)
+	if err != nil {
+		writeRoleError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, AccessInfo{Access: *access, EffectivePerm: user.EffectivePerm()})
+}
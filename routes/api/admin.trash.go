@@ -0,0 +1,96 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/satufile/satufile/storage"
+	"github.com/satufile/satufile/trash"
+)
+
+// PurgeReport summarises trash items removed by the janitor
+type PurgeReport struct {
+	Count      int           `json:"count"`
+	FreedBytes int64         `json:"freed_bytes"`
+	Purges     []trash.Purge `json:"purges"`
+}
+
+func newPurgeReport(purges []trash.Purge) *PurgeReport {
+	report := &PurgeReport{Count: len(purges), Purges: purges}
+	if report.Purges == nil {
+		report.Purges = []trash.Purge{}
+	}
+	for _, p := range purges {
+		report.FreedBytes += p.FileSize
+	}
+	return report
+}
+
+// AdminTrashPurgesGet handles GET /api/admin/trash/purges - purge history,
+// newest first. Optional query: user (ID), limit (default 100).
+func AdminTrashPurgesGet(deps *Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := 100
+		if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= 1000 {
+			limit = l
+		}
+
+		query := storage.GetDB().Order("purged_at desc").Limit(limit)
+		if u := r.URL.Query().Get("user"); u != "" {
+			userID, err := strconv.Atoi(u)
+			if err != nil {
+				http.Error(w, "Invalid user ID", http.StatusBadRequest)
+				return
+			}
+			query = query.Where("user_id = ?", userID)
+		}
+
+		var purges []trash.Purge
+		if err := query.Find(&purges).Error; err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(newPurgeReport(purges))
+	}
+}
+
+// AdminTrashPurgePost handles POST /api/admin/trash/purge - runs the
+// janitor now, for every user or only ?user={id}
+func AdminTrashPurgePost(deps *Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if deps.Janitor == nil {
+			http.Error(w, "Trash janitor not configured", http.StatusServiceUnavailable)
+			return
+		}
+
+		var purges []trash.Purge
+		var err error
+
+		if u := r.URL.Query().Get("user"); u != "" {
+			userID, convErr := strconv.Atoi(u)
+			if convErr != nil {
+				http.Error(w, "Invalid user ID", http.StatusBadRequest)
+				return
+			}
+			target, getErr := deps.UserRepo.GetByID(uint(userID))
+			if getErr != nil {
+				http.Error(w, "User not found", http.StatusNotFound)
+				return
+			}
+			purges, err = deps.Janitor.PurgeUser(target)
+		} else {
+			purges, err = deps.Janitor.PurgeAll()
+		}
+
+		if err != nil {
+			http.Error(w, "Purge failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(newPurgeReport(purges))
+	}
+}
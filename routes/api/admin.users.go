@@ -0,0 +1,214 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"github.com/satufile/satufile/accounts"
+	"github.com/satufile/satufile/auth"
+	"github.com/satufile/satufile/users"
+)
+
+// CreateUserRequest is the request body for POST /api/admin/users
+type CreateUserRequest struct {
+	Username            string          `json:"username"`
+	Password            string          `json:"password"`
+	Email               string          `json:"email"`
+	Scope               string          `json:"scope"`
+	Perm                map[string]bool `json:"perm"` // Over the defaults, e.g. {"admin": true}
+	StorageAllocationGb int             `json:"storageAllocationGb"`
+	// MustChangePassword asks the user for a new password at first login
+	MustChangePassword *bool `json:"mustChangePassword,omitempty"`
+	// Backend names the configured storage backend of the partition;
+	// empty for the local disk
+	Backend string `json:"backend,omitempty"`
+	// Encrypted encrypts the partition at rest with a key of its own
+	Encrypted bool `json:"encrypted,omitempty"`
+}
+
+// UpdateUserRequest is the request body for PUT /api/admin/users/{id};
+// omitted fields are left alone
+type UpdateUserRequest struct {
+	Email               *string         `json:"email,omitempty"`
+	Password            *string         `json:"password,omitempty"`
+	Scope               *string         `json:"scope,omitempty"`
+	Locale              *string         `json:"locale,omitempty"`
+	MustChangePassword  *bool           `json:"mustChangePassword,omitempty"`
+	Perm                map[string]bool `json:"perm,omitempty"`
+	StorageAllocationGb *int            `json:"storageAllocationGb,omitempty"`
+}
+
+// writeAccountError maps account errors to HTTP responses
+func writeAccountError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, users.ErrUserNotFound):
+		http.Error(w, "User not found", http.StatusNotFound)
+	case errors.Is(err, users.ErrUserExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, accounts.ErrLastAdmin), errors.Is(err, accounts.ErrQuotaBelowUsage):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, accounts.ErrInvalid):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// targetUser loads the user named by {id}
+func targetUser(deps *Deps, r *http.Request) (*users.User, error) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		return nil, users.ErrUserNotFound
+	}
+	return deps.UserRepo.GetByID(uint(id))
+}
+
+// AdminUsersGet handles GET /api/admin/users
+func AdminUsersGet(deps *Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		allUsers, err := deps.UserRepo.List()
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		infos := make([]*users.UserInfo, 0, len(allUsers))
+		for i := range allUsers {
+			infos = append(infos, allUsers[i].ToInfo())
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(infos)
+	}
+}
+
+// AdminUserGet handles GET /api/admin/users/{id}
+func AdminUserGet(deps *Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := targetUser(deps, r)
+		if err != nil {
+			writeAccountError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(user.ToInfo())
+	}
+}
+
+// AdminUserPost handles POST /api/admin/users - creates a user and
+// provisions their partition
+func AdminUserPost(deps *Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req CreateUserRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		mustChange := true
+		if req.MustChangePassword != nil {
+			mustChange = *req.MustChangePassword
+		}
+
+		user, err := deps.Accounts.Create(accounts.NewUser{
+			Username:            req.Username,
+			Password:            req.Password,
+			Email:               req.Email,
+			Scope:               req.Scope,
+			Permissions:         req.Perm,
+			StorageAllocationGb: req.StorageAllocationGb,
+			MustChangePassword:  mustChange,
+			Backend:             req.Backend,
+			Encrypted:           req.Encrypted,
+		})
+		if err != nil {
+			writeAccountError(w, err)
+			return
+		}
+		if deps.Index != nil {
+			deps.Index.Track(user.ID, user.FS(), user.Root())
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(user.ToInfo())
+	}
+}
+
+// AdminUserPut handles PUT /api/admin/users/{id}
+func AdminUserPut(deps *Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := targetUser(deps, r)
+		if err != nil {
+			writeAccountError(w, err)
+			return
+		}
+
+		var req UpdateUserRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		err = deps.Accounts.Update(user, accounts.Changes{
+			Email:               req.Email,
+			Password:            req.Password,
+			Scope:               req.Scope,
+			Locale:              req.Locale,
+			MustChangePassword:  req.MustChangePassword,
+			Permissions:         req.Perm,
+			StorageAllocationGb: req.StorageAllocationGb,
+		})
+		if err != nil {
+			writeAccountError(w, err)
+			return
+		}
+		// The effective permissions may have changed with the flags
+		if fresh, err := deps.UserRepo.GetByID(user.ID); err == nil {
+			user = fresh
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(user.ToInfo())
+	}
+}
+
+// AdminUserDelete handles DELETE /api/admin/users/{id}?data=archive|remove
+// - deletes a user; their files are archived unless data=remove
+func AdminUserDelete(deps *Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := targetUser(deps, r)
+		if err != nil {
+			writeAccountError(w, err)
+			return
+		}
+
+		if current := auth.GetUserFromContext(r.Context()); current != nil && current.ID == user.ID {
+			http.Error(w, "Cannot delete your own account", http.StatusConflict)
+			return
+		}
+
+		data := r.URL.Query().Get("data")
+		if data == "" {
+			data = accounts.DataArchive
+		}
+
+		archived, err := deps.Accounts.Delete(user, data)
+		if err != nil {
+			writeAccountError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"username": user.Username,
+			"data":     data,
+			"archive":  archived,
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package api
+
+import (
+	"net/http"
+	"os"
+
+	"github.com/satufile/satufile/spaces"
+	"github.com/satufile/satufile/users"
+)
+
+// permission is an action guarded by one of the users.Permissions flags
+// and, inside a shared space, by one of the rights of its access list
+type permission struct {
+	name    string
+	granted func(users.Permissions) bool
+	allowed func(spaces.Access) bool
+}
+
+var (
+	permCreate   = permission{"create", func(p users.Permissions) bool { return p.Create }, canWrite}
+	permRename   = permission{"rename", func(p users.Permissions) bool { return p.Rename }, canWrite}
+	permModify   = permission{"modify", func(p users.Permissions) bool { return p.Modify }, canWrite}
+	permDelete   = permission{"delete", func(p users.Permissions) bool { return p.Delete }, func(a spaces.Access) bool { return a.Delete }}
+	permShare    = permission{"share", func(p users.Permissions) bool { return p.Share }, func(a spaces.Access) bool { return a.Share }}
+	permDownload = permission{"download", func(p users.Permissions) bool { return p.Download }, func(a spaces.Access) bool { return a.Read }}
+)
+
+func canWrite(a spaces.Access) bool { return a.Write }
+
+// authorize is where every file operation checks the user's effective
+// permissions, as their roles, groups and overrides resolve. It returns a
+// 403 opError, written as {"error": "permission_denied"} JSON, naming the
+// first permission the user lacks.
+//
+// Scope needs no check here: handlers resolve paths below user.Root(),
+// so a scoped user cannot name anything outside their scope. Paths in
+// shared spaces are checked with location.authorize.
+func authorize(user *users.User, perms ...permission) error {
+	for _, p := range perms {
+		if !p.granted(user.EffectivePerm()) {
+			return &opError{
+				Status: http.StatusForbidden,
+				Code:   "permission_denied",
+				Msg:    "Permission denied: " + p.name,
+			}
+		}
+	}
+	return nil
+}
+
+// authorizeWrite checks the permission to write a file at fullPath:
+// modify if it already exists, create if it does not
+func authorizeWrite(user *users.User, fullPath string) error {
+	if _, err := os.Lstat(fullPath); err == nil {
+		return authorize(user, permModify)
+	}
+	return authorize(user, permCreate)
+}
@@ -0,0 +1,312 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/satufile/satufile/auth"
+	"github.com/satufile/satufile/share"
+	"github.com/satufile/satufile/users"
+)
+
+const (
+	// BatchSyncLimit is the largest batch answered in the HTTP response;
+	// bigger batches run in the background and report over the WebSocket
+	BatchSyncLimit = 20
+	// MaxBatchOperations caps the number of operations in one batch
+	MaxBatchOperations = 10000
+	// BatchJobTTL is how long finished jobs stay queryable
+	BatchJobTTL = time.Hour
+	// batchProgressInterval throttles progress events for long batches
+	batchProgressInterval = 250 * time.Millisecond
+)
+
+// BatchOperation is a single entry of a batch request
+type BatchOperation struct {
+	Op          string `json:"op"` // "delete", "move", "copy" or "share"
+	Path        string `json:"path"`
+	Destination string `json:"destination,omitempty"` // move/copy target path
+	Conflict    string `json:"conflict,omitempty"`    // move/copy conflict policy
+	Expires     string `json:"expires,omitempty"`     // share duration
+	Unit        string `json:"unit,omitempty"`        // share duration unit
+}
+
+// BatchResult is the outcome of one operation
+type BatchResult struct {
+	Index   int         `json:"index"`
+	Op      string      `json:"op"`
+	Path    string      `json:"path"`
+	Success bool        `json:"success"`
+	Status  int         `json:"status"`
+	Error   string      `json:"error,omitempty"`
+	Item    interface{} `json:"item,omitempty"`
+}
+
+// BatchJob tracks the progress of a batch
+type BatchJob struct {
+	ID         string        `json:"id"`
+	Status     string        `json:"status"` // running, completed
+	Total      int           `json:"total"`
+	Done       int           `json:"done"`
+	Failed     int           `json:"failed"`
+	Results    []BatchResult `json:"results"`
+	CreatedAt  time.Time     `json:"created_at"`
+	FinishedAt *time.Time    `json:"finished_at,omitempty"`
+
+	userID uint
+	mu     sync.Mutex
+}
+
+// snapshot returns a copy of the job that is safe to encode
+func (j *BatchJob) snapshot() *BatchJob {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return &BatchJob{
+		ID:         j.ID,
+		Status:     j.Status,
+		Total:      j.Total,
+		Done:       j.Done,
+		Failed:     j.Failed,
+		Results:    append([]BatchResult{}, j.Results...),
+		CreatedAt:  j.CreatedAt,
+		FinishedAt: j.FinishedAt,
+	}
+}
+
+var (
+	batchJobs  = make(map[string]*BatchJob)
+	batchMutex sync.Mutex
+)
+
+// registerBatchJob stores a job and drops finished jobs past their TTL
+func registerBatchJob(job *BatchJob) {
+	batchMutex.Lock()
+	defer batchMutex.Unlock()
+
+	for id, j := range batchJobs {
+		j.mu.Lock()
+		expired := j.FinishedAt != nil && time.Since(*j.FinishedAt) > BatchJobTTL
+		j.mu.Unlock()
+		if expired {
+			delete(batchJobs, id)
+		}
+	}
+	batchJobs[job.ID] = job
+}
+
+// BatchPost handles POST /api/batch
+// Small batches return their results directly (200); larger ones, or
+// requests with "async": true, return 202 with a job and publish
+// BATCH_PROGRESS / BATCH_COMPLETE events over the WebSocket.
+func BatchPost(deps *Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := auth.GetUserFromContext(r.Context())
+		if user == nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		// Use user's storage path if set, otherwise reject
+		if user.StoragePath == "" {
+			http.Error(w, "Storage not initialized", http.StatusForbidden)
+			return
+		}
+
+		var req struct {
+			Operations []BatchOperation `json:"operations"`
+			Async      bool             `json:"async"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		if len(req.Operations) == 0 {
+			http.Error(w, "No operations given", http.StatusBadRequest)
+			return
+		}
+		if len(req.Operations) > MaxBatchOperations {
+			http.Error(w, "Too many operations in one batch", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		job := &BatchJob{
+			ID:        generateID(),
+			Status:    "running",
+			Total:     len(req.Operations),
+			Results:   make([]BatchResult, 0, len(req.Operations)),
+			CreatedAt: time.Now(),
+			userID:    user.ID,
+		}
+		registerBatchJob(job)
+
+		// The job may outlive the request, so work on a copy of the user
+		owner := *user
+		async := req.Async || len(req.Operations) > BatchSyncLimit
+
+		if !async {
+			runBatch(deps, job, &owner, req.Operations, false)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(job.snapshot())
+			return
+		}
+
+		go runBatch(deps, job, &owner, req.Operations, true)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(job.snapshot())
+	}
+}
+
+// BatchGet handles GET /api/batch/{id} - job status and results
+func BatchGet(deps *Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := auth.GetUserFromContext(r.Context())
+		if user == nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		batchMutex.Lock()
+		job, ok := batchJobs[mux.Vars(r)["id"]]
+		batchMutex.Unlock()
+
+		if !ok || job.userID != user.ID {
+			http.Error(w, "Job not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(job.snapshot())
+	}
+}
+
+// runBatch executes operations in order, recording per-item results.
+// A failing item does not stop the batch.
+func runBatch(deps *Deps, job *BatchJob, user *users.User, ops []BatchOperation, notify bool) {
+	var lastEvent time.Time
+
+	for i, op := range ops {
+		result := runBatchOperation(deps, user, op)
+		result.Index = i
+
+		job.mu.Lock()
+		job.Results = append(job.Results, result)
+		job.Done++
+		if !result.Success {
+			job.Failed++
+		}
+		done, failed := job.Done, job.Failed
+		job.mu.Unlock()
+
+		if notify && (time.Since(lastEvent) >= batchProgressInterval || done == job.Total) {
+			lastEvent = time.Now()
+			deps.publish(job.userID, "", "BATCH_PROGRESS", map[string]interface{}{
+				"jobId":  job.ID,
+				"done":   done,
+				"failed": failed,
+				"total":  job.Total,
+				"result": result,
+			})
+		}
+	}
+
+	now := time.Now()
+	job.mu.Lock()
+	job.Status = "completed"
+	job.FinishedAt = &now
+	job.mu.Unlock()
+
+	if notify {
+		deps.publish(job.userID, "", "BATCH_COMPLETE", job.snapshot())
+	}
+}
+
+// runBatchOperation executes a single operation
+func runBatchOperation(deps *Deps, user *users.User, op BatchOperation) BatchResult {
+	path := filepath.Clean("/" + op.Path)
+	result := BatchResult{Op: op.Op, Path: path}
+
+	if strings.HasPrefix(path, "..") {
+		return failBatchResult(result, newOpError(http.StatusBadRequest, "Invalid path"))
+	}
+
+	var item interface{}
+	var err error
+
+	switch op.Op {
+	case "delete":
+		err = deleteResource(deps, user, path)
+	case "move", "copy":
+		item, err = transferResource(deps, user, path, TransferRequest{
+			Action:      op.Op,
+			Destination: op.Destination,
+			Conflict:    op.Conflict,
+		})
+	case "share":
+		item, err = shareResource(deps, user, path, parseShareExpiry(op.Expires, op.Unit))
+	default:
+		err = newOpError(http.StatusBadRequest, "Unknown operation: "+op.Op)
+	}
+
+	if err != nil {
+		return failBatchResult(result, err)
+	}
+
+	result.Success = true
+	result.Status = http.StatusOK
+	result.Item = item
+	return result
+}
+
+func failBatchResult(result BatchResult, err error) BatchResult {
+	result.Status = opStatus(err)
+	result.Error = err.Error()
+	return result
+}
+
+// shareResource creates a share link for path, detecting file or folder
+func shareResource(deps *Deps, user *users.User, path string, expiresHours int) (*share.Link, error) {
+	loc, err := deps.locate(user, path)
+	if err != nil {
+		return nil, err
+	}
+	if err := loc.authorize(user, permShare, permDownload); err != nil {
+		return nil, err
+	}
+
+	fullPath := loc.full()
+	if !strings.HasPrefix(fullPath, filepath.Clean(loc.Root)) {
+		return nil, newOpError(http.StatusForbidden, "Access denied")
+	}
+
+	info, err := loc.FS.Stat(fullPath)
+	if err != nil {
+		return nil, newOpError(http.StatusNotFound, "File or folder not found")
+	}
+
+	linkType := "file"
+	if info.IsDir() {
+		linkType = "folder"
+	}
+
+	link, err := share.NewLink(path, linkType, expiresHours)
+	if err != nil {
+		return nil, newOpError(http.StatusInternalServerError, "Failed to create share link")
+	}
+	link.OwnerID = user.ID
+
+	if err := deps.Share.CreateLink(link); err != nil {
+		return nil, newOpError(http.StatusInternalServerError, "Failed to save share link")
+	}
+	deps.publish(user.ID, TopicShares, "SHARE_CREATED", link)
+	return link, nil
+}
@@ -1,11 +1,22 @@
 package api
 
 import (
+	"os"
+	"path"
+	"strings"
+
+	"github.com/satufile/satufile/accounts"
+	"github.com/satufile/satufile/dedup"
+	"github.com/satufile/satufile/preview"
+	"github.com/satufile/satufile/search"
 	"github.com/satufile/satufile/share"
+	"github.com/satufile/satufile/spaces"
 	"github.com/satufile/satufile/system/detection"
 	"github.com/satufile/satufile/system/partition"
+	"github.com/satufile/satufile/trash"
 	"github.com/satufile/satufile/uploads"
 	"github.com/satufile/satufile/users"
+	"github.com/satufile/satufile/versions"
 )
 
 // Deps contains dependencies for API handlers
@@ -16,4 +27,87 @@ type Deps struct {
 	DataDir        string
 	Detector       detection.Detector
 	StorageManager partition.StorageManager
+	Events         EventPublisher
+	Janitor        *trash.Janitor
+	Dedup          *dedup.Store // nil when deduplication is disabled
+	Index          *search.Index
+	Previews       *preview.Service // nil when thumbnails are disabled
+	Versions       *versions.Store  // nil when versioning is disabled
+	Accounts       *accounts.Manager
+	Spaces         *spaces.Store // nil when shared spaces are disabled
+}
+
+// changed is called with the absolute paths below loc's root that an API
+// call created, modified, moved or removed. It refreshes the search index
+// and drops the previews of paths that are gone (moved or trashed). The
+// index of a space is built by the first search in it.
+func (d *Deps) changed(loc *location, paths ...string) {
+	if d.Index != nil && loc.Space == nil {
+		d.Index.Track(loc.Owner, loc.FS, loc.Root)
+	}
+	for _, p := range paths {
+		if d.Index != nil {
+			d.Index.Refresh(loc.Owner, p)
+		}
+		if d.Previews != nil {
+			if _, err := loc.FS.Lstat(p); os.IsNotExist(err) {
+				d.Previews.Remove(loc.Owner, relPath(loc.Root, p))
+			}
+		}
+	}
+}
+
+// keepVersion returns a writeVerified hook that preserves the file at
+// fullPath before it is overwritten, or nil when versioning is disabled.
+// Versions are kept for the user's own files on the local disk only, not
+// in spaces or on other storage backends.
+func (d *Deps) keepVersion(user *users.User, loc *location, fullPath string) func() error {
+	if d.Versions == nil || loc.Space != nil || !loc.isLocal() {
+		return nil
+	}
+	return func() error {
+		_, err := d.Versions.Keep(user, relPath(loc.Root, fullPath))
+		return err
+	}
+}
+
+// EventPublisher delivers real-time events to a user's WebSocket clients.
+// Clients may subscribe to topics; events without a topic reach all of the
+// user's clients.
+type EventPublisher interface {
+	Publish(userID uint, topic, eventType string, payload interface{})
+}
+
+// Event topics
+const (
+	TopicUploads = "uploads" // finished uploads
+	TopicShares  = "shares"  // share links and what visitors upload through them
+	TopicTrash   = "trash"   // items entering and leaving the trash
+	topicDir     = "dir:"
+)
+
+// DirTopic is the topic of changes to the entries of the folder at the API
+// path p
+func DirTopic(p string) string {
+	return topicDir + path.Clean("/"+p)
+}
+
+// NormalizeTopic returns topic in the form events are published with, or
+// false if clients cannot subscribe to it
+func NormalizeTopic(topic string) (string, bool) {
+	switch topic {
+	case TopicUploads, TopicShares, TopicTrash:
+		return topic, true
+	}
+	if dir, ok := strings.CutPrefix(topic, topicDir); ok && strings.HasPrefix(dir, "/") {
+		return DirTopic(dir), true
+	}
+	return "", false
+}
+
+// publish sends an event if a publisher is configured
+func (d *Deps) publish(userID uint, topic, eventType string, payload interface{}) {
+	if d.Events != nil {
+		d.Events.Publish(userID, topic, eventType, payload)
+	}
 }
@@ -0,0 +1,98 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"path/filepath"
+
+	"github.com/satufile/satufile/checksum"
+	"github.com/satufile/satufile/files"
+	"github.com/satufile/satufile/vfs"
+)
+
+// requestDigest reads the checksums a client sent for the request body
+// (Content-Digest, Repr-Digest or the older Digest header)
+func requestDigest(r *http.Request) (checksum.Sums, error) {
+	for _, name := range []string{"Content-Digest", "Repr-Digest", "Digest"} {
+		if header := r.Header.Get(name); header != "" {
+			sums, err := checksum.ParseDigest(header)
+			if err != nil {
+				return checksum.Sums{}, newOpError(http.StatusBadRequest, "Invalid "+name+": "+err.Error())
+			}
+			return sums, nil
+		}
+	}
+	return checksum.Sums{}, nil
+}
+
+// checksumError converts a checksum.ErrMismatch into a 400 response
+func checksumError(err error) error {
+	if errors.Is(err, checksum.ErrMismatch) {
+		return &opError{Status: http.StatusBadRequest, Code: "checksum_mismatch", Msg: err.Error()}
+	}
+	return err
+}
+
+// isChecksumMismatch reports whether err is a rejected checksum
+func isChecksumMismatch(err error) bool {
+	var oe *opError
+	return errors.As(err, &oe) && oe.Code == "checksum_mismatch"
+}
+
+// writeVerified writes the file at path on fsys through a temporary file
+// in the partial folder of root, so the previous content is only replaced
+// once fill succeeded and the data matches expected. keep, if set, runs
+// right before that to preserve the previous content. It returns the
+// digests of what was written.
+func writeVerified(fsys vfs.FS, root, path string, expected checksum.Sums, fill func(io.Writer) error, keep func() error) (checksum.Sums, error) {
+	partial := filepath.Join(root, files.PartialDir)
+	if err := fsys.MkdirAll(partial, 0755); err != nil {
+		return checksum.Sums{}, err
+	}
+	tmp := filepath.Join(partial, generateID())
+	f, err := fsys.Create(tmp)
+	if err != nil {
+		return checksum.Sums{}, err
+	}
+	defer fsys.Remove(tmp) // no-op once renamed
+
+	hasher := checksum.NewHasher()
+	if err := fill(io.MultiWriter(f, hasher)); err != nil {
+		f.Close()
+		return checksum.Sums{}, err
+	}
+	if err := f.Close(); err != nil {
+		return checksum.Sums{}, err
+	}
+
+	sums := hasher.Sums()
+	if err := expected.Verify(sums); err != nil {
+		return sums, checksumError(err)
+	}
+
+	if keep != nil {
+		if err := keep(); err != nil {
+			return sums, err
+		}
+	}
+
+	// Renaming replaces the directory entry, so hardlinked copies of the
+	// old content are left alone
+	if err := fsys.Rename(tmp, path); err != nil {
+		return sums, err
+	}
+	return sums, nil
+}
+
+// setDigestHeaders advertises a file's digests on a response
+func setDigestHeaders(w http.ResponseWriter, sums checksum.Sums) {
+	if sums.Empty() {
+		return
+	}
+	w.Header().Set("Repr-Digest", sums.DigestHeader())
+	w.Header().Set("Digest", sums.LegacyDigestHeader())
+	if etag := sums.ETag(); etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+}
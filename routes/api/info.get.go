@@ -16,6 +16,7 @@ type InfoResponse struct {
 	Name              string     `json:"name"`
 	Version           string     `json:"version"`
 	SupportedLanguages []Language `json:"supportedLanguages"`
+	Dedup             bool       `json:"dedup"` // chunk skipping via /api/uploads/{id}/chunks
 }
 
 // InfoGet handles GET /api/info
@@ -31,6 +32,7 @@ func InfoGet(deps *Deps) http.HandlerFunc {
 			Name:              "SatuFile",
 			Version:           "0.1.0",
 			SupportedLanguages: languages,
+			Dedup:             deps.Dedup != nil,
 		}
 
 		w.Header().Set("Content-Type", "application/json")
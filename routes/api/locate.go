@@ -0,0 +1,132 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/satufile/satufile/spaces"
+	"github.com/satufile/satufile/system/partition"
+	"github.com/satufile/satufile/users"
+	"github.com/satufile/satufile/vfs"
+)
+
+// spacesMount is the API path shared spaces are mounted below
+var spacesMount = "/" + spaces.MountDir
+
+// location is where an API path lives: below the user's root, on their
+// storage backend, or inside a shared space mounted at /Spaces/{name}
+type location struct {
+	Owner uint   // user ID, or the space's key; owns search entries and previews
+	FS    vfs.FS // filesystem Root is on
+	Root  string // folder Path is relative to
+	Path  string // clean path below Root
+	Mount string // API path Root is mounted at
+
+	Space  *spaces.Space // nil for the user's own files
+	Access spaces.Access // the user's access to Space
+}
+
+// home is the location of the user's own root
+func home(user *users.User) *location {
+	return &location{Owner: user.ID, FS: user.FS(), Root: user.Root(), Path: "/", Mount: "/"}
+}
+
+// isSpacesMount reports whether p is the folder listing the user's spaces
+func (d *Deps) isSpacesMount(p string) bool {
+	return d.Spaces != nil && p == spacesMount
+}
+
+// locate resolves an API path for user. Spaces the user may not read are
+// reported as not found; the mount folder itself holds no files.
+func (d *Deps) locate(user *users.User, p string) (*location, error) {
+	p = filepath.ToSlash(filepath.Clean("/" + p))
+
+	if d.Spaces == nil || (p != spacesMount && !strings.HasPrefix(p, spacesMount+"/")) {
+		loc := home(user)
+		loc.Path = p
+		return loc, nil
+	}
+	if p == spacesMount {
+		return nil, newOpError(http.StatusForbidden, "Access denied")
+	}
+
+	name, rest, _ := strings.Cut(strings.TrimPrefix(p, spacesMount+"/"), "/")
+	member, err := d.Spaces.Lookup(user.ID, name)
+	if errors.Is(err, spaces.ErrNotFound) {
+		return nil, newOpError(http.StatusNotFound, "Not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &location{
+		Owner:  member.Key(),
+		FS:     vfs.Local,
+		Root:   d.Spaces.Dir(member.ID),
+		Path:   "/" + rest,
+		Mount:  spacesMount + "/" + name,
+		Space:  &member.Space,
+		Access: member.Access,
+	}, nil
+}
+
+// full returns the location's absolute path on its filesystem
+func (l *location) full() string {
+	return filepath.Join(l.Root, l.Path)
+}
+
+// isLocal reports whether the location is on the local disk, where
+// deduplication, versions, checksums and previews are available
+func (l *location) isLocal() bool {
+	return vfs.IsLocal(l.FS)
+}
+
+// apiPath converts a path below Root to the path the user sees
+func (l *location) apiPath(rel string) string {
+	return path.Join(l.Mount, filepath.ToSlash(rel))
+}
+
+// authorize checks the user's permissions and, inside a space, the rights
+// the space's access control list grants
+func (l *location) authorize(user *users.User, perms ...permission) error {
+	if err := authorize(user, perms...); err != nil {
+		return err
+	}
+	if l.Space == nil {
+		return nil
+	}
+	for _, p := range perms {
+		if !p.allowed(l.Access) {
+			return &opError{
+				Status: http.StatusForbidden,
+				Code:   "permission_denied",
+				Msg:    "Permission denied: " + p.name + " in " + l.Space.Name,
+			}
+		}
+	}
+	return nil
+}
+
+// authorizeWrite checks the permission to write the file at the location:
+// modify if it already exists, create if it does not
+func (l *location) authorizeWrite(user *users.User) error {
+	if _, err := l.FS.Lstat(l.full()); err == nil {
+		return l.authorize(user, permModify)
+	}
+	return l.authorize(user, permCreate)
+}
+
+// checkQuota fails with 413 if adding size bytes would exceed the quota
+// the location draws on: the user's partition or the space's pool
+func (l *location) checkQuota(user *users.User, size int64) error {
+	dir, gb := user.StoragePath, user.StorageAllocationGb
+	if l.Space != nil {
+		dir, gb = l.Root, l.Space.QuotaGb
+	}
+	if err := partition.CheckQuota(l.FS, dir, gb, size); err != nil {
+		return &opError{Status: http.StatusRequestEntityTooLarge, Code: "quota_exceeded", Msg: err.Error()}
+	}
+	return nil
+}
@@ -37,7 +37,7 @@ func MeGet(deps *Deps) http.HandlerFunc {
 
 		// Add storage usage information if storage is allocated
 		if user.StoragePath != "" && user.StorageAllocationGb > 0 {
-			usedGb, err := partition.CalculateStorageUsage(user.StoragePath)
+			usedGb, err := partition.CalculateStorageUsage(user.FS(), user.StoragePath)
 			if err != nil {
 				// If calculation fails, set to 0
 				usedGb = 0
@@ -62,7 +62,7 @@ func MeGet(deps *Deps) http.HandlerFunc {
 
 		// Get trash count
 		var count int64
-		storage.GetDB().Model(&trash.TrashItem{}).Count(&count)
+		storage.GetDB().Model(&trash.TrashItem{}).Where("user_id = ?", user.ID).Count(&count)
 		response.TrashCount = count
 
 		w.Header().Set("Content-Type", "application/json")
@@ -15,6 +15,13 @@ type UpdateProfileRequest struct {
 	ViewMode     *string `json:"viewMode,omitempty"`
 	HideDotfiles *bool   `json:"hideDotfiles,omitempty"`
 	SingleClick  *bool   `json:"singleClick,omitempty"`
+	// TrashRetentionDays overrides the server retention; 0 restores it and
+	// -1 (users.KeepForever) keeps the trash whatever the server retains
+	TrashRetentionDays *int `json:"trashRetentionDays,omitempty"`
+	// VersionCount and VersionRetentionDays override the server's version
+	// limits; 0 restores them
+	VersionCount         *int `json:"versionCount,omitempty"`
+	VersionRetentionDays *int `json:"versionRetentionDays,omitempty"`
 }
 
 // UpdateProfilePut handles PUT /api/me - Update user profile preferences
@@ -54,6 +61,27 @@ func UpdateProfilePut(deps *Deps) http.HandlerFunc {
 		if req.SingleClick != nil {
 			user.SingleClick = *req.SingleClick
 		}
+		if req.TrashRetentionDays != nil {
+			if *req.TrashRetentionDays < users.KeepForever {
+				http.Error(w, "trashRetentionDays must be -1 (forever), 0 (server default) or a number of days", http.StatusBadRequest)
+				return
+			}
+			user.TrashRetentionDays = *req.TrashRetentionDays
+		}
+		if req.VersionCount != nil {
+			if *req.VersionCount < 0 {
+				http.Error(w, "versionCount must not be negative", http.StatusBadRequest)
+				return
+			}
+			user.VersionCount = *req.VersionCount
+		}
+		if req.VersionRetentionDays != nil {
+			if *req.VersionRetentionDays < 0 {
+				http.Error(w, "versionRetentionDays must not be negative", http.StatusBadRequest)
+				return
+			}
+			user.VersionRetentionDays = *req.VersionRetentionDays
+		}
 
 		if err := deps.UserRepo.Update(user); err != nil {
 			http.Error(w, "Failed to update profile", http.StatusInternalServerError)
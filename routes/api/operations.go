@@ -0,0 +1,294 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/satufile/satufile/files"
+	"github.com/satufile/satufile/share"
+	"github.com/satufile/satufile/storage"
+	"github.com/satufile/satufile/system/partition"
+	"github.com/satufile/satufile/users"
+	"github.com/satufile/satufile/versions"
+)
+
+// opError is a failed file operation and the HTTP status it maps to.
+// Operations return it so single-item handlers and batch jobs report
+// failures the same way.
+type opError struct {
+	Status int
+	Code   string // Machine-readable error for JSON responses, optional
+	Msg    string
+}
+
+func (e *opError) Error() string {
+	return e.Msg
+}
+
+func newOpError(status int, msg string) error {
+	return &opError{Status: status, Msg: msg}
+}
+
+// opStatus returns the HTTP status for an operation error
+func opStatus(err error) int {
+	var oe *opError
+	if errors.As(err, &oe) {
+		return oe.Status
+	}
+	return http.StatusInternalServerError
+}
+
+// errQuotaExceeded is returned when the kernel stops a write at the
+// partition's limit
+var errQuotaExceeded = &opError{Status: http.StatusRequestEntityTooLarge, Code: "quota_exceeded", Msg: "Storage quota exceeded"}
+
+// writeOpError writes an operation error as an HTTP response
+func writeOpError(w http.ResponseWriter, err error) {
+	if partition.IsFull(err) {
+		err = errQuotaExceeded
+	}
+	var oe *opError
+	if !errors.As(err, &oe) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if oe.Code != "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(oe.Status)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error":   oe.Code,
+			"message": oe.Msg,
+		})
+		return
+	}
+	http.Error(w, oe.Msg, oe.Status)
+}
+
+// relPath converts a full filesystem path below root to an API path
+func relPath(root, fullPath string) string {
+	return "/" + strings.TrimPrefix(strings.TrimPrefix(fullPath, filepath.Clean(root)), "/")
+}
+
+// deleteResource soft-deletes path into the user's trash
+func deleteResource(deps *Deps, user *users.User, path string) error {
+	loc, err := deps.locate(user, path)
+	if err != nil {
+		return err
+	}
+	root := loc.Root
+
+	if err := loc.authorize(user, permDelete); err != nil {
+		return err
+	}
+
+	if loc.Path == "/" {
+		if loc.Space != nil {
+			return newOpError(http.StatusForbidden, "Cannot delete a space")
+		}
+		return newOpError(http.StatusForbidden, "Cannot delete root")
+	}
+
+	if files.IsReserved(loc.Path) {
+		return newOpError(http.StatusForbidden, "Access denied")
+	}
+
+	// Check if trying to delete a core folder
+	if loc.Space == nil && IsCoreFolder(path) {
+		return newOpError(http.StatusForbidden, "Cannot delete protected folder")
+	}
+
+	fullPath := loc.full()
+
+	// Verify path safety
+	if !strings.HasPrefix(fullPath, filepath.Clean(root)) {
+		return newOpError(http.StatusForbidden, "Access denied")
+	}
+
+	// Get file info for DB
+	info, err := files.NewFileInfo(loc.FS, root, loc.Path)
+	if err != nil {
+		return newOpError(http.StatusNotFound, "File not found")
+	}
+
+	item, err := moveToTrash(user, loc, info)
+	if err != nil {
+		return err
+	}
+	deps.changed(loc, fullPath)
+	deps.publish(user.ID, TopicTrash, "TRASH_ADDED", item)
+	return nil
+}
+
+// transferResource copies or moves path to req.Destination within the
+// user's tree, which may cross into or out of a shared space
+func transferResource(deps *Deps, user *users.User, path string, req TransferRequest) (*TransferResponse, error) {
+	if req.Action != "copy" && req.Action != "move" {
+		return nil, newOpError(http.StatusBadRequest, "Invalid action, must be 'copy' or 'move'")
+	}
+
+	src, err := deps.locate(user, path)
+	if err != nil {
+		return nil, err
+	}
+
+	if src.Path == "/" {
+		return nil, newOpError(http.StatusForbidden, "Cannot move root")
+	}
+
+	if files.IsReserved(src.Path) {
+		return nil, newOpError(http.StatusForbidden, "Access denied")
+	}
+
+	// Copying a core folder is fine, moving it is not
+	if req.Action == "move" && src.Space == nil && IsCoreFolder(path) {
+		return nil, newOpError(http.StatusForbidden, "Cannot move protected folder")
+	}
+
+	policy := files.ConflictPolicy(req.Conflict)
+	if !files.ValidPolicy(policy) {
+		return nil, newOpError(http.StatusBadRequest, "Invalid conflict policy, must be 'overwrite', 'skip' or 'rename'")
+	}
+
+	if req.Destination == "" {
+		return nil, newOpError(http.StatusBadRequest, "Destination is required")
+	}
+
+	dst, err := deps.locate(user, req.Destination)
+	if err != nil {
+		return nil, err
+	}
+	if dst.Path == "/" || files.IsReserved(dst.Path) {
+		return nil, newOpError(http.StatusBadRequest, "Invalid destination")
+	}
+
+	// Copies create items, moves rename them; replacing existing items
+	// modifies them as well. Moving out of a root deletes from it.
+	perms := []permission{permCreate}
+	if req.Action == "move" {
+		perms[0] = permRename
+	}
+	if policy == files.ConflictOverwrite {
+		perms = append(perms, permModify)
+	}
+	if err := dst.authorize(user, perms...); err != nil {
+		return nil, err
+	}
+	sameRoot := src.FS == dst.FS && src.Root == dst.Root
+	if req.Action == "move" {
+		srcPerms := []permission{permRename}
+		if !sameRoot {
+			srcPerms = append(srcPerms, permDelete)
+		}
+		if err := src.authorize(user, srcPerms...); err != nil {
+			return nil, err
+		}
+	}
+
+	// Core folders can receive items but never be replaced
+	if dst.Space == nil && IsCoreFolder(dst.Path) && policy == files.ConflictOverwrite {
+		return nil, newOpError(http.StatusForbidden, "Cannot overwrite protected folder")
+	}
+
+	srcRoot, dstRoot := filepath.Clean(src.Root), filepath.Clean(dst.Root)
+	srcPath := src.full()
+	dstPath := dst.full()
+
+	// Verify path safety
+	if !strings.HasPrefix(srcPath, srcRoot) || !strings.HasPrefix(dstPath, dstRoot) {
+		return nil, newOpError(http.StatusForbidden, "Access denied")
+	}
+
+	srcInfo, err := src.FS.Stat(srcPath)
+	if err != nil {
+		return nil, newOpError(http.StatusNotFound, "Not found")
+	}
+
+	if parent, err := dst.FS.Stat(filepath.Dir(dstPath)); err != nil || !parent.IsDir() {
+		return nil, newOpError(http.StatusConflict, "Destination folder does not exist")
+	}
+
+	// Copies add data to the destination's quota, and so do moves into
+	// another root
+	if req.Action == "copy" || !sameRoot {
+		size := srcInfo.Size()
+		if srcInfo.IsDir() {
+			size = getDirSize(src.FS, srcPath)
+		}
+		if err := dst.checkQuota(user, size); err != nil {
+			return nil, err
+		}
+	}
+
+	result, err := files.Transfer(srcPath, dstPath, files.TransferOptions{
+		Move:   req.Action == "move",
+		Policy: policy,
+		SrcFS:  src.FS,
+		DstFS:  dst.FS,
+		// Replaced items go to the trash instead of being lost
+		Remove: func(fullPath string) error {
+			itemPath := relPath(dstRoot, fullPath)
+			if dst.Space == nil && IsCoreFolder(itemPath) {
+				return errors.New("cannot overwrite protected folder")
+			}
+			info, err := files.NewFileInfo(dst.FS, dstRoot, itemPath)
+			if err != nil {
+				return err
+			}
+			replaced := *dst
+			replaced.Path = itemPath
+			_, err = moveToTrash(user, &replaced, info)
+			return err
+		},
+	})
+	switch {
+	case errors.Is(err, files.ErrTargetExists):
+		return nil, newOpError(http.StatusConflict, err.Error())
+	case errors.Is(err, files.ErrTargetInsideSrc):
+		return nil, newOpError(http.StatusBadRequest, err.Error())
+	case err != nil:
+		return nil, err
+	}
+
+	newPath := relPath(dstRoot, result.Destination)
+	deps.changed(src, srcPath)
+	deps.changed(dst, result.Destination)
+
+	skipped := make([]string, 0, len(result.Skipped))
+	for _, s := range result.Skipped {
+		skipped = append(skipped, src.apiPath(relPath(srcRoot, s)))
+	}
+
+	// Keep share links and previous versions with moved items
+	if req.Action == "move" {
+		// Links of other members follow only within the same space
+		shared := src.Space != nil && dst.Space != nil && src.Space.ID == dst.Space.ID
+		if err := share.RelocateLinks(deps.Share, user.ID, shared, src.apiPath(src.Path), dst.apiPath(newPath)); err != nil {
+			log.Printf("Share: failed to relocate links of %s: %v", path, err)
+		}
+		switch {
+		case src.Space == nil && dst.Space == nil:
+			if err := versions.Relocate(storage.GetDB(), user.ID, src.Path, newPath, skipped...); err != nil {
+				log.Printf("Versions: failed to relocate %s: %v", path, err)
+			}
+		case src.Space == nil:
+			// Versions are not kept in spaces
+			if err := versions.Discard(storage.GetDB(), src.Root, user.ID, src.Path); err != nil {
+				log.Printf("Versions: failed to discard %s: %v", path, err)
+			}
+		}
+	}
+
+	info, _ := files.NewFileInfo(dst.FS, dstRoot, newPath)
+	if info != nil {
+		info.Path = dst.apiPath(newPath)
+	}
+	return &TransferResponse{
+		FileInfo: info,
+		Skipped:  skipped,
+	}, nil
+}
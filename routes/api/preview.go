@@ -0,0 +1,93 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/satufile/satufile/auth"
+	"github.com/satufile/satufile/files"
+	"github.com/satufile/satufile/preview"
+)
+
+// PreviewGet handles GET /api/preview/{size}/{path:.*} - serves a cached
+// JPEG preview (size small, medium or large) of an image. WebP output is
+// not offered, see the preview package.
+func PreviewGet(deps *Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := auth.GetUserFromContext(r.Context())
+		if user == nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		// Use user's storage path if set, otherwise reject
+		effectiveRoot := user.Root()
+		if effectiveRoot == "" {
+			http.Error(w, "Storage not initialized", http.StatusForbidden)
+			return
+		}
+
+		vars := mux.Vars(r)
+		loc, err := deps.locate(user, vars["path"])
+		if err != nil {
+			writeOpError(w, err)
+			return
+		}
+
+		// Thumbnails show the content, so they count as downloads
+		if err := loc.authorize(user, permDownload); err != nil {
+			writeOpError(w, err)
+			return
+		}
+
+		if deps.Previews == nil {
+			http.Error(w, "Thumbnails are disabled", http.StatusNotFound)
+			return
+		}
+
+		fullPath := loc.full()
+		if !strings.HasPrefix(fullPath, filepath.Clean(loc.Root)) || files.IsReserved(loc.Path) {
+			http.Error(w, "Access denied", http.StatusForbidden)
+			return
+		}
+
+		file, err := deps.Previews.Get(loc.FS, loc.Owner, loc.Root, loc.Path, vars["size"])
+		switch {
+		case errors.Is(err, preview.ErrInvalidSize):
+			http.Error(w, "Invalid size, must be small, medium or large", http.StatusBadRequest)
+			return
+		case errors.Is(err, preview.ErrUnsupported):
+			http.Error(w, "No preview for this file type", http.StatusUnsupportedMediaType)
+			return
+		case errors.Is(err, preview.ErrTooLarge):
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		case os.IsNotExist(err):
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		defer file.Close()
+
+		info, err := file.Stat()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// The preview changes only with the source, whose mtime it carries
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("Cache-Control", "private, max-age=86400")
+		w.Header().Set("ETag", fmt.Sprintf(`"%s-%x-%x"`, vars["size"], info.ModTime().UnixNano(), info.Size()))
+		http.ServeContent(w, r, "", info.ModTime(), file)
+	}
+}
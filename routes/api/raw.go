@@ -1,7 +1,7 @@
 package api
 
 import (
-	"io"
+	"fmt"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -10,9 +10,13 @@ import (
 	"github.com/gorilla/mux"
 
 	"github.com/satufile/satufile/auth"
+	"github.com/satufile/satufile/checksum"
+	"github.com/satufile/satufile/storage"
+	"github.com/satufile/satufile/vfs"
 )
 
-// RawGet handles GET /api/raw/{path:.*} - stream file content for download
+// RawGet handles GET /api/raw/{path:.*} - stream file content for download.
+// ?disposition=inline asks for in-browser display where that is safe.
 func RawGet(deps *Deps) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		user := auth.GetUserFromContext(r.Context())
@@ -22,7 +26,7 @@ func RawGet(deps *Deps) http.HandlerFunc {
 		}
 
 		// Use user's storage path if set, otherwise reject
-		effectiveRoot := user.StoragePath
+		effectiveRoot := user.Root()
 		if effectiveRoot == "" {
 			http.Error(w, "Storage not initialized", http.StatusForbidden)
 			return
@@ -35,7 +39,19 @@ func RawGet(deps *Deps) http.HandlerFunc {
 			return
 		}
 
-		fullPath := filepath.Join(effectiveRoot, path)
+		loc, err := deps.locate(user, path)
+		if err != nil {
+			writeOpError(w, err)
+			return
+		}
+		effectiveRoot = loc.Root
+
+		if err := loc.authorize(user, permDownload); err != nil {
+			writeOpError(w, err)
+			return
+		}
+
+		fullPath := loc.full()
 
 		// Security: ensure path is within effectiveRoot
 		cleanPath := filepath.Clean(fullPath)
@@ -45,7 +61,7 @@ func RawGet(deps *Deps) http.HandlerFunc {
 		}
 
 		// Check if file exists
-		info, err := os.Stat(fullPath)
+		info, err := loc.FS.Stat(fullPath)
 		if err != nil {
 			http.Error(w, "Not found", http.StatusNotFound)
 			return
@@ -58,22 +74,114 @@ func RawGet(deps *Deps) http.HandlerFunc {
 		}
 
 		// Open file
-		file, err := os.Open(fullPath)
+		file, err := loc.FS.Open(fullPath)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 		defer file.Close()
 
-		// Set headers for download
-		filename := filepath.Base(fullPath)
-		w.Header().Set("Content-Disposition", "attachment; filename=\""+filename+"\"")
-		w.Header().Set("Content-Type", getContentType(fullPath))
-		w.Header().Set("Content-Length", string(rune(info.Size())))
+		contentType := getContentType(fullPath)
+		disposition := "attachment"
+		if r.URL.Query().Get("disposition") == "inline" && inlineSafe(contentType) {
+			disposition = "inline"
+		}
+		w.Header().Set("Content-Disposition", contentDisposition(disposition, filepath.Base(fullPath)))
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Cache-Control", "private, no-cache")
+
+		// Let clients verify the download end to end. Hashing a large file
+		// up front would stall seeking, so range requests only use a digest
+		// that is already known and fall back to a weak ETag. Digests are
+		// cached for the local disk only.
+		var sums checksum.Sums
+		switch {
+		case !loc.isLocal():
+		case r.Header.Get("Range") == "":
+			sums, _ = checksum.Get(storage.GetDB(), fullPath)
+		default:
+			sums, _ = checksum.Lookup(storage.GetDB(), fullPath)
+		}
+		setDigestHeaders(w, sums)
+		if sums.SHA256 == "" {
+			w.Header().Set("ETag", weakETag(info))
+		}
+
+		// ServeContent handles Range (including multipart/byteranges),
+		// If-Match, If-None-Match, If-Modified-Since, If-Range and HEAD
+		http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+	}
+}
+
+// serveFile serves the file at name on fsys like http.ServeFile, with
+// ranges and conditional requests
+func serveFile(w http.ResponseWriter, r *http.Request, fsys vfs.FS, name string) {
+	file, err := fsys.Open(name)
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
 
-		// Stream file
-		io.Copy(w, file)
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+}
+
+// weakETag identifies a file version by modification time and size
+func weakETag(info os.FileInfo) string {
+	return fmt.Sprintf(`W/"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+}
+
+// inlineSafe reports whether a type may be rendered by the browser without
+// running content on our origin
+func inlineSafe(contentType string) bool {
+	switch {
+	case contentType == "image/svg+xml", contentType == "text/html", contentType == "application/javascript":
+		return false
+	case strings.HasPrefix(contentType, "image/"),
+		strings.HasPrefix(contentType, "video/"),
+		strings.HasPrefix(contentType, "audio/"),
+		contentType == "text/plain",
+		contentType == "application/pdf",
+		contentType == "application/json":
+		return true
+	}
+	return false
+}
+
+// contentDisposition builds a Content-Disposition header with an ASCII
+// filename fallback and the exact name in RFC 5987 encoding
+func contentDisposition(disposition, name string) string {
+	fallback := strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' {
+			return '_'
+		}
+		return r
+	}, name)
+
+	header := disposition + `; filename="` + fallback + `"`
+	if fallback != name {
+		header += "; filename*=UTF-8''" + rfc5987Escape(name)
+	}
+	return header
+}
+
+// rfc5987Escape percent-encodes everything but RFC 5987 attr-chars
+func rfc5987Escape(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') ||
+			strings.IndexByte("!#$&+-.^_`|~", c) >= 0 {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
 	}
+	return b.String()
 }
 
 // getContentType returns the MIME type for a file
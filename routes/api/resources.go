@@ -2,21 +2,22 @@ package api
 
 import (
 	"encoding/json"
-	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
-	"time"
 
 	"github.com/gorilla/mux"
 
 	"github.com/satufile/satufile/auth"
+	"github.com/satufile/satufile/checksum"
 	"github.com/satufile/satufile/files"
+	"github.com/satufile/satufile/share"
+	"github.com/satufile/satufile/spaces"
 	"github.com/satufile/satufile/storage"
-	"github.com/satufile/satufile/trash"
-	"github.com/satufile/satufile/system/partition"
+	"github.com/satufile/satufile/versions"
 )
 
 // ResourceGet handles GET /api/resources/{path:.*}
@@ -29,7 +30,7 @@ func ResourceGet(deps *Deps) http.HandlerFunc {
 		}
 
 		// Use user's storage path if set, otherwise reject
-		effectiveRoot := user.StoragePath
+		effectiveRoot := user.Root()
 		if effectiveRoot == "" {
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusForbidden)
@@ -48,15 +49,47 @@ func ResourceGet(deps *Deps) http.HandlerFunc {
 			return
 		}
 
+		// The mount folder lists the spaces the user belongs to
+		if deps.isSpacesMount(path) {
+			listing, err := spacesListing(deps, user)
+			if err != nil {
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			listing.ApplySort(listingSort(r))
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"path":     path,
+				"name":     spaces.MountDir,
+				"isDir":    true,
+				"items":    listing.Items,
+				"numDirs":  listing.NumDirs,
+				"numFiles": listing.NumFiles,
+			})
+			return
+		}
+
+		loc, err := deps.locate(user, path)
+		if err != nil {
+			writeOpError(w, err)
+			return
+		}
+		effectiveRoot = loc.Root
+
 		// Get file/dir info
-		info, err := files.NewFileInfo(effectiveRoot, path)
+		info, err := files.NewFileInfo(loc.FS, effectiveRoot, loc.Path)
 		if err != nil {
 			http.Error(w, "Not found", http.StatusNotFound)
 			return
 		}
+		info.Path = path
+		if loc.Space != nil && loc.Path == "/" {
+			info.Name = loc.Space.Name
+		}
 
 		// Verify the resolved path is still within effectiveRoot
-		fullPath := filepath.Join(effectiveRoot, path)
+		fullPath := loc.full()
 		if !strings.HasPrefix(fullPath, filepath.Clean(effectiveRoot)) {
 			http.Error(w, "Access denied", http.StatusForbidden)
 			return
@@ -67,11 +100,17 @@ func ResourceGet(deps *Deps) http.HandlerFunc {
 		// If directory, list contents
 		if info.IsDir {
 			hideDotfiles := user.HideDotfiles
-			listing, err := files.ReadDir(effectiveRoot, path, hideDotfiles)
+			listing, err := files.ReadDir(loc.FS, effectiveRoot, loc.Path, hideDotfiles)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
+			for _, item := range listing.Items {
+				item.Path = loc.apiPath(item.Path)
+			}
+			if path == "/" {
+				mountSpaces(deps, user, listing)
+			}
 
 			// Check share status for each item
 			links, _ := deps.Share.ListLinks()
@@ -109,12 +148,7 @@ func ResourceGet(deps *Deps) http.HandlerFunc {
 			}
 
 			// Apply sorting
-			sortBy := r.URL.Query().Get("sort")
-			sortAsc := r.URL.Query().Get("order") != "desc"
-			if sortBy == "" {
-				sortBy = "name"
-			}
-			listing.ApplySort(files.Sorting{By: sortBy, Asc: sortAsc})
+			listing.ApplySort(listingSort(r))
 
 			json.NewEncoder(w).Encode(map[string]interface{}{
 				"path":     path,
@@ -137,11 +171,32 @@ func ResourceGet(deps *Deps) http.HandlerFunc {
 			}
 		}
 
+		// Single files on the local disk carry their digests once known.
+		// Those of files written outside the API are computed in the
+		// background rather than holding up the request.
+		if loc.isLocal() {
+			if sums, ok := checksum.Lookup(storage.GetDB(), fullPath); ok {
+				info.SHA256, info.CRC32C = sums.SHA256, sums.CRC32C
+				setDigestHeaders(w, sums)
+			} else {
+				checksum.Queue(storage.GetDB(), fullPath)
+			}
+		}
+
 		// Single file info
 		json.NewEncoder(w).Encode(info)
 	}
 }
 
+// listingSort reads the sort and order parameters of a listing
+func listingSort(r *http.Request) files.Sorting {
+	sortBy := r.URL.Query().Get("sort")
+	if sortBy == "" {
+		sortBy = "name"
+	}
+	return files.Sorting{By: sortBy, Asc: r.URL.Query().Get("order") != "desc"}
+}
+
 // ResourcePost handles POST /api/resources/{path:.*} (upload/create)
 func ResourcePost(deps *Deps) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -152,7 +207,7 @@ func ResourcePost(deps *Deps) http.HandlerFunc {
 		}
 
 		// Use user's storage path if set, otherwise reject
-		effectiveRoot := user.StoragePath
+		effectiveRoot := user.Root()
 		if effectiveRoot == "" {
 			http.Error(w, "Storage not initialized", http.StatusForbidden)
 			return
@@ -165,13 +220,30 @@ func ResourcePost(deps *Deps) http.HandlerFunc {
 			return
 		}
 
+		loc, err := deps.locate(user, path)
+		if err != nil {
+			writeOpError(w, err)
+			return
+		}
+		effectiveRoot = loc.Root
+
+		if files.IsReserved(loc.Path) {
+			http.Error(w, "Access denied", http.StatusForbidden)
+			return
+		}
+
 		// If path ends with /, create directory
 		if strings.HasSuffix(vars["path"], "/") {
-			fullPath := filepath.Join(effectiveRoot, path)
-			if err := os.MkdirAll(fullPath, 0755); err != nil {
+			if err := loc.authorize(user, permCreate); err != nil {
+				writeOpError(w, err)
+				return
+			}
+			fullPath := loc.full()
+			if err := loc.FS.MkdirAll(fullPath, 0755); err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
+			deps.changed(loc, fullPath)
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusCreated)
 			json.NewEncoder(w).Encode(map[string]string{
@@ -182,49 +254,61 @@ func ResourcePost(deps *Deps) http.HandlerFunc {
 		}
 
 		// Otherwise, handle file upload
-		fullPath := filepath.Join(effectiveRoot, path)
+		fullPath := loc.full()
 
 		// Verify path safety
-		if !strings.HasPrefix(fullPath, filepath.Clean(effectiveRoot)) {
+		if loc.Path == "/" || !strings.HasPrefix(fullPath, filepath.Clean(effectiveRoot)) {
 			http.Error(w, "Access denied", http.StatusForbidden)
 			return
 		}
 
+		if err := loc.authorizeWrite(user); err != nil {
+			writeOpError(w, err)
+			return
+		}
+
 		// Check quota before saving (if file size is known from Content-Length)
 		if r.ContentLength > 0 {
-			if err := partition.CheckQuota(effectiveRoot, user.StorageAllocationGb, r.ContentLength); err != nil {
-				w.Header().Set("Content-Type", "application/json")
-				w.WriteHeader(http.StatusRequestEntityTooLarge)
-				json.NewEncoder(w).Encode(map[string]string{
-					"error":   "quota_exceeded",
-					"message": err.Error(),
-				})
+			if err := loc.checkQuota(user, r.ContentLength); err != nil {
+				writeOpError(w, err)
 				return
 			}
 		}
 
 		// Ensure parent directory exists
-		if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		if err := loc.FS.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		// Create destination file
-		dst, err := os.Create(fullPath)
+		// Clients may send Content-Digest to have the body verified
+		expected, err := requestDigest(r)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeOpError(w, err)
 			return
 		}
-		defer dst.Close()
 
-		// Copy from request body to file
-		_, err = io.Copy(dst, r.Body)
+		sums, err := writeVerified(loc.FS, loc.Root, fullPath, expected, func(dst io.Writer) error {
+			_, err := io.Copy(dst, r.Body)
+			return err
+		}, deps.keepVersion(user, loc, fullPath))
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeOpError(w, err)
 			return
 		}
+		if loc.isLocal() {
+			if err := checksum.Save(storage.GetDB(), fullPath, sums); err != nil {
+				log.Printf("Checksum: failed to record %s: %v", path, err)
+			}
+		}
+		deps.changed(loc, fullPath)
 
-		info, _ := files.NewFileInfo(effectiveRoot, path)
+		info, _ := files.NewFileInfo(loc.FS, effectiveRoot, loc.Path)
+		if info != nil {
+			info.Path = path
+			info.SHA256, info.CRC32C = sums.SHA256, sums.CRC32C
+		}
+		setDigestHeaders(w, sums)
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusCreated)
 		json.NewEncoder(w).Encode(info)
@@ -261,7 +345,7 @@ func ResourceDelete(deps *Deps) http.HandlerFunc {
 		}
 
 		// Use user's storage path if set, otherwise reject
-		effectiveRoot := user.StoragePath
+		effectiveRoot := user.Root()
 		if effectiveRoot == "" {
 			http.Error(w, "Storage not initialized", http.StatusForbidden)
 			return
@@ -274,69 +358,11 @@ func ResourceDelete(deps *Deps) http.HandlerFunc {
 			return
 		}
 
-		if path == "/" {
-			http.Error(w, "Cannot delete root", http.StatusForbidden)
-			return
-		}
-
-		// Check if trying to delete a core folder
-		if IsCoreFolder(path) {
-			http.Error(w, "Cannot delete protected folder", http.StatusForbidden)
-			return
-		}
-
-		fullPath := filepath.Join(effectiveRoot, path)
-
-		// Verify path safety
-		if !strings.HasPrefix(fullPath, filepath.Clean(effectiveRoot)) {
-			http.Error(w, "Access denied", http.StatusForbidden)
-			return
-		}
-
-		// Get file info for DB
-		info, err := files.NewFileInfo(effectiveRoot, path)
-		if err != nil {
-			http.Error(w, "File not found", http.StatusNotFound)
-			return
-		}
-
-		// Start transaction
-		tx := storage.GetDB().Begin()
-
-		// Create trash record
-		item := &trash.TrashItem{
-			OriginalPath: path,
-			DeletedAt:    time.Now(),
-			FileSize:     info.Size,
-			IsDirectory:  info.IsDir,
-			Name:         info.Name,
-		}
-
-		if err := tx.Create(item).Error; err != nil {
-			tx.Rollback()
-			http.Error(w, "Database error", http.StatusInternalServerError)
-			return
-		}
-
-		// Create .trash dir if not exists
-		trashDir := filepath.Join(effectiveRoot, ".trash")
-		if err := os.MkdirAll(trashDir, 0755); err != nil {
-			tx.Rollback()
-			http.Error(w, "Failed to create trash directory", http.StatusInternalServerError)
+		if err := deleteResource(deps, user, path); err != nil {
+			writeOpError(w, err)
 			return
 		}
 
-		// Move file to .trash/{id}
-		// We use ID to avoid name conflicts in trash
-		trashPath := filepath.Join(trashDir, fmt.Sprintf("%d", item.ID))
-		if err := os.Rename(fullPath, trashPath); err != nil {
-			tx.Rollback()
-			http.Error(w, "Failed to move to trash: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		tx.Commit()
-
 		w.WriteHeader(http.StatusNoContent)
 	}
 }
@@ -346,7 +372,21 @@ type RenameRequest struct {
 	NewName string `json:"newName"`
 }
 
-// ResourcePatch handles PATCH /api/resources/{path:.*} (rename)
+// TransferRequest represents the copy/move request body
+type TransferRequest struct {
+	Action      string `json:"action"`      // "copy" or "move"
+	Destination string `json:"destination"` // Full target path, e.g. "/Documents/report.pdf"
+	Conflict    string `json:"conflict"`    // "overwrite", "skip", "rename"; empty fails on conflict
+}
+
+// TransferResponse is returned after a copy or move
+type TransferResponse struct {
+	*files.FileInfo
+	Skipped []string `json:"skipped,omitempty"`
+}
+
+// ResourcePatch handles PATCH /api/resources/{path:.*}
+// Renames in place with {"newName"}, or copies/moves with {"action", "destination"}
 func ResourcePatch(deps *Deps) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		user := auth.GetUserFromContext(r.Context())
@@ -356,7 +396,7 @@ func ResourcePatch(deps *Deps) http.HandlerFunc {
 		}
 
 		// Use user's storage path if set, otherwise reject
-		effectiveRoot := user.StoragePath
+		effectiveRoot := user.Root()
 		if effectiveRoot == "" {
 			http.Error(w, "Storage not initialized", http.StatusForbidden)
 			return
@@ -374,16 +414,30 @@ func ResourcePatch(deps *Deps) http.HandlerFunc {
 			return
 		}
 
-		// Check if trying to rename a core folder
-		if IsCoreFolder(path) {
+		// Parse request body
+		var req struct {
+			RenameRequest
+			TransferRequest
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		// Copying a core folder is fine, moving or renaming it is not
+		if IsCoreFolder(path) && req.Action != "copy" {
 			http.Error(w, "Cannot rename protected folder", http.StatusForbidden)
 			return
 		}
 
-		// Parse request body
-		var req RenameRequest
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid request body", http.StatusBadRequest)
+		if req.Action != "" {
+			resp, err := transferResource(deps, user, path, req.TransferRequest)
+			if err != nil {
+				writeOpError(w, err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(resp)
 			return
 		}
 
@@ -392,13 +446,31 @@ func ResourcePatch(deps *Deps) http.HandlerFunc {
 			return
 		}
 
+		loc, err := deps.locate(user, path)
+		if err != nil {
+			writeOpError(w, err)
+			return
+		}
+		effectiveRoot = loc.Root
+
+		// Spaces are renamed by an admin
+		if loc.Path == "/" {
+			http.Error(w, "Cannot rename a space", http.StatusForbidden)
+			return
+		}
+
+		if err := loc.authorize(user, permRename); err != nil {
+			writeOpError(w, err)
+			return
+		}
+
 		// Validate new name
 		if strings.ContainsAny(req.NewName, "/\\:*?\"<>|") {
 			http.Error(w, "Invalid characters in name", http.StatusBadRequest)
 			return
 		}
 
-		oldPath := filepath.Join(effectiveRoot, path)
+		oldPath := loc.full()
 		newPath := filepath.Join(filepath.Dir(oldPath), req.NewName)
 
 		// Verify path safety
@@ -406,24 +478,46 @@ func ResourcePatch(deps *Deps) http.HandlerFunc {
 			http.Error(w, "Access denied", http.StatusForbidden)
 			return
 		}
+		if files.IsReserved(loc.Path) || files.IsReserved(relPath(effectiveRoot, newPath)) {
+			http.Error(w, "Access denied", http.StatusForbidden)
+			return
+		}
 
 		// Check if target already exists
-		if _, err := os.Stat(newPath); err == nil {
+		if _, err := loc.FS.Stat(newPath); err == nil {
 			http.Error(w, "A file or folder with that name already exists", http.StatusConflict)
 			return
 		}
 
 		// Rename
-		if err := os.Rename(oldPath, newPath); err != nil {
+		if err := loc.FS.Rename(oldPath, newPath); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
+		deps.changed(loc, oldPath, newPath)
+
 		// Return new file info
-		newFilePath := filepath.Join(filepath.Dir(path), req.NewName)
-		info, _ := files.NewFileInfo(effectiveRoot, newFilePath)
+		newFilePath := filepath.Join(filepath.Dir(loc.Path), req.NewName)
+
+		// Keep previous versions with the file
+		if loc.Space == nil {
+			if err := versions.Relocate(storage.GetDB(), user.ID, path, newFilePath); err != nil {
+				log.Printf("Versions: failed to relocate %s: %v", path, err)
+			}
+		}
+
+		// Keep share links pointing at the renamed item
+		if err := share.RelocateLinks(deps.Share, user.ID, loc.Space != nil, path, loc.apiPath(newFilePath)); err != nil {
+			log.Printf("Share: failed to relocate links of %s: %v", path, err)
+		}
+		info, _ := files.NewFileInfo(loc.FS, effectiveRoot, newFilePath)
+		if info != nil {
+			info.Path = loc.apiPath(newFilePath)
+		}
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(info)
 	}
 }
+
@@ -3,18 +3,38 @@ package api
 import (
 	"encoding/json"
 	"errors"
-	"io/fs"
+	"fmt"
 	"net/http"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/satufile/satufile/auth"
 	"github.com/satufile/satufile/files"
+	"github.com/satufile/satufile/search"
+	"github.com/satufile/satufile/users"
+	"github.com/satufile/satufile/vfs"
 )
 
-var ErrLimitReached = errors.New("limit reached")
+const (
+	defaultSearchLimit = 50
+	maxSearchLimit     = 500
+)
 
-// SearchGet handles GET /api/search
+// SearchGet handles GET /api/search - queries the file index.
+//
+// Parameters: q (name substring), type (image, video, audio, text, pdf,
+// blob or dir), ext (comma-separated extensions), minSize and maxSize
+// (bytes), after and before (modification time, RFC 3339 or YYYY-MM-DD),
+// path (directory to search below), offset and limit.
+//
+// With mode=content, q is looked up in the text of indexed documents
+// instead and each result carries a snippet with the matches in <mark>;
+// only the path filter applies.
+//
+// Without a path, the user's own files and every space they belong to are
+// searched.
 func SearchGet(deps *Deps) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		user := auth.GetUserFromContext(r.Context())
@@ -24,73 +44,252 @@ func SearchGet(deps *Deps) http.HandlerFunc {
 		}
 
 		// Use user's storage path
-		effectiveRoot := user.StoragePath
+		effectiveRoot := user.Root()
 		if effectiveRoot == "" {
 			http.Error(w, "Storage not initialized", http.StatusForbidden)
 			return
 		}
 
-		query := strings.ToLower(r.URL.Query().Get("q"))
-		if len(query) < 2 {
+		if deps.Index == nil {
+			http.Error(w, "Search index unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		query, err := parseSearchQuery(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		scopes, err := deps.searchScopes(user, &query)
+		if err != nil {
+			writeOpError(w, err)
+			return
+		}
+
+		if r.URL.Query().Get("mode") == "content" {
+			searchContent(deps, w, scopes, query)
+			return
+		}
+
+		results := []files.FileInfo{}
+
+		// A bare name query needs at least two characters
+		if len(query.Name) < 2 && !query.Filtered() {
 			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(map[string]interface{}{
-				"results": []files.FileInfo{},
+				"results": results,
+				"total":   0,
+				"offset":  query.Offset,
+				"limit":   query.Limit,
 			})
 			return
 		}
 
-		results := []files.FileInfo{}
-		count := 0
+		owners, err := ensureScopes(deps, scopes)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 
-		err := filepath.WalkDir(effectiveRoot, func(path string, d fs.DirEntry, err error) error {
-			if err != nil {
-				return nil // Ignore errors accessing specific files
-			}
+		entries, total, err := deps.Index.Search(owners, query)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for i := range entries {
+			info := entries[i].FileInfo()
+			info.Path = scopes[entries[i].UserID].apiPath(info.Path)
+			results = append(results, *info)
+		}
 
-			// Skip root
-			if path == effectiveRoot {
-				return nil
-			}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"results": results,
+			"total":   total,
+			"offset":  query.Offset,
+			"limit":   query.Limit,
+		})
+	}
+}
+
+// searchScopes returns the locations a search covers by owner. A path
+// inside a space narrows it to that space, with the prefix made relative
+// to it; the mount folder covers every space.
+func (d *Deps) searchScopes(user *users.User, query *search.Query) (map[uint]*location, error) {
+	scopes := make(map[uint]*location)
+	if d.Spaces == nil || (query.Prefix != "" && query.Prefix != spacesMount &&
+		!strings.HasPrefix(query.Prefix, spacesMount+"/")) {
+		scopes[user.ID] = home(user)
+		return scopes, nil
+	}
+
+	if query.Prefix != "" && query.Prefix != spacesMount {
+		loc, err := d.locate(user, query.Prefix)
+		if err != nil {
+			return nil, err
+		}
+		query.Prefix = ""
+		if loc.Path != "/" {
+			query.Prefix = loc.Path
+		}
+		scopes[loc.Owner] = loc
+		return scopes, nil
+	}
+
+	if query.Prefix == "" {
+		scopes[user.ID] = home(user)
+	}
+	query.Prefix = ""
+	members, err := d.Spaces.Memberships(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range members {
+		m := &members[i]
+		scopes[m.Key()] = &location{
+			Owner:  m.Key(),
+			FS:     vfs.Local,
+			Root:   d.Spaces.Dir(m.ID),
+			Path:   "/",
+			Mount:  spacesMount + "/" + m.Name,
+			Space:  &m.Space,
+			Access: m.Access,
+		}
+	}
+	return scopes, nil
+}
 
-			// Get relative path for display and checking
-			relPath, err := filepath.Rel(effectiveRoot, path)
+// ensureScopes builds the index of every scope not indexed yet and returns
+// their owners
+func ensureScopes(deps *Deps, scopes map[uint]*location) ([]uint, error) {
+	owners := make([]uint, 0, len(scopes))
+	for owner, loc := range scopes {
+		if err := deps.Index.Ensure(owner, loc.FS, loc.Root); err != nil {
+			return nil, err
+		}
+		owners = append(owners, owner)
+	}
+	return owners, nil
+}
+
+// contentResult is a file matched by its content
+type contentResult struct {
+	files.FileInfo
+	Snippet string `json:"snippet"`
+}
+
+// searchContent answers a mode=content search
+func searchContent(deps *Deps, w http.ResponseWriter, scopes map[uint]*location, query search.Query) {
+	content := deps.Index.Content()
+	if content == nil {
+		http.Error(w, "Content search is disabled", http.StatusNotImplemented)
+		return
+	}
+
+	results := []contentResult{}
+	var total int64
+	if len(query.Name) >= 2 {
+		owners, err := ensureScopes(deps, scopes)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		hits, n, err := content.Search(owners, query.Name, query.Prefix, query.Offset, query.Limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		total = n
+		for _, hit := range hits {
+			loc := scopes[hit.UserID]
+			info, err := files.NewFileInfo(loc.FS, loc.Root, hit.Path)
 			if err != nil {
-				return nil
+				continue // removed since it was indexed
 			}
+			info.Path = loc.apiPath(info.Path)
+			results = append(results, contentResult{FileInfo: *info, Snippet: hit.Snippet})
+		}
+	}
 
-			// Skip .trash folder explicitly
-			if d.IsDir() && d.Name() == ".trash" {
-				return fs.SkipDir
-			}
-			
-			// Also skip any path starting with .trash (double check)
-			if strings.HasPrefix(relPath, ".trash") {
-				return fs.SkipDir
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"results": results,
+		"total":   total,
+		"offset":  query.Offset,
+		"limit":   query.Limit,
+	})
+}
+
+// parseSearchQuery reads the search filters from the query string
+func parseSearchQuery(r *http.Request) (search.Query, error) {
+	params := r.URL.Query()
+	q := search.Query{
+		Name:  strings.TrimSpace(params.Get("q")),
+		Type:  params.Get("type"),
+		Limit: defaultSearchLimit,
+	}
+
+	if ext := params.Get("ext"); ext != "" {
+		for _, e := range strings.Split(ext, ",") {
+			if e = strings.TrimSpace(e); e != "" {
+				q.Extensions = append(q.Extensions, e)
 			}
+		}
+	}
+
+	if p := params.Get("path"); p != "" {
+		q.Prefix = filepath.ToSlash(filepath.Clean("/" + p))
+		if q.Prefix == "/" {
+			q.Prefix = ""
+		}
+	}
 
-			// Perform match (case-insensitive)
-			if strings.Contains(strings.ToLower(d.Name()), query) {
-				info, err := files.NewFileInfo(effectiveRoot, "/" + relPath)
-				if err == nil {
-					results = append(results, *info)
-					count++
-					if count >= 50 {
-						return ErrLimitReached
-					}
-				}
+	var err error
+	ints := []struct {
+		name string
+		dst  *int64
+	}{{"minSize", &q.MinSize}, {"maxSize", &q.MaxSize}}
+	for _, p := range ints {
+		if v := params.Get(p.name); v != "" {
+			if *p.dst, err = strconv.ParseInt(v, 10, 64); err != nil || *p.dst < 0 {
+				return q, fmt.Errorf("Invalid %s", p.name)
 			}
+		}
+	}
 
-			return nil
-		})
+	times := []struct {
+		name string
+		dst  *time.Time
+	}{{"after", &q.After}, {"before", &q.Before}}
+	for _, p := range times {
+		if v := params.Get(p.name); v != "" {
+			if *p.dst, err = parseSearchTime(v); err != nil {
+				return q, fmt.Errorf("Invalid %s", p.name)
+			}
+		}
+	}
 
-		if err != nil && err != ErrLimitReached {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+	if v := params.Get("offset"); v != "" {
+		if q.Offset, err = strconv.Atoi(v); err != nil || q.Offset < 0 {
+			return q, errors.New("Invalid offset")
+		}
+	}
+	if v := params.Get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit <= 0 {
+			return q, errors.New("Invalid limit")
+		}
+		if q.Limit > maxSearchLimit {
+			q.Limit = maxSearchLimit
 		}
+	}
+	return q, nil
+}
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"results": results,
-		})
+func parseSearchTime(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
 	}
+	return time.ParseInLocation("2006-01-02", v, time.Local)
 }
@@ -2,22 +2,41 @@ package api
 
 import (
 	"net/http"
+
+	"github.com/satufile/satufile/auth"
 )
 
 // ShareDelete handles DELETE /api/share/:id
 func ShareDelete(deps *Deps) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		user := auth.GetUserFromContext(r.Context())
+		if user == nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if err := authorize(user, permShare); err != nil {
+			writeOpError(w, err)
+			return
+		}
+
 		token := r.URL.Query().Get("token")
 		if token == "" {
 			http.Error(w, "Missing token", http.StatusBadRequest)
 			return
 		}
 
+		link, ok := ownedLink(deps, w, user, token)
+		if !ok {
+			return
+		}
+
 		if err := deps.Share.DeleteLink(token); err != nil {
 			http.Error(w, "Failed to delete share link", http.StatusInternalServerError)
 			return
 		}
 
+		deps.publish(linkOwner(link, user), TopicShares, "SHARE_DELETED", map[string]interface{}{"token": token})
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("Share link deleted successfully"))
 	}
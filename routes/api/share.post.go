@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"net/http"
 	"os"
-	"path/filepath"
 
 	"github.com/satufile/satufile/auth"
 	"github.com/satufile/satufile/share"
@@ -21,7 +20,7 @@ func SharePost(deps *Deps) http.HandlerFunc {
 		}
 
 		// Use user's storage path if set, otherwise reject
-		effectiveRoot := user.StoragePath
+		effectiveRoot := user.Root()
 		if effectiveRoot == "" {
 			http.Error(w, "Storage not initialized", http.StatusForbidden)
 			return
@@ -29,10 +28,11 @@ func SharePost(deps *Deps) http.HandlerFunc {
 
 		var req struct {
 			Path     string `json:"path"`
-			Type     string `json:"type"`               // "file" or "folder"
+			Type     string `json:"type"`               // "file", "folder" or "upload"
 			Expires  string `json:"expires,omitempty"`  // Duration as string (e.g., "24")
 			Unit     string `json:"unit,omitempty"`     // "hours", "days", "weeks"
 			Password string `json:"password,omitempty"` // Optional password
+			share.Options
 		}
 
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -40,22 +40,44 @@ func SharePost(deps *Deps) http.HandlerFunc {
 			return
 		}
 
+		if err := req.Options.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		// Validate type
-		if req.Type != "file" && req.Type != "folder" {
-			http.Error(w, "Invalid type, must be 'file' or 'folder'", http.StatusBadRequest)
+		if req.Type != share.TypeFile && req.Type != share.TypeFolder && req.Type != share.TypeUpload {
+			http.Error(w, "Invalid type, must be 'file', 'folder' or 'upload'", http.StatusBadRequest)
+			return
+		}
+
+		loc, err := deps.locate(user, req.Path)
+		if err != nil {
+			writeOpError(w, err)
+			return
+		}
+
+		// A share lets anyone with the link download the item, or upload
+		// into the folder
+		perms := []permission{permShare, permDownload}
+		if req.Type == share.TypeUpload {
+			perms = []permission{permShare, permCreate}
+		}
+		if err := loc.authorize(user, perms...); err != nil {
+			writeOpError(w, err)
 			return
 		}
 
 		// Validate path exists
-		fullPath := filepath.Join(effectiveRoot, req.Path)
-		if _, err := os.Stat(fullPath); os.IsNotExist(err) {
+		fullPath := loc.full()
+		if _, err := loc.FS.Stat(fullPath); os.IsNotExist(err) {
 			http.Error(w, "File or folder not found", http.StatusNotFound)
 			return
 		}
 
 		// If folder, validate it's actually a directory
-		if req.Type == "folder" {
-			info, err := os.Stat(fullPath)
+		if req.Type != share.TypeFile {
+			info, err := loc.FS.Stat(fullPath)
 			if err != nil {
 				http.Error(w, "Failed to access folder", http.StatusInternalServerError)
 				return
@@ -67,27 +89,7 @@ func SharePost(deps *Deps) http.HandlerFunc {
 		}
 
 		// Parse expires duration
-		expiresHours := 24 // Default 24 hours
-		if req.Expires != "" && req.Unit != "" {
-			// Convert string to hours based on unit
-			var hours int
-			if _, err := fmt.Sscanf(req.Expires, "%d", &hours); err == nil {
-				switch req.Unit {
-				case "hours", "hour":
-					expiresHours = hours
-				case "days", "day":
-					expiresHours = hours * 24
-				case "weeks", "week":
-					expiresHours = hours * 24 * 7
-				}
-			}
-		} else if req.Expires != "" {
-			// Parse the expires value as number of hours
-			var hours int
-			if _, err := fmt.Sscanf(req.Expires, "%d", &hours); err == nil {
-				expiresHours = hours
-			}
-		}
+		expiresHours := parseShareExpiry(req.Expires, req.Unit)
 
 		// Create share link
 		link, err := share.NewLink(req.Path, req.Type, expiresHours)
@@ -96,13 +98,47 @@ func SharePost(deps *Deps) http.HandlerFunc {
 			return
 		}
 
+		link.OwnerID = user.ID
+		link.Options = req.Options
+		if err := link.SetPassword(req.Password); err != nil {
+			http.Error(w, "Failed to create share link", http.StatusInternalServerError)
+			return
+		}
+
 		// Save share link
 		if err := deps.Share.CreateLink(link); err != nil {
 			http.Error(w, "Failed to save share link", http.StatusInternalServerError)
 			return
 		}
+		deps.publish(user.ID, TopicShares, "SHARE_CREATED", link)
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(link)
 	}
 }
+
+// parseShareExpiry converts an expires/unit pair to hours (default 24)
+func parseShareExpiry(expires, unit string) int {
+	expiresHours := 24 // Default 24 hours
+	if expires != "" && unit != "" {
+		// Convert string to hours based on unit
+		var hours int
+		if _, err := fmt.Sscanf(expires, "%d", &hours); err == nil {
+			switch unit {
+			case "hours", "hour":
+				expiresHours = hours
+			case "days", "day":
+				expiresHours = hours * 24
+			case "weeks", "week":
+				expiresHours = hours * 24 * 7
+			}
+		}
+	} else if expires != "" {
+		// Parse the expires value as number of hours
+		var hours int
+		if _, err := fmt.Sscanf(expires, "%d", &hours); err == nil {
+			expiresHours = hours
+		}
+	}
+	return expiresHours
+}
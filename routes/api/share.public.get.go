@@ -3,15 +3,17 @@ package api
 import (
 	"archive/zip"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"io"
+	"io/fs"
 	"mime"
 	"net/http"
-	"os"
 	"path/filepath"
 	"strings"
 
 	"github.com/satufile/satufile/files"
+	"github.com/satufile/satufile/share"
+	"github.com/satufile/satufile/vfs"
 )
 
 // SharePublicGetResponse is JSON response for share info
@@ -24,6 +26,25 @@ type SharePublicGetResponse struct {
 	ExpiresAt string `json:"expires_at"`
 	Expires   string `json:"expires"` // Alias for frontend compatibility
 	IsDir     bool   `json:"isDir"`
+	shareAccess
+}
+
+// shareAccess tells visitors what a link lets them do
+type shareAccess struct {
+	Mode          string `json:"mode"`
+	HasPassword   bool   `json:"has_password"`
+	DownloadsLeft *int   `json:"downloads_left,omitempty"` // omitted when unlimited
+}
+
+func newShareAccess(link *share.Link) shareAccess {
+	access := shareAccess{Mode: link.Mode, HasPassword: link.HasPassword}
+	if access.Mode == "" {
+		access.Mode = share.ModeDownload
+	}
+	if left := link.DownloadsLeft(); left >= 0 {
+		access.DownloadsLeft = &left
+	}
+	return access
 }
 
 // SharePublicGet handles GET /api/share/public
@@ -31,8 +52,15 @@ type SharePublicGetResponse struct {
 // Query params:
 //   - token: the share token (required)
 //   - download: if "true", forces download as attachment
+//   - inline: if "true", serves a file for viewing in the browser
 //   - subpath: path within shared folder (optional, for folder shares)
-func SharePublicGet(deps *Deps, root string) http.HandlerFunc {
+//
+// Links may be limited to some addresses, locked by a password (see
+// SharePublicUnlockPost), view-only or limited in downloads. Every download
+// counts towards the limit unless it resumes one counted before (see
+// shareResumable). Files that can be previewed may be viewed inline
+// without counting, until the limit is used up.
+func SharePublicGet(deps *Deps, dataDir string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		token := r.URL.Query().Get("token")
 		if token == "" {
@@ -46,10 +74,26 @@ func SharePublicGet(deps *Deps, root string) http.HandlerFunc {
 			http.Error(w, "Invalid or expired share link", http.StatusNotFound)
 			return
 		}
+		if !guardShareLink(w, r, link) {
+			return
+		}
+
+		// Upload links only tell visitors where their files go
+		if link.Type == share.TypeUpload {
+			writeUploadLinkInfo(w, link)
+			return
+		}
+
+		loc, err := deps.shareLocation(link, dataDir)
+		if err != nil {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		root := loc.Root
 
 		// Handle subpath for folder shares
 		subpath := r.URL.Query().Get("subpath")
-		targetPath := link.Path
+		targetPath := loc.Path
 		if subpath != "" && link.Type == "folder" {
 			// Sanitize subpath to prevent directory traversal
 			subpath = filepath.Clean(subpath)
@@ -57,11 +101,11 @@ func SharePublicGet(deps *Deps, root string) http.HandlerFunc {
 				http.Error(w, "Invalid subpath", http.StatusBadRequest)
 				return
 			}
-			targetPath = filepath.Join(link.Path, subpath)
+			targetPath = filepath.Join(loc.Path, subpath)
 		}
 
 		// Get file info for the target path
-		fileInfo, err := files.NewFileInfo(root, targetPath)
+		fileInfo, err := files.NewFileInfo(loc.FS, root, targetPath)
 		if err != nil {
 			http.Error(w, "File not found", http.StatusNotFound)
 			return
@@ -69,11 +113,39 @@ func SharePublicGet(deps *Deps, root string) http.HandlerFunc {
 
 		// Check if download is requested
 		forceDownload := r.URL.Query().Get("download") == "true"
+		if forceDownload {
+			if !link.CanDownload() {
+				writeOpError(w, errShareViewOnly)
+				return
+			}
+			if !shareResumable(r, link) {
+				if err := deps.Share.RecordDownload(link.Token); err != nil {
+					if errors.Is(err, share.ErrDownloadLimit) {
+						writeOpError(w, errShareLimit)
+					} else {
+						http.Error(w, "Invalid or expired share link", http.StatusNotFound)
+					}
+					return
+				}
+				setShareResume(w, r, link)
+			}
+		} else if r.URL.Query().Get("inline") == "true" {
+			if fileInfo.IsDir {
+				http.Error(w, "Folders cannot be viewed inline", http.StatusBadRequest)
+				return
+			}
+			if link.DownloadsLeft() == 0 {
+				writeOpError(w, errShareLimit)
+				return
+			}
+			servePublicInline(w, r, loc.FS, filepath.Join(root, targetPath))
+			return
+		}
 
 		// If it's a folder and not downloading, return folder contents or info
 		if fileInfo.IsDir && !forceDownload {
 			// Return folder listing
-			listing, err := files.ReadDir(root, targetPath, true)
+			listing, err := files.ReadDir(loc.FS, root, targetPath, true)
 			if err != nil {
 				http.Error(w, "Failed to read directory", http.StatusInternalServerError)
 				return
@@ -92,18 +164,20 @@ func SharePublicGet(deps *Deps, root string) http.HandlerFunc {
 				Items     []*files.FileInfo `json:"items"`
 				NumDirs   int               `json:"numDirs"`
 				NumFiles  int               `json:"numFiles"`
+				shareAccess
 			}{
-				Token:     link.Token,
-				Path:      link.Path,
-				Name:      fileInfo.Name,
-				Type:      link.Type,
-				ExpiresAt: expiresStr,
-				Expires:   expiresStr,
-				IsDir:     true,
-				Subpath:   subpath,
-				Items:     listing.Items,
-				NumDirs:   listing.NumDirs,
-				NumFiles:  listing.NumFiles,
+				Token:       link.Token,
+				Path:        link.Path,
+				Name:        fileInfo.Name,
+				Type:        link.Type,
+				ExpiresAt:   expiresStr,
+				Expires:     expiresStr,
+				IsDir:       true,
+				Subpath:     subpath,
+				Items:       listing.Items,
+				NumDirs:     listing.NumDirs,
+				NumFiles:    listing.NumFiles,
+				shareAccess: newShareAccess(link),
 			}
 			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(response)
@@ -114,14 +188,15 @@ func SharePublicGet(deps *Deps, root string) http.HandlerFunc {
 		if !forceDownload {
 			expiresStr := link.ExpiresAt.Format("2006-01-02T15:04:05Z07:00")
 			response := SharePublicGetResponse{
-				Token:     link.Token,
-				Path:      link.Path,
-				Name:      fileInfo.Name,
-				Type:      link.Type,
-				Size:      fileInfo.Size,
-				ExpiresAt: expiresStr,
-				Expires:   expiresStr,
-				IsDir:     fileInfo.IsDir,
+				Token:       link.Token,
+				Path:        link.Path,
+				Name:        fileInfo.Name,
+				Type:        link.Type,
+				Size:        fileInfo.Size,
+				ExpiresAt:   expiresStr,
+				Expires:     expiresStr,
+				IsDir:       fileInfo.IsDir,
+				shareAccess: newShareAccess(link),
 			}
 			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(response)
@@ -133,13 +208,13 @@ func SharePublicGet(deps *Deps, root string) http.HandlerFunc {
 			// Stream folder as ZIP
 			zipName := fileInfo.Name + ".zip"
 			w.Header().Set("Content-Type", "application/zip")
-			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", zipName))
+			w.Header().Set("Content-Disposition", contentDisposition("attachment", zipName))
 
 			zw := zip.NewWriter(w)
 			defer zw.Close()
 
 			baseDir := filepath.Join(root, targetPath)
-			err := filepath.Walk(baseDir, func(path string, info os.FileInfo, err error) error {
+			err := vfs.WalkDir(loc.FS, baseDir, func(path string, d fs.DirEntry, err error) error {
 				if err != nil {
 					return err
 				}
@@ -148,6 +223,10 @@ func SharePublicGet(deps *Deps, root string) http.HandlerFunc {
 				if path == baseDir {
 					return nil
 				}
+				info, err := d.Info()
+				if err != nil {
+					return err
+				}
 
 				// Create header
 				header, err := zip.FileInfoHeader(info)
@@ -177,7 +256,7 @@ func SharePublicGet(deps *Deps, root string) http.HandlerFunc {
 					return nil
 				}
 
-				file, err := os.Open(path)
+				file, err := loc.FS.Open(path)
 				if err != nil {
 					return err
 				}
@@ -206,12 +285,105 @@ func SharePublicGet(deps *Deps, root string) http.HandlerFunc {
 
 		// Set headers for download
 		w.Header().Set("Content-Type", contentType)
-		w.Header().Set("Content-Disposition", "attachment; filename=\""+filepath.Base(filePath)+"\"")
+		w.Header().Set("Content-Disposition", contentDisposition("attachment", filepath.Base(filePath)))
 
-		http.ServeFile(w, r, filePath)
+		serveFile(w, r, loc.FS, filePath)
 	}
 }
 
+// shareLocation resolves the path of a download link in its owner's files,
+// as long as the owner may still share it. Links without an owner resolve
+// against dataDir.
+func (d *Deps) shareLocation(link *share.Link, dataDir string) (*location, error) {
+	if link.OwnerID == 0 {
+		return &location{FS: vfs.Local, Root: dataDir, Path: filepath.Clean("/" + link.Path), Mount: "/"}, nil
+	}
+
+	owner, err := d.UserRepo.GetByID(link.OwnerID)
+	if err != nil {
+		return nil, err
+	}
+	if owner.Root() == "" {
+		return nil, newOpError(http.StatusNotFound, "Not found")
+	}
+	loc, err := d.locate(owner, link.Path)
+	if err != nil {
+		return nil, err
+	}
+	if err := loc.authorize(owner, permShare, permDownload); err != nil {
+		return nil, err
+	}
+	return loc, nil
+}
+
+// writeUploadLinkInfo answers with what an upload link accepts
+func writeUploadLinkInfo(w http.ResponseWriter, link *share.Link) {
+	expiresStr := link.ExpiresAt.Format("2006-01-02T15:04:05Z07:00")
+	response := struct {
+		Token          string `json:"token"`
+		Name           string `json:"name"`
+		Type           string `json:"type"`
+		ExpiresAt      string `json:"expires_at"`
+		Expires        string `json:"expires"`
+		HasPassword    bool   `json:"has_password"`
+		MaxUploads     int    `json:"max_uploads"`
+		MaxUploadBytes int64  `json:"max_upload_bytes"`
+		Uploads        int    `json:"uploads"`
+		UploadedBytes  int64  `json:"uploaded_bytes"`
+		UploadURL      string `json:"upload_url"`
+	}{
+		Token:          link.Token,
+		Name:           filepath.Base(link.Path),
+		Type:           link.Type,
+		ExpiresAt:      expiresStr,
+		Expires:        expiresStr,
+		HasPassword:    link.HasPassword,
+		MaxUploads:     link.MaxUploads,
+		MaxUploadBytes: link.MaxUploadBytes,
+		Uploads:        link.Uploads,
+		UploadedBytes:  link.UploadedBytes,
+		UploadURL:      "/api/share/public/" + link.Token + "/tus",
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// previewableTypes are the content types browsers can show themselves
+var previewableTypes = []string{
+	"text/",
+	"image/",
+	"video/",
+	"audio/",
+	"application/pdf",
+	"application/json",
+}
+
+func isPreviewable(contentType string) bool {
+	for _, prefix := range previewableTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// servePublicInline serves a shared file for viewing in the browser. It
+// cannot stop visitors from saving what they see; view-only links only
+// withhold the download endpoints, and other files are not served inline.
+func servePublicInline(w http.ResponseWriter, r *http.Request, fsys vfs.FS, filePath string) {
+	contentType := mime.TypeByExtension(strings.ToLower(filepath.Ext(filePath)))
+	if !isPreviewable(contentType) {
+		writeOpError(w, errShareNoPreview)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", contentDisposition("inline", filepath.Base(filePath)))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	// Shared HTML must not run scripts on our origin
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	serveFile(w, r, fsys, filePath)
+}
+
 // StreamFile serves a file with proper content-type headers
 func StreamFile(w http.ResponseWriter, r *http.Request, filePath string) {
 	// Detect content type
@@ -226,27 +398,10 @@ func StreamFile(w http.ResponseWriter, r *http.Request, filePath string) {
 	w.Header().Set("Content-Type", contentType)
 
 	// Check if file should be served inline or as attachment
-	inlineMimeTypes := []string{
-		"text/",
-		"image/",
-		"video/",
-		"audio/",
-		"application/pdf",
-		"application/json",
-	}
-
-	inline := false
-	for _, mimePrefix := range inlineMimeTypes {
-		if strings.HasPrefix(contentType, mimePrefix) {
-			inline = true
-			break
-		}
-	}
-
-	if inline {
-		w.Header().Set("Content-Disposition", "inline; filename=\""+filepath.Base(filePath)+"\"")
+	if isPreviewable(contentType) {
+		w.Header().Set("Content-Disposition", contentDisposition("inline", filepath.Base(filePath)))
 	} else {
-		w.Header().Set("Content-Disposition", "attachment; filename=\""+filepath.Base(filePath)+"\"")
+		w.Header().Set("Content-Disposition", contentDisposition("attachment", filepath.Base(filePath)))
 	}
 
 	// Open and serve file
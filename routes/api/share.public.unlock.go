@@ -0,0 +1,187 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/satufile/satufile/auth"
+	"github.com/satufile/satufile/share"
+)
+
+// shareUnlockTTL is how long an unlocked password-protected link stays
+// open in the visitor's browser
+const shareUnlockTTL = time.Hour
+
+// shareResumeTTL is how long a visitor may resume a counted download
+// without it counting again
+const shareResumeTTL = time.Hour
+
+// Errors visitors of a public link can get
+var (
+	errShareForbiddenIP = &opError{Status: http.StatusForbidden, Code: "ip_not_allowed", Msg: "This link cannot be opened from your address"}
+	errSharePassword    = &opError{Status: http.StatusUnauthorized, Code: "password_required", Msg: "This link is protected by a password"}
+	errShareViewOnly    = &opError{Status: http.StatusForbidden, Code: "view_only", Msg: "This link does not allow downloads"}
+	errShareLimit       = &opError{Status: http.StatusGone, Code: "download_limit", Msg: "This link has reached its download limit"}
+	errShareNoPreview   = &opError{Status: http.StatusUnsupportedMediaType, Code: "not_previewable", Msg: "This file cannot be viewed in the browser"}
+)
+
+// SharePublicUnlockPost handles POST /api/share/public/unlock - checks
+// {"token", "password"} and answers with a short-lived cookie that opens
+// the link
+func SharePublicUnlockPost(deps *Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Token    string `json:"token"`
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		link, err := deps.Share.GetLink(req.Token)
+		if err != nil {
+			http.Error(w, "Invalid or expired share link", http.StatusNotFound)
+			return
+		}
+		if !link.AllowsIP(visitorIP(r)) {
+			writeOpError(w, errShareForbiddenIP)
+			return
+		}
+		if !link.HasPassword {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if !link.CheckPassword(req.Password) {
+			writeOpError(w, &opError{Status: http.StatusUnauthorized, Code: "invalid_password", Msg: "Wrong password"})
+			return
+		}
+
+		expires := time.Now().Add(shareUnlockTTL)
+		http.SetCookie(w, &http.Cookie{
+			Name:     shareCookieName(link),
+			Value:    signShareUnlock(link, expires),
+			Path:     "/api/share/public",
+			Expires:  expires,
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// guardShareLink checks the visitor's address and, for protected links,
+// the unlock cookie, and writes the error if the visitor may not proceed
+func guardShareLink(w http.ResponseWriter, r *http.Request, link *share.Link) bool {
+	if !link.AllowsIP(visitorIP(r)) {
+		writeOpError(w, errShareForbiddenIP)
+		return false
+	}
+	if link.HasPassword && !shareUnlocked(r, link) {
+		writeOpError(w, errSharePassword)
+		return false
+	}
+	return true
+}
+
+// visitorIP is the address the request came from. Forwarding headers are
+// ignored as anyone can set them, so allow lists behind a reverse proxy
+// have to be enforced by the proxy.
+func visitorIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+func shareCookieName(link *share.Link) string {
+	return "share_unlock_" + link.ID
+}
+
+func shareResumeCookieName(link *share.Link) string {
+	return "share_resume_" + link.ID
+}
+
+// signShareUnlock returns the cookie value unlocking link until expires.
+// The password hash is part of the signature, so changing or removing the
+// password locks out everyone who unlocked the link before.
+func signShareUnlock(link *share.Link, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return exp + "." + shareUnlockMAC(link, exp)
+}
+
+func shareUnlockMAC(link *share.Link, exp string) string {
+	mac := hmac.New(sha256.New, auth.SecretKey)
+	fmt.Fprintf(mac, "%s|%s|%s", link.ID, link.PasswordHash, exp)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// shareUnlocked reports whether the request carries a valid unlock cookie
+// for link
+func shareUnlocked(r *http.Request, link *share.Link) bool {
+	return validShareCookie(r, shareCookieName(link), func(exp string) string {
+		return shareUnlockMAC(link, exp)
+	})
+}
+
+// setShareResume answers a counted download with a cookie that lets the
+// visitor resume it, see shareResumable
+func setShareResume(w http.ResponseWriter, r *http.Request, link *share.Link) {
+	expires := time.Now().Add(shareResumeTTL)
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	http.SetCookie(w, &http.Cookie{
+		Name:     shareResumeCookieName(link),
+		Value:    exp + "." + shareResumeMAC(link, exp),
+		Path:     "/api/share/public",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func shareResumeMAC(link *share.Link, exp string) string {
+	mac := hmac.New(sha256.New, auth.SecretKey)
+	fmt.Fprintf(mac, "resume|%s|%s", link.ID, exp)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// shareResumable reports whether the request resumes a download of link
+// that was already counted: a range request from a visitor holding the
+// cookie set by setShareResume. Anything else counts as a new download.
+func shareResumable(r *http.Request, link *share.Link) bool {
+	if r.Header.Get("Range") == "" {
+		return false
+	}
+	return validShareCookie(r, shareResumeCookieName(link), func(exp string) string {
+		return shareResumeMAC(link, exp)
+	})
+}
+
+// validShareCookie checks that the cookie called name is an unexpired
+// "exp.sig" pair signed by mac
+func validShareCookie(r *http.Request, name string, mac func(exp string) string) bool {
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return false
+	}
+	exp, sig, ok := strings.Cut(cookie.Value, ".")
+	if !ok {
+		return false
+	}
+	unix, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || time.Now().Unix() > unix {
+		return false
+	}
+	return hmac.Equal([]byte(sig), []byte(mac(exp)))
+}
@@ -5,16 +5,37 @@ import (
 	"fmt"
 	"net/http"
 	"time"
+
+	"github.com/satufile/satufile/auth"
+	"github.com/satufile/satufile/share"
+	"github.com/satufile/satufile/users"
 )
 
 // SharePut handles PUT /api/share
-// Updates the expiration time of a share link
+// Updates the expiration time and the restrictions of a share link;
+// omitted restrictions are left alone and an empty password removes it
 func SharePut(deps *Deps) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		user := auth.GetUserFromContext(r.Context())
+		if user == nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if err := authorize(user, permShare); err != nil {
+			writeOpError(w, err)
+			return
+		}
+
 		var req struct {
 			Token   string `json:"token"`
 			Expires string `json:"expires,omitempty"` // Duration as string (e.g., "24")
 			Unit    string `json:"unit,omitempty"`    // "hours", "days", "weeks"
+
+			Password     *string `json:"password,omitempty"`
+			MaxDownloads *int    `json:"max_downloads,omitempty"`
+			Mode         *string `json:"mode,omitempty"`
+			AllowedIPs   *string `json:"allowed_ips,omitempty"`
 		}
 
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -27,6 +48,45 @@ func SharePut(deps *Deps) http.HandlerFunc {
 			return
 		}
 
+		link, ok := ownedLink(deps, w, user, req.Token)
+		if !ok {
+			return
+		}
+
+		changesOptions := req.Password != nil || req.MaxDownloads != nil || req.Mode != nil || req.AllowedIPs != nil
+		if changesOptions {
+			options := link.Options
+			if req.MaxDownloads != nil {
+				options.MaxDownloads = *req.MaxDownloads
+			}
+			if req.Mode != nil {
+				options.Mode = *req.Mode
+			}
+			if req.AllowedIPs != nil {
+				options.AllowedIPs = *req.AllowedIPs
+			}
+			if err := options.Validate(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if req.Password != nil {
+				if err := options.SetPassword(*req.Password); err != nil {
+					http.Error(w, "Failed to update share link", http.StatusInternalServerError)
+					return
+				}
+			}
+			if err := deps.Share.UpdateLinkOptions(req.Token, options); err != nil {
+				http.Error(w, "Failed to update share link: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			// Only a given expiry changes it alongside the restrictions
+			if req.Expires == "" {
+				writeUpdatedLink(deps, w, linkOwner(link, user), req.Token)
+				return
+			}
+		}
+
 		// Parse expires duration
 		expiresHours := 24 // Default 24 hours
 		if req.Expires != "" && req.Unit != "" {
@@ -57,14 +117,44 @@ func SharePut(deps *Deps) http.HandlerFunc {
 			return
 		}
 
-		// Get updated link to return
-		link, err := deps.Share.GetLink(req.Token)
-		if err != nil {
-			http.Error(w, "Share updated but failed to retrieve", http.StatusInternalServerError)
-			return
-		}
+		writeUpdatedLink(deps, w, linkOwner(link, user), req.Token)
+	}
+}
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(link)
+// ownedLink loads the link with token, writing an error response unless
+// user created it or is an admin
+func ownedLink(deps *Deps, w http.ResponseWriter, user *users.User, token string) (*share.Link, bool) {
+	link, err := deps.Share.GetLink(token)
+	if err != nil {
+		http.Error(w, "Share link not found", http.StatusNotFound)
+		return nil, false
 	}
+	if link.OwnerID != user.ID && !user.EffectivePerm().Admin {
+		writeOpError(w, &opError{Status: http.StatusForbidden, Code: "permission_denied", Msg: "Not your share link"})
+		return nil, false
+	}
+	return link, true
+}
+
+// linkOwner returns the user events about link go to: its owner, or user
+// for links created before links had owners
+func linkOwner(link *share.Link, user *users.User) uint {
+	if link.OwnerID == 0 {
+		return user.ID
+	}
+	return link.OwnerID
+}
+
+// writeUpdatedLink answers with the link with token, telling userID it
+// was updated
+func writeUpdatedLink(deps *Deps, w http.ResponseWriter, userID uint, token string) {
+	link, err := deps.Share.GetLink(token)
+	if err != nil {
+		http.Error(w, "Share updated but failed to retrieve", http.StatusInternalServerError)
+		return
+	}
+	deps.publish(userID, TopicShares, "SHARE_UPDATED", link)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(link)
 }
@@ -0,0 +1,139 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/gorilla/mux"
+
+	"github.com/satufile/satufile/share"
+	"github.com/satufile/satufile/uploads"
+	"github.com/satufile/satufile/users"
+)
+
+var errShareUploadLimit = &opError{Status: http.StatusRequestEntityTooLarge, Code: "upload_limit", Msg: "This link does not accept more uploads"}
+
+// ShareTusCreate handles POST /api/share/public/{token}/tus - starts an
+// anonymous tus upload into the folder of an upload link. Only the file
+// name of the metadata is used; files land directly in the shared folder
+// and never replace what is there. The owner's quota is charged and the
+// owner is told about every finished upload with a SHARE_UPLOAD event.
+func ShareTusCreate(deps *Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !tusHeaders(w, r) {
+			return
+		}
+
+		link, owner := shareUploadLink(deps, w, r)
+		if link == nil {
+			return
+		}
+
+		creation, ok := parseTusCreation(w, r)
+		if !ok {
+			return
+		}
+		if err := link.AcceptsUpload(creation.size); err != nil {
+			writeOpError(w, errShareUploadLimit)
+			return
+		}
+
+		loc, err := deps.locate(owner, path.Join(link.Path, creation.filename))
+		if err != nil {
+			writeOpError(w, err)
+			return
+		}
+		if _, err := uploadTarget(loc); err != nil {
+			writeOpError(w, err)
+			return
+		}
+		if err := loc.authorize(owner, permCreate); err != nil {
+			writeOpError(w, err)
+			return
+		}
+
+		startTusUpload(deps, w, r, owner, loc, creation, link.Token)
+	}
+}
+
+// ShareTusHead handles HEAD /api/share/public/{token}/tus/{id}
+func ShareTusHead(deps *Deps) http.HandlerFunc {
+	return tusHead(deps, shareTusSession)
+}
+
+// ShareTusPatch handles PATCH /api/share/public/{token}/tus/{id}
+func ShareTusPatch(deps *Deps) http.HandlerFunc {
+	return tusPatch(deps, shareTusSession)
+}
+
+// ShareTusDelete handles DELETE /api/share/public/{token}/tus/{id}
+func ShareTusDelete(deps *Deps) http.HandlerFunc {
+	return tusDelete(deps, shareTusSession)
+}
+
+// shareTusSession is the tusLookup of anonymous uploads: the session must
+// have been started through the link in the URL
+func shareTusSession(deps *Deps, w http.ResponseWriter, r *http.Request) (*uploads.Session, *users.User) {
+	link, owner := shareUploadLink(deps, w, r)
+	if link == nil {
+		return nil, nil
+	}
+
+	session := loadTusSession(deps, w, r, func(s *uploads.Session) bool {
+		return s.ShareToken == link.Token && s.UserID == owner.ID
+	})
+	if session == nil {
+		return nil, nil
+	}
+	return session, owner
+}
+
+// shareUploadLink loads the upload link in the URL and its owner, writing
+// an error response and returning nils if the visitor may not upload
+// through it
+func shareUploadLink(deps *Deps, w http.ResponseWriter, r *http.Request) (*share.Link, *users.User) {
+	link, err := deps.Share.GetLink(mux.Vars(r)["token"])
+	if err != nil || link.Type != share.TypeUpload || link.OwnerID == 0 {
+		http.Error(w, "Invalid or expired share link", http.StatusNotFound)
+		return nil, nil
+	}
+	if !guardShareLink(w, r, link) {
+		return nil, nil
+	}
+
+	owner, err := deps.UserRepo.GetByID(link.OwnerID)
+	if err != nil || owner.Root() == "" {
+		http.Error(w, "Invalid or expired share link", http.StatusNotFound)
+		return nil, nil
+	}
+
+	// The folder may have been removed or the owner's access revoked
+	loc, err := deps.locate(owner, link.Path)
+	if err != nil {
+		writeOpError(w, err)
+		return nil, nil
+	}
+	if info, err := loc.FS.Stat(loc.full()); err != nil || !info.IsDir() {
+		http.Error(w, "Shared folder not found", http.StatusNotFound)
+		return nil, nil
+	}
+	return link, owner
+}
+
+// recordShareUpload counts a finished anonymous upload against its link,
+// failing the session if the link's caps were reached meanwhile
+func recordShareUpload(deps *Deps, session *uploads.Session) error {
+	err := deps.Share.RecordUpload(session.ShareToken, session.TotalSize)
+	if err == nil {
+		return nil
+	}
+
+	session.Status = "failed"
+	os.RemoveAll(session.TempDir)
+	if errors.Is(err, share.ErrUploadLimit) {
+		return errShareUploadLimit
+	}
+	return newOpError(http.StatusNotFound, "Invalid or expired share link")
+}
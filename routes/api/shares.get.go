@@ -3,18 +3,36 @@ package api
 import (
 	"encoding/json"
 	"net/http"
+
+	"github.com/satufile/satufile/auth"
+	"github.com/satufile/satufile/share"
 )
 
 // SharesGet handles GET /api/shares
-// Returns all active share links for the admin user
+// Returns the active share links of the user, or of everyone for admins
 func SharesGet(deps *Deps) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		user := auth.GetUserFromContext(r.Context())
+		if user == nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
 		// Get all shares from storage
 		links, err := deps.Share.ListLinks()
 		if err != nil {
 			http.Error(w, "Failed to get shares", http.StatusInternalServerError)
 			return
 		}
+		if !user.EffectivePerm().Admin {
+			own := []*share.Link{}
+			for _, link := range links {
+				if link.OwnerID == user.ID {
+					own = append(own, link)
+				}
+			}
+			links = own
+		}
 
 		// Return as JSON
 		w.Header().Set("Content-Type", "application/json")
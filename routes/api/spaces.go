@@ -0,0 +1,334 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"github.com/satufile/satufile/auth"
+	"github.com/satufile/satufile/files"
+	"github.com/satufile/satufile/spaces"
+	"github.com/satufile/satufile/storage"
+	"github.com/satufile/satufile/trash"
+	"github.com/satufile/satufile/users"
+	"github.com/satufile/satufile/vfs"
+)
+
+// SpaceInfo is a space as returned by the spaces APIs
+type SpaceInfo struct {
+	spaces.Space
+	UsedBytes int64          `json:"usedBytes"`
+	Access    *spaces.Access `json:"access,omitempty"` // the requesting user's
+	ACL       []spaces.Entry `json:"acl,omitempty"`    // admin APIs only
+}
+
+// SpaceRequest is the request body for POST and PUT /api/admin/spaces;
+// omitted fields are left alone on PUT
+type SpaceRequest struct {
+	Name    *string `json:"name,omitempty"`
+	QuotaGb *int    `json:"quotaGb,omitempty"`
+}
+
+// writeSpaceError maps space errors to HTTP responses
+func writeSpaceError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, spaces.ErrNotFound):
+		http.Error(w, "Space not found", http.StatusNotFound)
+	case errors.Is(err, spaces.ErrExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, spaces.ErrInvalid):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// spaceInfo adds a space's usage
+func spaceInfo(deps *Deps, sp spaces.Space) SpaceInfo {
+	return SpaceInfo{Space: sp, UsedBytes: getDirSize(vfs.Local, deps.Spaces.Dir(sp.ID))}
+}
+
+// spacesListing lists the spaces a user belongs to as the folders of the
+// mount
+func spacesListing(deps *Deps, user *users.User) (*files.Listing, error) {
+	members, err := deps.Spaces.Memberships(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	listing := &files.Listing{Items: []*files.FileInfo{}}
+	for _, m := range members {
+		info, err := files.NewFileInfo(vfs.Local, deps.Spaces.Dir(m.ID), "/")
+		if err != nil {
+			continue
+		}
+		info.Path = spacesMount + "/" + m.Name
+		info.Name = m.Name
+		listing.Items = append(listing.Items, info)
+		listing.NumDirs++
+	}
+	return listing, nil
+}
+
+// mountSpaces puts the mount folder into a listing of the user's root if
+// they belong to a space. Listings never hold a folder of that name, as
+// it is reserved.
+func mountSpaces(deps *Deps, user *users.User, listing *files.Listing) {
+	if deps.Spaces == nil {
+		return
+	}
+
+	members, err := deps.Spaces.Memberships(user.ID)
+	if err != nil || len(members) == 0 {
+		return
+	}
+	mount := &files.FileInfo{Path: spacesMount, Name: spaces.MountDir, IsDir: true, Mode: fs.ModeDir | 0755}
+	for _, m := range members {
+		if m.UpdatedAt.After(mount.ModTime) {
+			mount.ModTime = m.UpdatedAt
+		}
+	}
+	listing.Items = append(listing.Items, mount)
+	listing.NumDirs++
+}
+
+// SpacesGet handles GET /api/spaces - the spaces the user belongs to and
+// what they may do in them
+func SpacesGet(deps *Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := auth.GetUserFromContext(r.Context())
+		if user == nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		infos := []SpaceInfo{}
+		if deps.Spaces != nil {
+			members, err := deps.Spaces.Memberships(user.ID)
+			if err != nil {
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			for i := range members {
+				info := spaceInfo(deps, members[i].Space)
+				info.Access = &members[i].Access
+				infos = append(infos, info)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(infos)
+	}
+}
+
+// targetSpace loads the space named by {id}
+func targetSpace(deps *Deps, r *http.Request) (*spaces.Space, error) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		return nil, spaces.ErrNotFound
+	}
+	return deps.Spaces.Get(uint(id))
+}
+
+// requireSpaces answers 404 when shared spaces are disabled
+func requireSpaces(deps *Deps, w http.ResponseWriter) bool {
+	if deps.Spaces == nil {
+		http.Error(w, "Shared spaces are disabled", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// AdminSpacesGet handles GET /api/admin/spaces
+func AdminSpacesGet(deps *Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireSpaces(deps, w) {
+			return
+		}
+
+		list, err := deps.Spaces.List()
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		infos := make([]SpaceInfo, 0, len(list))
+		for _, sp := range list {
+			info := spaceInfo(deps, sp)
+			info.ACL, _ = deps.Spaces.Entries(sp.ID)
+			infos = append(infos, info)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(infos)
+	}
+}
+
+// AdminSpaceGet handles GET /api/admin/spaces/{id}
+func AdminSpaceGet(deps *Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireSpaces(deps, w) {
+			return
+		}
+
+		sp, err := targetSpace(deps, r)
+		if err != nil {
+			writeSpaceError(w, err)
+			return
+		}
+		writeAdminSpace(deps, w, http.StatusOK, sp)
+	}
+}
+
+// writeAdminSpace writes a space with its usage and access list
+func writeAdminSpace(deps *Deps, w http.ResponseWriter, status int, sp *spaces.Space) {
+	info := spaceInfo(deps, *sp)
+	acl, err := deps.Spaces.Entries(sp.ID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	info.ACL = acl
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(info)
+}
+
+// AdminSpacePost handles POST /api/admin/spaces - creates a space with
+// {"name", "quotaGb"}
+func AdminSpacePost(deps *Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireSpaces(deps, w) {
+			return
+		}
+
+		var req SpaceRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if req.Name == nil || req.QuotaGb == nil {
+			http.Error(w, "Name and quotaGb are required", http.StatusBadRequest)
+			return
+		}
+
+		sp, err := deps.Spaces.Create(*req.Name, *req.QuotaGb)
+		if err != nil {
+			writeSpaceError(w, err)
+			return
+		}
+		writeAdminSpace(deps, w, http.StatusCreated, sp)
+	}
+}
+
+// AdminSpacePut handles PUT /api/admin/spaces/{id} - renames or resizes
+// a space
+func AdminSpacePut(deps *Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireSpaces(deps, w) {
+			return
+		}
+
+		sp, err := targetSpace(deps, r)
+		if err != nil {
+			writeSpaceError(w, err)
+			return
+		}
+
+		var req SpaceRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if req.Name != nil {
+			sp.Name = *req.Name
+		}
+		if req.QuotaGb != nil {
+			used := getDirSize(vfs.Local, deps.Spaces.Dir(sp.ID))
+			if float64(used) > float64(*req.QuotaGb)*1024*1024*1024 {
+				http.Error(w, fmt.Sprintf("Quota is below current usage (%d bytes)", used), http.StatusConflict)
+				return
+			}
+			sp.QuotaGb = *req.QuotaGb
+		}
+
+		if err := deps.Spaces.Update(sp); err != nil {
+			writeSpaceError(w, err)
+			return
+		}
+		writeAdminSpace(deps, w, http.StatusOK, sp)
+	}
+}
+
+// AdminSpaceDelete handles DELETE /api/admin/spaces/{id} - removes a
+// space with its files and trash
+func AdminSpaceDelete(deps *Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireSpaces(deps, w) {
+			return
+		}
+
+		sp, err := targetSpace(deps, r)
+		if err != nil {
+			writeSpaceError(w, err)
+			return
+		}
+
+		if err := deps.Spaces.Delete(sp.ID); err != nil {
+			writeSpaceError(w, err)
+			return
+		}
+		if err := storage.GetDB().Where("space_id = ?", sp.ID).Delete(&trash.TrashItem{}).Error; err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if deps.Index != nil {
+			deps.Index.Forget(sp.Key())
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// AdminSpaceACLPut handles PUT /api/admin/spaces/{id}/acl - sets the
+// access of {"userId"} or {"groupId"} to {"read", "write", "delete",
+// "share"}; granting nothing removes the entry
+func AdminSpaceACLPut(deps *Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireSpaces(deps, w) {
+			return
+		}
+
+		sp, err := targetSpace(deps, r)
+		if err != nil {
+			writeSpaceError(w, err)
+			return
+		}
+
+		var entry spaces.Entry
+		if err := json.NewDecoder(r.Body).Decode(&entry); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		entry.SpaceID = sp.ID
+
+		if entry.UserID != 0 {
+			if _, err := deps.UserRepo.GetByID(entry.UserID); err != nil {
+				writeAccountError(w, err)
+				return
+			}
+		}
+
+		if err := deps.Spaces.Grant(entry); err != nil {
+			writeSpaceError(w, err)
+			return
+		}
+		writeAdminSpace(deps, w, http.StatusOK, sp)
+	}
+}
@@ -3,13 +3,15 @@ package api
 import (
 	"encoding/json"
 	"net/http"
-	"os"
 	"path/filepath"
 	"sync"
 	"time"
 
 	"github.com/satufile/satufile/auth"
+	"github.com/satufile/satufile/files"
+	"github.com/satufile/satufile/system/partition"
 	"github.com/satufile/satufile/users"
+	"github.com/satufile/satufile/vfs"
 )
 
 // StorageStats represents detailed storage breakdown
@@ -106,12 +108,12 @@ func StorageUsageGet(deps *Deps) http.HandlerFunc {
 }
 
 func calculateStats(user *users.User) (StorageStats, error) {
-	effectiveRoot := user.StoragePath
+	effectiveRoot, fsys := user.StoragePath, user.FS()
 	stats := StorageStats{
 		Folders: make(map[string]int64),
 	}
 
-	stats.Used = getDirSize(effectiveRoot)
+	stats.Used = getDirSize(fsys, effectiveRoot)
 
 	if user.StorageAllocationGb > 0 {
 		stats.Total = int64(user.StorageAllocationGb) * 1024 * 1024 * 1024
@@ -124,12 +126,12 @@ func calculateStats(user *users.User) (StorageStats, error) {
 		stats.Free = 0
 	}
 
-	entries, err := os.ReadDir(effectiveRoot)
+	entries, err := fsys.ReadDir(effectiveRoot)
 	if err == nil {
 		for _, entry := range entries {
-			if entry.IsDir() && entry.Name() != ".trash" {
+			if entry.IsDir() && !files.IsReserved(entry.Name()) {
 				folderPath := filepath.Join(effectiveRoot, entry.Name())
-				size := getDirSize(folderPath)
+				size := getDirSize(fsys, folderPath)
 				stats.Folders[entry.Name()] = size
 			}
 		}
@@ -146,24 +148,8 @@ func calculateStats(user *users.User) (StorageStats, error) {
 }
 
 // getDirSize calculates the total size of a directory recursively
-func getDirSize(path string) int64 {
-	var size int64
-
-	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
-		if err != nil {
-			return nil
-		}
-		// Skip .trash folder from calculation if it's encountered during walk?
-		// If we are walking root, we WILL encounter .trash.
-		// We should skip it to avoid counting trash in "Used" space?
-		// The design says "Total Used: 45.2 GB". Trash usually COUNTS towards quota.
-		// So we should NOT skip .trash in getDirSize.
-		
-		if !info.IsDir() {
-			size += info.Size()
-		}
-		return nil
-	})
-
-	return size
+// Trash counts towards quota, so .trash is not skipped; hardlinked
+// (deduplicated) files are counted once.
+func getDirSize(fsys vfs.FS, path string) int64 {
+	return partition.DiskUsage(fsys, path)
 }
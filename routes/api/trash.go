@@ -2,6 +2,7 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
@@ -12,10 +13,95 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/satufile/satufile/auth"
+	"github.com/satufile/satufile/files"
+	"github.com/satufile/satufile/spaces"
 	"github.com/satufile/satufile/storage"
 	"github.com/satufile/satufile/trash"
+	"github.com/satufile/satufile/users"
+	"github.com/satufile/satufile/versions"
+	"github.com/satufile/satufile/vfs"
 )
 
+// moveToTrash soft-deletes the item at loc by recording it in the trash
+// table and moving it to .trash/{id} below loc's root
+func moveToTrash(user *users.User, loc *location, info *files.FileInfo) (*trash.TrashItem, error) {
+	fullPath := loc.full()
+
+	// Start transaction
+	tx := storage.GetDB().Begin()
+
+	// Create trash record
+	item := &trash.TrashItem{
+		UserID:       user.ID,
+		OriginalPath: loc.Path,
+		DeletedAt:    time.Now(),
+		FileSize:     info.Size,
+		IsDirectory:  info.IsDir,
+		Name:         info.Name,
+	}
+	if loc.Space != nil {
+		item.SpaceID = loc.Space.ID
+	}
+
+	if err := tx.Create(item).Error; err != nil {
+		tx.Rollback()
+		return nil, errors.New("Database error")
+	}
+
+	// Previous versions stay with the item while it is in the trash
+	if loc.Space == nil {
+		if err := versions.Relocate(tx, user.ID, loc.Path, trash.ItemPath(item.ID)); err != nil {
+			tx.Rollback()
+			return nil, errors.New("Database error")
+		}
+	}
+
+	// Create .trash dir if not exists
+	trashDir := filepath.Join(loc.Root, ".trash")
+	if err := loc.FS.MkdirAll(trashDir, 0755); err != nil {
+		tx.Rollback()
+		return nil, errors.New("Failed to create trash directory")
+	}
+
+	// Move file to .trash/{id}
+	// We use ID to avoid name conflicts in trash
+	trashPath := filepath.Join(trashDir, fmt.Sprintf("%d", item.ID))
+	if err := loc.FS.Rename(fullPath, trashPath); err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("Failed to move to trash: %w", err)
+	}
+
+	tx.Commit()
+	return item, nil
+}
+
+// trashRoot returns the root whose .trash folder holds item
+func (d *Deps) trashRoot(user *users.User, item *trash.TrashItem) string {
+	if item.SpaceID == 0 || d.Spaces == nil {
+		return user.Root()
+	}
+	return d.Spaces.Dir(item.SpaceID)
+}
+
+// trashLocation returns the location a trash item was deleted from. In a
+// space the user can no longer read, it grants no access.
+func (d *Deps) trashLocation(user *users.User, item *trash.TrashItem) *location {
+	if item.SpaceID == 0 || d.Spaces == nil {
+		return home(user)
+	}
+
+	loc := &location{FS: vfs.Local, Root: d.trashRoot(user, item), Path: "/", Space: &spaces.Space{ID: item.SpaceID}}
+	if sp, err := d.Spaces.Get(item.SpaceID); err == nil {
+		loc.Space = sp
+	}
+	if member, err := d.Spaces.Member(user.ID, item.SpaceID); err == nil {
+		loc.Access = member.Access
+	}
+	loc.Owner = loc.Space.Key()
+	loc.Mount = spacesMount + "/" + loc.Space.Name
+	return loc
+}
+
 // TrashGet handles GET /api/trash
 func TrashGet(deps *Deps) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -25,8 +111,13 @@ func TrashGet(deps *Deps) http.HandlerFunc {
 			return
 		}
 
+		if user.StoragePath == "" {
+			http.Error(w, "Storage not initialized", http.StatusForbidden)
+			return
+		}
+
 		var items []trash.TrashItem
-		if err := storage.GetDB().Order("deleted_at desc").Find(&items).Error; err != nil {
+		if err := storage.GetDB().Where("user_id = ?", user.ID).Order("deleted_at desc").Find(&items).Error; err != nil {
 			http.Error(w, "Database error", http.StatusInternalServerError)
 			return
 		}
@@ -45,6 +136,11 @@ func TrashRestore(deps *Deps) http.HandlerFunc {
 			return
 		}
 
+		if user.StoragePath == "" {
+			http.Error(w, "Storage not initialized", http.StatusForbidden)
+			return
+		}
+
 		vars := mux.Vars(r)
 		idStr := vars["id"]
 		id, err := strconv.Atoi(idStr)
@@ -53,22 +149,28 @@ func TrashRestore(deps *Deps) http.HandlerFunc {
 			return
 		}
 
-		tx := storage.GetDB().Begin()
-
 		var item trash.TrashItem
-		if err := tx.First(&item, id).Error; err != nil {
-			tx.Rollback()
+		if err := storage.GetDB().Where("user_id = ?", user.ID).First(&item, id).Error; err != nil {
 			http.Error(w, "Item not found", http.StatusNotFound)
 			return
 		}
 
+		// Restoring brings the item back into the folder tree
+		loc := deps.trashLocation(user, &item)
+		if err := loc.authorize(user, permCreate); err != nil {
+			writeOpError(w, err)
+			return
+		}
+
+		tx := storage.GetDB().Begin()
+
 		// Restore file
-		effectiveRoot := user.StoragePath
+		effectiveRoot := loc.Root
 		trashPath := filepath.Join(effectiveRoot, ".trash", fmt.Sprintf("%d", item.ID))
 		originalPath := filepath.Join(effectiveRoot, item.OriginalPath)
 
 		// Check if original path exists
-		if _, err := os.Stat(originalPath); err == nil {
+		if _, err := loc.FS.Stat(originalPath); err == nil {
 			// Conflict handling: rename restored file
 			// Simple strategy: append timestamp
 			ext := filepath.Ext(item.OriginalPath)
@@ -78,26 +180,35 @@ func TrashRestore(deps *Deps) http.HandlerFunc {
 		}
 
 		// Ensure parent dir exists
-		if err := os.MkdirAll(filepath.Dir(originalPath), 0755); err != nil {
+		if err := loc.FS.MkdirAll(filepath.Dir(originalPath), 0755); err != nil {
 			tx.Rollback()
 			http.Error(w, "Failed to create directory", http.StatusInternalServerError)
 			return
 		}
 
-		if err := os.Rename(trashPath, originalPath); err != nil {
+		if err := loc.FS.Rename(trashPath, originalPath); err != nil {
 			tx.Rollback()
 			http.Error(w, "Failed to restore file: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		// Delete from DB
-		if err := tx.Delete(&item).Error; err != nil {
+		// Delete from DB, bringing back the item's versions
+		err = versions.Relocate(tx, user.ID, trash.ItemPath(item.ID), relPath(effectiveRoot, originalPath))
+		if err == nil {
+			err = tx.Delete(&item).Error
+		}
+		if err != nil {
 			tx.Rollback()
 			http.Error(w, "Database error", http.StatusInternalServerError)
 			return
 		}
 
 		tx.Commit()
+		deps.changed(loc, originalPath)
+		deps.publish(user.ID, TopicTrash, "TRASH_RESTORED", map[string]interface{}{
+			"id":   item.ID,
+			"path": loc.apiPath(relPath(effectiveRoot, originalPath)),
+		})
 		w.WriteHeader(http.StatusOK)
 	}
 }
@@ -111,6 +222,11 @@ func TrashDelete(deps *Deps) http.HandlerFunc {
 			return
 		}
 
+		if user.StoragePath == "" {
+			http.Error(w, "Storage not initialized", http.StatusForbidden)
+			return
+		}
+
 		vars := mux.Vars(r)
 		idStr := vars["id"]
 		id, err := strconv.Atoi(idStr)
@@ -119,24 +235,35 @@ func TrashDelete(deps *Deps) http.HandlerFunc {
 			return
 		}
 
+		if err := authorize(user, permDelete); err != nil {
+			writeOpError(w, err)
+			return
+		}
+
 		tx := storage.GetDB().Begin()
 
 		var item trash.TrashItem
-		if err := tx.First(&item, id).Error; err != nil {
+		if err := tx.Where("user_id = ?", user.ID).First(&item, id).Error; err != nil {
 			tx.Rollback()
 			http.Error(w, "Item not found", http.StatusNotFound)
 			return
 		}
 
 		// Delete file from .trash
-		effectiveRoot := user.StoragePath
+		loc := deps.trashLocation(user, &item)
+		effectiveRoot := loc.Root
 		trashPath := filepath.Join(effectiveRoot, ".trash", fmt.Sprintf("%d", item.ID))
 
-		if err := os.RemoveAll(trashPath); err != nil && !os.IsNotExist(err) {
+		if err := loc.FS.RemoveAll(trashPath); err != nil && !os.IsNotExist(err) {
 			tx.Rollback()
 			http.Error(w, "Failed to delete file: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
+		if err := versions.Discard(tx, effectiveRoot, user.ID, trash.ItemPath(item.ID)); err != nil {
+			tx.Rollback()
+			http.Error(w, "Failed to delete versions: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
 
 		// Delete from DB
 		if err := tx.Delete(&item).Error; err != nil {
@@ -146,6 +273,7 @@ func TrashDelete(deps *Deps) http.HandlerFunc {
 		}
 
 		tx.Commit()
+		deps.publish(user.ID, TopicTrash, "TRASH_DELETED", map[string]interface{}{"id": item.ID})
 		w.WriteHeader(http.StatusNoContent)
 	}
 }
@@ -159,33 +287,44 @@ func TrashEmpty(deps *Deps) http.HandlerFunc {
 			return
 		}
 
+		if user.StoragePath == "" {
+			http.Error(w, "Storage not initialized", http.StatusForbidden)
+			return
+		}
+
+		if err := authorize(user, permDelete); err != nil {
+			writeOpError(w, err)
+			return
+		}
+
 		tx := storage.GetDB().Begin()
 
-		// Get all items
+		// Get all of the user's items
 		var items []trash.TrashItem
-		if err := tx.Find(&items).Error; err != nil {
+		if err := tx.Where("user_id = ?", user.ID).Find(&items).Error; err != nil {
 			tx.Rollback()
 			http.Error(w, "Database error", http.StatusInternalServerError)
 			return
 		}
 
-		effectiveRoot := user.StoragePath
-		trashDir := filepath.Join(effectiveRoot, ".trash")
-
 		// Delete all files
 		for _, item := range items {
-			trashPath := filepath.Join(trashDir, fmt.Sprintf("%d", item.ID))
-			os.RemoveAll(trashPath) // Ignore errors, best effort
+			loc := deps.trashLocation(user, &item)
+			effectiveRoot := loc.Root
+			trashPath := filepath.Join(effectiveRoot, ".trash", fmt.Sprintf("%d", item.ID))
+			loc.FS.RemoveAll(trashPath) // Ignore errors, best effort
+			versions.Discard(tx, effectiveRoot, user.ID, trash.ItemPath(item.ID))
 		}
 
-		// Truncate table
-		if err := tx.Exec("DELETE FROM trash_items").Error; err != nil {
+		// Remove the user's rows only
+		if err := tx.Where("user_id = ?", user.ID).Delete(&trash.TrashItem{}).Error; err != nil {
 			tx.Rollback()
 			http.Error(w, "Database error", http.StatusInternalServerError)
 			return
 		}
 
 		tx.Commit()
+		deps.publish(user.ID, TopicTrash, "TRASH_EMPTIED", map[string]interface{}{"count": len(items)})
 		w.WriteHeader(http.StatusNoContent)
 	}
 }
@@ -0,0 +1,522 @@
+package api
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/satufile/satufile/auth"
+	"github.com/satufile/satufile/checksum"
+	"github.com/satufile/satufile/uploads"
+	"github.com/satufile/satufile/users"
+	"github.com/satufile/satufile/vfs"
+)
+
+// tus 1.0 protocol constants (https://tus.io/protocols/resumable-upload)
+const (
+	TusVersion    = "1.0.0"
+	TusExtensions = "creation,creation-with-upload,termination,checksum,expiration"
+
+	tusContentType = "application/offset+octet-stream"
+	tusPartFormat  = "part_%d" // the bytes of one request, by their offset
+	// statusChecksumMismatch is the tus-specific 460 Checksum Mismatch
+	statusChecksumMismatch = 460
+)
+
+// tusChecksums maps Upload-Checksum algorithm names to hash constructors
+var tusChecksums = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"crc32c": func() hash.Hash { return checksum.NewCRC32C() },
+}
+
+// tusHeaders sets Tus-Resumable and rejects requests for another protocol
+// version with 412 Precondition Failed
+func tusHeaders(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", TusVersion)
+	if r.Header.Get("Tus-Resumable") != TusVersion {
+		w.Header().Set("Tus-Version", TusVersion)
+		http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// TusOptions handles OPTIONS /api/tus - protocol discovery, no auth
+func TusOptions(deps *Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", TusVersion)
+		w.Header().Set("Tus-Version", TusVersion)
+		w.Header().Set("Tus-Extension", TusExtensions)
+		w.Header().Set("Tus-Checksum-Algorithm", "md5,sha1,sha256,crc32c")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// TusCreate handles POST /api/tus - creates an upload from Upload-Length
+// and Upload-Metadata ("filename" or "name", optional target folder
+// "path", optional whole-file "sha256"/"crc32c" in hex), optionally with
+// the first bytes in the body
+func TusCreate(deps *Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !tusHeaders(w, r) {
+			return
+		}
+
+		user := auth.GetUserFromContext(r.Context())
+		if user == nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		// Use user's storage path if set, otherwise reject
+		effectiveRoot := user.Root()
+		if effectiveRoot == "" {
+			http.Error(w, "Storage not initialized", http.StatusForbidden)
+			return
+		}
+
+		creation, ok := parseTusCreation(w, r)
+		if !ok {
+			return
+		}
+		target := filepath.Join("/", creation.meta["path"], creation.filename)
+
+		loc, err := deps.locate(user, target)
+		if err != nil {
+			writeOpError(w, err)
+			return
+		}
+		if _, err := uploadTarget(loc); err != nil {
+			writeOpError(w, err)
+			return
+		}
+		if err := loc.authorizeWrite(user); err != nil {
+			writeOpError(w, err)
+			return
+		}
+
+		startTusUpload(deps, w, r, user, loc, creation, "")
+	}
+}
+
+// tusCreation is what a creation request asks for
+type tusCreation struct {
+	size     int64
+	filename string
+	meta     map[string]string
+	expected checksum.Sums
+}
+
+// parseTusCreation reads Upload-Length and Upload-Metadata, writing an
+// error response if they are unusable
+func parseTusCreation(w http.ResponseWriter, r *http.Request) (*tusCreation, bool) {
+	size, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || size < 0 {
+		http.Error(w, "Missing or invalid Upload-Length", http.StatusBadRequest)
+		return nil, false
+	}
+
+	meta, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, "Invalid Upload-Metadata", http.StatusBadRequest)
+		return nil, false
+	}
+	filename := meta["filename"]
+	if filename == "" {
+		filename = meta["name"]
+	}
+	filename = filepath.Base(filepath.Clean("/" + filename))
+	if filename == "/" || filename == "." {
+		http.Error(w, "Upload-Metadata must contain a filename", http.StatusBadRequest)
+		return nil, false
+	}
+
+	expected := checksum.Sums{SHA256: meta["sha256"], CRC32C: meta["crc32c"]}
+	if err := expected.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return &tusCreation{size: size, filename: filename, meta: meta, expected: expected}, true
+}
+
+// startTusUpload creates the session for an authorized upload to loc,
+// drawing on user's quota. shareToken names the upload link of anonymous
+// uploads.
+func startTusUpload(deps *Deps, w http.ResponseWriter, r *http.Request, user *users.User, loc *location, creation *tusCreation, shareToken string) {
+	// Check quota
+	if err := loc.checkQuota(user, creation.size); err != nil {
+		writeOpError(w, err)
+		return
+	}
+
+	sessionID := generateID()
+	tempDir := filepath.Join(uploads.TempBase(), sessionID)
+	if err := os.MkdirAll(tempDir, 0755); err != nil {
+		http.Error(w, "Failed to create temp directory", http.StatusInternalServerError)
+		return
+	}
+
+	session := &uploads.Session{
+		ID:          sessionID,
+		Filename:    creation.filename,
+		Path:        loc.apiPath(loc.Path),
+		TotalSize:   creation.size,
+		ChunkSize:   creation.size,
+		TotalChunks: 1,
+		Status:      "uploading",
+		TempDir:     tempDir,
+		ExpiresAt:   time.Now().Add(SessionExpiry),
+		UserID:      user.ID,
+		Protocol:    uploads.ProtocolTus,
+		Metadata:    r.Header.Get("Upload-Metadata"),
+		SHA256:      creation.expected.SHA256,
+		CRC32C:      creation.expected.CRC32C,
+		ShareToken:  shareToken,
+	}
+
+	unlock := uploads.Lock(sessionID)
+	defer unlock()
+
+	// The session exists before the body is read, so the reaper knows the
+	// temp dir is in use however long the request takes
+	if err := deps.Uploads.CreateSession(session); err != nil {
+		os.RemoveAll(tempDir)
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
+
+	// creation-with-upload: the body holds the first bytes, and an
+	// empty upload is complete right away. The client has no URL to
+	// resume from if that fails, so the session goes too.
+	if r.Header.Get("Content-Type") == tusContentType || creation.size == 0 {
+		err := tusAppend(deps, user, session, r)
+		if err == nil {
+			err = deps.Uploads.UpdateSession(session)
+		}
+		if err != nil {
+			deps.Uploads.DeleteSession(sessionID)
+			os.RemoveAll(tempDir)
+			uploads.Forget(sessionID)
+			writeTusError(w, err)
+			return
+		}
+		if session.Status == "completed" {
+			uploads.Forget(sessionID)
+		}
+	}
+
+	w.Header().Set("Location", strings.TrimSuffix(r.URL.Path, "/")+"/"+sessionID)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(session.UploadedSize, 10))
+	setTusExpires(w, session)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// tusLookup loads the session named in the URL and the user whose quota
+// it draws on, writing an error response and returning nils if the
+// request may not use it
+type tusLookup func(deps *Deps, w http.ResponseWriter, r *http.Request) (*uploads.Session, *users.User)
+
+// TusHead handles HEAD /api/tus/{id} - reports the current offset
+func TusHead(deps *Deps) http.HandlerFunc {
+	return tusHead(deps, tusSession)
+}
+
+func tusHead(deps *Deps, lookup tusLookup) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !tusHeaders(w, r) {
+			return
+		}
+
+		session, user := lookup(deps, w, r)
+		if session == nil || user == nil {
+			return
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Upload-Offset", strconv.FormatInt(session.UploadedSize, 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(session.TotalSize, 10))
+		if session.Metadata != "" {
+			w.Header().Set("Upload-Metadata", session.Metadata)
+		}
+		setTusExpires(w, session)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// TusPatch handles PATCH /api/tus/{id} - appends the body at Upload-Offset
+// and assembles the file once the upload is complete
+func TusPatch(deps *Deps) http.HandlerFunc {
+	return tusPatch(deps, tusSession)
+}
+
+func tusPatch(deps *Deps, lookup tusLookup) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !tusHeaders(w, r) {
+			return
+		}
+
+		if r.Header.Get("Content-Type") != tusContentType {
+			http.Error(w, "Content-Type must be "+tusContentType, http.StatusUnsupportedMediaType)
+			return
+		}
+
+		unlock := uploads.Lock(mux.Vars(r)["id"])
+		defer unlock()
+
+		session, user := lookup(deps, w, r)
+		if session == nil || user == nil {
+			return
+		}
+
+		offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+		if err != nil || offset < 0 {
+			http.Error(w, "Missing or invalid Upload-Offset", http.StatusBadRequest)
+			return
+		}
+		if offset != session.UploadedSize {
+			http.Error(w, "Upload-Offset does not match the current offset", http.StatusConflict)
+			return
+		}
+
+		appendErr := tusAppend(deps, user, session, r)
+
+		// Keep whatever was received, even from an interrupted request
+		session.ExpiresAt = time.Now().Add(SessionExpiry)
+		if err := deps.Uploads.UpdateSession(session); err != nil {
+			http.Error(w, "Failed to update session", http.StatusInternalServerError)
+			return
+		}
+		if appendErr != nil {
+			writeTusError(w, appendErr)
+			return
+		}
+		if session.Status == "completed" {
+			uploads.Forget(session.ID)
+		}
+
+		w.Header().Set("Upload-Offset", strconv.FormatInt(session.UploadedSize, 10))
+		setTusExpires(w, session)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// TusDelete handles DELETE /api/tus/{id} - termination extension
+func TusDelete(deps *Deps) http.HandlerFunc {
+	return tusDelete(deps, tusSession)
+}
+
+func tusDelete(deps *Deps, lookup tusLookup) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !tusHeaders(w, r) {
+			return
+		}
+
+		unlock := uploads.Lock(mux.Vars(r)["id"])
+		defer unlock()
+
+		session, user := lookup(deps, w, r)
+		if session == nil || user == nil {
+			return
+		}
+
+		os.RemoveAll(session.TempDir)
+		if err := deps.Uploads.DeleteSession(session.ID); err != nil {
+			http.Error(w, "Failed to delete session", http.StatusInternalServerError)
+			return
+		}
+		uploads.Forget(session.ID)
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// tusSession loads the user's tus session named in the URL, writing an
+// error response and returning nils if it is unusable
+func tusSession(deps *Deps, w http.ResponseWriter, r *http.Request) (*uploads.Session, *users.User) {
+	user := auth.GetUserFromContext(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, nil
+	}
+
+	if user.StoragePath == "" {
+		http.Error(w, "Storage not initialized", http.StatusForbidden)
+		return nil, nil
+	}
+
+	session := loadTusSession(deps, w, r, func(s *uploads.Session) bool {
+		return s.UserID == user.ID && s.ShareToken == ""
+	})
+	if session == nil {
+		return nil, nil
+	}
+	return session, user
+}
+
+// loadTusSession loads the tus session named in the URL if belongs says it
+// is the caller's, writing an error response and returning nil otherwise
+func loadTusSession(deps *Deps, w http.ResponseWriter, r *http.Request, belongs func(*uploads.Session) bool) *uploads.Session {
+	session, err := deps.Uploads.GetSession(mux.Vars(r)["id"])
+	if err != nil || session.Protocol != uploads.ProtocolTus || !belongs(session) {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return nil
+	}
+
+	if time.Now().After(session.ExpiresAt) || session.Status == "failed" {
+		http.Error(w, "Upload expired", http.StatusGone)
+		return nil
+	}
+	return session
+}
+
+// tusAppend writes the request body at the session's offset, verifying
+// Upload-Checksum, and completes the upload when all bytes have arrived
+func tusAppend(deps *Deps, user *users.User, session *uploads.Session, r *http.Request) error {
+	if session.Status == "completed" {
+		if r.ContentLength > 0 {
+			return newOpError(http.StatusRequestEntityTooLarge, "Upload is already complete")
+		}
+		return nil
+	}
+
+	remaining := session.TotalSize - session.UploadedSize
+	if r.ContentLength > remaining {
+		return newOpError(http.StatusRequestEntityTooLarge, "Body exceeds Upload-Length")
+	}
+
+	var hasher hash.Hash
+	var expected []byte
+	if header := r.Header.Get("Upload-Checksum"); header != "" {
+		algorithm, sum, ok := strings.Cut(header, " ")
+		newHash, known := tusChecksums[algorithm]
+		if !ok || !known {
+			return newOpError(http.StatusBadRequest, "Unsupported checksum algorithm")
+		}
+		decoded, err := base64.StdEncoding.DecodeString(sum)
+		if err != nil {
+			return newOpError(http.StatusBadRequest, "Invalid Upload-Checksum")
+		}
+		hasher, expected = newHash(), decoded
+	}
+
+	if _, err := os.Stat(session.TempDir); err != nil {
+		return newOpError(http.StatusGone, "Upload data is gone")
+	}
+	temp, err := tempFS(deps, user, session)
+	if err != nil {
+		return err
+	}
+
+	// Every request is kept in a part of its own, as encrypted files
+	// cannot be appended to
+	partPath := filepath.Join(session.TempDir, fmt.Sprintf(tusPartFormat, session.UploadedSize))
+	f, err := temp.Create(partPath)
+	if err != nil {
+		return err
+	}
+
+	var dst io.Writer = f
+	if hasher != nil {
+		dst = io.MultiWriter(f, hasher)
+	}
+	written, copyErr := io.Copy(dst, io.LimitReader(r.Body, remaining))
+	if err := f.Close(); copyErr == nil {
+		copyErr = err
+	}
+
+	if hasher != nil && copyErr == nil && !bytes.Equal(hasher.Sum(nil), expected) {
+		copyErr = newOpError(statusChecksumMismatch, "Checksum Mismatch")
+	}
+	// A checksum covers the whole request, so partial or wrong data is
+	// discarded
+	if written == 0 || (hasher != nil && copyErr != nil) {
+		os.Remove(partPath)
+		written = 0
+	}
+
+	session.UploadedSize += written
+	if copyErr != nil {
+		return copyErr
+	}
+
+	if session.UploadedSize == session.TotalSize {
+		parts, err := tusParts(temp, session)
+		if err != nil {
+			return err
+		}
+		session.UploadedChunks = 1
+		return completeUpload(deps, user, session, parts)
+	}
+	return nil
+}
+
+// tusParts returns the names of the parts of a session, in order
+func tusParts(temp vfs.FS, session *uploads.Session) ([]string, error) {
+	var parts []string
+	for offset := int64(0); offset < session.TotalSize; {
+		name := fmt.Sprintf(tusPartFormat, offset)
+		info, err := temp.Stat(filepath.Join(session.TempDir, name))
+		if err != nil || info.Size() == 0 {
+			return nil, newOpError(http.StatusGone, "Upload data is gone")
+		}
+		parts = append(parts, name)
+		offset += info.Size()
+	}
+	return parts, nil
+}
+
+// writeTusError writes an operation error; 460 has no standard status text
+func writeTusError(w http.ResponseWriter, err error) {
+	var oe *opError
+	if errors.As(err, &oe) && oe.Status == statusChecksumMismatch {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(statusChecksumMismatch)
+		io.WriteString(w, oe.Msg+"\n")
+		return
+	}
+	writeOpError(w, err)
+}
+
+func setTusExpires(w http.ResponseWriter, session *uploads.Session) {
+	if session.Status != "completed" {
+		w.Header().Set("Upload-Expires", session.ExpiresAt.UTC().Format(http.TimeFormat))
+	}
+}
+
+// parseTusMetadata decodes an Upload-Metadata header: comma-separated
+// "key base64(value)" pairs, where the value may be omitted
+func parseTusMetadata(header string) (map[string]string, error) {
+	meta := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return meta, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("empty metadata key")
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, err
+		}
+		meta[key] = string(value)
+	}
+	return meta, nil
+}
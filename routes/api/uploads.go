@@ -4,8 +4,10 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"math"
 	"net/http"
 	"os"
@@ -16,8 +18,14 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/satufile/satufile/auth"
+	"github.com/satufile/satufile/checksum"
+	"github.com/satufile/satufile/dedup"
+	"github.com/satufile/satufile/files"
+	"github.com/satufile/satufile/storage"
 	"github.com/satufile/satufile/system/partition"
 	"github.com/satufile/satufile/uploads"
+	"github.com/satufile/satufile/users"
+	"github.com/satufile/satufile/vfs"
 )
 
 const (
@@ -35,7 +43,7 @@ func UploadCreate(deps *Deps) http.HandlerFunc {
 		}
 
 		// Use user's storage path if set, otherwise reject
-		effectiveRoot := user.StoragePath
+		effectiveRoot := user.Root()
 		if effectiveRoot == "" {
 			http.Error(w, "Storage not initialized", http.StatusForbidden)
 			return
@@ -45,6 +53,9 @@ func UploadCreate(deps *Deps) http.HandlerFunc {
 			Filename string `json:"filename"`
 			Path     string `json:"path"`
 			Size     int64  `json:"size"`
+			// Optional whole-file digests (hex), verified on completion
+			SHA256 string `json:"sha256"`
+			CRC32C string `json:"crc32c"`
 		}
 
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -57,26 +68,39 @@ func UploadCreate(deps *Deps) http.HandlerFunc {
 			return
 		}
 
-		// Check quota
-		if err := partition.CheckQuota(user.StoragePath, user.StorageAllocationGb, req.Size); err != nil {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusRequestEntityTooLarge)
-			json.NewEncoder(w).Encode(map[string]string{
-				"error":   "quota_exceeded",
-				"message": err.Error(),
-			})
+		expected := checksum.Sums{SHA256: req.SHA256, CRC32C: req.CRC32C}
+		if err := expected.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		// Sanitize path
+		loc, err := deps.locate(user, req.Path)
+		if err != nil {
+			writeOpError(w, err)
+			return
+		}
 
+		// Check quota
+		if err := loc.checkQuota(user, req.Size); err != nil {
+			writeOpError(w, err)
+			return
+		}
 
+		// Sanitize path
+		if _, err := uploadTarget(loc); err != nil {
+			writeOpError(w, err)
+			return
+		}
+		if err := loc.authorizeWrite(user); err != nil {
+			writeOpError(w, err)
+			return
+		}
 
 		// Generate session ID
 		sessionID := generateID()
 
 		// Create temp directory for chunks
-		tempDir := filepath.Join(os.TempDir(), "satufile-uploads", sessionID)
+		tempDir := filepath.Join(uploads.TempBase(), sessionID)
 		if err := os.MkdirAll(tempDir, 0755); err != nil {
 			http.Error(w, "Failed to create temp directory", http.StatusInternalServerError)
 			return
@@ -98,6 +122,10 @@ func UploadCreate(deps *Deps) http.HandlerFunc {
 			Status:         "uploading",
 			TempDir:        tempDir,
 			ExpiresAt:      time.Now().Add(SessionExpiry),
+			UserID:         user.ID,
+			Protocol:       uploads.ProtocolChunked,
+			SHA256:         expected.SHA256,
+			CRC32C:         expected.CRC32C,
 		}
 
 		if err := deps.Uploads.CreateSession(session); err != nil {
@@ -156,6 +184,17 @@ func UploadChunk(deps *Deps) http.HandlerFunc {
 			return
 		}
 
+		if session.Protocol == uploads.ProtocolTus {
+			http.Error(w, "Session belongs to the tus endpoint", http.StatusConflict)
+			return
+		}
+
+		temp, err := tempFS(deps, user, session)
+		if err != nil {
+			writeOpError(w, err)
+			return
+		}
+
 		// Write chunk to temp file
 		chunkPath := filepath.Join(session.TempDir, fmt.Sprintf("chunk_%d", chunkIndex))
 
@@ -165,14 +204,29 @@ func UploadChunk(deps *Deps) http.HandlerFunc {
 			chunkAlreadyExists = true
 		}
 
-		chunkFile, err := os.Create(chunkPath)
+		chunkFile, err := temp.Create(chunkPath)
 		if err != nil {
 			http.Error(w, "Failed to create chunk file", http.StatusInternalServerError)
 			return
 		}
-		defer chunkFile.Close()
 
-		written, err := io.Copy(chunkFile, r.Body)
+		// Clients may send the chunk's digests (Content-Digest, or the
+		// SHA-256 as X-Chunk-Hash) so corruption is caught early
+		expected, err := requestDigest(r)
+		if err != nil {
+			os.Remove(chunkPath)
+			writeOpError(w, err)
+			return
+		}
+		if hash := r.Header.Get("X-Chunk-Hash"); hash != "" {
+			expected.SHA256 = strings.ToLower(hash)
+		}
+		hasher := checksum.NewHasher()
+
+		written, err := io.Copy(io.MultiWriter(chunkFile, hasher), r.Body)
+		if cerr := chunkFile.Close(); err == nil {
+			err = cerr
+		}
 		if err != nil {
 			http.Error(w, "Failed to write chunk", http.StatusInternalServerError)
 			return
@@ -195,6 +249,12 @@ func UploadChunk(deps *Deps) http.HandlerFunc {
 			}
 		}
 
+		if err := expected.Verify(hasher.Sums()); err != nil {
+			os.Remove(chunkPath) // Cleanup corrupted chunk
+			writeOpError(w, checksumError(err))
+			return
+		}
+
 		// Update session only if this is a new chunk
 		if !chunkAlreadyExists {
 			session.UploadedChunks++
@@ -209,60 +269,126 @@ func UploadChunk(deps *Deps) http.HandlerFunc {
 				return
 			}
 
-			// Final quota check before assembly
-			if err := partition.CheckQuota(user.StoragePath, user.StorageAllocationGb, session.TotalSize); err != nil {
-				w.Header().Set("Content-Type", "application/json")
-				w.WriteHeader(http.StatusRequestEntityTooLarge)
-				json.NewEncoder(w).Encode(map[string]string{
-					"error":   "quota_exceeded",
-					"message": err.Error(),
-				})
+			parts := make([]string, session.TotalChunks)
+			for i := range parts {
+				parts[i] = fmt.Sprintf("chunk_%d", i)
+			}
+			if err := completeUpload(deps, user, session, parts); err != nil {
+				if session.Status == "failed" {
+					deps.Uploads.UpdateSession(session)
+				}
+				writeOpError(w, err)
 				return
 			}
+		}
 
-			// Assemble file
-			finalPath := filepath.Join(effectiveRoot, filepath.Clean("/"+session.Path))
-			
-			// Verify path safety
-			if !strings.HasPrefix(finalPath, filepath.Clean(effectiveRoot)) {
-				http.Error(w, "Access denied", http.StatusForbidden)
-				return
+		if err := deps.Uploads.UpdateSession(session); err != nil {
+			http.Error(w, "Failed to update session", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(session)
+	}
+}
+
+// UploadChunksPost handles POST /api/uploads/{id}/chunks - the client
+// lists the SHA-256 of every chunk ({"hashes": [...]}, by index) and the
+// server fills in those it already has from the user's deduplicated pool.
+// The response lists the chunk indexes the client still has to send.
+func UploadChunksPost(deps *Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := auth.GetUserFromContext(r.Context())
+		if user == nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if user.StoragePath == "" {
+			http.Error(w, "Storage not initialized", http.StatusForbidden)
+			return
+		}
+
+		if deps.Dedup == nil {
+			http.Error(w, "Deduplication is disabled", http.StatusNotImplemented)
+			return
+		}
+
+		session, err := deps.Uploads.GetSession(mux.Vars(r)["id"])
+		if err != nil || session.UserID != user.ID {
+			http.Error(w, "Session not found", http.StatusNotFound)
+			return
+		}
+
+		if time.Now().After(session.ExpiresAt) {
+			http.Error(w, "Session expired", http.StatusGone)
+			return
+		}
+
+		if session.Protocol == uploads.ProtocolTus || session.Status == "completed" {
+			http.Error(w, "Session does not accept chunks", http.StatusConflict)
+			return
+		}
+
+		var req struct {
+			Hashes []string `json:"hashes"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if len(req.Hashes) != session.TotalChunks {
+			http.Error(w, fmt.Sprintf("Expected %d chunk hashes, got %d", session.TotalChunks, len(req.Hashes)), http.StatusBadRequest)
+			return
+		}
+
+		// The pool holds plaintext, which encrypted partitions cannot use
+		if temp, err := tempFS(deps, user, session); err != nil || temp != vfs.Local {
+			http.Error(w, "Deduplication is not available for this upload", http.StatusNotImplemented)
+			return
+		}
+
+		missing := []int{}
+		for i, sum := range req.Hashes {
+			chunkPath := filepath.Join(session.TempDir, fmt.Sprintf("chunk_%d", i))
+			if _, err := os.Stat(chunkPath); err == nil {
+				continue // already uploaded
 			}
 
-			if err := os.MkdirAll(filepath.Dir(finalPath), 0755); err != nil {
-				http.Error(w, "Failed to create directory", http.StatusInternalServerError)
-				return
+			sum = strings.ToLower(sum)
+			if !dedup.ValidHash(sum) {
+				missing = append(missing, i)
+				continue
 			}
 
-			finalFile, err := os.Create(finalPath)
-			if err != nil {
-				http.Error(w, "Failed to create final file", http.StatusInternalServerError)
-				return
+			expected := session.ChunkSize
+			if i == session.TotalChunks-1 {
+				expected = session.TotalSize - int64(i)*session.ChunkSize
 			}
-			defer finalFile.Close()
-
-			// Assemble chunks in order
-			for i := 0; i < session.TotalChunks; i++ {
-				chunkPath := filepath.Join(session.TempDir, fmt.Sprintf("chunk_%d", i))
-				chunk, err := os.Open(chunkPath)
-				if err != nil {
-					http.Error(w, fmt.Sprintf("Failed to open chunk %d", i), http.StatusInternalServerError)
-					return
-				}
 
-				if _, err := io.Copy(finalFile, chunk); err != nil {
-					chunk.Close()
-					http.Error(w, "Failed to assemble file", http.StatusInternalServerError)
-					return
-				}
-				chunk.Close()
+			size, err := deps.Dedup.CopyChunk(user.ID, user.StoragePath, sum, chunkPath)
+			if err != nil || size != expected {
+				os.Remove(chunkPath)
+				missing = append(missing, i)
+				continue
 			}
 
-			// Update status
-			session.Status = "completed"
+			session.UploadedChunks++
+			session.UploadedSize += size
+		}
 
-			// Cleanup temp directory
-			os.RemoveAll(session.TempDir)
+		if session.UploadedChunks >= session.TotalChunks && session.UploadedSize == session.TotalSize {
+			parts := make([]string, session.TotalChunks)
+			for i := range parts {
+				parts[i] = fmt.Sprintf("chunk_%d", i)
+			}
+			if err := completeUpload(deps, user, session, parts); err != nil {
+				if session.Status == "failed" {
+					deps.Uploads.UpdateSession(session)
+				}
+				writeOpError(w, err)
+				return
+			}
 		}
 
 		if err := deps.Uploads.UpdateSession(session); err != nil {
@@ -271,7 +397,10 @@ func UploadChunk(deps *Deps) http.HandlerFunc {
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(session)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"missing": missing,
+			"session": session,
+		})
 	}
 }
 
@@ -331,6 +460,158 @@ func UploadCancel(deps *Deps) http.HandlerFunc {
 	}
 }
 
+// uploadTarget returns the file an upload to loc writes, refusing the
+// root and reserved folders
+func uploadTarget(loc *location) (string, error) {
+	finalPath := loc.full()
+
+	// Verify path safety
+	if loc.Path == "/" || !strings.HasPrefix(finalPath, filepath.Clean(loc.Root)) {
+		return "", newOpError(http.StatusForbidden, "Access denied")
+	}
+	if files.IsReserved(loc.Path) {
+		return "", newOpError(http.StatusForbidden, "Access denied")
+	}
+	return finalPath, nil
+}
+
+// completeUpload assembles the session's parts (file names inside
+// TempDir, in order) into the target file and marks the session completed,
+// or failed if the file does not match the session's declared digests
+func completeUpload(deps *Deps, user *users.User, session *uploads.Session, parts []string) error {
+	loc, err := deps.locate(user, session.Path)
+	if err != nil {
+		return err
+	}
+
+	// Final quota check before assembly
+	if err := loc.checkQuota(user, session.TotalSize); err != nil {
+		return err
+	}
+
+	// Anonymous uploads never replace what is already there, and count
+	// against the caps of their link
+	if session.ShareToken != "" {
+		loc.Path = relPath(loc.Root, files.AvailableName(loc.FS, loc.full()))
+		session.Path = loc.apiPath(loc.Path)
+		if err := recordShareUpload(deps, session); err != nil {
+			return err
+		}
+	}
+
+	// Assemble file
+	finalPath, err := uploadTarget(loc)
+	if err != nil {
+		return err
+	}
+	// Permissions may have changed since the upload started
+	if err := loc.authorizeWrite(user); err != nil {
+		return err
+	}
+
+	if err := loc.FS.MkdirAll(filepath.Dir(finalPath), 0755); err != nil {
+		return newOpError(http.StatusInternalServerError, "Failed to create directory")
+	}
+
+	// Spaces are not deduplicated; the pool is per user and on local disk
+	var hasher *dedup.Hasher
+	if deps.Dedup != nil && loc.Space == nil && loc.isLocal() {
+		hasher = deps.Dedup.NewHasher()
+	}
+
+	// Assemble parts in order, checking the digests the client declared
+	temp := vfs.Like(loc.FS, vfs.Local)
+	expected := checksum.Sums{SHA256: session.SHA256, CRC32C: session.CRC32C}
+	sums, err := writeVerified(loc.FS, loc.Root, finalPath, expected, func(dst io.Writer) error {
+		if hasher != nil {
+			dst = io.MultiWriter(dst, hasher)
+		}
+		for i, name := range parts {
+			part, err := temp.Open(filepath.Join(session.TempDir, name))
+			if err != nil {
+				return newOpError(http.StatusInternalServerError, fmt.Sprintf("Failed to open chunk %d", i))
+			}
+
+			_, err = io.Copy(dst, part)
+			part.Close()
+			if partition.IsFull(err) {
+				return errQuotaExceeded
+			}
+			if err != nil {
+				return newOpError(http.StatusInternalServerError, "Failed to assemble file")
+			}
+		}
+		return nil
+	}, deps.keepVersion(user, loc, finalPath))
+	if isChecksumMismatch(err) {
+		// The received bytes are wrong; the client has to start over
+		session.Status = "failed"
+		os.RemoveAll(session.TempDir)
+		return err
+	}
+	if err != nil {
+		var oe *opError
+		if errors.As(err, &oe) {
+			return err
+		}
+		if partition.IsFull(err) {
+			return errQuotaExceeded
+		}
+		return newOpError(http.StatusInternalServerError, "Failed to assemble file")
+	}
+
+	// Store identical content once; the upload is valid either way
+	if hasher != nil {
+		if _, err := deps.Dedup.Add(user.ID, user.StoragePath, finalPath, hasher); err != nil {
+			log.Printf("Dedup: failed to pool %s: %v", session.Path, err)
+		}
+	}
+
+	if loc.isLocal() {
+		if err := checksum.Save(storage.GetDB(), finalPath, sums); err != nil {
+			log.Printf("Checksum: failed to record %s: %v", session.Path, err)
+		}
+	}
+	deps.changed(loc, finalPath)
+
+	// Update status
+	session.Status = "completed"
+
+	// Cleanup temp directory
+	os.RemoveAll(session.TempDir)
+
+	deps.publish(user.ID, TopicUploads, "UPLOAD_COMPLETE", map[string]interface{}{
+		"id":   session.ID,
+		"path": session.Path,
+		"size": session.TotalSize,
+	})
+	if session.ShareToken != "" {
+		deps.publish(user.ID, TopicShares, "SHARE_UPLOAD", map[string]interface{}{
+			"token": session.ShareToken,
+			"path":  session.Path,
+			"name":  filepath.Base(session.Path),
+			"size":  session.TotalSize,
+		})
+	}
+	return nil
+}
+
+// tempFS returns the filesystem the temp files of an upload are written
+// through: the local disk with the layers of the target partition on top,
+// so the chunks of an upload to an encrypted partition are encrypted too
+func tempFS(deps *Deps, user *users.User, session *uploads.Session) (vfs.FS, error) {
+	loc, err := deps.locate(user, session.Path)
+	if err != nil {
+		return nil, err
+	}
+	// A partition that cannot be opened, such as an encrypted one without
+	// the master key, must not receive plaintext chunks
+	if _, err := loc.FS.Stat(loc.Root); err != nil {
+		return nil, newOpError(http.StatusServiceUnavailable, "Storage is unavailable")
+	}
+	return vfs.Like(loc.FS, vfs.Local), nil
+}
+
 // generateID generates a random session ID
 func generateID() string {
 	b := make([]byte, 16)
@@ -38,7 +38,7 @@ func UserStorageGet(deps *Deps) http.HandlerFunc {
 		}
 
 		// Calculate actual storage usage
-		usedGb, err := partition.CalculateStorageUsage(user.StoragePath)
+		usedGb, err := partition.CalculateStorageUsage(user.FS(), user.StoragePath)
 		if err != nil {
 			// If we can't calculate usage, return allocated info without usage
 			usedGb = 0
@@ -0,0 +1,255 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/satufile/satufile/auth"
+	"github.com/satufile/satufile/files"
+	"github.com/satufile/satufile/users"
+	"github.com/satufile/satufile/versions"
+)
+
+// versionsUser returns the authenticated user if versions are available,
+// writing the error response otherwise
+func versionsUser(deps *Deps, w http.ResponseWriter, r *http.Request) *users.User {
+	user := auth.GetUserFromContext(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil
+	}
+
+	if user.StoragePath == "" {
+		http.Error(w, "Storage not initialized", http.StatusForbidden)
+		return nil
+	}
+
+	if deps.Versions == nil {
+		http.Error(w, "Versioning is disabled", http.StatusNotFound)
+		return nil
+	}
+	return user
+}
+
+// versionedPath validates the ?path= of a file whose versions are requested
+func versionedPath(r *http.Request) (string, error) {
+	raw := r.URL.Query().Get("path")
+	if raw == "" {
+		return "", newOpError(http.StatusBadRequest, "path is required")
+	}
+	path := filepath.Clean("/" + raw)
+	if path == "/" || files.IsReserved(path) {
+		return "", newOpError(http.StatusForbidden, "Access denied")
+	}
+	return path, nil
+}
+
+// userVersion loads the version named by {id}, writing the error response
+// if it does not exist
+func userVersion(deps *Deps, user *users.User, w http.ResponseWriter, r *http.Request) *versions.Version {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return nil
+	}
+
+	v, err := deps.Versions.Get(user.ID, uint(id))
+	if errors.Is(err, versions.ErrNotFound) {
+		http.Error(w, "Version not found", http.StatusNotFound)
+		return nil
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return nil
+	}
+	return v
+}
+
+// VersionsGet handles GET /api/versions?path= - lists the previous
+// versions of a file, newest first
+func VersionsGet(deps *Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := versionsUser(deps, w, r)
+		if user == nil {
+			return
+		}
+
+		path, err := versionedPath(r)
+		if err != nil {
+			writeOpError(w, err)
+			return
+		}
+
+		list, err := deps.Versions.List(user.ID, path)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	}
+}
+
+// VersionsDelete handles DELETE /api/versions?path=&keep=&before= -
+// removes the versions of a file beyond the newest keep and those replaced
+// before the RFC 3339 time before. Without either, all versions go.
+func VersionsDelete(deps *Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := versionsUser(deps, w, r)
+		if user == nil {
+			return
+		}
+
+		path, err := versionedPath(r)
+		if err != nil {
+			writeOpError(w, err)
+			return
+		}
+
+		if err := authorize(user, permDelete); err != nil {
+			writeOpError(w, err)
+			return
+		}
+
+		q := r.URL.Query()
+		keep := -1
+		if s := q.Get("keep"); s != "" {
+			keep, err = strconv.Atoi(s)
+			if err != nil || keep < 0 {
+				http.Error(w, "Invalid keep", http.StatusBadRequest)
+				return
+			}
+		}
+		var before time.Time
+		if s := q.Get("before"); s != "" {
+			before, err = time.Parse(time.RFC3339, s)
+			if err != nil {
+				http.Error(w, "Invalid before, must be RFC 3339", http.StatusBadRequest)
+				return
+			}
+		}
+		if keep < 0 && before.IsZero() {
+			keep = 0
+		}
+
+		removed, err := deps.Versions.DeleteOlder(user, path, keep, before)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"removed": removed})
+	}
+}
+
+// VersionRawGet handles GET /api/versions/{id}/raw - downloads a version
+func VersionRawGet(deps *Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := versionsUser(deps, w, r)
+		if user == nil {
+			return
+		}
+
+		v := userVersion(deps, user, w, r)
+		if v == nil {
+			return
+		}
+
+		if err := authorize(user, permDownload); err != nil {
+			writeOpError(w, err)
+			return
+		}
+
+		file, err := os.Open(versions.BlobPath(user.Root(), v.ID))
+		if err != nil {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		defer file.Close()
+
+		w.Header().Set("Content-Disposition", contentDisposition("attachment", filepath.Base(v.Path)))
+		w.Header().Set("Content-Type", getContentType(v.Path))
+		w.Header().Set("Cache-Control", "private, max-age=86400") // versions never change
+		http.ServeContent(w, r, "", v.ModTime, file)
+	}
+}
+
+// VersionRestore handles POST /api/versions/{id}/restore - replaces the
+// file with the version; the replaced content becomes a version itself
+func VersionRestore(deps *Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := versionsUser(deps, w, r)
+		if user == nil {
+			return
+		}
+
+		v := userVersion(deps, user, w, r)
+		if v == nil {
+			return
+		}
+
+		if err := authorize(user, permModify); err != nil {
+			writeOpError(w, err)
+			return
+		}
+
+		if files.IsReserved(v.Path) {
+			http.Error(w, "The file is in the trash, restore it first", http.StatusConflict)
+			return
+		}
+		if info, err := os.Stat(filepath.Join(user.Root(), v.Path)); err == nil && info.IsDir() {
+			http.Error(w, "A folder now exists at "+v.Path, http.StatusConflict)
+			return
+		}
+
+		if _, err := deps.Versions.Restore(user, v.ID); err != nil {
+			http.Error(w, "Failed to restore version: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		deps.changed(home(user), filepath.Join(user.Root(), v.Path))
+
+		info, err := files.NewFileInfo(user.FS(), user.Root(), v.Path)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(info)
+	}
+}
+
+// VersionDelete handles DELETE /api/versions/{id}
+func VersionDelete(deps *Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := versionsUser(deps, w, r)
+		if user == nil {
+			return
+		}
+
+		v := userVersion(deps, user, w, r)
+		if v == nil {
+			return
+		}
+
+		if err := authorize(user, permDelete); err != nil {
+			writeOpError(w, err)
+			return
+		}
+
+		if err := deps.Versions.Delete(user, v.ID); err != nil && !errors.Is(err, versions.ErrNotFound) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
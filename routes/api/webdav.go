@@ -0,0 +1,822 @@
+package api
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/satufile/satufile/auth"
+	"github.com/satufile/satufile/checksum"
+	"github.com/satufile/satufile/files"
+	"github.com/satufile/satufile/storage"
+	"github.com/satufile/satufile/system/partition"
+	"github.com/satufile/satufile/trash"
+	"github.com/satufile/satufile/users"
+	"github.com/satufile/satufile/versions"
+	"github.com/satufile/satufile/vfs"
+	"github.com/satufile/satufile/webdav"
+)
+
+// davAllow lists the methods supported by the WebDAV endpoint
+const davAllow = "OPTIONS, GET, HEAD, PUT, DELETE, MKCOL, COPY, MOVE, PROPFIND, PROPPATCH, LOCK, UNLOCK"
+
+// davSupportedLock is the static value of the supportedlock property
+const davSupportedLock = "<D:lockentry><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockentry>" +
+	"<D:lockentry><D:lockscope><D:shared/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockentry>"
+
+// davMicrosoftNS is the namespace of the Win32 timestamp properties that
+// Windows clients PROPPATCH after every upload
+const davMicrosoftNS = "urn:schemas-microsoft-com:"
+
+// errDavFull stops a PUT whose body does not fit in the user's quota
+var errDavFull = errors.New("storage quota exceeded")
+
+// davRequest carries per-request state for the WebDAV handler
+type davRequest struct {
+	deps   *Deps
+	locks  *webdav.LockSystem
+	user   *users.User
+	fs     vfs.FS // the user's partition, through any layers
+	root   string
+	prefix string
+}
+
+// WebDAV handles every method below prefix (e.g. /dav), serving the
+// authenticated user's root as a WebDAV collection
+func WebDAV(deps *Deps, prefix string) http.HandlerFunc {
+	locks := webdav.NewLockSystem()
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := auth.GetUserFromContext(r.Context())
+		if user == nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		// Use user's storage path if set, otherwise reject
+		effectiveRoot := user.Root()
+		if effectiveRoot == "" {
+			http.Error(w, "Storage not initialized", http.StatusForbidden)
+			return
+		}
+		// WebDAV works on the local disk, encrypted or not; remote
+		// partitions are served by the API only
+		fsys := user.FS()
+		if !vfs.IsLocal(vfs.Base(fsys)) {
+			http.Error(w, "WebDAV is not available for remote storage", http.StatusNotImplemented)
+			return
+		}
+
+		if r.URL.Path != prefix && !strings.HasPrefix(r.URL.Path, prefix+"/") {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		path := filepath.Clean("/" + strings.TrimPrefix(r.URL.Path, prefix))
+
+		d := &davRequest{
+			deps:   deps,
+			locks:  locks,
+			user:   user,
+			fs:     fsys,
+			root:   filepath.Clean(effectiveRoot),
+			prefix: prefix,
+		}
+
+		switch r.Method {
+		case "OPTIONS":
+			d.options(w, r)
+		case "GET", "HEAD":
+			d.get(w, r, path)
+		case "PUT":
+			d.put(w, r, path)
+		case "DELETE":
+			d.delete(w, r, path)
+		case "MKCOL":
+			d.mkcol(w, r, path)
+		case "COPY", "MOVE":
+			d.copyMove(w, r, path)
+		case "PROPFIND":
+			d.propfind(w, r, path)
+		case "PROPPATCH":
+			d.proppatch(w, r, path)
+		case "LOCK":
+			d.lock(w, r, path)
+		case "UNLOCK":
+			d.unlock(w, r, path)
+		default:
+			w.Header().Set("Allow", davAllow)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// resolve maps a client path onto the partition, rejecting anything that
+// escapes the root or reaches into a reserved folder such as .trash
+func (d *davRequest) resolve(path string) (string, bool) {
+	fullPath := filepath.Join(d.root, path)
+	if fullPath != d.root && !strings.HasPrefix(fullPath, d.root+string(os.PathSeparator)) {
+		return "", false
+	}
+	if files.IsReserved(path) {
+		return "", false
+	}
+	return fullPath, true
+}
+
+// at returns the location of path below the user's root; WebDAV serves
+// the user's own files only, without shared spaces
+func (d *davRequest) at(path string) *location {
+	loc := home(d.user)
+	loc.Path = path
+	return loc
+}
+
+// isDir reports whether fullPath is an existing collection
+func (d *davRequest) isDir(fullPath string) bool {
+	info, err := d.fs.Stat(fullPath)
+	return err == nil && info.IsDir()
+}
+
+// confirmLocks writes 423 Locked if any of the resources is locked by a
+// token the client did not submit
+func (d *davRequest) confirmLocks(w http.ResponseWriter, r *http.Request, fullPaths ...string) bool {
+	tokens := webdav.IfTokens(r)
+	for _, p := range fullPaths {
+		if err := d.locks.Confirm(p, tokens); err != nil {
+			webdav.WriteError(w, http.StatusLocked, "lock-token-submitted")
+			return false
+		}
+	}
+	return true
+}
+
+func (d *davRequest) options(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Allow", davAllow)
+	w.Header().Set("DAV", "1, 2")
+	w.Header().Set("MS-Author-Via", "DAV")
+	w.WriteHeader(http.StatusOK)
+}
+
+func (d *davRequest) get(w http.ResponseWriter, r *http.Request, path string) {
+	fullPath, ok := d.resolve(path)
+	if !ok {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	if err := authorize(d.user, permDownload); err != nil {
+		writeOpError(w, err)
+		return
+	}
+
+	file, err := d.fs.Open(fullPath)
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if info.IsDir() {
+		w.Header().Set("Allow", "OPTIONS, PROPFIND, MKCOL, COPY, MOVE, DELETE, LOCK, UNLOCK")
+		http.Error(w, "Cannot download directory", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// ServeContent handles Range, If-Match and If-Modified-Since for us
+	w.Header().Set("Content-Type", getContentType(fullPath))
+	w.Header().Set("ETag", davETag(info))
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+}
+
+func (d *davRequest) put(w http.ResponseWriter, r *http.Request, path string) {
+	fullPath, ok := d.resolve(path)
+	if !ok {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	if path == "/" || IsCoreFolder(path) {
+		http.Error(w, "Cannot overwrite protected folder", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := d.at(path).authorizeWrite(d.user); err != nil {
+		writeOpError(w, err)
+		return
+	}
+
+	if !d.confirmLocks(w, r, fullPath) {
+		return
+	}
+
+	existing, err := d.fs.Stat(fullPath)
+	if err == nil && existing.IsDir() {
+		http.Error(w, "Cannot overwrite a collection", http.StatusMethodNotAllowed)
+		return
+	}
+	created := err != nil
+
+	if !d.isDir(filepath.Dir(fullPath)) {
+		http.Error(w, "Parent collection does not exist", http.StatusConflict)
+		return
+	}
+
+	// Chunked bodies do not announce their size, so the quota is also
+	// enforced while the body is copied
+	avail, err := partition.Available(d.fs, d.user.StoragePath, d.user.StorageAllocationGb)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if r.ContentLength > avail {
+		http.Error(w, errDavFull.Error(), http.StatusInsufficientStorage)
+		return
+	}
+
+	expected, err := requestDigest(r)
+	if err != nil {
+		writeOpError(w, err)
+		return
+	}
+
+	sums, err := writeVerified(d.fs, d.root, fullPath, expected, func(dst io.Writer) error {
+		n, err := io.Copy(dst, io.LimitReader(r.Body, avail+1))
+		if err == nil && n > avail {
+			return errDavFull
+		}
+		return err
+	}, d.deps.keepVersion(d.user, home(d.user), fullPath))
+	if errors.Is(err, errDavFull) || partition.IsFull(err) {
+		http.Error(w, errDavFull.Error(), http.StatusInsufficientStorage)
+		return
+	}
+	if err != nil {
+		writeOpError(w, err)
+		return
+	}
+	if vfs.IsLocal(d.fs) {
+		if err := checksum.Save(storage.GetDB(), fullPath, sums); err != nil {
+			log.Printf("Checksum: failed to record %s: %v", path, err)
+		}
+	}
+	d.deps.changed(home(d.user), fullPath)
+
+	if info, err := d.fs.Stat(fullPath); err == nil {
+		w.Header().Set("ETag", davETag(info))
+	}
+	if created {
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (d *davRequest) delete(w http.ResponseWriter, r *http.Request, path string) {
+	fullPath, ok := d.resolve(path)
+	if !ok {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	if path == "/" {
+		http.Error(w, "Cannot delete root", http.StatusForbidden)
+		return
+	}
+
+	// Check if trying to delete a core folder
+	if IsCoreFolder(path) {
+		http.Error(w, "Cannot delete protected folder", http.StatusForbidden)
+		return
+	}
+
+	if err := authorize(d.user, permDelete); err != nil {
+		writeOpError(w, err)
+		return
+	}
+
+	info, err := files.NewFileInfo(d.fs, d.root, path)
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	if !d.confirmLocks(w, r, fullPath) {
+		return
+	}
+
+	// Soft delete, same as the JSON API
+	if _, err := moveToTrash(d.user, d.at(path), info); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	d.locks.Release(fullPath)
+	d.deps.changed(home(d.user), fullPath)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (d *davRequest) mkcol(w http.ResponseWriter, r *http.Request, path string) {
+	fullPath, ok := d.resolve(path)
+	if !ok {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	if r.ContentLength > 0 {
+		http.Error(w, "MKCOL request bodies are not supported", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	if err := authorize(d.user, permCreate); err != nil {
+		writeOpError(w, err)
+		return
+	}
+
+	if _, err := d.fs.Stat(fullPath); err == nil {
+		http.Error(w, "Resource already exists", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !d.confirmLocks(w, r, fullPath) {
+		return
+	}
+
+	if !d.isDir(filepath.Dir(fullPath)) {
+		http.Error(w, "Parent collection does not exist", http.StatusConflict)
+		return
+	}
+	if err := d.fs.MkdirAll(fullPath, 0755); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	d.deps.changed(home(d.user), fullPath)
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (d *davRequest) copyMove(w http.ResponseWriter, r *http.Request, path string) {
+	isMove := r.Method == "MOVE"
+
+	srcPath, ok := d.resolve(path)
+	if !ok {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	srcInfo, err := d.fs.Stat(srcPath)
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	dest, err := webdav.ParseDestination(r, d.prefix)
+	if err != nil {
+		http.Error(w, "Invalid destination: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	dest = filepath.Clean(dest)
+
+	dstPath, ok := d.resolve(dest)
+	if !ok {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	if srcPath == dstPath || strings.HasPrefix(dstPath, srcPath+string(os.PathSeparator)) {
+		http.Error(w, "Destination must not be the source or inside it", http.StatusForbidden)
+		return
+	}
+
+	if path == "/" || dest == "/" || IsCoreFolder(dest) || (isMove && IsCoreFolder(path)) {
+		http.Error(w, "Cannot move or overwrite protected folder", http.StatusForbidden)
+		return
+	}
+
+	depth, err := webdav.ParseDepth(r, webdav.DepthInfinity)
+	if err != nil || depth == webdav.DepthOne || (isMove && depth != webdav.DepthInfinity) {
+		http.Error(w, "Invalid Depth header", http.StatusBadRequest)
+		return
+	}
+
+	if !d.isDir(filepath.Dir(dstPath)) {
+		http.Error(w, "Destination collection does not exist", http.StatusConflict)
+		return
+	}
+
+	// Same permissions as a copy or move through the JSON API
+	perm := permCreate
+	if isMove {
+		perm = permRename
+	}
+	perms := []permission{perm}
+	if _, err := d.fs.Stat(dstPath); err == nil {
+		perms = append(perms, permModify)
+	}
+	if err := authorize(d.user, perms...); err != nil {
+		writeOpError(w, err)
+		return
+	}
+
+	lockedPaths := []string{dstPath}
+	if isMove {
+		lockedPaths = append(lockedPaths, srcPath)
+	}
+	if !d.confirmLocks(w, r, lockedPaths...) {
+		return
+	}
+
+	if !isMove {
+		size := srcInfo.Size()
+		if srcInfo.IsDir() {
+			size = getDirSize(d.fs, srcPath)
+		}
+		if err := partition.CheckQuota(d.fs, d.user.StoragePath, d.user.StorageAllocationGb, size); err != nil {
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
+			return
+		}
+	}
+
+	_, err = d.fs.Stat(dstPath)
+	overwritten := err == nil
+	var replaced *trash.TrashItem
+	if overwritten {
+		if !webdav.ParseOverwrite(r) {
+			http.Error(w, "Destination exists", http.StatusPreconditionFailed)
+			return
+		}
+
+		// The replaced resource goes to the trash rather than being lost,
+		// and comes back from there if the copy or move fails
+		dstInfo, err := files.NewFileInfo(d.fs, d.root, dest)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if replaced, err = moveToTrash(d.user, d.at(dest), dstInfo); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	switch {
+	case isMove:
+		err = d.fs.Rename(srcPath, dstPath)
+	case srcInfo.IsDir() && depth == webdav.DepthZero:
+		err = d.fs.MkdirAll(dstPath, srcInfo.Mode().Perm())
+	default:
+		err = files.Copy(d.fs, srcPath, d.fs, dstPath)
+	}
+	if err != nil {
+		if replaced != nil {
+			d.untrash(dstPath, replaced)
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if overwritten {
+		d.locks.Release(dstPath)
+	}
+	if isMove {
+		d.locks.Release(srcPath)
+		if err := versions.Relocate(storage.GetDB(), d.user.ID, relPath(d.root, srcPath), relPath(d.root, dstPath)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	d.deps.changed(home(d.user), srcPath, dstPath)
+
+	if overwritten {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// untrash puts back a resource moved to the trash to make way for a COPY
+// or MOVE that then failed, dropping whatever the copy left behind
+func (d *davRequest) untrash(dstPath string, item *trash.TrashItem) {
+	d.fs.RemoveAll(dstPath)
+	err := d.fs.Rename(filepath.Join(d.root, trash.ItemPath(item.ID)), dstPath)
+	if err == nil {
+		db := storage.GetDB()
+		if err = versions.Relocate(db, d.user.ID, trash.ItemPath(item.ID), item.OriginalPath); err == nil {
+			err = db.Delete(item).Error
+		}
+	}
+	if err != nil {
+		log.Printf("WebDAV: failed to put back %s: %v", item.OriginalPath, err)
+	}
+}
+
+func (d *davRequest) propfind(w http.ResponseWriter, r *http.Request, path string) {
+	fullPath, ok := d.resolve(path)
+	if !ok {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	info, err := d.fs.Stat(fullPath)
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	// A missing Depth means infinity, which would walk the whole tree in
+	// one request; RFC 4918 lets servers refuse it
+	depth, err := webdav.ParseDepth(r, webdav.DepthInfinity)
+	if err != nil {
+		http.Error(w, "Invalid Depth header", http.StatusBadRequest)
+		return
+	}
+	if depth == webdav.DepthInfinity {
+		webdav.WriteError(w, http.StatusForbidden, "propfind-finite-depth")
+		return
+	}
+
+	pf, err := webdav.ParsePropFind(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid PROPFIND body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ms := webdav.NewMultiStatus()
+	props := &davProps{d: d}
+	ms.Add(props.response(pf, path, fullPath, info))
+
+	if info.IsDir() && depth == webdav.DepthOne {
+		entries, err := d.fs.ReadDir(fullPath)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, entry := range entries {
+			itemPath := filepath.ToSlash(filepath.Join(path, entry.Name()))
+			if files.IsReserved(itemPath) {
+				continue
+			}
+			fi, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			ms.Add(props.response(pf, itemPath, filepath.Join(fullPath, entry.Name()), fi))
+		}
+	}
+
+	ms.WriteTo(w)
+}
+
+func (d *davRequest) proppatch(w http.ResponseWriter, r *http.Request, path string) {
+	fullPath, ok := d.resolve(path)
+	if !ok {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	if _, err := d.fs.Stat(fullPath); err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	if !d.confirmLocks(w, r, fullPath) {
+		return
+	}
+
+	names, err := webdav.ParsePropPatch(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid PROPPATCH body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Dead properties are not stored. Win32 timestamps are acknowledged so
+	// Windows does not report a failed upload; everything else is refused.
+	resp := webdav.Response{
+		Href:      webdav.Href(d.prefix, path, false),
+		Propstats: map[int][]webdav.Property{},
+	}
+	for _, name := range names {
+		status := http.StatusForbidden
+		if name.Space == davMicrosoftNS {
+			status = http.StatusOK
+		}
+		resp.Propstats[status] = append(resp.Propstats[status], webdav.Property{Name: name})
+	}
+
+	ms := webdav.NewMultiStatus()
+	ms.Add(resp)
+	ms.WriteTo(w)
+}
+
+func (d *davRequest) lock(w http.ResponseWriter, r *http.Request, path string) {
+	fullPath, ok := d.resolve(path)
+	if !ok {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	li, err := webdav.ParseLockInfo(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid LOCK body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	timeout := webdav.ParseTimeout(r)
+
+	// An empty body refreshes the lock named in the If header
+	if li == nil {
+		tokens := webdav.IfTokens(r)
+		if len(tokens) != 1 {
+			http.Error(w, "Lock refresh requires exactly one lock token", http.StatusBadRequest)
+			return
+		}
+		lock, err := d.locks.Refresh(fullPath, tokens[0], timeout)
+		if err != nil {
+			webdav.WriteError(w, http.StatusPreconditionFailed, "lock-token-matches-request-uri")
+			return
+		}
+		webdav.WriteLockResponse(w, lock, http.StatusOK)
+		return
+	}
+
+	depth, err := webdav.ParseDepth(r, webdav.DepthInfinity)
+	if err != nil || depth == webdav.DepthOne {
+		http.Error(w, "Invalid Depth header", http.StatusBadRequest)
+		return
+	}
+
+	info, statErr := d.fs.Stat(fullPath)
+	if statErr != nil {
+		if err := authorize(d.user, permCreate); err != nil {
+			writeOpError(w, err)
+			return
+		}
+	}
+	lock, err := d.locks.Create(fullPath, webdav.Href(d.prefix, path, statErr == nil && info.IsDir()), li.Owner, depth == webdav.DepthInfinity, li.Exclusive, timeout)
+	if err != nil {
+		webdav.WriteError(w, http.StatusLocked, "no-conflicting-lock")
+		return
+	}
+
+	// Locking an unmapped URL creates an empty resource (RFC 4918 7.3)
+	status := http.StatusOK
+	if statErr != nil {
+		if !d.isDir(filepath.Dir(fullPath)) {
+			d.locks.Unlock(fullPath, lock.Token)
+			http.Error(w, "Parent collection does not exist", http.StatusConflict)
+			return
+		}
+		if err := vfs.WriteFile(d.fs, fullPath, nil); err != nil {
+			d.locks.Unlock(fullPath, lock.Token)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		status = http.StatusCreated
+	}
+
+	webdav.WriteLockResponse(w, lock, status)
+}
+
+func (d *davRequest) unlock(w http.ResponseWriter, r *http.Request, path string) {
+	fullPath, ok := d.resolve(path)
+	if !ok {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	token := webdav.ParseLockToken(r)
+	if token == "" {
+		http.Error(w, "Missing Lock-Token header", http.StatusBadRequest)
+		return
+	}
+
+	if err := d.locks.Unlock(fullPath, token); err != nil {
+		if errors.Is(err, webdav.ErrNoSuchLock) || errors.Is(err, webdav.ErrLockNotOwned) {
+			webdav.WriteError(w, http.StatusConflict, "lock-token-matches-request-uri")
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// davProps computes live properties for PROPFIND responses
+type davProps struct {
+	d *davRequest
+	// usedBytes caches the partition usage for quota properties
+	usedBytes int64
+	usedKnown bool
+}
+
+// davLiveProps are reported for allprop and propname requests
+var davLiveProps = []string{
+	"resourcetype", "displayname", "getlastmodified", "creationdate",
+	"getcontentlength", "getcontenttype", "getetag", "supportedlock", "lockdiscovery",
+}
+
+// value returns the XML value of a property, or false if it is unknown
+func (p *davProps) value(name xml.Name, fullPath string, info os.FileInfo) (string, bool) {
+	if name.Space != webdav.NS {
+		return "", false
+	}
+
+	switch name.Local {
+	case "resourcetype":
+		if info.IsDir() {
+			return "<D:collection/>", true
+		}
+		return "", true
+	case "displayname":
+		return webdav.Escape(info.Name()), true
+	case "getlastmodified":
+		return info.ModTime().UTC().Format(http.TimeFormat), true
+	case "creationdate":
+		return info.ModTime().UTC().Format(time.RFC3339), true
+	case "getcontentlength":
+		if info.IsDir() {
+			return "", false
+		}
+		return fmt.Sprintf("%d", info.Size()), true
+	case "getcontenttype":
+		if info.IsDir() {
+			return "", false
+		}
+		return webdav.Escape(getContentType(fullPath)), true
+	case "getetag":
+		if info.IsDir() {
+			return "", false
+		}
+		return webdav.Escape(davETag(info)), true
+	case "supportedlock":
+		return davSupportedLock, true
+	case "lockdiscovery":
+		var b strings.Builder
+		for _, l := range p.d.locks.Discover(fullPath) {
+			b.WriteString(webdav.ActiveLockXML(l))
+		}
+		return b.String(), true
+	case "quota-used-bytes", "quota-available-bytes":
+		if !p.usedKnown {
+			p.usedBytes = getDirSize(p.d.fs, p.d.user.StoragePath)
+			p.usedKnown = true
+		}
+		if name.Local == "quota-used-bytes" {
+			return fmt.Sprintf("%d", p.usedBytes), true
+		}
+		available := int64(p.d.user.StorageAllocationGb)*1024*1024*1024 - p.usedBytes
+		if available < 0 {
+			available = 0
+		}
+		return fmt.Sprintf("%d", available), true
+	}
+	return "", false
+}
+
+// response builds the multistatus entry for one resource
+func (p *davProps) response(pf *webdav.PropFind, path, fullPath string, info os.FileInfo) webdav.Response {
+	resp := webdav.Response{
+		Href:      webdav.Href(p.d.prefix, path, info.IsDir()),
+		Propstats: map[int][]webdav.Property{},
+	}
+
+	names := pf.Props
+	if pf.AllProp || pf.PropName {
+		names = nil
+		for _, local := range davLiveProps {
+			names = append(names, xml.Name{Space: webdav.NS, Local: local})
+		}
+	}
+
+	for _, name := range names {
+		value, ok := p.value(name, fullPath, info)
+		switch {
+		case !ok && (pf.AllProp || pf.PropName):
+			// Not applicable to this resource type
+		case !ok:
+			resp.Propstats[http.StatusNotFound] = append(resp.Propstats[http.StatusNotFound], webdav.Property{Name: name})
+		case pf.PropName:
+			resp.Propstats[http.StatusOK] = append(resp.Propstats[http.StatusOK], webdav.Property{Name: name})
+		default:
+			resp.Propstats[http.StatusOK] = append(resp.Propstats[http.StatusOK], webdav.Property{Name: name, Value: value})
+		}
+	}
+
+	return resp
+}
+
+// davETag derives an entity tag from modification time and size
+func davETag(info os.FileInfo) string {
+	return fmt.Sprintf(`"%x%x"`, info.ModTime().UnixNano(), info.Size())
+}
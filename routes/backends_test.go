@@ -0,0 +1,126 @@
+package routes
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/satufile/satufile/files"
+	"github.com/satufile/satufile/trash"
+	"github.com/satufile/satufile/vfs"
+	"github.com/satufile/satufile/vfs/s3test"
+)
+
+func TestRemoteBackend(t *testing.T) {
+	env := setupTestEnv(t)
+	server := s3test.NewServer("drive")
+	defer server.Close()
+	fsys, err := vfs.NewS3(vfs.S3Config{Endpoint: server.URL, Bucket: "drive", Prefix: "partitions", AccessKey: s3test.AccessKey, SecretKey: s3test.SecretKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vfs.Register("remote", fsys)
+
+	// The partition lives on the backend only
+	user, token := env.createReadyUser(t, "erin")
+	user.Backend = "remote"
+	user.StoragePath = "/erin"
+	env.DB.Model(user).Updates(map[string]interface{}{"backend": user.Backend, "storage_path": user.StoragePath})
+	if err := fsys.MkdirAll("/erin/Documents", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(method, path string, body []byte, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		env.Router.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := do("POST", "/api/resources/Documents/notes.txt", []byte("remote marmalade"), nil); w.Code != http.StatusCreated {
+		t.Fatalf("Upload failed: %d %s", w.Code, w.Body.String())
+	}
+	if data, err := vfs.ReadFile(fsys, "/erin/Documents/notes.txt"); err != nil || string(data) != "remote marmalade" {
+		t.Fatalf("Expected the file on the backend, got %q %v", data, err)
+	}
+
+	// Resumable uploads are assembled on the backend as well
+	data := []byte("hello tus world")
+	w := env.tusRequest(token, "POST", "/api/tus", data, map[string]string{
+		"Upload-Length":   strconv.Itoa(len(data)),
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("tus.txt")) + ",path " + base64.StdEncoding.EncodeToString([]byte("/Documents")),
+		"Content-Type":    "application/offset+octet-stream",
+	})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("tus upload failed: %d %s", w.Code, w.Body.String())
+	}
+	if got, err := vfs.ReadFile(fsys, "/erin/Documents/tus.txt"); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Expected the tus upload on the backend, got %q %v", got, err)
+	}
+
+	w = do("GET", "/api/resources/Documents", nil, nil)
+	var listing files.Listing
+	json.NewDecoder(w.Body).Decode(&listing)
+	if w.Code != http.StatusOK || len(listing.Items) != 2 || listing.Items[0].Name != "notes.txt" || listing.Items[0].Size != 16 {
+		t.Fatalf("Unexpected listing: %d %s", w.Code, w.Body.String())
+	}
+
+	w = do("GET", "/api/raw/Documents/notes.txt", nil, map[string]string{"Range": "bytes=7-"})
+	if w.Code != http.StatusPartialContent || w.Body.String() != "marmalade" {
+		t.Errorf("Expected a ranged read from the backend, got %d %q", w.Code, w.Body.String())
+	}
+
+	w = do("PATCH", "/api/resources/Documents/notes.txt", []byte(`{"newName":"jam.txt"}`), nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Rename failed: %d %s", w.Code, w.Body.String())
+	}
+	w = do("GET", "/api/search?q=jam", nil, nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "/Documents/jam.txt") {
+		t.Errorf("Expected the renamed file to be found, got %d %s", w.Code, w.Body.String())
+	}
+
+	// Deleting moves the file to the trash on the backend, and restoring
+	// brings it back
+	if w := do("DELETE", "/api/resources/Documents/jam.txt", nil, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("Delete failed: %d %s", w.Code, w.Body.String())
+	}
+	var item trash.TrashItem
+	if err := env.DB.Where("user_id = ?", user.ID).First(&item).Error; err != nil {
+		t.Fatal(err)
+	}
+	id := strconv.FormatUint(uint64(item.ID), 10)
+	if _, err := fsys.Stat("/erin/.trash/" + id); err != nil {
+		t.Errorf("Expected the item in the backend's trash: %v", err)
+	}
+	if w := do("POST", "/api/trash/"+id+"/restore", nil, nil); w.Code != http.StatusOK {
+		t.Fatalf("Restore failed: %d %s", w.Code, w.Body.String())
+	}
+	if _, err := fsys.Stat("/erin/Documents/jam.txt"); err != nil {
+		t.Errorf("Expected the restored file: %v", err)
+	}
+
+	for _, key := range server.Keys("drive") {
+		if !strings.HasPrefix(key, "partitions/erin/") {
+			t.Errorf("Object %s outside the partition", key)
+		}
+	}
+}
+
+func TestUnknownBackend(t *testing.T) {
+	env := setupTestEnv(t)
+	user, token := env.createReadyUser(t, "frank")
+	env.DB.Model(user).Update("backend", "missing")
+
+	if w := env.requestAs(token, "GET", "/api/resources/"); w.Code == http.StatusOK {
+		t.Errorf("Expected a partition on an unknown backend to be unavailable, got %d", w.Code)
+	}
+}
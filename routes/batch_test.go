@@ -0,0 +1,143 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/satufile/satufile/routes/api"
+)
+
+// batchJob is api.BatchJob as clients decode it
+type batchJob struct {
+	ID         string            `json:"id"`
+	Status     string            `json:"status"`
+	Total      int               `json:"total"`
+	Done       int               `json:"done"`
+	Failed     int               `json:"failed"`
+	Results    []api.BatchResult `json:"results"`
+	FinishedAt *time.Time        `json:"finished_at"`
+}
+
+func TestBatch(t *testing.T) {
+	env := setupTestEnv(t)
+	events := &eventLog{}
+	env.Deps.Events = events
+	user, token := env.createReadyUser(t, "betty")
+	_, otherToken := env.createReadyUser(t, "bob")
+	os.MkdirAll(filepath.Join(user.StoragePath, "Documents"), 0755)
+	os.MkdirAll(filepath.Join(user.StoragePath, "Projects"), 0755)
+
+	post := func(ops []api.BatchOperation) (int, batchJob) {
+		t.Helper()
+		w := env.makeRequestWithBadHeader("POST", "/api/batch", map[string]interface{}{"operations": ops}, "Bearer "+token)
+		var job batchJob
+		json.NewDecoder(w.Body).Decode(&job)
+		return w.Code, job
+	}
+
+	// Small batches answer with their results, failures reported per item
+	os.WriteFile(filepath.Join(user.StoragePath, "Documents", "gone.txt"), []byte("x"), 0644)
+	code, job := post([]api.BatchOperation{
+		{Op: "delete", Path: "/Documents/gone.txt"},
+		{Op: "delete", Path: "/Documents/missing.txt"},
+		{Op: "rename", Path: "/Documents"},
+	})
+	if code != http.StatusOK || job.Status != "completed" || job.Done != 3 || job.Failed != 2 || len(job.Results) != 3 {
+		t.Fatalf("Unexpected sync batch: %d %+v", code, job)
+	}
+	for i, want := range []struct {
+		success bool
+		status  int
+	}{{true, http.StatusOK}, {false, http.StatusNotFound}, {false, http.StatusBadRequest}} {
+		r := job.Results[i]
+		if r.Index != i || r.Success != want.success || r.Status != want.status || r.Success == (r.Error != "") {
+			t.Errorf("Unexpected result %d: %+v", i, r)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(user.StoragePath, "Documents", "gone.txt")); !os.IsNotExist(err) {
+		t.Errorf("Expected the first item deleted despite later failures: %v", err)
+	}
+	if len(events.of("BATCH_PROGRESS")) != 0 || len(events.of("BATCH_COMPLETE")) != 0 {
+		t.Errorf("Expected no batch events for a sync batch")
+	}
+
+	// Batches over the sync limit run in the background
+	var ops []api.BatchOperation
+	for i := 0; i < api.BatchSyncLimit+4; i++ {
+		name := fmt.Sprintf("f%02d.txt", i)
+		os.WriteFile(filepath.Join(user.StoragePath, "Documents", name), []byte(name), 0644)
+		ops = append(ops, api.BatchOperation{Op: "copy", Path: "/Documents/" + name, Destination: "/Projects/" + name})
+	}
+	ops[3].Path = "/Documents/missing.txt"
+	code, job = post(ops)
+	if code != http.StatusAccepted || job.ID == "" || job.Total != len(ops) {
+		t.Fatalf("Expected a background job, got %d %+v", code, job)
+	}
+
+	var status batchJob
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		w := env.requestAs(token, "GET", "/api/batch/"+job.ID)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Polling the job failed: %d %s", w.Code, w.Body.String())
+		}
+		status = batchJob{}
+		json.NewDecoder(w.Body).Decode(&status)
+		if status.Status == "completed" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Job did not complete: %+v", status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status.Done != len(ops) || status.Failed != 1 || len(status.Results) != len(ops) || status.FinishedAt == nil {
+		t.Fatalf("Unexpected finished job: %+v", status)
+	}
+	for i, r := range status.Results {
+		failed := i == 3
+		if r.Index != i || r.Success == failed {
+			t.Errorf("Unexpected result %d: %+v", i, r)
+		}
+	}
+	if status.Results[3].Status != http.StatusNotFound {
+		t.Errorf("Expected the missing item to fail with 404, got %+v", status.Results[3])
+	}
+	if data, _ := os.ReadFile(filepath.Join(user.StoragePath, "Projects", "f00.txt")); string(data) != "f00.txt" {
+		t.Errorf("Expected the items copied, got %q", data)
+	}
+
+	// Only the owner sees the job and its events
+	if w := env.requestAs(otherToken, "GET", "/api/batch/"+job.ID); w.Code != http.StatusNotFound {
+		t.Errorf("Expected other users to get 404, got %d", w.Code)
+	}
+	progress := events.of("BATCH_PROGRESS")
+	if len(progress) == 0 {
+		t.Fatal("Expected progress events")
+	}
+	last := progress[len(progress)-1].payload.(map[string]interface{})
+	if last["jobId"] != job.ID || last["done"] != len(ops) || last["failed"] != 1 {
+		t.Errorf("Expected the last progress to report the whole job, got %+v", last)
+	}
+	// The job is marked completed just before the event goes out
+	complete := events.of("BATCH_COMPLETE")
+	for deadline := time.Now().Add(time.Second); len(complete) == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		complete = events.of("BATCH_COMPLETE")
+	}
+	if len(complete) != 1 {
+		t.Fatalf("Expected one BATCH_COMPLETE, got %d", len(complete))
+	}
+	if done := complete[0].payload.(*api.BatchJob); done.ID != job.ID || done.Failed != 1 {
+		t.Errorf("Unexpected BATCH_COMPLETE payload: %+v", done)
+	}
+	for _, e := range append(progress, complete...) {
+		if e.userID != user.ID {
+			t.Errorf("Expected batch events for the owner only, got one for user %d", e.userID)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package routes
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/satufile/satufile/files"
+	"github.com/satufile/satufile/uploads"
+)
+
+func TestChecksums(t *testing.T) {
+	env := setupTestEnv(t)
+	user, token := env.createReadyUser(t, "grace")
+
+	data := []byte("checksummed content")
+	sum := sha256.Sum256(data)
+	sumHex := hex.EncodeToString(sum[:])
+	wrong := sha256.Sum256([]byte("something else"))
+
+	upload := func(digest []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/resources/Documents/a.txt", bytes.NewReader(data))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(digest)+":")
+		w := httptest.NewRecorder()
+		env.Router.ServeHTTP(w, req)
+		return w
+	}
+
+	// A mismatching body is rejected and nothing is written
+	w := upload(wrong[:])
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "checksum_mismatch") {
+		t.Fatalf("Expected checksum_mismatch, got %d %s", w.Code, w.Body.String())
+	}
+	if _, err := os.Stat(filepath.Join(user.StoragePath, "Documents", "a.txt")); !os.IsNotExist(err) {
+		t.Fatalf("Rejected upload left a file behind: %v", err)
+	}
+
+	w = upload(sum[:])
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Upload failed: %d %s", w.Code, w.Body.String())
+	}
+	var info struct {
+		SHA256 string `json:"sha256"`
+		CRC32C string `json:"crc32c"`
+	}
+	json.NewDecoder(w.Body).Decode(&info)
+	if info.SHA256 != sumHex || info.CRC32C == "" {
+		t.Fatalf("Expected digests in file info, got %+v", info)
+	}
+
+	// The temporary file was written outside the folder and is not listed
+	entries, _ := os.ReadDir(filepath.Join(user.StoragePath, "Documents"))
+	if len(entries) != 1 {
+		t.Errorf("Expected only a.txt in the folder, got %v", entries)
+	}
+	if w := env.requestAs(token, "GET", "/api/resources/"); strings.Contains(w.Body.String(), files.PartialDir) {
+		t.Errorf("Expected the partial folder hidden, got %s", w.Body.String())
+	}
+
+	// Files written outside the API get their digests in the background
+	os.WriteFile(filepath.Join(user.StoragePath, "Documents", "direct.txt"), data, 0644)
+	info.SHA256 = ""
+	for i := 0; i < 50 && info.SHA256 == ""; i++ {
+		w = env.requestAs(token, "GET", "/api/resources/Documents/direct.txt")
+		json.NewDecoder(w.Body).Decode(&info)
+		if i == 0 && info.SHA256 != "" {
+			t.Errorf("Expected the first request not to wait for the digest")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if info.SHA256 != sumHex {
+		t.Errorf("Expected the digest computed in the background, got %+v", info)
+	}
+
+	// Downloads carry the digest and a strong ETag
+	w = env.requestAs(token, "GET", "/api/raw/Documents/a.txt")
+	if w.Code != http.StatusOK || w.Body.String() != string(data) {
+		t.Fatalf("Download failed: %d", w.Code)
+	}
+	if etag := w.Header().Get("ETag"); etag != `"`+sumHex+`"` {
+		t.Errorf("Expected ETag of the SHA-256, got %q", etag)
+	}
+	if digest := w.Header().Get("Repr-Digest"); !strings.Contains(digest, "sha-256=:"+base64.StdEncoding.EncodeToString(sum[:])+":") {
+		t.Errorf("Unexpected Repr-Digest %q", digest)
+	}
+	if digest := w.Header().Get("Digest"); !strings.Contains(digest, "SHA-256="+base64.StdEncoding.EncodeToString(sum[:])) {
+		t.Errorf("Unexpected Digest %q", digest)
+	}
+
+	// A chunked upload whose whole-file digest does not match fails
+	w = env.makeRequestWithBadHeader("POST", "/api/uploads", map[string]interface{}{
+		"filename": "b.txt", "path": "/Documents/b.txt", "size": len(data), "sha256": hex.EncodeToString(wrong[:]),
+	}, "Bearer "+token)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Create session failed: %d %s", w.Code, w.Body.String())
+	}
+	var session uploads.Session
+	json.NewDecoder(w.Body).Decode(&session)
+
+	req := httptest.NewRequest("PATCH", "/api/uploads/"+session.ID+"?chunk=0", bytes.NewReader(data))
+	req.Header.Set("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+	env.Router.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "checksum_mismatch") {
+		t.Fatalf("Expected checksum_mismatch, got %d %s", w.Code, w.Body.String())
+	}
+	if _, err := os.Stat(filepath.Join(user.StoragePath, "Documents", "b.txt")); !os.IsNotExist(err) {
+		t.Fatalf("Rejected upload left a file behind: %v", err)
+	}
+	if s, err := env.Deps.Uploads.GetSession(session.ID); err != nil || s.Status != "failed" {
+		t.Fatalf("Expected a failed session, got %+v %v", s, err)
+	}
+}
@@ -0,0 +1,144 @@
+package routes
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/satufile/satufile/encryption"
+	"github.com/satufile/satufile/search"
+	"github.com/satufile/satufile/vfs"
+)
+
+func TestContentSearch(t *testing.T) {
+	env := setupTestEnv(t)
+	content, err := search.NewContent(env.DB, 0)
+	if errors.Is(err, search.ErrNoFTS5) {
+		t.Skip("SQLite built without FTS5; run with -tags sqlite_fts5")
+	}
+	if err != nil {
+		t.Fatalf("Failed to create content index: %v", err)
+	}
+	env.Deps.Index.SetContent(content)
+
+	user, token := env.createReadyUser(t, "judy")
+	docs := filepath.Join(user.StoragePath, "Documents")
+	os.MkdirAll(docs, 0755)
+
+	os.WriteFile(filepath.Join(docs, "notes.md"), []byte("Remember the <b>marmalade</b> recipe from grandma"), 0644)
+	os.WriteFile(filepath.Join(docs, "binary.txt"), []byte("marmalade\x00\x01\x02"), 0644)
+	writeDocx(t, filepath.Join(docs, "letter.docx"), "Dear committee, the marmalade budget is approved")
+	writePDF(t, filepath.Join(docs, "invoice.pdf"), "Invoice for quince jelly")
+
+	if err := env.Deps.Index.Ensure(user.ID, vfs.Local, user.StoragePath); err != nil {
+		t.Fatalf("Index build failed: %v", err)
+	}
+	content.Drain()
+
+	type response struct {
+		Results []struct {
+			Path    string `json:"path"`
+			Snippet string `json:"snippet"`
+		} `json:"results"`
+		Total int `json:"total"`
+	}
+	searchFor := func(q string) response {
+		t.Helper()
+		w := env.requestAs(token, "GET", "/api/search?mode=content&q="+q)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Content search failed: %d %s", w.Code, w.Body.String())
+		}
+		var resp response
+		json.NewDecoder(w.Body).Decode(&resp)
+		return resp
+	}
+
+	resp := searchFor("marmalade")
+	if resp.Total != 2 {
+		t.Fatalf("Expected the note and the letter, got %+v", resp)
+	}
+	for _, r := range resp.Results {
+		if !strings.Contains(r.Snippet, "<mark>marmalade</mark>") {
+			t.Errorf("%s: match not highlighted in %q", r.Path, r.Snippet)
+		}
+		if strings.Contains(r.Snippet, "<b>") {
+			t.Errorf("%s: snippet is not escaped: %q", r.Path, r.Snippet)
+		}
+	}
+
+	if resp := searchFor("quin+jelly"); resp.Total != 0 {
+		t.Errorf("Expected all words to be required, got %+v", resp)
+	}
+	if resp := searchFor("jelly+quin"); resp.Total != 1 || resp.Results[0].Path != "/Documents/invoice.pdf" {
+		t.Errorf("Expected the PDF by prefix match, got %+v", resp)
+	}
+	if resp := searchFor(`"OR+NEAR(`); resp.Total != 0 {
+		t.Errorf("Expected query syntax to be literal, got %+v", resp)
+	}
+
+	// Changes through the API update the content index
+	if w := env.requestAs(token, "DELETE", "/api/resources/Documents/notes.md"); w.Code != http.StatusNoContent {
+		t.Fatalf("Delete failed: %d", w.Code)
+	}
+	content.Drain()
+	if resp := searchFor("grandma"); resp.Total != 0 {
+		t.Errorf("Expected deleted file to leave the content index, got %+v", resp)
+	}
+
+	// The text of encrypted partitions stays out of the index
+	master, _ := encryption.GenerateKey()
+	encryption.SetMasterKey(master)
+	defer encryption.SetMasterKey(nil)
+	user.DataKey, _ = encryption.NewDataKey()
+	env.DB.Model(user).Update("data_key", user.DataKey)
+	if err := vfs.WriteFile(user.FS(), filepath.Join(docs, "secret.txt"), []byte("encrypted marmalade")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.Deps.Index.Rebuild(user.ID, user.FS(), user.StoragePath); err != nil {
+		t.Fatalf("Index rebuild failed: %v", err)
+	}
+	content.Drain()
+	if resp := searchFor("marmalade"); resp.Total != 0 {
+		t.Errorf("Expected no content indexed for an encrypted partition, got %+v", resp)
+	}
+	var rows int64
+	env.DB.Raw("SELECT COUNT(*) FROM search_content").Scan(&rows)
+	if rows != 0 {
+		t.Errorf("Expected the plaintext dropped from the index, got %d rows", rows)
+	}
+}
+
+func writeDocx(t *testing.T, path, text string) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	w, _ := zw.Create("word/document.xml")
+	fmt.Fprintf(w, `<?xml version="1.0"?><w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"><w:body><w:p><w:r><w:t>%s</w:t></w:r></w:p></w:body></w:document>`, text)
+	zw.Close()
+}
+
+func writePDF(t *testing.T, path, text string) {
+	var stream bytes.Buffer
+	zw := zlib.NewWriter(&stream)
+	fmt.Fprintf(zw, "BT /F1 12 Tf 72 712 Td [(%s) -300 (jelly)] TJ ET", strings.TrimSuffix(text, " jelly"))
+	zw.Close()
+
+	var pdf bytes.Buffer
+	fmt.Fprintf(&pdf, "%%PDF-1.4\n1 0 obj\n<< /Length %d /Filter /FlateDecode >>\nstream\n", stream.Len())
+	pdf.Write(stream.Bytes())
+	pdf.WriteString("\nendstream\nendobj\n%%EOF\n")
+	if err := os.WriteFile(path, pdf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
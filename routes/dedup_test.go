@@ -0,0 +1,103 @@
+package routes
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/satufile/satufile/dedup"
+	"github.com/satufile/satufile/routes/api"
+	"github.com/satufile/satufile/system/partition"
+	"github.com/satufile/satufile/uploads"
+	"github.com/satufile/satufile/vfs"
+)
+
+func TestUploadDedup(t *testing.T) {
+	env := setupTestEnv(t)
+	store, err := dedup.NewStore(env.DB, api.DefaultChunkSize)
+	if err != nil {
+		t.Fatalf("Failed to create dedup store: %v", err)
+	}
+	env.Deps.Dedup = store
+
+	user, token := env.createReadyUser(t, "frank")
+	os.MkdirAll(filepath.Join(user.StoragePath, "Videos"), 0755)
+
+	data := bytes.Repeat([]byte("satufile"), api.DefaultChunkSize/8)
+	data = append(data, []byte("tail bytes")...)
+	chunks := [][]byte{data[:api.DefaultChunkSize], data[api.DefaultChunkSize:]}
+
+	createSession := func(path string) *uploads.Session {
+		w := env.makeRequestWithBadHeader("POST", "/api/uploads", map[string]interface{}{
+			"filename": filepath.Base(path), "path": path, "size": len(data),
+		}, "Bearer "+token)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Create session failed: %d %s", w.Code, w.Body.String())
+		}
+		var session uploads.Session
+		json.NewDecoder(w.Body).Decode(&session)
+		return &session
+	}
+
+	// First upload sends every chunk
+	first := createSession("/Videos/a.bin")
+	for i, c := range chunks {
+		req := httptest.NewRequest("PATCH", "/api/uploads/"+first.ID+"?chunk="+strconv.Itoa(i), bytes.NewReader(c))
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		env.Router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Chunk %d failed: %d %s", i, w.Code, w.Body.String())
+		}
+	}
+
+	// Second upload of the same content needs no data at all
+	second := createSession("/Videos/b.bin")
+	hashes := make([]string, len(chunks))
+	for i, c := range chunks {
+		sum := sha256.Sum256(c)
+		hashes[i] = hex.EncodeToString(sum[:])
+	}
+	w := env.makeRequestWithBadHeader("POST", "/api/uploads/"+second.ID+"/chunks", map[string]interface{}{"hashes": hashes}, "Bearer "+token)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Chunk lookup failed: %d %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Missing []int           `json:"missing"`
+		Session uploads.Session `json:"session"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	if len(resp.Missing) != 0 || resp.Session.Status != "completed" {
+		t.Fatalf("Expected a completed upload with no missing chunks, got %+v", resp)
+	}
+
+	a, _ := os.Stat(filepath.Join(user.StoragePath, "Videos", "a.bin"))
+	b, err := os.Stat(filepath.Join(user.StoragePath, "Videos", "b.bin"))
+	if err != nil || !os.SameFile(a, b) {
+		t.Fatalf("Expected b.bin to share a.bin's data: %v", err)
+	}
+	if used := partition.DiskUsage(vfs.Local, user.StoragePath); used != int64(len(data)) {
+		t.Errorf("Expected usage %d counted once, got %d", len(data), used)
+	}
+
+	// Listings never show the pool
+	w = env.makeRequestWithBadHeader("GET", "/api/resources/", nil, "Bearer "+token)
+	if bytes.Contains(w.Body.Bytes(), []byte(dedup.Dir)) {
+		t.Errorf("Listing exposes %s: %s", dedup.Dir, w.Body.String())
+	}
+
+	// Once no file uses the content any more, the pool entry is collected
+	os.Remove(filepath.Join(user.StoragePath, "Videos", "a.bin"))
+	os.Remove(filepath.Join(user.StoragePath, "Videos", "b.bin"))
+	removed, freed, err := store.Collect(user.ID, user.StoragePath)
+	if err != nil || removed != 1 || freed != int64(len(data)) {
+		t.Errorf("Collect: removed %d, freed %d, err %v", removed, freed, err)
+	}
+}
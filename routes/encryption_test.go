@@ -0,0 +1,190 @@
+package routes
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/satufile/satufile/encryption"
+	"github.com/satufile/satufile/files"
+	"github.com/satufile/satufile/preview"
+	"github.com/satufile/satufile/routes/api"
+	"github.com/satufile/satufile/share"
+	"github.com/satufile/satufile/uploads"
+	"github.com/satufile/satufile/vfs"
+)
+
+func TestEncryptedPartition(t *testing.T) {
+	env := setupTestEnv(t)
+	cacheDir := t.TempDir()
+	env.Deps.Previews = preview.NewService(cacheDir)
+
+	master, _ := encryption.GenerateKey()
+	if err := encryption.SetMasterKey(master); err != nil {
+		t.Fatal(err)
+	}
+	defer encryption.SetMasterKey(nil)
+
+	user, token := env.createReadyUser(t, "gina")
+	wrapped, err := encryption.NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.DataKey = wrapped
+	env.DB.Model(user).Update("data_key", wrapped)
+	os.MkdirAll(filepath.Join(user.StoragePath, "Documents"), 0755)
+	os.MkdirAll(filepath.Join(user.StoragePath, "Pictures"), 0755)
+
+	do := func(method, path string, body []byte, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		env.Router.ServeHTTP(w, req)
+		return w
+	}
+
+	// Uploads are stored encrypted
+	if w := do("POST", "/api/resources/Documents/notes.txt", []byte("encrypted marmalade"), nil); w.Code != http.StatusCreated {
+		t.Fatalf("Upload failed: %d %s", w.Code, w.Body.String())
+	}
+	raw, err := os.ReadFile(filepath.Join(user.StoragePath, "Documents", "notes.txt"))
+	if err != nil || bytes.Contains(raw, []byte("marmalade")) || !bytes.HasPrefix(raw, []byte("SATUENC1")) {
+		t.Fatalf("Expected the file encrypted on disk, got %q %v", raw, err)
+	}
+
+	// Listings and ranged reads see the plaintext
+	w := do("GET", "/api/resources/Documents", nil, nil)
+	var listing files.Listing
+	json.NewDecoder(w.Body).Decode(&listing)
+	if w.Code != http.StatusOK || len(listing.Items) != 1 || listing.Items[0].Size != 19 {
+		t.Fatalf("Unexpected listing: %d %s", w.Code, w.Body.String())
+	}
+	w = do("GET", "/api/raw/Documents/notes.txt", nil, map[string]string{"Range": "bytes=10-"})
+	if w.Code != http.StatusPartialContent || w.Body.String() != "marmalade" {
+		t.Errorf("Expected a ranged read of the plaintext, got %d %q", w.Code, w.Body.String())
+	}
+
+	// Public links serve the plaintext
+	w = env.makeRequestWithBadHeader("POST", "/api/share", map[string]interface{}{"path": "/Documents/notes.txt", "type": share.TypeFile}, "Bearer "+token)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Sharing failed: %d %s", w.Code, w.Body.String())
+	}
+	var link share.Link
+	json.NewDecoder(w.Body).Decode(&link)
+	w = env.makeRequest("GET", "/api/share/public?token="+link.Token+"&download=true", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "encrypted marmalade" {
+		t.Errorf("Expected the shared plaintext, got %d %q", w.Code, w.Body.String())
+	}
+
+	// Upload chunks wait on disk encrypted
+	plainOnDisk := func(dir string) bool {
+		found := false
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode().IsRegular() {
+				data, _ := os.ReadFile(path)
+				found = found || bytes.Contains(data, []byte("quince"))
+			}
+			return nil
+		})
+		return found
+	}
+	w = env.makeRequestWithBadHeader("POST", "/api/uploads", map[string]interface{}{
+		"filename": "jam.txt", "path": "/Documents/jam.txt", "size": 2 * api.DefaultChunkSize,
+	}, "Bearer "+token)
+	var session uploads.Session
+	json.NewDecoder(w.Body).Decode(&session)
+	chunk := bytes.Repeat([]byte("quince"), api.DefaultChunkSize/6+1)[:api.DefaultChunkSize]
+	if w := do("PATCH", "/api/uploads/"+session.ID+"?chunk=0", chunk, nil); w.Code != http.StatusOK {
+		t.Fatalf("Chunk upload failed: %d %s", w.Code, w.Body.String())
+	}
+	if plainOnDisk(session.TempDir) {
+		t.Error("Expected the chunks of an encrypted partition encrypted")
+	}
+	if w := do("PATCH", "/api/uploads/"+session.ID+"?chunk=1", chunk, nil); w.Code != http.StatusOK {
+		t.Fatalf("Chunk upload failed: %d %s", w.Code, w.Body.String())
+	}
+	if got, err := vfs.ReadFile(user.FS(), filepath.Join(user.StoragePath, "Documents", "jam.txt")); err != nil || !bytes.Equal(got, append(chunk, chunk...)) {
+		t.Errorf("Expected the chunks assembled, got %d bytes %v", len(got), err)
+	}
+
+	w = env.tusRequest(token, "POST", "/api/tus", []byte("quince "), map[string]string{
+		"Upload-Length":   "13",
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("jelly.txt")) + ",path " + base64.StdEncoding.EncodeToString([]byte("/Documents")),
+		"Content-Type":    "application/offset+octet-stream",
+	})
+	location := w.Header().Get("Location")
+	if w.Code != http.StatusCreated || plainOnDisk(filepath.Join(uploads.TempBase(), filepath.Base(location))) {
+		t.Errorf("Expected the tus upload kept encrypted, got %d", w.Code)
+	}
+	w = env.tusRequest(token, "PATCH", location, []byte("jelly!"), map[string]string{"Upload-Offset": "7", "Content-Type": "application/offset+octet-stream"})
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("PATCH failed: %d %s", w.Code, w.Body.String())
+	}
+	if got, err := vfs.ReadFile(user.FS(), filepath.Join(user.StoragePath, "Documents", "jelly.txt")); err != nil || string(got) != "quince jelly!" {
+		t.Errorf("Expected the tus upload assembled, got %q %v", got, err)
+	}
+
+	// WebDAV serves encrypted partitions too
+	if w := do("PUT", "/dav/Documents/dav.txt", []byte("webdav marmalade"), nil); w.Code != http.StatusCreated {
+		t.Fatalf("WebDAV PUT failed: %d %s", w.Code, w.Body.String())
+	}
+	if raw, _ := os.ReadFile(filepath.Join(user.StoragePath, "Documents", "dav.txt")); bytes.Contains(raw, []byte("marmalade")) {
+		t.Error("Expected the WebDAV upload encrypted on disk")
+	}
+	if w := do("GET", "/dav/Documents/dav.txt", nil, nil); w.Code != http.StatusOK || w.Body.String() != "webdav marmalade" {
+		t.Errorf("Expected the plaintext over WebDAV, got %d %q", w.Code, w.Body.String())
+	}
+	w = do("PROPFIND", "/dav/Documents", nil, map[string]string{"Depth": "1"})
+	if w.Code != http.StatusMultiStatus || !strings.Contains(w.Body.String(), "<D:getcontentlength>16</D:getcontentlength>") {
+		t.Errorf("Expected the plaintext size listed, got %d %s", w.Code, w.Body.String())
+	}
+
+	w = do("GET", "/api/search?q=notes", nil, nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "/Documents/notes.txt") {
+		t.Errorf("Expected the file to be found, got %d %s", w.Code, w.Body.String())
+	}
+
+	// Previews are generated from the plaintext and cached encrypted
+	png := filepath.Join(t.TempDir(), "wide.png")
+	writePNG(t, png, 400, 200)
+	data, _ := os.ReadFile(png)
+	if err := vfs.WriteFile(user.FS(), filepath.Join(user.StoragePath, "Pictures", "wide.png"), data); err != nil {
+		t.Fatal(err)
+	}
+	w = do("GET", "/api/preview/small/Pictures/wide.png", nil, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Preview failed: %d %s", w.Code, w.Body.String())
+	}
+	if _, err := jpeg.Decode(w.Body); err != nil {
+		t.Errorf("Preview is not a JPEG: %v", err)
+	}
+	cached := 0
+	filepath.Walk(cacheDir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			cached++
+			if data, _ := os.ReadFile(path); !bytes.HasPrefix(data, []byte("SATUENC1")) {
+				t.Errorf("Expected the cached preview %s encrypted", path)
+			}
+		}
+		return nil
+	})
+	if cached == 0 {
+		t.Error("Expected the preview cached")
+	}
+
+	// Without the master key the partition cannot be read
+	encryption.SetMasterKey(nil)
+	if w := do("GET", "/api/raw/Documents/notes.txt", nil, nil); w.Code == http.StatusOK {
+		t.Errorf("Expected the partition unavailable without the master key, got %d", w.Code)
+	}
+}
@@ -0,0 +1,378 @@
+package routes
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"github.com/satufile/satufile/preview"
+	"github.com/satufile/satufile/share"
+	"github.com/satufile/satufile/trash"
+	"github.com/satufile/satufile/users"
+)
+
+// permFixture is what every permission case starts from
+type permFixture struct {
+	versionID  uint
+	trashID    uint
+	shareToken string
+}
+
+// setupPermFixture gives user a file with a previous version, a picture,
+// a trashed file and a share link
+func setupPermFixture(t *testing.T, env *TestEnv, user *users.User, token string) permFixture {
+	t.Helper()
+	root := user.StoragePath
+	os.MkdirAll(filepath.Join(root, "Documents"), 0755)
+	os.MkdirAll(filepath.Join(root, "Projects"), 0755)
+	os.WriteFile(filepath.Join(root, "Documents", "a.txt"), []byte("hello"), 0644)
+	os.WriteFile(filepath.Join(root, "old.txt"), []byte("old"), 0644)
+	writePNG(t, filepath.Join(root, "photo.png"), 40, 20)
+
+	v, err := env.Deps.Versions.Keep(user, "/Documents/a.txt")
+	if err != nil || v == nil {
+		t.Fatalf("Failed to keep version: %v", err)
+	}
+
+	if w := env.requestAs(token, "DELETE", "/api/resources/old.txt"); w.Code != http.StatusNoContent {
+		t.Fatalf("Failed to trash old.txt: %d %s", w.Code, w.Body.String())
+	}
+	var item trash.TrashItem
+	if err := env.DB.Where("user_id = ?", user.ID).First(&item).Error; err != nil {
+		t.Fatalf("Trash row not created: %v", err)
+	}
+
+	link, _ := share.NewLink("/Documents/a.txt", "file", 24)
+	link.OwnerID = user.ID
+	env.Deps.Share.CreateLink(link)
+
+	return permFixture{versionID: v.ID, trashID: item.ID, shareToken: link.Token}
+}
+
+// permRequest builds the request of a permission case
+type permRequest struct {
+	method  string
+	path    string
+	body    string
+	headers map[string]string
+}
+
+// permCase is a request that needs perm, and its status when granted
+type permCase struct {
+	perm    string
+	name    string
+	request func(permFixture) permRequest
+	want    int  // status when the permission is granted
+	batch   bool // the status is that of the batch's only result
+}
+
+// permCases lists every operation guarded by a permission. Routes that
+// need none are listed in unguardedRoutes instead.
+func permCases() []permCase {
+	b64 := base64.StdEncoding.EncodeToString
+
+	batch := func(op string) func(permFixture) permRequest {
+		return func(permFixture) permRequest {
+			return permRequest{method: "POST", path: "/api/batch", body: fmt.Sprintf(
+				`{"operations":[{"op":%q,"path":"/Documents/a.txt","destination":"/Projects/a.txt"}]}`, op)}
+		}
+	}
+	fixed := func(method, path, body string) func(permFixture) permRequest {
+		return func(permFixture) permRequest {
+			return permRequest{method: method, path: path, body: body}
+		}
+	}
+
+	return []permCase{
+		{"create", "create folder", fixed("POST", "/api/resources/New/", ""), http.StatusCreated, false},
+		{"create", "upload new file", fixed("POST", "/api/resources/Documents/new.txt", "new"), http.StatusCreated, false},
+		{"create", "copy", fixed("PATCH", "/api/resources/Documents/a.txt", `{"action":"copy","destination":"/Projects/a.txt"}`), http.StatusOK, false},
+		{"create", "chunked upload", fixed("POST", "/api/uploads", `{"filename":"n.bin","path":"/Documents/n.bin","size":3}`), http.StatusCreated, false},
+		{"create", "tus upload", func(permFixture) permRequest {
+			return permRequest{method: "POST", path: "/api/tus", headers: map[string]string{
+				"Tus-Resumable":   "1.0.0",
+				"Upload-Length":   "3",
+				"Upload-Metadata": "filename " + b64([]byte("t.bin")) + ",path " + b64([]byte("/Documents")),
+			}}
+		}, http.StatusCreated, false},
+		{"create", "restore from trash", func(f permFixture) permRequest {
+			return permRequest{method: "POST", path: fmt.Sprintf("/api/trash/%d/restore", f.trashID)}
+		}, http.StatusOK, false},
+		{"create", "dav mkcol", fixed("MKCOL", "/dav/DavFolder", ""), http.StatusCreated, false},
+		{"create", "dav put new file", fixed("PUT", "/dav/Documents/dav.txt", "dav"), http.StatusCreated, false},
+		{"create", "dav copy", func(permFixture) permRequest {
+			return permRequest{method: "COPY", path: "/dav/Documents/a.txt", headers: map[string]string{"Destination": "/dav/Projects/a.txt"}}
+		}, http.StatusCreated, false},
+		{"create", "batch copy", batch("copy"), http.StatusOK, true},
+
+		{"modify", "overwrite file", fixed("POST", "/api/resources/Documents/a.txt", "changed"), http.StatusCreated, false},
+		{"modify", "copy with overwrite", fixed("PATCH", "/api/resources/Documents/a.txt", `{"action":"copy","destination":"/Projects/a.txt","conflict":"overwrite"}`), http.StatusOK, false},
+		{"modify", "restore version", func(f permFixture) permRequest {
+			return permRequest{method: "POST", path: fmt.Sprintf("/api/versions/%d/restore", f.versionID)}
+		}, http.StatusOK, false},
+		{"modify", "chunked upload over file", fixed("POST", "/api/uploads", `{"filename":"a.txt","path":"/Documents/a.txt","size":3}`), http.StatusCreated, false},
+		{"modify", "dav put existing file", fixed("PUT", "/dav/Documents/a.txt", "dav"), http.StatusNoContent, false},
+
+		{"rename", "rename", fixed("PATCH", "/api/resources/Documents/a.txt", `{"newName":"b.txt"}`), http.StatusOK, false},
+		{"rename", "move", fixed("PATCH", "/api/resources/Documents/a.txt", `{"action":"move","destination":"/Projects/a.txt"}`), http.StatusOK, false},
+		{"rename", "dav move", func(permFixture) permRequest {
+			return permRequest{method: "MOVE", path: "/dav/Documents/a.txt", headers: map[string]string{"Destination": "/dav/Projects/a.txt"}}
+		}, http.StatusCreated, false},
+		{"rename", "batch move", batch("move"), http.StatusOK, true},
+
+		{"delete", "delete", fixed("DELETE", "/api/resources/Documents/a.txt", ""), http.StatusNoContent, false},
+		{"delete", "delete from trash", func(f permFixture) permRequest {
+			return permRequest{method: "DELETE", path: fmt.Sprintf("/api/trash/%d", f.trashID)}
+		}, http.StatusNoContent, false},
+		{"delete", "empty trash", fixed("DELETE", "/api/trash", ""), http.StatusNoContent, false},
+		{"delete", "delete version", func(f permFixture) permRequest {
+			return permRequest{method: "DELETE", path: fmt.Sprintf("/api/versions/%d", f.versionID)}
+		}, http.StatusNoContent, false},
+		{"delete", "delete old versions", fixed("DELETE", "/api/versions?path=/Documents/a.txt", ""), http.StatusOK, false},
+		{"delete", "dav delete", fixed("DELETE", "/dav/Documents/a.txt", ""), http.StatusNoContent, false},
+		{"delete", "batch delete", batch("delete"), http.StatusOK, true},
+
+		{"share", "create share", fixed("POST", "/api/share", `{"path":"/Documents/a.txt","type":"file"}`), http.StatusOK, false},
+		{"share", "update share", func(f permFixture) permRequest {
+			return permRequest{method: "PUT", path: "/api/share", body: fmt.Sprintf(`{"token":%q,"expires":"2"}`, f.shareToken)}
+		}, http.StatusOK, false},
+		{"share", "delete share", func(f permFixture) permRequest {
+			return permRequest{method: "DELETE", path: "/api/share?token=" + f.shareToken}
+		}, http.StatusOK, false},
+		{"share", "batch share", batch("share"), http.StatusOK, true},
+
+		{"download", "raw", fixed("GET", "/api/raw/Documents/a.txt", ""), http.StatusOK, false},
+		{"download", "preview", fixed("GET", "/api/preview/small/photo.png", ""), http.StatusOK, false},
+		{"download", "version raw", func(f permFixture) permRequest {
+			return permRequest{method: "GET", path: fmt.Sprintf("/api/versions/%d/raw", f.versionID)}
+		}, http.StatusOK, false},
+		{"download", "dav get", fixed("GET", "/dav/Documents/a.txt", ""), http.StatusOK, false},
+		{"download", "create share", fixed("POST", "/api/share", `{"path":"/Documents/a.txt","type":"file"}`), http.StatusOK, false},
+		{"download", "batch share", batch("share"), http.StatusOK, true},
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	for _, tc := range permCases() {
+		for _, granted := range []bool{true, false} {
+			name := fmt.Sprintf("%s/%s/granted=%v", tc.perm, tc.name, granted)
+			t.Run(name, func(t *testing.T) {
+				env := setupTestEnv(t)
+				env.Deps.Previews = preview.NewService(t.TempDir())
+				user, token := env.createReadyUser(t, "perm")
+				fixture := setupPermFixture(t, env, user, token)
+
+				if !granted {
+					env.DB.Model(&users.User{}).Where("id = ?", user.ID).Update(tc.perm, false)
+				}
+
+				pr := tc.request(fixture)
+				req := httptest.NewRequest(pr.method, pr.path, strings.NewReader(pr.body))
+				req.Header.Set("Authorization", "Bearer "+token)
+				for k, v := range pr.headers {
+					req.Header.Set(k, v)
+				}
+				w := httptest.NewRecorder()
+				env.Router.ServeHTTP(w, req)
+
+				status := w.Code
+				var message map[string]string
+				if tc.batch {
+					var job struct {
+						Results []struct {
+							Status int    `json:"status"`
+							Error  string `json:"error"`
+						} `json:"results"`
+					}
+					json.NewDecoder(w.Body).Decode(&job)
+					if len(job.Results) != 1 {
+						t.Fatalf("Expected one batch result, got %d: %d", len(job.Results), w.Code)
+					}
+					status = job.Results[0].Status
+					message = map[string]string{"error": "permission_denied", "message": job.Results[0].Error}
+				} else if status == http.StatusForbidden {
+					json.NewDecoder(w.Body).Decode(&message)
+				}
+
+				if granted {
+					if status != tc.want {
+						t.Fatalf("Expected %d with the %s permission, got %d: %s", tc.want, tc.perm, status, w.Body.String())
+					}
+					return
+				}
+				if status != http.StatusForbidden {
+					t.Fatalf("Expected 403 without the %s permission, got %d: %s", tc.perm, status, w.Body.String())
+				}
+				if message["error"] != "permission_denied" || !strings.Contains(message["message"], tc.perm) {
+					t.Errorf("Expected a permission_denied error naming %s, got %v", tc.perm, message)
+				}
+			})
+		}
+	}
+}
+
+// unguardedRoutes are the /api routes no permission applies to, by
+// "METHODS template", and why. Admin routes are behind RequireAdmin.
+var unguardedRoutes = map[string]string{
+	"GET /api/info":                              "public",
+	"POST /api/login":                            "public",
+	"GET /api/share/public":                      "anonymous, checked against the link owner's permissions",
+	"POST /api/share/public/unlock":              "anonymous",
+	"OPTIONS /api/share/public/{token}/tus":      "tus discovery",
+	"OPTIONS /api/share/public/{token}/tus/{id}": "tus discovery",
+	"POST /api/share/public/{token}/tus":         "anonymous uploads through an upload link",
+	"HEAD /api/share/public/{token}/tus/{id}":    "anonymous uploads through an upload link",
+	"PATCH /api/share/public/{token}/tus/{id}":   "anonymous uploads through an upload link",
+	"DELETE /api/share/public/{token}/tus/{id}":  "anonymous uploads through an upload link",
+	"OPTIONS /api/tus":                           "tus discovery",
+	"OPTIONS /api/tus/{id}":                      "tus discovery",
+	"POST /api/renew":                            "own session",
+	"GET /api/me":                                "own account",
+	"PUT /api/me":                                "own account",
+	"POST /api/change-password":                  "own account",
+	"GET /api/setup/status":                      "first-run setup",
+	"GET /api/setup/drives":                      "first-run setup",
+	"POST /api/setup/password":                   "first-run setup",
+	"POST /api/setup/partition":                  "first-run setup",
+	"POST /api/setup/complete":                   "first-run setup",
+	"GET /api/user/storage":                      "read only",
+	"GET /api/resources":                         "read only",
+	"GET /api/resources/{path:.*}":               "read only, metadata without content",
+	"GET /api/batch/{id}":                        "status of the user's own batch",
+	"GET /api/storage":                           "read only",
+	"GET /api/storage/stats":                     "read only",
+	"GET /api/storage/usage":                     "read only",
+	"GET /api/search":                            "read only",
+	"GET /api/spaces":                            "read only",
+	"GET /api/versions":                          "read only",
+	"GET /api/trash":                             "read only",
+	"GET /api/shares":                            "read only",
+	"PATCH /api/uploads/{id}":                    "continues a session authorized when it was created",
+	"POST /api/uploads/{id}/chunks":              "continues a session authorized when it was created",
+	"GET /api/uploads/{id}":                      "continues a session authorized when it was created",
+	"DELETE /api/uploads/{id}":                   "cancels the user's own upload",
+	"HEAD /api/tus/{id}":                         "continues a session authorized when it was created",
+	"PATCH /api/tus/{id}":                        "continues a session authorized when it was created",
+	"DELETE /api/tus/{id}":                       "cancels the user's own upload",
+}
+
+// TestPermissionsCoverRoutes fails for /api routes that are neither
+// exercised by a permission case nor listed in unguardedRoutes, so new
+// routes have to decide which permission they need
+func TestPermissionsCoverRoutes(t *testing.T) {
+	env := setupTestEnv(t)
+
+	routeKey := func(route *mux.Route) string {
+		tpl, _ := route.GetPathTemplate()
+		methods, _ := route.GetMethods()
+		return strings.Join(methods, ",") + " " + tpl
+	}
+
+	covered := map[string]bool{}
+	for _, tc := range permCases() {
+		pr := tc.request(permFixture{versionID: 1, trashID: 1, shareToken: "token"})
+		var match mux.RouteMatch
+		if env.Router.Match(httptest.NewRequest(pr.method, pr.path, nil), &match) && match.Route != nil {
+			covered[routeKey(match.Route)] = true
+		}
+	}
+
+	registered := map[string]bool{}
+	env.Router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		tpl, err := route.GetPathTemplate()
+		if err != nil || !strings.HasPrefix(tpl, "/api/") || tpl == "/api/admin" {
+			return nil
+		}
+		key := routeKey(route)
+		registered[key] = true
+		if strings.HasPrefix(tpl, "/api/admin/") || covered[key] {
+			return nil
+		}
+		if _, ok := unguardedRoutes[key]; !ok {
+			t.Errorf("%s has no permission case; add one, or list it in unguardedRoutes", key)
+		}
+		return nil
+	})
+	for key := range unguardedRoutes {
+		if !registered[key] {
+			t.Errorf("%s is listed in unguardedRoutes but not registered", key)
+		}
+		if covered[key] {
+			t.Errorf("%s has a permission case and is listed in unguardedRoutes", key)
+		}
+	}
+}
+
+func TestScope(t *testing.T) {
+	env := setupTestEnv(t)
+	user, token := env.createReadyUser(t, "scoped")
+	root := user.StoragePath
+	os.MkdirAll(filepath.Join(root, "Projects", "site"), 0755)
+	os.MkdirAll(filepath.Join(root, "Projects", "drafts"), 0755)
+	os.WriteFile(filepath.Join(root, "secret.txt"), []byte("secret"), 0644)
+	os.WriteFile(filepath.Join(root, "Projects", "site", "index.html"), []byte("<p>"), 0644)
+	env.DB.Model(user).Update("scope", "/Projects")
+
+	// The scope is the user's "/"
+	w := env.requestAs(token, "GET", "/api/resources/")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Listing failed: %d %s", w.Code, w.Body.String())
+	}
+	var listing struct {
+		Items []struct {
+			Path string `json:"path"`
+		} `json:"items"`
+	}
+	json.NewDecoder(w.Body).Decode(&listing)
+	if len(listing.Items) != 2 || listing.Items[0].Path != "/drafts" || listing.Items[1].Path != "/site" {
+		t.Errorf("Expected only /drafts and /site at the root, got %+v", listing.Items)
+	}
+
+	// Nothing outside it can be named
+	for _, path := range []string{"/api/raw/secret.txt", "/api/raw/../secret.txt", "/api/raw/%2e%2e/secret.txt"} {
+		if w := env.requestAs(token, "GET", path); w.Code == http.StatusOK {
+			t.Errorf("%s escaped the scope: %s", path, w.Body.String())
+		}
+	}
+	w = env.makeRequestWithBadHeader("PATCH", "/api/resources/drafts", map[string]string{
+		"action": "move", "destination": "/../escaped",
+	}, "Bearer "+token)
+	if _, err := os.Stat(filepath.Join(root, "escaped")); err == nil {
+		t.Errorf("Move escaped the scope: %d", w.Code)
+	}
+
+	// Uploads, trash and versions live below the scope
+	req := httptest.NewRequest("POST", "/api/resources/site/index.html", strings.NewReader("<h1>"))
+	req.Header.Set("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+	env.Router.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Upload failed: %d %s", w.Code, w.Body.String())
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "Projects", "site", "index.html")); string(data) != "<h1>" {
+		t.Errorf("Upload did not land in the scope: %q", data)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(root, "Projects", ".versions")); len(entries) != 1 {
+		t.Errorf("Expected the replaced content in Projects/.versions, got %d entries", len(entries))
+	}
+
+	if w := env.requestAs(token, "DELETE", "/api/resources/site/index.html"); w.Code != http.StatusNoContent {
+		t.Fatalf("Delete failed: %d %s", w.Code, w.Body.String())
+	}
+	var item trash.TrashItem
+	env.DB.Where("user_id = ?", user.ID).First(&item)
+	if item.OriginalPath != "/site/index.html" {
+		t.Errorf("Expected the trash to record the scoped path, got %q", item.OriginalPath)
+	}
+	if _, err := os.Stat(filepath.Join(root, "Projects", ".trash", fmt.Sprint(item.ID))); err != nil {
+		t.Errorf("Trashed file is not in Projects/.trash: %v", err)
+	}
+}
@@ -0,0 +1,179 @@
+package routes
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/satufile/satufile/preview"
+)
+
+// writePNG writes a solid w×h PNG
+func writePNG(t *testing.T, path string, w, h int) {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{200, 40, 40, 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeRotatedJPEG writes a w×h JPEG whose Exif orientation is 6 (rotate 90° CW)
+func writeRotatedJPEG(t *testing.T, path string, w, h int) {
+	var enc bytes.Buffer
+	if err := jpeg.Encode(&enc, image.NewGray(image.Rect(0, 0, w, h)), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Big-endian TIFF header with a single IFD0 entry: Orientation = 6
+	var tiff bytes.Buffer
+	tiff.WriteString("MM\x00\x2a")
+	binary.Write(&tiff, binary.BigEndian, uint32(8))
+	binary.Write(&tiff, binary.BigEndian, uint16(1))
+	binary.Write(&tiff, binary.BigEndian, []uint16{0x0112, 3})
+	binary.Write(&tiff, binary.BigEndian, uint32(1))
+	binary.Write(&tiff, binary.BigEndian, []uint16{6, 0})
+	binary.Write(&tiff, binary.BigEndian, uint32(0))
+	payload := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+
+	var out bytes.Buffer
+	out.Write(enc.Bytes()[:2]) // SOI
+	out.Write([]byte{0xFF, 0xE1})
+	binary.Write(&out, binary.BigEndian, uint16(len(payload)+2))
+	out.Write(payload)
+	out.Write(enc.Bytes()[2:])
+	if err := os.WriteFile(path, out.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPreviewGet(t *testing.T) {
+	env := setupTestEnv(t)
+	cacheDir := t.TempDir()
+	env.Deps.Previews = preview.NewService(cacheDir)
+	user, token := env.createReadyUser(t, "ivan")
+
+	pictures := filepath.Join(user.StoragePath, "Pictures")
+	os.MkdirAll(pictures, 0755)
+	writePNG(t, filepath.Join(pictures, "wide.png"), 400, 200)
+	writeRotatedJPEG(t, filepath.Join(pictures, "phone.jpg"), 300, 100)
+	os.WriteFile(filepath.Join(pictures, "notes.txt"), []byte("hi"), 0644)
+
+	get := func(path string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		env.Router.ServeHTTP(w, req)
+		return w
+	}
+	bounds := func(t *testing.T, w *httptest.ResponseRecorder) image.Rectangle {
+		img, err := jpeg.Decode(w.Body)
+		if err != nil {
+			t.Fatalf("Preview is not a JPEG: %v", err)
+		}
+		return img.Bounds()
+	}
+
+	w := get("/api/preview/small/Pictures/wide.png", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "image/jpeg" {
+		t.Errorf("Unexpected Content-Type %q", ct)
+	}
+	if cc := w.Header().Get("Cache-Control"); cc != "private, max-age=86400" {
+		t.Errorf("Unexpected Cache-Control %q", cc)
+	}
+	etag := w.Header().Get("ETag")
+	if b := bounds(t, w); b.Dx() != 256 || b.Dy() != 128 {
+		t.Errorf("Expected 256x128, got %v", b.Size())
+	}
+
+	t.Run("NotModified", func(t *testing.T) {
+		w := get("/api/preview/small/Pictures/wide.png", map[string]string{"If-None-Match": etag})
+		if w.Code != http.StatusNotModified {
+			t.Errorf("Expected 304, got %d", w.Code)
+		}
+	})
+
+	t.Run("NeverEnlarges", func(t *testing.T) {
+		w := get("/api/preview/large/Pictures/wide.png", nil)
+		if b := bounds(t, w); b.Dx() != 400 || b.Dy() != 200 {
+			t.Errorf("Expected original 400x200, got %v", b.Size())
+		}
+	})
+
+	t.Run("RegeneratedWhenSourceChanges", func(t *testing.T) {
+		src := filepath.Join(pictures, "wide.png")
+		writePNG(t, src, 100, 400)
+		later := time.Now().Add(time.Minute)
+		os.Chtimes(src, later, later)
+
+		w := get("/api/preview/small/Pictures/wide.png", nil)
+		if w.Header().Get("ETag") == etag {
+			t.Error("ETag did not change with the source")
+		}
+		if b := bounds(t, w); b.Dx() != 64 || b.Dy() != 256 {
+			t.Errorf("Expected regenerated 64x256, got %v", b.Size())
+		}
+	})
+
+	t.Run("ExifOrientation", func(t *testing.T) {
+		w := get("/api/preview/small/Pictures/phone.jpg", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		if b := bounds(t, w); b.Dx() != 85 || b.Dy() != 256 {
+			t.Errorf("Expected rotated 85x256, got %v", b.Size())
+		}
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		cases := []struct {
+			path string
+			code int
+		}{
+			{"/api/preview/huge/Pictures/wide.png", http.StatusBadRequest},
+			{"/api/preview/small/Pictures/notes.txt", http.StatusUnsupportedMediaType},
+			{"/api/preview/small/Pictures/missing.png", http.StatusNotFound},
+			{"/api/preview/small/.trash/wide.png", http.StatusForbidden},
+		}
+		for _, c := range cases {
+			if w := get(c.path, nil); w.Code != c.code {
+				t.Errorf("%s: expected %d, got %d", c.path, c.code, w.Code)
+			}
+		}
+	})
+
+	t.Run("CleanedUpOnTrash", func(t *testing.T) {
+		cached := filepath.Join(cacheDir, "*", "Pictures", "wide.png@")
+		if m, _ := filepath.Glob(cached); len(m) == 0 {
+			t.Fatal("Expected a cached preview before deleting")
+		}
+		if w := env.requestAs(token, "DELETE", "/api/resources/Pictures/wide.png"); w.Code != http.StatusOK && w.Code != http.StatusNoContent {
+			t.Fatalf("Delete failed: %d %s", w.Code, w.Body.String())
+		}
+		if m, _ := filepath.Glob(cached); len(m) != 0 {
+			t.Errorf("Preview cache left behind: %v", m)
+		}
+	})
+}
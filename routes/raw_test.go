@@ -0,0 +1,103 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRawGet(t *testing.T) {
+	env := setupTestEnv(t)
+	user, token := env.createReadyUser(t, "heidi")
+
+	os.MkdirAll(filepath.Join(user.StoragePath, "Videos"), 0755)
+	content := "0123456789abcdefghij"
+	os.WriteFile(filepath.Join(user.StoragePath, "Videos", "clip.mp4"), []byte(content), 0644)
+	os.WriteFile(filepath.Join(user.StoragePath, "Videos", "résumé.txt"), []byte("bonjour"), 0644)
+
+	raw := func(method, path string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		env.Router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := raw("GET", "/api/raw/Videos/clip.mp4", nil)
+	if w.Code != http.StatusOK || w.Body.String() != content {
+		t.Fatalf("Full download failed: %d %q", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Content-Length") != "20" || w.Header().Get("Accept-Ranges") != "bytes" {
+		t.Errorf("Unexpected headers: %v", w.Header())
+	}
+	etag := w.Header().Get("ETag")
+	if !strings.HasPrefix(etag, `"`) {
+		t.Fatalf("Expected a strong ETag, got %q", etag)
+	}
+	if d := w.Header().Get("Content-Disposition"); d != `attachment; filename="clip.mp4"` {
+		t.Errorf("Unexpected disposition %q", d)
+	}
+
+	t.Run("SingleRange", func(t *testing.T) {
+		w := raw("GET", "/api/raw/Videos/clip.mp4", map[string]string{"Range": "bytes=5-9"})
+		if w.Code != http.StatusPartialContent || w.Body.String() != "56789" {
+			t.Fatalf("Expected 206 with 56789, got %d %q", w.Code, w.Body.String())
+		}
+		if cr := w.Header().Get("Content-Range"); cr != "bytes 5-9/20" {
+			t.Errorf("Unexpected Content-Range %q", cr)
+		}
+	})
+
+	t.Run("MultiRange", func(t *testing.T) {
+		w := raw("GET", "/api/raw/Videos/clip.mp4", map[string]string{"Range": "bytes=0-1,-2"})
+		if w.Code != http.StatusPartialContent || !strings.HasPrefix(w.Header().Get("Content-Type"), "multipart/byteranges") {
+			t.Fatalf("Expected multipart/byteranges, got %d %s", w.Code, w.Header().Get("Content-Type"))
+		}
+		if body := w.Body.String(); !strings.Contains(body, "bytes 0-1/20") || !strings.Contains(body, "bytes 18-19/20") {
+			t.Errorf("Missing parts in %q", body)
+		}
+	})
+
+	t.Run("Unsatisfiable", func(t *testing.T) {
+		w := raw("GET", "/api/raw/Videos/clip.mp4", map[string]string{"Range": "bytes=50-60"})
+		if w.Code != http.StatusRequestedRangeNotSatisfiable {
+			t.Fatalf("Expected 416, got %d", w.Code)
+		}
+	})
+
+	t.Run("Conditional", func(t *testing.T) {
+		if w := raw("GET", "/api/raw/Videos/clip.mp4", map[string]string{"If-None-Match": etag}); w.Code != http.StatusNotModified {
+			t.Errorf("If-None-Match: expected 304, got %d", w.Code)
+		}
+		since := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+		if w := raw("GET", "/api/raw/Videos/clip.mp4", map[string]string{"If-Modified-Since": since}); w.Code != http.StatusNotModified {
+			t.Errorf("If-Modified-Since: expected 304, got %d", w.Code)
+		}
+		w := raw("GET", "/api/raw/Videos/clip.mp4", map[string]string{"Range": "bytes=0-3", "If-Range": `"stale"`})
+		if w.Code != http.StatusOK {
+			t.Errorf("If-Range with a stale ETag: expected 200, got %d", w.Code)
+		}
+	})
+
+	t.Run("Head", func(t *testing.T) {
+		w := raw("HEAD", "/api/raw/Videos/clip.mp4", nil)
+		if w.Code != http.StatusOK || w.Body.Len() != 0 || w.Header().Get("Content-Length") != "20" {
+			t.Fatalf("Unexpected HEAD response: %d %v", w.Code, w.Header())
+		}
+	})
+
+	t.Run("Disposition", func(t *testing.T) {
+		w := raw("GET", "/api/raw/Videos/r%C3%A9sum%C3%A9.txt?disposition=inline", nil)
+		want := `inline; filename="r_sum_.txt"; filename*=UTF-8''r%C3%A9sum%C3%A9.txt`
+		if d := w.Header().Get("Content-Disposition"); d != want {
+			t.Errorf("Expected %q, got %q", want, d)
+		}
+	})
+}
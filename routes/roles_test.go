@@ -0,0 +1,172 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/satufile/satufile/auth"
+	"github.com/satufile/satufile/spaces"
+	"github.com/satufile/satufile/users"
+)
+
+func TestRolesAndGroups(t *testing.T) {
+	env := setupTestEnv(t)
+	admin, adminToken := env.createReadyUser(t, "root")
+	env.DB.Model(admin).Update("admin", true)
+	bob, bobToken := env.createReadyUser(t, "bob")
+	carol, carolToken := env.createReadyUser(t, "carol")
+
+	as := func(token, method, path string, body interface{}) *httptest.ResponseRecorder {
+		return env.makeRequestWithBadHeader(method, path, body, "Bearer "+token)
+	}
+	upload := func(token, path string) int {
+		req := httptest.NewRequest("POST", "/api/resources"+path, strings.NewReader("data"))
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		env.Router.ServeHTTP(w, req)
+		return w.Code
+	}
+	me := func(token string) users.UserInfo {
+		t.Helper()
+		w := as(token, "GET", "/api/me", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET /api/me failed: %d %s", w.Code, w.Body.String())
+		}
+		var info users.UserInfo
+		json.NewDecoder(w.Body).Decode(&info)
+		return info
+	}
+
+	// The default roles are seeded with exactly their permissions
+	w := as(adminToken, "GET", "/api/admin/roles", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Listing roles failed: %d %s", w.Code, w.Body.String())
+	}
+	var roles []users.Role
+	json.NewDecoder(w.Body).Decode(&roles)
+	byName := map[string]users.Role{}
+	for _, role := range roles {
+		byName[role.Name] = role
+	}
+	viewer, adminRole := byName["viewer"], byName["admin"]
+	if viewer.ID == 0 || adminRole.ID == 0 || byName["editor"].ID == 0 {
+		t.Fatalf("Expected the default roles, got %+v", roles)
+	}
+	if viewer.Perm != (users.Permissions{Download: true}) {
+		t.Errorf("Unexpected viewer permissions: %+v", viewer.Perm)
+	}
+	if w := as(adminToken, "POST", "/api/admin/roles", map[string]interface{}{"name": "viewer"}); w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for a duplicate role, got %d", w.Code)
+	}
+	if w := as(adminToken, "POST", "/api/admin/roles", map[string]interface{}{"name": "x", "perm": map[string]bool{"fly": true}}); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown permission, got %d", w.Code)
+	}
+	if w := as(bobToken, "GET", "/api/admin/roles", nil); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a non-admin, got %d", w.Code)
+	}
+
+	// A group's roles replace the member's own flags
+	w = as(adminToken, "POST", "/api/admin/groups", map[string]interface{}{"name": "readers", "roles": []uint{viewer.ID}})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Creating a group failed: %d %s", w.Code, w.Body.String())
+	}
+	var group users.Group
+	json.NewDecoder(w.Body).Decode(&group)
+	members := fmt.Sprintf("/api/admin/groups/%d/members/%d", group.ID, bob.ID)
+	if w := as(adminToken, "PUT", members, nil); w.Code != http.StatusOK {
+		t.Fatalf("Adding a member failed: %d %s", w.Code, w.Body.String())
+	}
+
+	info := me(bobToken)
+	if info.EffectivePerm != (users.Permissions{Download: true}) || !info.Perm.Create {
+		t.Errorf("Expected viewer permissions over bob's own flags, got %+v / %+v", info.EffectivePerm, info.Perm)
+	}
+	if len(info.Roles) != 1 || info.Roles[0] != "viewer" || len(info.Groups) != 1 || info.Groups[0] != "readers" {
+		t.Errorf("Unexpected roles and groups: %v %v", info.Roles, info.Groups)
+	}
+	if code := upload(bobToken, "/a.txt"); code != http.StatusForbidden {
+		t.Errorf("Expected 403 uploading as a viewer, got %d", code)
+	}
+
+	// Overrides apply on top of the roles
+	access := fmt.Sprintf("/api/admin/users/%d/access", bob.ID)
+	w = as(adminToken, "PUT", access, map[string]interface{}{"overrides": map[string]bool{"create": true}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Setting overrides failed: %d %s", w.Code, w.Body.String())
+	}
+	var resolved struct {
+		Groups        []uint            `json:"groups"`
+		EffectivePerm users.Permissions `json:"effectivePerm"`
+	}
+	json.NewDecoder(w.Body).Decode(&resolved)
+	if !resolved.EffectivePerm.Create || resolved.EffectivePerm.Delete || len(resolved.Groups) != 1 {
+		t.Errorf("Unexpected access: %+v", resolved)
+	}
+	if code := upload(bobToken, "/a.txt"); code != http.StatusCreated {
+		t.Errorf("Expected the override to allow uploads, got %d", code)
+	}
+
+	// Tokens carry the resolved permissions
+	loaded, err := env.UserRepo.GetByID(bob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _ := auth.GenerateToken(loaded, time.Hour)
+	claims, err := auth.ValidateToken(token)
+	if err != nil || !claims.Perm.Create || claims.Perm.Delete || claims.IsAdmin {
+		t.Errorf("Unexpected claims: %+v %v", claims, err)
+	}
+
+	// A role can make someone an admin
+	if w := as(carolToken, "GET", "/api/admin/users", nil); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 before the role, got %d", w.Code)
+	}
+	w = as(adminToken, "PUT", fmt.Sprintf("/api/admin/users/%d/access", carol.ID), map[string]interface{}{"roles": []uint{adminRole.ID}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Giving a role failed: %d %s", w.Code, w.Body.String())
+	}
+	if w := as(carolToken, "GET", "/api/admin/users", nil); w.Code != http.StatusOK {
+		t.Errorf("Expected the admin role to open the admin API, got %d", w.Code)
+	}
+	if w := as(adminToken, "PUT", fmt.Sprintf("/api/admin/users/%d/access", carol.ID), map[string]interface{}{"roles": []uint{999}}); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown role, got %d", w.Code)
+	}
+
+	// Group entries of a space's access list admit the group's members
+	store, err := spaces.NewStore(env.DB, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.SetGroups(env.UserRepo.GroupIDs)
+	env.Deps.Spaces = store
+	sp, _ := store.Create("Handbook", 1)
+	if err := store.Grant(spaces.Entry{SpaceID: sp.ID, GroupID: group.ID, Access: spaces.Access{Read: true}}); err != nil {
+		t.Fatal(err)
+	}
+	if w := as(bobToken, "GET", "/api/resources/Spaces/Handbook", nil); w.Code != http.StatusOK {
+		t.Errorf("Expected the group to open the space, got %d", w.Code)
+	}
+
+	// Leaving the group restores the user's own flags
+	if w := as(adminToken, "DELETE", members, nil); w.Code != http.StatusOK {
+		t.Fatalf("Removing a member failed: %d %s", w.Code, w.Body.String())
+	}
+	if info := me(bobToken); !info.EffectivePerm.Delete || len(info.Groups) != 0 {
+		t.Errorf("Expected bob's own flags back, got %+v %v", info.EffectivePerm, info.Groups)
+	}
+	if w := as(bobToken, "GET", "/api/resources/Spaces/Handbook", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 after leaving the group, got %d", w.Code)
+	}
+
+	if w := as(adminToken, "DELETE", fmt.Sprintf("/api/admin/roles/%d", viewer.ID), nil); w.Code != http.StatusNoContent {
+		t.Errorf("Deleting a role failed: %d", w.Code)
+	}
+	if w := as(adminToken, "DELETE", fmt.Sprintf("/api/admin/groups/%d", group.ID), nil); w.Code != http.StatusNoContent {
+		t.Errorf("Deleting a group failed: %d", w.Code)
+	}
+}
@@ -1,28 +1,37 @@
 package routes
 
 import (
-	"path/filepath"
-
 	"github.com/gorilla/mux"
 
+	"github.com/satufile/satufile/accounts"
 	"github.com/satufile/satufile/auth"
+	"github.com/satufile/satufile/dedup"
 	"github.com/satufile/satufile/middleware"
+	"github.com/satufile/satufile/preview"
 	"github.com/satufile/satufile/routes/api"
+	"github.com/satufile/satufile/search"
 	"github.com/satufile/satufile/share"
+	"github.com/satufile/satufile/spaces"
+	"github.com/satufile/satufile/storage"
 	"github.com/satufile/satufile/system/detection"
 	"github.com/satufile/satufile/system/partition"
+	"github.com/satufile/satufile/trash"
 	"github.com/satufile/satufile/uploads"
 	"github.com/satufile/satufile/users"
+	"github.com/satufile/satufile/versions"
 )
 
 // RegisterRoutes registers all file-based routes
-func RegisterRoutes(r *mux.Router, userRepo *users.Repository, root string, shareStorage share.StorageBackend, uploadsStorage uploads.StorageBackend) {
+func RegisterRoutes(r *mux.Router, userRepo *users.Repository, root string, shareStorage share.StorageBackend, uploadsStorage uploads.StorageBackend, events api.EventPublisher, janitor *trash.Janitor, dedupStore *dedup.Store, index *search.Index, previews *preview.Service, versionStore *versions.Store, spaceStore *spaces.Store) {
 	// Ensure we use a writable path for user partitions
-	absRoot, err := filepath.Abs(root)
-	if err != nil {
-		absRoot = root // Fallback
+	storageManager := partition.NewManager(partition.BasePath(root))
+
+	// Deleted users' files are archived next to the partitions
+	accountManager := accounts.NewManager(storage.GetDB(), userRepo, storageManager, accounts.ArchiveDir(root))
+	accountManager.SetIndex(index)
+	if spaceStore != nil {
+		accountManager.SetSpaces(spaceStore)
 	}
-	storagePath := filepath.Join(absRoot, "data", "cloud-storage")
 
 	// API dependencies
 	apiDeps := &api.Deps{
@@ -31,7 +40,15 @@ func RegisterRoutes(r *mux.Router, userRepo *users.Repository, root string, shar
 		Uploads:        uploadsStorage,
 		DataDir:        root,
 		Detector:       detection.NewDetector(),
-		StorageManager: partition.NewManager(storagePath),
+		StorageManager: storageManager,
+		Events:         events,
+		Janitor:        janitor,
+		Dedup:          dedupStore,
+		Index:          index,
+		Previews:       previews,
+		Versions:       versionStore,
+		Accounts:       accountManager,
+		Spaces:         spaceStore,
 	}
 
 	RegisterAPIRoutes(r, apiDeps)
@@ -52,6 +69,19 @@ func RegisterAPIRoutes(r *mux.Router, apiDeps *api.Deps) {
 	apiRouter.Handle("/login", middleware.LoginRateLimit(api.LoginPost(apiDeps))).Methods("POST")
 
 	apiRouter.HandleFunc("/share/public", api.SharePublicGet(apiDeps, apiDeps.DataDir)).Methods("GET") // Public share access
+	apiRouter.Handle("/share/public/unlock", middleware.LoginRateLimit(api.SharePublicUnlockPost(apiDeps))).Methods("POST")
+
+	// Anonymous tus uploads through upload links
+	apiRouter.HandleFunc("/share/public/{token}/tus", api.TusOptions(apiDeps)).Methods("OPTIONS")
+	apiRouter.HandleFunc("/share/public/{token}/tus/{id}", api.TusOptions(apiDeps)).Methods("OPTIONS")
+	apiRouter.HandleFunc("/share/public/{token}/tus", api.ShareTusCreate(apiDeps)).Methods("POST")
+	apiRouter.HandleFunc("/share/public/{token}/tus/{id}", api.ShareTusHead(apiDeps)).Methods("HEAD")
+	apiRouter.HandleFunc("/share/public/{token}/tus/{id}", api.ShareTusPatch(apiDeps)).Methods("PATCH")
+	apiRouter.HandleFunc("/share/public/{token}/tus/{id}", api.ShareTusDelete(apiDeps)).Methods("DELETE")
+
+	// tus discovery must work before the client authenticates
+	apiRouter.HandleFunc("/tus", api.TusOptions(apiDeps)).Methods("OPTIONS")
+	apiRouter.HandleFunc("/tus/{id}", api.TusOptions(apiDeps)).Methods("OPTIONS")
 
 	// ===== Protected Routes =====
 	protectedAPI := apiRouter.NewRoute().Subrouter()
@@ -79,8 +109,15 @@ func RegisterAPIRoutes(r *mux.Router, apiDeps *api.Deps) {
 	protectedAPI.HandleFunc("/resources/{path:.*}", api.ResourceDelete(apiDeps)).Methods("DELETE")
 	protectedAPI.HandleFunc("/resources/{path:.*}", api.ResourcePatch(apiDeps)).Methods("PATCH")
 
+	// Batch operations (multi-select actions)
+	protectedAPI.HandleFunc("/batch", api.BatchPost(apiDeps)).Methods("POST")
+	protectedAPI.HandleFunc("/batch/{id}", api.BatchGet(apiDeps)).Methods("GET")
+
+	// Image previews
+	protectedAPI.HandleFunc("/preview/{size}/{path:.*}", api.PreviewGet(apiDeps)).Methods("GET", "HEAD")
+
 	// Raw file download
-	protectedAPI.HandleFunc("/raw/{path:.*}", api.RawGet(apiDeps)).Methods("GET")
+	protectedAPI.HandleFunc("/raw/{path:.*}", api.RawGet(apiDeps)).Methods("GET", "HEAD")
 
 	// Storage usage
 	protectedAPI.HandleFunc("/storage", api.StorageStatsGet(apiDeps)).Methods("GET")
@@ -90,6 +127,16 @@ func RegisterAPIRoutes(r *mux.Router, apiDeps *api.Deps) {
 	// Search
 	protectedAPI.HandleFunc("/search", api.SearchGet(apiDeps)).Methods("GET")
 
+	// Shared spaces
+	protectedAPI.HandleFunc("/spaces", api.SpacesGet(apiDeps)).Methods("GET")
+
+	// File versions
+	protectedAPI.HandleFunc("/versions", api.VersionsGet(apiDeps)).Methods("GET")
+	protectedAPI.HandleFunc("/versions", api.VersionsDelete(apiDeps)).Methods("DELETE")
+	protectedAPI.HandleFunc("/versions/{id}/raw", api.VersionRawGet(apiDeps)).Methods("GET", "HEAD")
+	protectedAPI.HandleFunc("/versions/{id}/restore", api.VersionRestore(apiDeps)).Methods("POST")
+	protectedAPI.HandleFunc("/versions/{id}", api.VersionDelete(apiDeps)).Methods("DELETE")
+
 	// Trash endpoints
 	protectedAPI.HandleFunc("/trash", api.TrashGet(apiDeps)).Methods("GET")
 	protectedAPI.HandleFunc("/trash", api.TrashEmpty(apiDeps)).Methods("DELETE")
@@ -105,6 +152,48 @@ func RegisterAPIRoutes(r *mux.Router, apiDeps *api.Deps) {
 	// Upload endpoints (resumable uploads)
 	protectedAPI.HandleFunc("/uploads", api.UploadCreate(apiDeps)).Methods("POST")
 	protectedAPI.HandleFunc("/uploads/{id}", api.UploadChunk(apiDeps)).Methods("PATCH")
+	protectedAPI.HandleFunc("/uploads/{id}/chunks", api.UploadChunksPost(apiDeps)).Methods("POST")
 	protectedAPI.HandleFunc("/uploads/{id}", api.UploadProgress(apiDeps)).Methods("GET")
 	protectedAPI.HandleFunc("/uploads/{id}", api.UploadCancel(apiDeps)).Methods("DELETE")
+
+	// tus 1.0 resumable uploads (Uppy, tus-js-client, ...)
+	protectedAPI.HandleFunc("/tus", api.TusCreate(apiDeps)).Methods("POST")
+	protectedAPI.HandleFunc("/tus/{id}", api.TusHead(apiDeps)).Methods("HEAD")
+	protectedAPI.HandleFunc("/tus/{id}", api.TusPatch(apiDeps)).Methods("PATCH")
+	protectedAPI.HandleFunc("/tus/{id}", api.TusDelete(apiDeps)).Methods("DELETE")
+
+	// ===== Admin Routes =====
+	adminAPI := apiRouter.PathPrefix("/admin").Subrouter()
+	adminAPI.Use(auth.RequireAdmin(apiDeps.UserRepo))
+	adminAPI.HandleFunc("/users", api.AdminUsersGet(apiDeps)).Methods("GET")
+	adminAPI.HandleFunc("/users", api.AdminUserPost(apiDeps)).Methods("POST")
+	adminAPI.HandleFunc("/users/{id}", api.AdminUserGet(apiDeps)).Methods("GET")
+	adminAPI.HandleFunc("/users/{id}", api.AdminUserPut(apiDeps)).Methods("PUT")
+	adminAPI.HandleFunc("/users/{id}", api.AdminUserDelete(apiDeps)).Methods("DELETE")
+	adminAPI.HandleFunc("/users/{id}/access", api.AdminUserAccessGet(apiDeps)).Methods("GET")
+	adminAPI.HandleFunc("/users/{id}/access", api.AdminUserAccessPut(apiDeps)).Methods("PUT")
+	adminAPI.HandleFunc("/roles", api.AdminRolesGet(apiDeps)).Methods("GET")
+	adminAPI.HandleFunc("/roles", api.AdminRolePost(apiDeps)).Methods("POST")
+	adminAPI.HandleFunc("/roles/{id}", api.AdminRolePut(apiDeps)).Methods("PUT")
+	adminAPI.HandleFunc("/roles/{id}", api.AdminRoleDelete(apiDeps)).Methods("DELETE")
+	adminAPI.HandleFunc("/groups", api.AdminGroupsGet(apiDeps)).Methods("GET")
+	adminAPI.HandleFunc("/groups", api.AdminGroupPost(apiDeps)).Methods("POST")
+	adminAPI.HandleFunc("/groups/{id}", api.AdminGroupPut(apiDeps)).Methods("PUT")
+	adminAPI.HandleFunc("/groups/{id}", api.AdminGroupDelete(apiDeps)).Methods("DELETE")
+	adminAPI.HandleFunc("/groups/{id}/members/{userId}", api.AdminGroupMemberPut(apiDeps)).Methods("PUT")
+	adminAPI.HandleFunc("/groups/{id}/members/{userId}", api.AdminGroupMemberDelete(apiDeps)).Methods("DELETE")
+	adminAPI.HandleFunc("/spaces", api.AdminSpacesGet(apiDeps)).Methods("GET")
+	adminAPI.HandleFunc("/spaces", api.AdminSpacePost(apiDeps)).Methods("POST")
+	adminAPI.HandleFunc("/spaces/{id}", api.AdminSpaceGet(apiDeps)).Methods("GET")
+	adminAPI.HandleFunc("/spaces/{id}", api.AdminSpacePut(apiDeps)).Methods("PUT")
+	adminAPI.HandleFunc("/spaces/{id}", api.AdminSpaceDelete(apiDeps)).Methods("DELETE")
+	adminAPI.HandleFunc("/spaces/{id}/acl", api.AdminSpaceACLPut(apiDeps)).Methods("PUT")
+	adminAPI.HandleFunc("/trash/purges", api.AdminTrashPurgesGet(apiDeps)).Methods("GET")
+	adminAPI.HandleFunc("/trash/purge", api.AdminTrashPurgePost(apiDeps)).Methods("POST")
+
+	// ===== WebDAV =====
+	// Mounted outside /api so file managers can use it as a network drive.
+	// Clients send their password with every request, so failed ones are
+	// throttled like logins.
+	r.PathPrefix(auth.DAVPrefix).Handler(middleware.FailedLoginRateLimit(auth.RequireAuth(apiDeps.UserRepo)(api.WebDAV(apiDeps, auth.DAVPrefix))))
 }
@@ -0,0 +1,115 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSearchIndex(t *testing.T) {
+	env := setupTestEnv(t)
+	user, token := env.createReadyUser(t, "ivan")
+
+	write := func(rel string, size int, mod time.Time) {
+		full := filepath.Join(user.StoragePath, rel)
+		os.MkdirAll(filepath.Dir(full), 0755)
+		os.WriteFile(full, make([]byte, size), 0644)
+		os.Chtimes(full, mod, mod)
+	}
+	old := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	recent := time.Now().Add(-time.Hour)
+	write("Documents/report-2020.pdf", 100, old)
+	write("Documents/notes.txt", 10, recent)
+	write("Pictures/Holiday/beach.jpg", 5000, recent)
+	write("Pictures/Holiday/report.png", 20, recent)
+	os.MkdirAll(filepath.Join(user.StoragePath, ".trash"), 0755)
+	os.WriteFile(filepath.Join(user.StoragePath, ".trash", "report-deleted.txt"), nil, 0644)
+
+	type response struct {
+		Results []struct {
+			Path  string `json:"path"`
+			IsDir bool   `json:"isDir"`
+		} `json:"results"`
+		Total int `json:"total"`
+	}
+	searchFor := func(query string) response {
+		t.Helper()
+		w := env.requestAs(token, "GET", "/api/search?"+query)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Search %q failed: %d %s", query, w.Code, w.Body.String())
+		}
+		var resp response
+		json.NewDecoder(w.Body).Decode(&resp)
+		return resp
+	}
+	paths := func(resp response) []string {
+		var out []string
+		for _, r := range resp.Results {
+			out = append(out, r.Path)
+		}
+		return out
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"q=REPORT", []string{"/Documents/report-2020.pdf", "/Pictures/Holiday/report.png"}},
+		{"q=report&type=pdf", []string{"/Documents/report-2020.pdf"}},
+		{"ext=jpg,.PNG", []string{"/Pictures/Holiday/beach.jpg", "/Pictures/Holiday/report.png"}},
+		{"minSize=50&maxSize=1000", []string{"/Documents/report-2020.pdf"}},
+		{"q=o&before=2021-01-01", []string{"/Documents/report-2020.pdf"}},
+		{"q=report&after=" + recent.Add(-time.Minute).Format(time.RFC3339), []string{"/Pictures/Holiday/report.png"}},
+		{"path=/Pictures", []string{"/Pictures/Holiday", "/Pictures/Holiday/beach.jpg", "/Pictures/Holiday/report.png"}},
+		{"type=dir&q=holi", []string{"/Pictures/Holiday"}},
+		{"q=x", nil},
+	}
+	for _, tt := range tests {
+		if got := paths(searchFor(tt.query)); !equalStrings(got, tt.want) {
+			t.Errorf("%s: expected %v, got %v", tt.query, tt.want, got)
+		}
+	}
+
+	// Pagination reports the total
+	page := searchFor("path=/Pictures&limit=2&offset=2")
+	if page.Total != 3 || len(page.Results) != 1 || page.Results[0].Path != "/Pictures/Holiday/report.png" {
+		t.Errorf("Unexpected page: %+v", page)
+	}
+
+	if w := env.requestAs(token, "GET", "/api/search?minSize=big"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid size, got %d", w.Code)
+	}
+
+	// API changes keep the index current
+	w := env.makeRequestWithBadHeader("PATCH", "/api/resources/Documents/notes.txt", map[string]string{
+		"action": "move", "destination": "/Pictures/Holiday/notes.txt",
+	}, "Bearer "+token)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Move failed: %d %s", w.Code, w.Body.String())
+	}
+	if got := paths(searchFor("q=notes")); !equalStrings(got, []string{"/Pictures/Holiday/notes.txt"}) {
+		t.Errorf("Expected the moved file at its new path, got %v", got)
+	}
+
+	if w := env.requestAs(token, "DELETE", "/api/resources/Pictures/Holiday"); w.Code != http.StatusNoContent {
+		t.Fatalf("Delete failed: %d", w.Code)
+	}
+	if got := searchFor("path=/Pictures"); got.Total != 0 {
+		t.Errorf("Expected deleted folder to leave the index, got %v", paths(got))
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
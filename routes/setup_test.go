@@ -5,15 +5,23 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/satufile/satufile/auth"
+	"github.com/satufile/satufile/checksum"
 	"github.com/satufile/satufile/routes/api"
+	"github.com/satufile/satufile/search"
+	"github.com/satufile/satufile/share"
+	"github.com/satufile/satufile/storage"
 	"github.com/satufile/satufile/system/detection"
+	"github.com/satufile/satufile/trash"
+	"github.com/satufile/satufile/uploads"
 	"github.com/satufile/satufile/users"
+	"github.com/satufile/satufile/versions"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
@@ -54,8 +62,21 @@ func (m *MockPartitionManager) GetStoragePath(username string) string {
 	return filepath.Join("/tmp", "data", "cloud-storage", username)
 }
 
+func (m *MockPartitionManager) Resize(fullPath string, sizeGb int) error {
+	return m.Err
+}
+
+func (m *MockPartitionManager) Archive(fullPath, dest string) (string, error) {
+	return dest, os.Rename(fullPath, dest)
+}
+
+func (m *MockPartitionManager) Remove(fullPath string) error {
+	return os.RemoveAll(fullPath)
+}
+
 type TestEnv struct {
 	DB            *gorm.DB
+	Deps          *api.Deps
 	UserRepo      *users.Repository
 	Router        *mux.Router
 	MockDetector  *MockDetector
@@ -70,9 +91,16 @@ func setupTestEnv(t *testing.T) *TestEnv {
 	if err != nil {
 		t.Fatalf("failed to connect database: %v", err)
 	}
+	// Every connection to :memory: opens a new, empty database, so
+	// background work has to share the one the tables are in
+	if sqlDB, err := db.DB(); err == nil {
+		sqlDB.SetMaxOpenConns(1)
+	}
 
 	userRepo := users.NewRepository(db)
 	userRepo.Migrate()
+	db.AutoMigrate(&trash.TrashItem{}, &trash.Purge{}, &checksum.Record{})
+	storage.DB = db
 
 	// Setup mocks
 	mockDetector := &MockDetector{
@@ -89,11 +117,30 @@ func setupTestEnv(t *testing.T) *TestEnv {
 	}
 	mockPartition := &MockPartitionManager{}
 
+	uploadsStorage, err := uploads.NewStorage(db)
+	if err != nil {
+		t.Fatalf("failed to create upload storage: %v", err)
+	}
+
+	index, err := search.NewIndex(db)
+	if err != nil {
+		t.Fatalf("failed to create search index: %v", err)
+	}
+
+	versionStore, err := versions.NewStore(db, versions.Policy{Count: 10})
+	if err != nil {
+		t.Fatalf("failed to create version store: %v", err)
+	}
+
 	apiDeps := &api.Deps{
 		UserRepo:       userRepo,
 		DataDir:        "/tmp",
 		Detector:       mockDetector,
 		StorageManager: mockPartition,
+		Uploads:        uploadsStorage,
+		Share:          share.NewMemoryStorage(),
+		Index:          index,
+		Versions:       versionStore,
 	}
 
 	r := mux.NewRouter()
@@ -102,6 +149,7 @@ func setupTestEnv(t *testing.T) *TestEnv {
 
 	return &TestEnv{
 		DB:            db,
+		Deps:          apiDeps,
 		UserRepo:      userRepo,
 		Router:        r,
 		MockDetector:  mockDetector,
@@ -218,9 +266,9 @@ func TestSetupRedirect(t *testing.T) {
 	env := setupTestEnv(t)
 	env.createUser(t, "redirectuser", "password")
 
-	// Accessing /api/me (protected, NOT whitelisted) should return 403 (with my fix)
-	// Wait, my fix returns 403 for /api/ routes.
-	w := env.makeRequest("GET", "/api/me", nil)
+	// Accessing /api/trash (protected, NOT whitelisted) should return 403;
+	// /api/me is whitelisted so the setup UI can load the user
+	w := env.makeRequest("GET", "/api/trash", nil)
 	if w.Code != http.StatusForbidden {
 		t.Errorf("Expected 403 Forbidden for non-whitelisted route during setup, got %d", w.Code)
 	}
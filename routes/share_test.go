@@ -0,0 +1,472 @@
+package routes
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/satufile/satufile/routes/api"
+	"github.com/satufile/satufile/share"
+)
+
+func TestShareRestrictions(t *testing.T) {
+	env := setupTestEnv(t)
+	owner, token := env.createReadyUser(t, "owner")
+	if err := env.DB.AutoMigrate(&share.Link{}); err != nil {
+		t.Fatal(err)
+	}
+	env.Deps.Share = share.NewDBStorage(env.DB)
+	os.WriteFile(filepath.Join(owner.StoragePath, "doc.txt"), []byte("hello world"), 0644)
+
+	link, _ := share.NewLink("/doc.txt", "file", 24)
+	link.OwnerID = owner.ID
+	link.MaxDownloads = 2
+	link.SetPassword("s3cret")
+	if err := env.Deps.Share.CreateLink(link); err != nil {
+		t.Fatal(err)
+	}
+
+	// unlock requests come from their own address so the login rate
+	// limit of other tests does not interfere
+	var unlocked, resume *http.Cookie
+	unlock := func(password string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]string{"token": link.Token, "password": password})
+		req := httptest.NewRequest("POST", "/api/share/public/unlock", strings.NewReader(string(body)))
+		req.RemoteAddr = "198.51.100.7:4000"
+		w := httptest.NewRecorder()
+		env.Router.ServeHTTP(w, req)
+		return w
+	}
+	visit := func(query, rng string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/share/public?token="+link.Token+query, nil)
+		if unlocked != nil {
+			req.AddCookie(unlocked)
+		}
+		if resume != nil {
+			req.AddCookie(resume)
+		}
+		if rng != "" {
+			req.Header.Set("Range", rng)
+		}
+		w := httptest.NewRecorder()
+		env.Router.ServeHTTP(w, req)
+		return w
+	}
+	update := func(fields map[string]interface{}) {
+		t.Helper()
+		fields["token"] = link.Token
+		if w := env.makeRequestWithBadHeader("PUT", "/api/share", fields, "Bearer "+token); w.Code != http.StatusOK {
+			t.Fatalf("Updating the link failed: %d %s", w.Code, w.Body.String())
+		}
+	}
+	errorCode := func(w *httptest.ResponseRecorder) string {
+		var body struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(w.Body).Decode(&body)
+		return body.Error
+	}
+
+	// A protected link needs the password first
+	if w := visit("", ""); w.Code != http.StatusUnauthorized || errorCode(w) != "password_required" {
+		t.Fatalf("Expected password_required, got %d %s", w.Code, w.Body.String())
+	}
+	if w := unlock("wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a wrong password, got %d", w.Code)
+	}
+	w := unlock("s3cret")
+	if w.Code != http.StatusNoContent || len(w.Result().Cookies()) != 1 {
+		t.Fatalf("Unlocking failed: %d %v", w.Code, w.Result().Cookies())
+	}
+	unlocked = w.Result().Cookies()[0]
+	if !unlocked.HttpOnly {
+		t.Error("Expected an HttpOnly unlock cookie")
+	}
+
+	w = visit("", "")
+	var info struct {
+		Mode          string `json:"mode"`
+		HasPassword   bool   `json:"has_password"`
+		DownloadsLeft *int   `json:"downloads_left"`
+	}
+	json.NewDecoder(w.Body).Decode(&info)
+	if w.Code != http.StatusOK || info.Mode != share.ModeDownload || !info.HasPassword || info.DownloadsLeft == nil || *info.DownloadsLeft != 2 {
+		t.Fatalf("Unexpected share info: %d %+v", w.Code, info)
+	}
+
+	// Downloads count until the limit. Only ranges resuming a counted
+	// download are free; viewing is free until the limit is used up.
+	w = visit("&download=true", "")
+	if w.Code != http.StatusOK || w.Body.String() != "hello world" {
+		t.Fatalf("First download failed: %d %s", w.Code, w.Body.String())
+	}
+	for _, c := range w.Result().Cookies() {
+		if c.Name == "share_resume_"+link.ID {
+			resume = c
+		}
+	}
+	if resume == nil {
+		t.Fatal("Expected a cookie to resume the download")
+	}
+	if w := visit("&download=true", "bytes=6-"); w.Code != http.StatusPartialContent {
+		t.Errorf("Expected a resumed range to be served, got %d", w.Code)
+	}
+	if w := visit("&inline=true", ""); w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Disposition"), "inline") {
+		t.Errorf("Expected the file inline, got %d %q", w.Code, w.Header().Get("Content-Disposition"))
+	}
+	if stored, _ := env.Deps.Share.GetLink(link.Token); stored.Downloads != 1 {
+		t.Errorf("Expected resuming and viewing not to count, got %d downloads", stored.Downloads)
+	}
+	resume = nil
+	if w := visit("&download=true", "bytes=1-"); w.Code != http.StatusPartialContent {
+		t.Fatalf("Second download failed: %d", w.Code)
+	}
+	if w := visit("&download=true", ""); w.Code != http.StatusGone || errorCode(w) != "download_limit" {
+		t.Errorf("Expected a range without the resume cookie to count, got %d %s", w.Code, w.Body.String())
+	}
+	if w := visit("&inline=true", ""); w.Code != http.StatusGone || errorCode(w) != "download_limit" {
+		t.Errorf("Expected no viewing past the limit, got %d %s", w.Code, w.Body.String())
+	}
+	stored, _ := env.Deps.Share.GetLink(link.Token)
+	if stored.Downloads != 2 {
+		t.Errorf("Expected 2 recorded downloads, got %d", stored.Downloads)
+	}
+
+	// View-only links can still be viewed, but only what a browser shows
+	update(map[string]interface{}{"mode": share.ModeView, "max_downloads": 0})
+	if w := visit("&download=true", ""); w.Code != http.StatusForbidden || errorCode(w) != "view_only" {
+		t.Errorf("Expected view_only, got %d %s", w.Code, w.Body.String())
+	}
+	if w := visit("&inline=true", ""); w.Code != http.StatusOK {
+		t.Errorf("Expected view-only links to be viewable, got %d", w.Code)
+	}
+	os.WriteFile(filepath.Join(owner.StoragePath, "data.bin"), []byte{0, 1, 2}, 0644)
+	binary, _ := share.NewLink("/data.bin", "file", 24)
+	binary.OwnerID = owner.ID
+	binary.Mode = share.ModeView
+	if err := env.Deps.Share.CreateLink(binary); err != nil {
+		t.Fatal(err)
+	}
+	w = env.makeRequest("GET", "/api/share/public?token="+binary.Token+"&inline=true", nil)
+	if w.Code != http.StatusUnsupportedMediaType || errorCode(w) != "not_previewable" {
+		t.Errorf("Expected a view-only binary not to be served, got %d %s", w.Code, w.Body.String())
+	}
+
+	// A new password locks out earlier visitors, an empty one removes it
+	update(map[string]interface{}{"password": "other"})
+	if w := visit("", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the old cookie to stop working, got %d", w.Code)
+	}
+	update(map[string]interface{}{"password": ""})
+	unlocked = nil
+	if w := visit("", ""); w.Code != http.StatusOK {
+		t.Errorf("Expected an open link without a password, got %d", w.Code)
+	}
+
+	// Visitors outside the allow list are turned away
+	update(map[string]interface{}{"allowed_ips": "10.0.0.0/8, 192.168.1.1"})
+	if w := visit("", ""); w.Code != http.StatusForbidden || errorCode(w) != "ip_not_allowed" {
+		t.Errorf("Expected ip_not_allowed, got %d %s", w.Code, w.Body.String())
+	}
+	stored, _ = env.Deps.Share.GetLink(link.Token)
+	if stored.AllowedIPs != "10.0.0.0/8,192.168.1.1" || stored.Mode != share.ModeView {
+		t.Errorf("Unexpected stored options: %+v", stored.Options)
+	}
+	update(map[string]interface{}{"allowed_ips": "192.0.2.0/24"})
+	if w := visit("", ""); w.Code != http.StatusOK {
+		t.Errorf("Expected the test client's address to be allowed, got %d", w.Code)
+	}
+
+	fields := map[string]interface{}{"token": link.Token, "allowed_ips": "nope"}
+	if w := env.makeRequestWithBadHeader("PUT", "/api/share", fields, "Bearer "+token); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid address, got %d", w.Code)
+	}
+}
+
+// eventLog records published events
+type eventLog struct {
+	mu     sync.Mutex
+	events []publishedEvent
+}
+
+type publishedEvent struct {
+	userID    uint
+	topic     string
+	eventType string
+	payload   interface{}
+}
+
+func (l *eventLog) Publish(userID uint, topic, eventType string, payload interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, publishedEvent{userID, topic, eventType, payload})
+}
+
+// of returns the events of eventType
+func (l *eventLog) of(eventType string) []publishedEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var events []publishedEvent
+	for _, e := range l.events {
+		if e.eventType == eventType {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+func TestShareUploadLink(t *testing.T) {
+	env := setupTestEnv(t)
+	owner, token := env.createReadyUser(t, "collector")
+	if err := env.DB.AutoMigrate(&share.Link{}); err != nil {
+		t.Fatal(err)
+	}
+	env.Deps.Share = share.NewDBStorage(env.DB)
+	events := &eventLog{}
+	env.Deps.Events = events
+
+	drop := filepath.Join(owner.StoragePath, "Drop")
+	os.MkdirAll(drop, 0755)
+	os.WriteFile(filepath.Join(drop, "a.txt"), []byte("old"), 0644)
+
+	w := env.makeRequestWithBadHeader("POST", "/api/share", map[string]interface{}{
+		"path": "/Drop", "type": share.TypeUpload, "max_uploads": 2, "max_upload_bytes": 20,
+	}, "Bearer "+token)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Creating the upload link failed: %d %s", w.Code, w.Body.String())
+	}
+	var link share.Link
+	json.NewDecoder(w.Body).Decode(&link)
+
+	// Visitors learn where to upload but not what is there
+	w = env.makeRequest("GET", "/api/share/public?token="+link.Token+"&download=true", nil)
+	var info struct {
+		Type      string `json:"type"`
+		UploadURL string `json:"upload_url"`
+	}
+	body := w.Body.String()
+	json.NewDecoder(strings.NewReader(body)).Decode(&info)
+	if w.Code != http.StatusOK || info.Type != share.TypeUpload || strings.Contains(body, "a.txt") || strings.Contains(body, "old") {
+		t.Fatalf("Unexpected upload link info: %d %s", w.Code, body)
+	}
+
+	b64 := base64.StdEncoding.EncodeToString
+	tus := func(method, path string, data []byte, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewReader(data))
+		req.Header.Set("Tus-Resumable", "1.0.0")
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		env.Router.ServeHTTP(w, req)
+		return w
+	}
+	create := func(name string, size int, data []byte) *httptest.ResponseRecorder {
+		headers := map[string]string{
+			"Upload-Length":   strconv.Itoa(size),
+			"Upload-Metadata": "filename " + b64([]byte(name)) + ",path " + b64([]byte("/../elsewhere")),
+		}
+		if data != nil {
+			headers["Content-Type"] = "application/offset+octet-stream"
+		}
+		return tus("POST", info.UploadURL, data, headers)
+	}
+	patch := func(location string, data []byte) *httptest.ResponseRecorder {
+		return tus("PATCH", location, data, map[string]string{
+			"Upload-Offset": "0",
+			"Content-Type":  "application/offset+octet-stream",
+		})
+	}
+
+	// Uploads land in the folder without replacing anything
+	if w := create("a.txt", 5, []byte("hello")); w.Code != http.StatusCreated {
+		t.Fatalf("Anonymous upload failed: %d %s", w.Code, w.Body.String())
+	}
+	if data, _ := os.ReadFile(filepath.Join(drop, "a.txt")); string(data) != "old" {
+		t.Errorf("Expected the existing file to be kept, got %q", data)
+	}
+	if data, _ := os.ReadFile(filepath.Join(drop, "a (1).txt")); string(data) != "hello" {
+		t.Errorf("Expected the upload next to it, got %q", data)
+	}
+	notified := events.of("SHARE_UPLOAD")
+	if len(notified) != 1 || notified[0].userID != owner.ID || notified[0].topic != api.TopicShares {
+		t.Fatalf("Expected the owner to be notified, got %+v", events.events)
+	}
+	if payload := notified[0].payload.(map[string]interface{}); payload["path"] != "/Drop/a (1).txt" {
+		t.Errorf("Unexpected event payload: %v", payload)
+	}
+
+	// Resumable uploads work as with /api/tus
+	w = create("b.txt", 5, nil)
+	location := w.Header().Get("Location")
+	if w.Code != http.StatusCreated || !strings.HasPrefix(location, info.UploadURL+"/") {
+		t.Fatalf("Creating an upload failed: %d %q", w.Code, location)
+	}
+	if w := tus("HEAD", location, nil, nil); w.Code != http.StatusOK || w.Header().Get("Upload-Offset") != "0" {
+		t.Errorf("HEAD failed: %d %v", w.Code, w.Header())
+	}
+	id := location[strings.LastIndex(location, "/")+1:]
+	if w := env.tusRequest(token, "HEAD", "/api/tus/"+id, nil, nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected anonymous uploads to stay out of /api/tus, got %d", w.Code)
+	}
+
+	// The caps are checked when an upload starts and when it completes
+	started := create("c.txt", 5, nil)
+	if w := patch(location, []byte("12345")); w.Code != http.StatusNoContent {
+		t.Fatalf("PATCH failed: %d %s", w.Code, w.Body.String())
+	}
+	if w := create("d.txt", 1, nil); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected the file cap to be reached, got %d", w.Code)
+	}
+	if w := patch(started.Header().Get("Location"), []byte("12345")); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected completing past the cap to fail, got %d", w.Code)
+	}
+	if _, err := os.Stat(filepath.Join(drop, "c.txt")); !os.IsNotExist(err) {
+		t.Errorf("Expected no file past the cap: %v", err)
+	}
+
+	w = env.makeRequestWithBadHeader("PUT", "/api/share", map[string]interface{}{"token": link.Token, "max_uploads": 0}, "Bearer "+token)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Updating the link failed: %d %s", w.Code, w.Body.String())
+	}
+	if w := create("e.txt", 11, nil); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected the size cap to be reached, got %d", w.Code)
+	}
+	stored, _ := env.Deps.Share.GetLink(link.Token)
+	if stored.Uploads != 2 || stored.UploadedBytes != 10 {
+		t.Errorf("Unexpected counters: %d uploads, %d bytes", stored.Uploads, stored.UploadedBytes)
+	}
+
+	// Download links do not accept uploads
+	file, _ := share.NewLink("/Drop/a.txt", share.TypeFile, 1)
+	file.OwnerID = owner.ID
+	env.Deps.Share.CreateLink(file)
+	info.UploadURL = "/api/share/public/" + file.Token + "/tus"
+	if w := create("f.txt", 1, nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 uploading through a download link, got %d", w.Code)
+	}
+}
+
+func TestShareLinksFollowTheirOwner(t *testing.T) {
+	env := setupTestEnv(t)
+	if err := env.DB.AutoMigrate(&share.Link{}); err != nil {
+		t.Fatal(err)
+	}
+	env.Deps.Share = share.NewDBStorage(env.DB)
+
+	link := func(user uint) *share.Link {
+		l, _ := share.NewLink("/Documents/x.txt", share.TypeFile, 1)
+		l.OwnerID = user
+		if err := env.Deps.Share.CreateLink(l); err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+	alice, aliceToken := env.createReadyUser(t, "alice")
+	bob, _ := env.createReadyUser(t, "bob")
+	for _, u := range []string{alice.StoragePath, bob.StoragePath} {
+		os.MkdirAll(filepath.Join(u, "Documents"), 0755)
+		os.WriteFile(filepath.Join(u, "Documents", "x.txt"), []byte("x"), 0644)
+	}
+	mine, theirs := link(alice.ID), link(bob.ID)
+
+	w := env.makeRequestWithBadHeader("PATCH", "/api/resources/Documents/x.txt", map[string]string{"newName": "y.txt"}, "Bearer "+aliceToken)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Rename failed: %d %s", w.Code, w.Body.String())
+	}
+	if l, _ := env.Deps.Share.GetLink(mine.Token); l.Path != "/Documents/y.txt" {
+		t.Errorf("Expected the renamer's link to follow, got %s", l.Path)
+	}
+	if l, _ := env.Deps.Share.GetLink(theirs.Token); l.Path != "/Documents/x.txt" {
+		t.Errorf("Expected another user's link left alone, got %s", l.Path)
+	}
+
+	os.MkdirAll(filepath.Join(alice.StoragePath, "Projects"), 0755)
+	w = env.makeRequestWithBadHeader("PATCH", "/api/resources/Documents/y.txt", map[string]string{
+		"action": "move", "destination": "/Projects/y.txt",
+	}, "Bearer "+aliceToken)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Move failed: %d %s", w.Code, w.Body.String())
+	}
+	if l, _ := env.Deps.Share.GetLink(mine.Token); l.Path != "/Projects/y.txt" {
+		t.Errorf("Expected the mover's link to follow, got %s", l.Path)
+	}
+	if l, _ := env.Deps.Share.GetLink(theirs.Token); l.Path != "/Documents/x.txt" {
+		t.Errorf("Expected another user's link left alone, got %s", l.Path)
+	}
+}
+
+func TestShareLinksBelongToTheirOwner(t *testing.T) {
+	env := setupTestEnv(t)
+	if err := env.DB.AutoMigrate(&share.Link{}); err != nil {
+		t.Fatal(err)
+	}
+	env.Deps.Share = share.NewDBStorage(env.DB)
+	events := &eventLog{}
+	env.Deps.Events = events
+
+	alice, aliceToken := env.createReadyUser(t, "alice")
+	_, bobToken := env.createReadyUser(t, "bob")
+	admin, adminToken := env.createReadyUser(t, "root")
+	env.DB.Model(admin).Update("admin", true)
+
+	link, _ := share.NewLink("/Documents/x.txt", share.TypeFile, 1)
+	link.OwnerID = alice.ID
+	if err := env.Deps.Share.CreateLink(link); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another user can neither change nor delete the link
+	w := env.makeRequestWithBadHeader("PUT", "/api/share", map[string]interface{}{"token": link.Token, "password": ""}, "Bearer "+bobToken)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 updating another user's link, got %d", w.Code)
+	}
+	if w := env.requestAs(bobToken, "DELETE", "/api/share?token="+link.Token); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 deleting another user's link, got %d", w.Code)
+	}
+	if _, err := env.Deps.Share.GetLink(link.Token); err != nil {
+		t.Fatalf("Expected the link to survive: %v", err)
+	}
+	if len(events.of("SHARE_UPDATED")) != 0 || len(events.of("SHARE_DELETED")) != 0 {
+		t.Errorf("Expected no events for refused changes")
+	}
+
+	// Nor see it
+	listed := func(token string) int {
+		var links []share.Link
+		json.NewDecoder(env.requestAs(token, "GET", "/api/shares").Body).Decode(&links)
+		return len(links)
+	}
+	if n := listed(bobToken); n != 0 {
+		t.Errorf("Expected bob to see no links, got %d", n)
+	}
+	if n := listed(aliceToken); n != 1 {
+		t.Errorf("Expected alice to see her link, got %d", n)
+	}
+	if n := listed(adminToken); n != 1 {
+		t.Errorf("Expected the admin to see every link, got %d", n)
+	}
+
+	// Admins may manage it; the owner hears about it
+	w = env.makeRequestWithBadHeader("PUT", "/api/share", map[string]interface{}{"token": link.Token, "max_downloads": 3}, "Bearer "+adminToken)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Admin update failed: %d %s", w.Code, w.Body.String())
+	}
+	if e := events.of("SHARE_UPDATED"); len(e) != 1 || e[0].userID != alice.ID {
+		t.Errorf("Expected SHARE_UPDATED sent to the owner, got %+v", e)
+	}
+	if w := env.requestAs(aliceToken, "DELETE", "/api/share?token="+link.Token); w.Code != http.StatusOK {
+		t.Fatalf("Owner delete failed: %d %s", w.Code, w.Body.String())
+	}
+	if e := events.of("SHARE_DELETED"); len(e) != 1 || e[0].userID != alice.ID {
+		t.Errorf("Expected SHARE_DELETED sent to the owner, got %+v", e)
+	}
+}
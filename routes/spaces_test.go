@@ -0,0 +1,228 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/satufile/satufile/spaces"
+	"github.com/satufile/satufile/trash"
+)
+
+func TestSpaces(t *testing.T) {
+	env := setupTestEnv(t)
+	store, err := spaces.NewStore(env.DB, t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create space store: %v", err)
+	}
+	env.Deps.Spaces = store
+
+	admin, adminToken := env.createReadyUser(t, "root")
+	env.DB.Model(admin).Update("admin", true)
+	ann, annToken := env.createReadyUser(t, "ann")
+	ben, benToken := env.createReadyUser(t, "ben")
+	_, calToken := env.createReadyUser(t, "cal")
+
+	as := func(token, method, path string, body interface{}) *httptest.ResponseRecorder {
+		return env.makeRequestWithBadHeader(method, path, body, "Bearer "+token)
+	}
+	upload := func(token, path, content string) int {
+		req := httptest.NewRequest("POST", "/api/resources"+path, strings.NewReader(content))
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		env.Router.ServeHTTP(w, req)
+		return w.Code
+	}
+	listPaths := func(token, path string) []string {
+		t.Helper()
+		w := as(token, "GET", "/api/resources"+path, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Listing %s failed: %d %s", path, w.Code, w.Body.String())
+		}
+		var listing struct {
+			Items []struct {
+				Path string `json:"path"`
+			} `json:"items"`
+		}
+		json.NewDecoder(w.Body).Decode(&listing)
+		var out []string
+		for _, item := range listing.Items {
+			out = append(out, item.Path)
+		}
+		return out
+	}
+
+	// Only admins manage spaces
+	if w := as(annToken, "POST", "/api/admin/spaces", map[string]interface{}{"name": "Marketing", "quotaGb": 1}); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a non-admin, got %d", w.Code)
+	}
+	w := as(adminToken, "POST", "/api/admin/spaces", map[string]interface{}{"name": "Marketing", "quotaGb": 1})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Create failed: %d %s", w.Code, w.Body.String())
+	}
+	var sp spaces.Space
+	json.NewDecoder(w.Body).Decode(&sp)
+	dir := store.Dir(sp.ID)
+	if w := as(adminToken, "POST", "/api/admin/spaces", map[string]interface{}{"name": "Marketing", "quotaGb": 1}); w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for a duplicate name, got %d", w.Code)
+	}
+
+	acl := "/api/admin/spaces/" + fmt.Sprint(sp.ID) + "/acl"
+	if w := as(adminToken, "PUT", acl, map[string]interface{}{"userId": ann.ID, "write": true, "delete": true}); w.Code != http.StatusOK {
+		t.Fatalf("Granting ann failed: %d %s", w.Code, w.Body.String())
+	}
+	if w := as(adminToken, "PUT", acl, map[string]interface{}{"userId": ben.ID, "read": true}); w.Code != http.StatusOK {
+		t.Fatalf("Granting ben failed: %d %s", w.Code, w.Body.String())
+	}
+	if w := as(adminToken, "PUT", acl, map[string]interface{}{"read": true}); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an entry without user or group, got %d", w.Code)
+	}
+
+	// Members see the mount, others do not
+	if paths := listPaths(annToken, "/"); !equalStrings(paths, []string{"/Spaces"}) {
+		t.Errorf("Expected the mount in ann's root, got %v", paths)
+	}
+	if paths := listPaths(calToken, "/"); len(paths) != 0 {
+		t.Errorf("Expected an empty root for a non-member, got %v", paths)
+	}
+	if paths := listPaths(benToken, "/Spaces"); !equalStrings(paths, []string{"/Spaces/Marketing"}) {
+		t.Errorf("Expected the space in the mount, got %v", paths)
+	}
+
+	// Writers upload into the space's folder; readers only download
+	if code := upload(annToken, "/Spaces/Marketing/plan.txt", "plan"); code != http.StatusCreated {
+		t.Fatalf("Upload failed: %d", code)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "plan.txt")); string(data) != "plan" {
+		t.Errorf("Upload did not land in the space: %q", data)
+	}
+	if code := upload(benToken, "/Spaces/Marketing/plan.txt", "mine"); code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a read-only member, got %d", code)
+	}
+	if w := as(benToken, "GET", "/api/raw/Spaces/Marketing/plan.txt", nil); w.Code != http.StatusOK || w.Body.String() != "plan" {
+		t.Errorf("Reader download failed: %d %q", w.Code, w.Body.String())
+	}
+	if w := as(calToken, "GET", "/api/raw/Spaces/Marketing/plan.txt", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a non-member, got %d", w.Code)
+	}
+	if code := upload(annToken, "/Spaces/new.txt", "x"); code == http.StatusCreated {
+		t.Errorf("Uploaded into the mount itself")
+	}
+
+	// Moving from home into the space
+	os.WriteFile(filepath.Join(ann.StoragePath, "draft.txt"), []byte("draft"), 0644)
+	w = as(annToken, "PATCH", "/api/resources/draft.txt", map[string]string{
+		"action": "move", "destination": "/Spaces/Marketing/draft.txt",
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Move failed: %d %s", w.Code, w.Body.String())
+	}
+	if _, err := os.Stat(filepath.Join(dir, "draft.txt")); err != nil {
+		t.Errorf("Moved file is not in the space: %v", err)
+	}
+
+	// Search covers the user's spaces, or one space below its path
+	search := func(token, query string) []string {
+		t.Helper()
+		w := as(token, "GET", "/api/search?"+query, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Search %q failed: %d %s", query, w.Code, w.Body.String())
+		}
+		var resp struct {
+			Results []struct {
+				Path string `json:"path"`
+			} `json:"results"`
+		}
+		json.NewDecoder(w.Body).Decode(&resp)
+		var out []string
+		for _, r := range resp.Results {
+			out = append(out, r.Path)
+		}
+		return out
+	}
+	if paths := search(benToken, "q=plan"); !equalStrings(paths, []string{"/Spaces/Marketing/plan.txt"}) {
+		t.Errorf("Expected the space's file, got %v", paths)
+	}
+	if paths := search(annToken, "q=.txt&path=/Spaces/Marketing"); !equalStrings(paths, []string{"/Spaces/Marketing/draft.txt", "/Spaces/Marketing/plan.txt"}) {
+		t.Errorf("Expected the space's files, got %v", paths)
+	}
+	if paths := search(calToken, "q=plan"); len(paths) != 0 {
+		t.Errorf("Non-member found %v", paths)
+	}
+
+	// Deletes go to the space's trash and need the delete right
+	if w := as(benToken, "DELETE", "/api/resources/Spaces/Marketing/plan.txt", nil); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 deleting without the right, got %d", w.Code)
+	}
+	if w := as(annToken, "DELETE", "/api/resources/Spaces/Marketing/plan.txt", nil); w.Code != http.StatusNoContent {
+		t.Fatalf("Delete failed: %d %s", w.Code, w.Body.String())
+	}
+	var item trash.TrashItem
+	env.DB.Where("user_id = ?", ann.ID).First(&item)
+	if item.SpaceID != sp.ID || item.OriginalPath != "/plan.txt" {
+		t.Errorf("Unexpected trash item: %+v", item)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".trash", fmt.Sprint(item.ID))); err != nil {
+		t.Errorf("Trashed file is not in the space's trash: %v", err)
+	}
+	if w := as(annToken, "POST", "/api/trash/"+fmt.Sprint(item.ID)+"/restore", nil); w.Code != http.StatusOK {
+		t.Fatalf("Restore failed: %d %s", w.Code, w.Body.String())
+	}
+	if _, err := os.Stat(filepath.Join(dir, "plan.txt")); err != nil {
+		t.Errorf("Restored file missing: %v", err)
+	}
+
+	// Deleting the space unmounts it
+	if w := as(adminToken, "DELETE", "/api/admin/spaces/"+fmt.Sprint(sp.ID), nil); w.Code != http.StatusNoContent {
+		t.Fatalf("Deleting the space failed: %d %s", w.Code, w.Body.String())
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("Space folder was not removed: %v", err)
+	}
+	if w := as(annToken, "GET", "/api/resources/Spaces/Marketing", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 after deletion, got %d", w.Code)
+	}
+}
+
+func TestSpacesMountPoint(t *testing.T) {
+	env := setupTestEnv(t)
+	store, err := spaces.NewStore(env.DB, t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create space store: %v", err)
+	}
+	env.Deps.Spaces = store
+	user, token := env.createReadyUser(t, "dora")
+
+	// A folder made before spaces existed is renamed, not hidden
+	own := filepath.Join(user.StoragePath, spaces.MountDir)
+	os.MkdirAll(own, 0755)
+	os.WriteFile(filepath.Join(own, "plan.txt"), []byte("mine"), 0644)
+	moved, err := spaces.MoveAside(user.FS(), user.StoragePath)
+	if err != nil || moved != "Spaces (personal)" {
+		t.Fatalf("Expected the folder moved aside, got %q %v", moved, err)
+	}
+	if moved, err := spaces.MoveAside(user.FS(), user.StoragePath); err != nil || moved != "" {
+		t.Errorf("Expected nothing left to move, got %q %v", moved, err)
+	}
+	w := env.requestAs(token, "GET", "/api/resources/Spaces%20(personal)/plan.txt")
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected the renamed folder reachable, got %d", w.Code)
+	}
+
+	// The name is reserved, so it cannot be taken again
+	if w := env.requestAs(token, "POST", "/api/resources/Spaces/"); w.Code == http.StatusCreated {
+		t.Error("Expected creating a Spaces folder to be refused")
+	}
+	w = env.makeRequestWithBadHeader("PATCH", "/api/resources/Spaces%20(personal)", map[string]string{"newName": "Spaces"}, "Bearer "+token)
+	if w.Code == http.StatusOK {
+		t.Error("Expected renaming a folder to Spaces to be refused")
+	}
+	if _, err := os.Stat(own); !os.IsNotExist(err) {
+		t.Errorf("Expected no Spaces folder in the partition, got %v", err)
+	}
+}
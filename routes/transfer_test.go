@@ -0,0 +1,175 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/satufile/satufile/trash"
+)
+
+func TestTransferConflicts(t *testing.T) {
+	env := setupTestEnv(t)
+
+	tests := []struct {
+		name     string
+		action   string
+		path     string
+		conflict string
+		status   int
+		newPath  string            // path answered for the transferred item
+		want     map[string]string // file contents afterwards, "" if gone
+		skipped  []string          // source paths left alone
+		trashed  string            // original path of the item replaced into the trash
+	}{
+		{
+			name: "file fails by default", action: "copy", path: "a.txt", status: http.StatusConflict,
+			want: map[string]string{"Projects/a.txt": "old"},
+		},
+		{
+			name: "file overwrite", action: "copy", path: "a.txt", conflict: "overwrite", status: http.StatusOK,
+			newPath: "/Projects/a.txt",
+			want:    map[string]string{"Projects/a.txt": "new", "Documents/a.txt": "new"},
+			trashed: "/Projects/a.txt",
+		},
+		{
+			name: "file skip", action: "copy", path: "a.txt", conflict: "skip", status: http.StatusOK,
+			newPath: "/Projects/a.txt",
+			want:    map[string]string{"Projects/a.txt": "old"},
+			skipped: []string{"/Documents/a.txt"},
+		},
+		{
+			name: "file rename", action: "copy", path: "a.txt", conflict: "rename", status: http.StatusOK,
+			newPath: "/Projects/a (1).txt",
+			want:    map[string]string{"Projects/a.txt": "old", "Projects/a (1).txt": "new"},
+		},
+		{
+			name: "file move overwrite", action: "move", path: "a.txt", conflict: "overwrite", status: http.StatusOK,
+			newPath: "/Projects/a.txt",
+			want:    map[string]string{"Projects/a.txt": "new", "Documents/a.txt": ""},
+			trashed: "/Projects/a.txt",
+		},
+		{
+			name: "folder fails by default", action: "copy", path: "Folder", status: http.StatusConflict,
+			want: map[string]string{"Projects/Folder/x.txt": "old-x", "Projects/Folder/y.txt": ""},
+		},
+		{
+			name: "folder overwrite merges", action: "copy", path: "Folder", conflict: "overwrite", status: http.StatusOK,
+			newPath: "/Projects/Folder",
+			want:    map[string]string{"Projects/Folder/x.txt": "new-x", "Projects/Folder/y.txt": "new-y", "Projects/Folder/z.txt": "old-z"},
+			trashed: "/Projects/Folder/x.txt",
+		},
+		{
+			name: "folder skip merges", action: "copy", path: "Folder", conflict: "skip", status: http.StatusOK,
+			newPath: "/Projects/Folder",
+			want:    map[string]string{"Projects/Folder/x.txt": "old-x", "Projects/Folder/y.txt": "new-y", "Projects/Folder/z.txt": "old-z"},
+			skipped: []string{"/Documents/Folder/x.txt"},
+		},
+		{
+			name: "folder rename", action: "copy", path: "Folder", conflict: "rename", status: http.StatusOK,
+			newPath: "/Projects/Folder (1)",
+			want:    map[string]string{"Projects/Folder/x.txt": "old-x", "Projects/Folder/y.txt": "", "Projects/Folder (1)/x.txt": "new-x", "Projects/Folder (1)/y.txt": "new-y"},
+		},
+		{
+			name: "folder move skip keeps what was skipped", action: "move", path: "Folder", conflict: "skip", status: http.StatusOK,
+			newPath: "/Projects/Folder",
+			want:    map[string]string{"Projects/Folder/x.txt": "old-x", "Projects/Folder/y.txt": "new-y", "Documents/Folder/x.txt": "new-x", "Documents/Folder/y.txt": ""},
+			skipped: []string{"/Documents/Folder/x.txt"},
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, token := env.createReadyUser(t, "transfer"+string(rune('a'+i)))
+			for rel, content := range map[string]string{
+				"Documents/a.txt":        "new",
+				"Projects/a.txt":         "old",
+				"Documents/Folder/x.txt": "new-x",
+				"Documents/Folder/y.txt": "new-y",
+				"Projects/Folder/x.txt":  "old-x",
+				"Projects/Folder/z.txt":  "old-z",
+			} {
+				os.MkdirAll(filepath.Join(user.StoragePath, filepath.Dir(rel)), 0755)
+				os.WriteFile(filepath.Join(user.StoragePath, rel), []byte(content), 0644)
+			}
+
+			body := map[string]string{"action": tt.action, "destination": "/Projects/" + tt.path, "conflict": tt.conflict}
+			w := env.makeRequestWithBadHeader("PATCH", "/api/resources/Documents/"+tt.path, body, "Bearer "+token)
+			if w.Code != tt.status {
+				t.Fatalf("Expected %d, got %d %s", tt.status, w.Code, w.Body.String())
+			}
+
+			if tt.status == http.StatusOK {
+				var resp struct {
+					Path    string   `json:"path"`
+					Skipped []string `json:"skipped"`
+				}
+				json.NewDecoder(w.Body).Decode(&resp)
+				if resp.Path != tt.newPath {
+					t.Errorf("Expected the item at %s, got %s", tt.newPath, resp.Path)
+				}
+				if !reflect.DeepEqual(resp.Skipped, tt.skipped) {
+					t.Errorf("Expected %v skipped, got %v", tt.skipped, resp.Skipped)
+				}
+			}
+
+			for rel, content := range tt.want {
+				data, err := os.ReadFile(filepath.Join(user.StoragePath, rel))
+				if content == "" {
+					if !os.IsNotExist(err) {
+						t.Errorf("Expected %s to be absent, got %q", rel, data)
+					}
+				} else if string(data) != content {
+					t.Errorf("Expected %s to hold %q, got %q (%v)", rel, content, data, err)
+				}
+			}
+
+			var items []trash.TrashItem
+			env.DB.Where("user_id = ?", user.ID).Find(&items)
+			switch {
+			case tt.trashed == "" && len(items) > 0:
+				t.Errorf("Expected nothing replaced, found %+v", items)
+			case tt.trashed != "" && (len(items) != 1 || items[0].OriginalPath != tt.trashed):
+				t.Errorf("Expected %s in the trash, found %+v", tt.trashed, items)
+			}
+		})
+	}
+}
+
+func TestTransferQuota(t *testing.T) {
+	env := setupTestEnv(t)
+	user, token := env.createReadyUser(t, "quincy")
+	os.MkdirAll(filepath.Join(user.StoragePath, "Documents"), 0755)
+	os.MkdirAll(filepath.Join(user.StoragePath, "Projects"), 0755)
+	os.WriteFile(filepath.Join(user.StoragePath, "Documents", "big.txt"), make([]byte, 64), 0644)
+
+	// Fill the partition up to a few bytes below its 1 GB
+	f, err := os.Create(filepath.Join(user.StoragePath, "filler"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Truncate(1<<30 - 96) // sparse, but counted at its size
+	f.Close()
+
+	body := map[string]string{"action": "copy", "destination": "/Projects/big.txt"}
+	w := env.makeRequestWithBadHeader("PATCH", "/api/resources/Documents/big.txt", body, "Bearer "+token)
+	var resp struct {
+		Error string `json:"error"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	if w.Code != http.StatusRequestEntityTooLarge || resp.Error != "quota_exceeded" {
+		t.Fatalf("Expected the copy refused over quota, got %d %+v", w.Code, resp)
+	}
+	if _, err := os.Stat(filepath.Join(user.StoragePath, "Projects", "big.txt")); !os.IsNotExist(err) {
+		t.Errorf("Expected nothing copied: %v", err)
+	}
+
+	// Moving within the partition adds nothing and still works
+	body["action"] = "move"
+	if w := env.makeRequestWithBadHeader("PATCH", "/api/resources/Documents/big.txt", body, "Bearer "+token); w.Code != http.StatusOK {
+		t.Errorf("Expected a move to succeed at the quota, got %d %s", w.Code, w.Body.String())
+	}
+}
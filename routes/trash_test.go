@@ -0,0 +1,182 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/satufile/satufile/auth"
+	"github.com/satufile/satufile/routes/api"
+	"github.com/satufile/satufile/trash"
+	"github.com/satufile/satufile/users"
+)
+
+// createReadyUser creates a user that has finished setup and owns a
+// temporary partition, returning its token
+func (env *TestEnv) createReadyUser(t *testing.T, username string) (*users.User, string) {
+	hashedPwd, _ := users.HashPassword("DefaultPassword1!")
+	user := &users.User{
+		Username:            username,
+		Email:               username + "@example.com",
+		Password:            hashedPwd,
+		SetupStep:           "complete",
+		StoragePath:         t.TempDir(),
+		StorageAllocationGb: 1,
+	}
+	if err := env.UserRepo.Create(user); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	// gorm applies the column defaults on create, so clear the setup flags
+	env.DB.Model(user).Updates(map[string]interface{}{"force_setup": false, "is_default_password": false})
+
+	token, err := auth.GenerateToken(user, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to generate token: %v", err)
+	}
+	return user, token
+}
+
+func (env *TestEnv) requestAs(token, method, path string) *httptest.ResponseRecorder {
+	return env.makeRequestWithBadHeader(method, path, nil, "Bearer "+token)
+}
+
+func TestTrashIsolation(t *testing.T) {
+	env := setupTestEnv(t)
+	alice, aliceToken := env.createReadyUser(t, "alice")
+	_, bobToken := env.createReadyUser(t, "bob")
+	events := &eventLog{}
+	env.Deps.Events = events
+
+	if err := os.WriteFile(filepath.Join(alice.StoragePath, "notes.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w := env.requestAs(aliceToken, "DELETE", "/api/resources/notes.txt")
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE failed: %d Body: %s", w.Code, w.Body.String())
+	}
+
+	var item trash.TrashItem
+	if err := env.DB.First(&item).Error; err != nil {
+		t.Fatalf("Trash row not created: %v", err)
+	}
+	if item.UserID != alice.ID {
+		t.Errorf("Expected owner %d, got %d", alice.ID, item.UserID)
+	}
+
+	listCount := func(token string) int {
+		w := env.requestAs(token, "GET", "/api/trash")
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET /api/trash failed: %d Body: %s", w.Code, w.Body.String())
+		}
+		var items []trash.TrashItem
+		json.NewDecoder(w.Body).Decode(&items)
+		return len(items)
+	}
+
+	if n := listCount(aliceToken); n != 1 {
+		t.Errorf("Expected 1 item for owner, got %d", n)
+	}
+	if n := listCount(bobToken); n != 0 {
+		t.Errorf("Expected 0 items for other user, got %d", n)
+	}
+
+	// Another user can neither restore, purge nor empty the item
+	id := strconv.FormatUint(uint64(item.ID), 10)
+	if w := env.requestAs(bobToken, "POST", "/api/trash/"+id+"/restore"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 restoring another user's item, got %d", w.Code)
+	}
+	if w := env.requestAs(bobToken, "DELETE", "/api/trash/"+id); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 deleting another user's item, got %d", w.Code)
+	}
+	env.requestAs(bobToken, "DELETE", "/api/trash")
+	if n := listCount(aliceToken); n != 1 {
+		t.Errorf("Emptying another user's trash removed items: got %d", n)
+	}
+
+	w = env.requestAs(aliceToken, "POST", "/api/trash/"+id+"/restore")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Restore failed: %d Body: %s", w.Code, w.Body.String())
+	}
+	if _, err := os.Stat(filepath.Join(alice.StoragePath, "notes.txt")); err != nil {
+		t.Errorf("Restored file missing: %v", err)
+	}
+
+	// Trash events go to the owner on the trash topic
+	for _, eventType := range []string{"TRASH_ADDED", "TRASH_RESTORED"} {
+		published := events.of(eventType)
+		if len(published) != 1 || published[0].userID != alice.ID || published[0].topic != api.TopicTrash {
+			t.Errorf("Unexpected %s events: %+v", eventType, published)
+		}
+	}
+	if restored := events.of("TRASH_RESTORED"); len(restored) == 1 {
+		if payload := restored[0].payload.(map[string]interface{}); payload["path"] != "/notes.txt" {
+			t.Errorf("Unexpected restore payload: %v", payload)
+		}
+	}
+}
+
+func TestTrashJanitor(t *testing.T) {
+	env := setupTestEnv(t)
+	user, token := env.createReadyUser(t, "carol")
+
+	for _, name := range []string{"old.txt", "new.txt"} {
+		if err := os.WriteFile(filepath.Join(user.StoragePath, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if w := env.requestAs(token, "DELETE", "/api/resources/"+name); w.Code != http.StatusNoContent {
+			t.Fatalf("DELETE %s failed: %d", name, w.Code)
+		}
+	}
+
+	// Age one item past the retention period
+	env.DB.Model(&trash.TrashItem{}).Where("name = ?", "old.txt").
+		Update("deleted_at", time.Now().Add(-48*time.Hour))
+
+	janitor := trash.NewJanitor(env.DB, env.UserRepo, trash.Policy{Retention: 24 * time.Hour})
+	purged, err := janitor.PurgeAll()
+	if err != nil {
+		t.Fatalf("PurgeAll failed: %v", err)
+	}
+	if len(purged) != 1 || purged[0].Name != "old.txt" || purged[0].Reason != trash.ReasonExpired {
+		t.Fatalf("Expected old.txt to be purged as expired, got %+v", purged)
+	}
+	if _, err := os.Stat(filepath.Join(user.StoragePath, ".trash", strconv.FormatUint(uint64(purged[0].ItemID), 10))); !os.IsNotExist(err) {
+		t.Errorf("Purged data still on disk")
+	}
+
+	var remaining, history int64
+	env.DB.Model(&trash.TrashItem{}).Count(&remaining)
+	env.DB.Model(&trash.Purge{}).Count(&history)
+	if remaining != 1 || history != 1 {
+		t.Errorf("Expected 1 item and 1 purge record, got %d and %d", remaining, history)
+	}
+
+	// A per-user retention overrides the server default
+	env.DB.Model(user).Update("trash_retention_days", 365)
+	env.DB.Model(&trash.TrashItem{}).Where("user_id = ?", user.ID).
+		Update("deleted_at", time.Now().Add(-48*time.Hour))
+	if purged, _ := janitor.PurgeAll(); len(purged) != 0 {
+		t.Errorf("Expected user retention to keep items, purged %d", len(purged))
+	}
+
+	// Users can keep their trash forever through their profile
+	w := env.makeRequestWithBadHeader("PUT", "/api/me", map[string]int{"trashRetentionDays": users.KeepForever}, "Bearer "+token)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Updating the profile failed: %d %s", w.Code, w.Body.String())
+	}
+	env.DB.Model(&trash.TrashItem{}).Where("user_id = ?", user.ID).
+		Update("deleted_at", time.Now().Add(-1000*24*time.Hour))
+	if purged, _ := janitor.PurgeAll(); len(purged) != 0 {
+		t.Errorf("Expected the trash kept forever, purged %d", len(purged))
+	}
+	w = env.makeRequestWithBadHeader("PUT", "/api/me", map[string]int{"trashRetentionDays": -2}, "Bearer "+token)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a retention below -1, got %d", w.Code)
+	}
+}
@@ -0,0 +1,106 @@
+package routes
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func (env *TestEnv) tusRequest(token, method, path string, body []byte, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	env.Router.ServeHTTP(w, req)
+	return w
+}
+
+func TestTusUpload(t *testing.T) {
+	env := setupTestEnv(t)
+	user, token := env.createReadyUser(t, "dave")
+	os.MkdirAll(filepath.Join(user.StoragePath, "Documents"), 0755)
+
+	b64 := base64.StdEncoding.EncodeToString
+	data := []byte("hello tus world")
+
+	// Discovery needs no credentials
+	req := httptest.NewRequest("OPTIONS", "/api/tus", nil)
+	w := httptest.NewRecorder()
+	env.Router.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent || !strings.Contains(w.Header().Get("Tus-Extension"), "checksum") {
+		t.Fatalf("OPTIONS failed: %d %v", w.Code, w.Header())
+	}
+
+	// Wrong protocol version
+	w = env.tusRequest(token, "POST", "/api/tus", nil, map[string]string{"Tus-Resumable": "0.2.2", "Upload-Length": "15"})
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 for unsupported version, got %d", w.Code)
+	}
+
+	// Creation with the first five bytes
+	w = env.tusRequest(token, "POST", "/api/tus", data[:5], map[string]string{
+		"Upload-Length":   "15",
+		"Upload-Metadata": "filename " + b64([]byte("hello.txt")) + ",path " + b64([]byte("/Documents")),
+		"Content-Type":    "application/offset+octet-stream",
+	})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("POST failed: %d Body: %s", w.Code, w.Body.String())
+	}
+	location := w.Header().Get("Location")
+	if w.Header().Get("Upload-Offset") != "5" || !strings.HasPrefix(location, "/api/tus/") {
+		t.Fatalf("Unexpected creation headers: %v", w.Header())
+	}
+
+	w = env.tusRequest(token, "HEAD", location, nil, nil)
+	if w.Code != http.StatusOK || w.Header().Get("Upload-Offset") != "5" || w.Header().Get("Upload-Length") != "15" {
+		t.Fatalf("HEAD failed: %d %v", w.Code, w.Header())
+	}
+
+	patch := func(offset string, body []byte, checksum string) *httptest.ResponseRecorder {
+		headers := map[string]string{"Upload-Offset": offset, "Content-Type": "application/offset+octet-stream"}
+		if checksum != "" {
+			headers["Upload-Checksum"] = checksum
+		}
+		return env.tusRequest(token, "PATCH", location, body, headers)
+	}
+
+	if w := patch("3", data[3:], ""); w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for wrong offset, got %d", w.Code)
+	}
+
+	if w := patch("5", data[5:], "sha1 "+b64(make([]byte, 20))); w.Code != 460 {
+		t.Errorf("Expected 460 for bad checksum, got %d", w.Code)
+	}
+
+	sum := sha1.Sum(data[5:])
+	if w := patch("5", data[5:], "sha1 "+b64(sum[:])); w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != "15" {
+		t.Fatalf("PATCH failed: %d %v %s", w.Code, w.Header(), w.Body.String())
+	}
+
+	got, err := os.ReadFile(filepath.Join(user.StoragePath, "Documents", "hello.txt"))
+	if err != nil || string(got) != string(data) {
+		t.Fatalf("Assembled file mismatch: %q, %v", got, err)
+	}
+
+	// Another user cannot see the upload
+	_, otherToken := env.createReadyUser(t, "erin")
+	if w := env.tusRequest(otherToken, "HEAD", location, nil, nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for another user's upload, got %d", w.Code)
+	}
+
+	if w := env.tusRequest(token, "DELETE", location, nil, nil); w.Code != http.StatusNoContent {
+		t.Errorf("DELETE failed: %d", w.Code)
+	}
+	if w := env.tusRequest(token, "HEAD", location, nil, nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 after termination, got %d", w.Code)
+	}
+}
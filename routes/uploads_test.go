@@ -0,0 +1,89 @@
+package routes
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/satufile/satufile/uploads"
+)
+
+func TestUploadReaper(t *testing.T) {
+	env := setupTestEnv(t)
+	store, err := uploads.NewStorage(env.DB)
+	if err != nil {
+		t.Fatalf("Failed to create upload storage: %v", err)
+	}
+	base := t.TempDir()
+
+	newSession := func(id string, expires time.Time, withDir bool) *uploads.Session {
+		session := &uploads.Session{
+			ID:          id,
+			Filename:    id + ".bin",
+			Path:        "/",
+			TotalSize:   10,
+			ChunkSize:   10,
+			TotalChunks: 1,
+			Status:      "uploading",
+			TempDir:     filepath.Join(base, id),
+			ExpiresAt:   expires,
+		}
+		if withDir {
+			os.MkdirAll(session.TempDir, 0755)
+			os.WriteFile(filepath.Join(session.TempDir, "chunk_0"), []byte("0123456789"), 0644)
+		}
+		if err := store.CreateSession(session); err != nil {
+			t.Fatalf("Failed to create session: %v", err)
+		}
+		return session
+	}
+
+	newSession("expired", time.Now().Add(-time.Hour), true)
+	newSession("live", time.Now().Add(time.Hour), true)
+	newSession("vanished", time.Now().Add(time.Hour), false)
+	os.MkdirAll(filepath.Join(base, "orphan"), 0755)
+	os.WriteFile(filepath.Join(base, "orphan", "chunk_0"), []byte("01234"), 0644)
+	stale := time.Now().Add(-2 * uploads.OrphanGrace)
+	os.Chtimes(filepath.Join(base, "orphan"), stale, stale)
+	// An upload whose session is about to be created
+	os.MkdirAll(filepath.Join(base, "starting"), 0755)
+
+	// A request stuck on the expired session holds its lock
+	release := uploads.Lock("expired")
+	defer release()
+
+	result, err := uploads.Reap(store, base)
+	if err != nil {
+		t.Fatalf("Reap failed: %v", err)
+	}
+	if result.Expired != 1 || result.Failed != 1 || result.Orphans != 1 {
+		t.Errorf("Unexpected result: %+v", result)
+	}
+	if result.ReclaimedBytes != 15 {
+		t.Errorf("Expected 15 reclaimed bytes, got %d", result.ReclaimedBytes)
+	}
+
+	if _, err := store.GetSession("expired"); err == nil {
+		t.Errorf("Expired session still exists")
+	}
+	locked := make(chan struct{})
+	go func() {
+		uploads.Lock("expired")()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Errorf("Expected the lock of the reaped session to be dropped")
+	}
+	if s, _ := store.GetSession("vanished"); s == nil || s.Status != "failed" {
+		t.Errorf("Expected vanished session to be marked failed, got %+v", s)
+	}
+	if _, err := os.Stat(filepath.Join(base, "live", "chunk_0")); err != nil {
+		t.Errorf("Live session chunks were removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(base, "starting")); err != nil {
+		t.Errorf("A fresh temp dir without a session yet was removed: %v", err)
+	}
+}
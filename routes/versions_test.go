@@ -0,0 +1,184 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/satufile/satufile/versions"
+)
+
+func TestFileVersions(t *testing.T) {
+	env := setupTestEnv(t)
+	user, token := env.createReadyUser(t, "judy")
+	os.MkdirAll(filepath.Join(user.StoragePath, "Documents"), 0755)
+
+	upload := func(path, content string) {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/api/resources"+path, strings.NewReader(content))
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		env.Router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK && w.Code != http.StatusCreated {
+			t.Fatalf("Upload of %s failed: %d %s", path, w.Code, w.Body.String())
+		}
+	}
+	list := func(path string) []versions.Version {
+		t.Helper()
+		w := env.requestAs(token, "GET", "/api/versions?path="+path)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Listing versions of %s failed: %d %s", path, w.Code, w.Body.String())
+		}
+		var out []versions.Version
+		json.NewDecoder(w.Body).Decode(&out)
+		return out
+	}
+	read := func(path string) string {
+		data, _ := os.ReadFile(filepath.Join(user.StoragePath, path))
+		return string(data)
+	}
+
+	upload("/Documents/draft.txt", "one")
+	upload("/Documents/draft.txt", "two")
+	upload("/Documents/draft.txt", "three")
+
+	got := list("/Documents/draft.txt")
+	if len(got) != 2 {
+		t.Fatalf("Expected 2 versions, got %d", len(got))
+	}
+	if got[0].Size != 3 || got[1].Size != 3 {
+		t.Errorf("Unexpected version sizes: %+v", got)
+	}
+
+	// Newest first: "two" then "one"
+	w := env.requestAs(token, "GET", fmt.Sprintf("/api/versions/%d/raw", got[1].ID))
+	if w.Code != http.StatusOK || w.Body.String() != "one" {
+		t.Fatalf("Expected the first content, got %d %q", w.Code, w.Body.String())
+	}
+	if d := w.Header().Get("Content-Disposition"); d != `attachment; filename="draft.txt"` {
+		t.Errorf("Unexpected disposition %q", d)
+	}
+
+	t.Run("Restore", func(t *testing.T) {
+		w := env.requestAs(token, "POST", fmt.Sprintf("/api/versions/%d/restore", got[1].ID))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Restore failed: %d %s", w.Code, w.Body.String())
+		}
+		if c := read("/Documents/draft.txt"); c != "one" {
+			t.Errorf("Expected restored content, got %q", c)
+		}
+		// The replaced content is kept, the restored one leaves the list
+		after := list("/Documents/draft.txt")
+		if len(after) != 2 {
+			t.Fatalf("Expected 2 versions after restore, got %d", len(after))
+		}
+		w = env.requestAs(token, "GET", fmt.Sprintf("/api/versions/%d/raw", after[0].ID))
+		if w.Body.String() != "three" {
+			t.Errorf("Expected the replaced content kept, got %q", w.Body.String())
+		}
+	})
+
+	t.Run("OtherUsers", func(t *testing.T) {
+		_, otherToken := env.createReadyUser(t, "mallory")
+		if w := env.requestAs(otherToken, "GET", fmt.Sprintf("/api/versions/%d/raw", got[0].ID)); w.Code != http.StatusNotFound {
+			t.Errorf("Expected 404 for another user's version, got %d", w.Code)
+		}
+		if w := env.requestAs(token, "GET", "/api/versions?path=/.versions/1"); w.Code != http.StatusForbidden {
+			t.Errorf("Expected 403 for reserved paths, got %d", w.Code)
+		}
+	})
+
+	t.Run("CountLimit", func(t *testing.T) {
+		env.DB.Model(user).Update("version_count", 2)
+		for i := 0; i < 4; i++ {
+			upload("/Documents/log.txt", fmt.Sprint(i))
+		}
+		if n := len(list("/Documents/log.txt")); n != 2 {
+			t.Errorf("Expected the count limit of 2, got %d", n)
+		}
+		env.DB.Model(user).Update("version_count", 0)
+	})
+
+	t.Run("FollowRenameAndMove", func(t *testing.T) {
+		w := env.makeRequestWithBadHeader("PATCH", "/api/resources/Documents/draft.txt", map[string]string{
+			"newName": "final.txt",
+		}, "Bearer "+token)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Rename failed: %d %s", w.Code, w.Body.String())
+		}
+		os.MkdirAll(filepath.Join(user.StoragePath, "Projects"), 0755)
+		w = env.makeRequestWithBadHeader("PATCH", "/api/resources/Documents/final.txt", map[string]string{
+			"action": "move", "destination": "/Projects/final.txt",
+		}, "Bearer "+token)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Move failed: %d %s", w.Code, w.Body.String())
+		}
+		if n := len(list("/Documents/draft.txt")); n != 0 {
+			t.Errorf("Versions left at the old path: %d", n)
+		}
+		if n := len(list("/Projects/final.txt")); n != 2 {
+			t.Errorf("Expected 2 versions at the new path, got %d", n)
+		}
+	})
+
+	t.Run("KeptInTrash", func(t *testing.T) {
+		if w := env.requestAs(token, "DELETE", "/api/resources/Projects"); w.Code != http.StatusNoContent {
+			t.Fatalf("Delete failed: %d", w.Code)
+		}
+		if n := len(list("/Projects/final.txt")); n != 0 {
+			t.Errorf("Trashed versions still listed: %d", n)
+		}
+
+		var items []struct {
+			ID uint `json:"id"`
+		}
+		json.NewDecoder(env.requestAs(token, "GET", "/api/trash").Body).Decode(&items)
+		if len(items) != 1 {
+			t.Fatalf("Expected 1 trash item, got %d", len(items))
+		}
+		if w := env.requestAs(token, "POST", fmt.Sprintf("/api/trash/%d/restore", items[0].ID)); w.Code != http.StatusOK {
+			t.Fatalf("Restore from trash failed: %d", w.Code)
+		}
+		if n := len(list("/Projects/final.txt")); n != 2 {
+			t.Errorf("Expected versions back with the file, got %d", n)
+		}
+	})
+
+	t.Run("DeleteOld", func(t *testing.T) {
+		w := env.requestAs(token, "DELETE", "/api/versions?path=/Projects/final.txt&keep=1")
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"removed":1`) {
+			t.Fatalf("Expected 1 removed, got %d %s", w.Code, w.Body.String())
+		}
+		rest := list("/Projects/final.txt")
+		if len(rest) != 1 {
+			t.Fatalf("Expected 1 version left, got %d", len(rest))
+		}
+		if w := env.requestAs(token, "DELETE", fmt.Sprintf("/api/versions/%d", rest[0].ID)); w.Code != http.StatusNoContent {
+			t.Errorf("Delete failed: %d", w.Code)
+		}
+		if n := len(list("/Projects/final.txt")); n != 0 {
+			t.Errorf("Expected no versions left, got %d", n)
+		}
+		if m, _ := filepath.Glob(filepath.Join(user.StoragePath, ".versions", "*")); len(m) != 2 {
+			// Only the two versions of log.txt remain on disk
+			t.Errorf("Unexpected version data left: %v", m)
+		}
+	})
+
+	t.Run("PurgedWithTrash", func(t *testing.T) {
+		if w := env.requestAs(token, "DELETE", "/api/resources/Documents/log.txt"); w.Code != http.StatusNoContent {
+			t.Fatalf("Delete failed: %d", w.Code)
+		}
+		if w := env.requestAs(token, "DELETE", "/api/trash"); w.Code != http.StatusNoContent {
+			t.Fatalf("Emptying the trash failed: %d", w.Code)
+		}
+		if m, _ := filepath.Glob(filepath.Join(user.StoragePath, ".versions", "*")); len(m) != 0 {
+			t.Errorf("Version data left after purge: %v", m)
+		}
+	})
+}
@@ -0,0 +1,236 @@
+package routes
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/satufile/satufile/files"
+	"github.com/satufile/satufile/trash"
+)
+
+func (env *TestEnv) davRequest(token, method, path string, body []byte, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	env.Router.ServeHTTP(w, req)
+	return w
+}
+
+func TestWebDAV(t *testing.T) {
+	env := setupTestEnv(t)
+	user, token := env.createReadyUser(t, "wendy")
+	os.MkdirAll(filepath.Join(user.StoragePath, "Documents", "Deep", "Deeper"), 0755)
+	os.WriteFile(filepath.Join(user.StoragePath, "Documents", "Deep", "Deeper", "buried.txt"), []byte("x"), 0644)
+	os.MkdirAll(filepath.Join(user.StoragePath, ".trash"), 0755)
+
+	dav := func(method, path string, body []byte, headers map[string]string) *httptest.ResponseRecorder {
+		return env.davRequest(token, method, path, body, headers)
+	}
+	read := func(rel string) string {
+		data, err := os.ReadFile(filepath.Join(user.StoragePath, rel))
+		if err != nil {
+			return ""
+		}
+		return string(data)
+	}
+
+	// PUT creates, then replaces; GET reads it back
+	if w := dav("PUT", "/dav/Documents/a.txt", []byte("first"), nil); w.Code != http.StatusCreated {
+		t.Fatalf("PUT failed: %d %s", w.Code, w.Body.String())
+	}
+	if w := dav("PUT", "/dav/Documents/a.txt", []byte("second"), nil); w.Code != http.StatusNoContent {
+		t.Fatalf("PUT over a file failed: %d %s", w.Code, w.Body.String())
+	}
+	if w := dav("GET", "/dav/Documents/a.txt", nil, nil); w.Code != http.StatusOK || w.Body.String() != "second" {
+		t.Errorf("Expected the new content, got %d %q", w.Code, w.Body.String())
+	}
+	if w := dav("PUT", "/dav/Missing/a.txt", []byte("x"), nil); w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 without a parent collection, got %d", w.Code)
+	}
+
+	// PROPFIND lists one level at most
+	w := dav("PROPFIND", "/dav/Documents", nil, map[string]string{"Depth": "0"})
+	if w.Code != http.StatusMultiStatus || strings.Contains(w.Body.String(), "a.txt") {
+		t.Errorf("Expected Depth 0 to describe the collection only, got %d %s", w.Code, w.Body.String())
+	}
+	w = dav("PROPFIND", "/dav/Documents", nil, map[string]string{"Depth": "1"})
+	if w.Code != http.StatusMultiStatus || !strings.Contains(w.Body.String(), "a.txt") || strings.Contains(w.Body.String(), "Deeper") {
+		t.Errorf("Expected Depth 1 to list the children only, got %d %s", w.Code, w.Body.String())
+	}
+	for _, depth := range []string{"infinity", ""} {
+		w = dav("PROPFIND", "/dav/Documents", nil, map[string]string{"Depth": depth})
+		if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "propfind-finite-depth") {
+			t.Errorf("Expected Depth %q to be refused, got %d %s", depth, w.Code, w.Body.String())
+		}
+	}
+	w = dav("PROPFIND", "/dav/", nil, map[string]string{"Depth": "1"})
+	if w.Code != http.StatusMultiStatus || strings.Contains(w.Body.String(), ".trash") {
+		t.Errorf("Expected reserved folders left out, got %d %s", w.Code, w.Body.String())
+	}
+
+	// MKCOL
+	if w := dav("MKCOL", "/dav/Documents/New", nil, nil); w.Code != http.StatusCreated {
+		t.Errorf("MKCOL failed: %d %s", w.Code, w.Body.String())
+	}
+	if w := dav("MKCOL", "/dav/Documents/New", nil, nil); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for an existing collection, got %d", w.Code)
+	}
+	if w := dav("MKCOL", "/dav/Nowhere/New", nil, nil); w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 without a parent collection, got %d", w.Code)
+	}
+
+	// COPY and MOVE only replace with Overwrite: T, keeping the replaced
+	// file in the trash
+	dav("PUT", "/dav/Documents/b.txt", []byte("bee"), nil)
+	copyTo := map[string]string{"Destination": "/dav/Documents/b.txt", "Overwrite": "F"}
+	if w := dav("COPY", "/dav/Documents/a.txt", nil, copyTo); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 with Overwrite: F, got %d", w.Code)
+	}
+	copyTo["Overwrite"] = "T"
+	if w := dav("COPY", "/dav/Documents/a.txt", nil, copyTo); w.Code != http.StatusNoContent {
+		t.Fatalf("COPY failed: %d %s", w.Code, w.Body.String())
+	}
+	if read("Documents/b.txt") != "second" || read("Documents/a.txt") != "second" {
+		t.Errorf("Expected a.txt copied over b.txt")
+	}
+	var replaced trash.TrashItem
+	if err := env.DB.Where("original_path = ?", "/Documents/b.txt").First(&replaced).Error; err != nil {
+		t.Fatalf("Expected the replaced file in the trash: %v", err)
+	}
+	if read(trash.ItemPath(replaced.ID)) != "bee" {
+		t.Errorf("Expected the trash to hold the old content")
+	}
+
+	if w := dav("MOVE", "/dav/Documents/a.txt", nil, map[string]string{"Destination": "/dav/Documents/c.txt"}); w.Code != http.StatusCreated {
+		t.Fatalf("MOVE failed: %d %s", w.Code, w.Body.String())
+	}
+	if read("Documents/c.txt") != "second" || read("Documents/a.txt") != "" {
+		t.Errorf("Expected a.txt moved to c.txt")
+	}
+	if w := dav("MOVE", "/dav/Documents/c.txt", nil, map[string]string{"Destination": "/dav/Documents/b.txt", "Overwrite": "F"}); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 with Overwrite: F, got %d", w.Code)
+	}
+
+	// LOCK keeps others out until UNLOCK
+	lockBody := []byte(`<?xml version="1.0"?><D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockinfo>`)
+	w = dav("LOCK", "/dav/Documents/b.txt", lockBody, map[string]string{"Depth": "0"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("LOCK failed: %d %s", w.Code, w.Body.String())
+	}
+	lockToken := w.Header().Get("Lock-Token")
+	if w := dav("PUT", "/dav/Documents/b.txt", []byte("x"), nil); w.Code != http.StatusLocked {
+		t.Errorf("Expected 423 without the lock token, got %d", w.Code)
+	}
+	if w := dav("PUT", "/dav/Documents/b.txt", []byte("locked"), map[string]string{"If": "(" + lockToken + ")"}); w.Code != http.StatusNoContent {
+		t.Errorf("Expected the lock holder to write, got %d %s", w.Code, w.Body.String())
+	}
+	if w := dav("UNLOCK", "/dav/Documents/b.txt", nil, map[string]string{"Lock-Token": lockToken}); w.Code != http.StatusNoContent {
+		t.Errorf("UNLOCK failed: %d %s", w.Code, w.Body.String())
+	}
+	if w := dav("PUT", "/dav/Documents/b.txt", []byte("free"), nil); w.Code != http.StatusNoContent {
+		t.Errorf("Expected writes after UNLOCK, got %d", w.Code)
+	}
+
+	// Reserved folders cannot be reached
+	if w := dav("GET", "/dav/.trash/"+filepath.Base(trash.ItemPath(replaced.ID)), nil, nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected the trash hidden, got %d", w.Code)
+	}
+	if w := dav("PUT", "/dav/.versions/x.txt", []byte("x"), nil); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 writing into a reserved folder, got %d", w.Code)
+	}
+	if w := dav("MOVE", "/dav/Documents/b.txt", nil, map[string]string{"Destination": "/dav/.trash/b.txt"}); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 moving into a reserved folder, got %d", w.Code)
+	}
+	if w := dav("COPY", "/dav/Documents/b.txt", nil, map[string]string{"Destination": "http://elsewhere.example/dav/b.txt"}); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 copying to another server, got %d", w.Code)
+	}
+
+	// A chunked body is stopped at the quota, leaving nothing behind
+	filler := filepath.Join(user.StoragePath, "filler")
+	f, err := os.Create(filler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Truncate(1<<30 - 32) // sparse, but counted at its size
+	f.Close()
+	req := httptest.NewRequest("PUT", "/dav/Documents/big.txt", bytes.NewReader(bytes.Repeat([]byte("x"), 64)))
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.ContentLength = -1
+	w = httptest.NewRecorder()
+	env.Router.ServeHTTP(w, req)
+	if w.Code != http.StatusInsufficientStorage {
+		t.Errorf("Expected 507 past the quota, got %d %s", w.Code, w.Body.String())
+	}
+	if _, err := os.Stat(filepath.Join(user.StoragePath, "Documents", "big.txt")); !os.IsNotExist(err) {
+		t.Errorf("Expected the refused upload not to be created: %v", err)
+	}
+	if partials, _ := os.ReadDir(filepath.Join(user.StoragePath, files.PartialDir)); len(partials) != 0 {
+		t.Errorf("Expected no partial file left behind, found %v", partials)
+	}
+	os.Remove(filler)
+
+	// A scoped user works inside their scope only
+	scoped, scopedToken := env.createReadyUser(t, "sam")
+	os.MkdirAll(filepath.Join(scoped.StoragePath, "Work"), 0755)
+	os.WriteFile(filepath.Join(scoped.StoragePath, "secret.txt"), []byte("x"), 0644)
+	env.DB.Model(scoped).Update("scope", "/Work")
+	if w := env.davRequest(scopedToken, "PUT", "/dav/in.txt", []byte("in"), nil); w.Code != http.StatusCreated {
+		t.Fatalf("Scoped PUT failed: %d %s", w.Code, w.Body.String())
+	}
+	if _, err := os.Stat(filepath.Join(scoped.StoragePath, "Work", "in.txt")); err != nil {
+		t.Errorf("Expected the file inside the scope: %v", err)
+	}
+	w = env.davRequest(scopedToken, "PROPFIND", "/dav/", nil, map[string]string{"Depth": "1"})
+	if w.Code != http.StatusMultiStatus || strings.Contains(w.Body.String(), "secret.txt") {
+		t.Errorf("Expected only the scope listed, got %d %s", w.Code, w.Body.String())
+	}
+	if w := env.davRequest(scopedToken, "GET", "/dav/../secret.txt", nil, nil); w.Code == http.StatusOK {
+		t.Errorf("Expected files outside the scope unreachable, got %d", w.Code)
+	}
+}
+
+func TestWebDAVBasicAuth(t *testing.T) {
+	env := setupTestEnv(t)
+	env.createReadyUser(t, "basil")
+
+	// requests come from their own address so the login rate limit of
+	// other tests does not interfere
+	basic := func(path, password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PROPFIND", path, nil)
+		req.Header.Set("Depth", "0")
+		req.SetBasicAuth("basil", password)
+		req.RemoteAddr = "198.51.100.21:4000"
+		w := httptest.NewRecorder()
+		env.Router.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := basic("/dav/", "DefaultPassword1!"); w.Code != http.StatusMultiStatus {
+		t.Fatalf("Expected basic credentials to open WebDAV, got %d %s", w.Code, w.Body.String())
+	}
+	req := httptest.NewRequest("GET", "/api/me", nil)
+	req.SetBasicAuth("basil", "DefaultPassword1!")
+	w := httptest.NewRecorder()
+	env.Router.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected basic credentials refused outside WebDAV, got %d", w.Code)
+	}
+
+	// Wrong passwords are throttled like logins, right ones are not counted
+	for i := 0; i < 3; i++ {
+		if w := basic("/dav/", "wrong"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected 401 for a wrong password, got %d", w.Code)
+		}
+	}
+	if w := basic("/dav/", "wrong"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected guessing to be throttled, got %d", w.Code)
+	}
+}
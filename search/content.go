@@ -0,0 +1,369 @@
+package search
+
+import (
+	"context"
+	"errors"
+	"html"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"gorm.io/gorm"
+
+	"github.com/satufile/satufile/vfs"
+)
+
+// ErrNoFTS5 means SQLite was built without FTS5 (build with -tags sqlite_fts5)
+var ErrNoFTS5 = errors.New("sqlite FTS5 is not available")
+
+// maxPending bounds queued single-file updates; overflow waits for the
+// next sync
+const maxPending = 10000
+
+// Snippet highlight markers; replaced by <mark> after HTML escaping
+const (
+	markOpen  = "\ue000"
+	markClose = "\ue001"
+)
+
+// Document records the indexed version of a file's content. Its ID is the
+// rowid of the file's text in the search_content FTS5 table.
+type Document struct {
+	ID      uint   `gorm:"primaryKey"`
+	UserID  uint   `gorm:"uniqueIndex:idx_search_document"`
+	Path    string `gorm:"uniqueIndex:idx_search_document"`
+	Size    int64
+	ModTime time.Time
+	Error   string // extraction failure, retried when the file changes
+}
+
+// TableName specifies the table name for GORM
+func (Document) TableName() string {
+	return "search_documents"
+}
+
+// Hit is one content search result
+type Hit struct {
+	UserID  uint // owner of the document
+	Path    string
+	Snippet string // HTML-escaped, matches wrapped in <mark>
+}
+
+// Content indexes the text of documents in an SQLite FTS5 table. A single
+// background worker extracts text at a limited rate so indexing never
+// competes with requests for long.
+type Content struct {
+	db      *gorm.DB
+	limiter *rate.Limiter
+
+	mu      sync.Mutex
+	pending map[job]struct{} // single files
+	syncs   map[uint]tracked // user ID -> root, full reconciliations
+	wake    chan struct{}
+}
+
+type job struct {
+	userID uint
+	fs     vfs.FS
+	root   string
+	path   string
+}
+
+// NewContent creates the content index. perSecond limits how many files
+// are extracted per second.
+func NewContent(db *gorm.DB, perSecond float64) (*Content, error) {
+	if err := db.AutoMigrate(&Document{}); err != nil {
+		return nil, err
+	}
+	err := db.Exec("CREATE VIRTUAL TABLE IF NOT EXISTS search_content USING fts5(body, tokenize = 'unicode61 remove_diacritics 2')").Error
+	if err != nil {
+		if strings.Contains(err.Error(), "no such module") {
+			return nil, ErrNoFTS5
+		}
+		return nil, err
+	}
+	if perSecond <= 0 {
+		perSecond = 10
+	}
+	return &Content{
+		db:      db,
+		limiter: rate.NewLimiter(rate.Limit(perSecond), 1),
+		pending: make(map[job]struct{}),
+		syncs:   make(map[uint]tracked),
+		wake:    make(chan struct{}, 1),
+	}, nil
+}
+
+// Enqueue schedules a file below root on fsys for (re-)indexing
+func (c *Content) Enqueue(userID uint, fsys vfs.FS, root, path string) {
+	if !indexed(fsys) {
+		return
+	}
+	c.mu.Lock()
+	if len(c.pending) < maxPending {
+		c.pending[job{userID, fsys, root, path}] = struct{}{}
+	}
+	c.mu.Unlock()
+	c.signal()
+}
+
+// Sync schedules a reconciliation of a user's content with the file index
+func (c *Content) Sync(userID uint, fsys vfs.FS, root string) {
+	c.mu.Lock()
+	c.syncs[userID] = tracked{fs: fsys, root: root}
+	c.mu.Unlock()
+	c.signal()
+}
+
+func (c *Content) signal() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run processes queued work until stop is closed
+func (c *Content) Run(stop <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	for {
+		if !c.step(ctx) {
+			select {
+			case <-c.wake:
+			case <-stop:
+				return
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// step does one unit of queued work, reporting false when idle
+func (c *Content) step(ctx context.Context) bool {
+	c.mu.Lock()
+	for j := range c.pending {
+		delete(c.pending, j)
+		c.mu.Unlock()
+		c.indexFile(ctx, j.userID, j.fs, j.root, j.path)
+		return true
+	}
+	for userID, t := range c.syncs {
+		delete(c.syncs, userID)
+		c.mu.Unlock()
+		if err := c.sync(ctx, userID, t.fs, t.root); err != nil && ctx.Err() == nil {
+			log.Printf("Search: content sync of user %d failed: %v", userID, err)
+		}
+		return true
+	}
+	c.mu.Unlock()
+	return false
+}
+
+// Drain processes all queued work synchronously and without throttling
+func (c *Content) Drain() {
+	limit := c.limiter.Limit()
+	c.limiter.SetLimit(rate.Inf)
+	defer c.limiter.SetLimit(limit)
+	for c.step(context.Background()) {
+	}
+}
+
+// indexed reports whether the content of files on fsys may be indexed.
+// Layered filesystems store files encrypted, and the index would keep
+// their text in plaintext.
+func indexed(fsys vfs.FS) bool {
+	_, layered := fsys.(vfs.Layer)
+	return !layered
+}
+
+// sync indexes new and changed documents of the user and drops documents
+// whose file is gone
+func (c *Content) sync(ctx context.Context, userID uint, fsys vfs.FS, root string) error {
+	if !indexed(fsys) {
+		// Drops what was indexed before the partition was encrypted
+		c.deleteDocuments(c.db.Where("user_id = ?", userID))
+		return nil
+	}
+	var lastID uint
+	for {
+		var entries []Entry
+		err := c.db.Where("user_id = ? AND is_dir = ? AND id > ?", userID, false, lastID).
+			Order("id").Limit(batchSize).Find(&entries).Error
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			break
+		}
+		lastID = entries[len(entries)-1].ID
+
+		paths := make([]string, 0, len(entries))
+		for _, e := range entries {
+			if Indexable(e.Name) {
+				paths = append(paths, e.Path)
+			}
+		}
+		var docs []Document
+		if len(paths) > 0 {
+			if err := c.db.Where("user_id = ? AND path IN ?", userID, paths).Find(&docs).Error; err != nil {
+				return err
+			}
+		}
+		known := make(map[string]Document, len(docs))
+		for _, d := range docs {
+			known[d.Path] = d
+		}
+
+		for _, e := range entries {
+			if !Indexable(e.Name) {
+				continue
+			}
+			if d, ok := known[e.Path]; ok && d.Size == e.Size && d.ModTime.Equal(e.ModTime) {
+				continue
+			}
+			if err := c.indexFile(ctx, userID, fsys, root, e.Path); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Documents without a file entry were deleted or moved away
+	var stale []Document
+	err := c.db.Where("user_id = ? AND path NOT IN (?)", userID,
+		c.db.Model(&Entry{}).Select("path").Where("user_id = ?", userID)).Find(&stale).Error
+	if err != nil {
+		return err
+	}
+	for _, d := range stale {
+		c.deleteDocuments(c.db.Where("id = ?", d.ID))
+	}
+	return nil
+}
+
+// indexFile extracts and stores the text of one file, returning an error
+// only when the worker should stop
+func (c *Content) indexFile(ctx context.Context, userID uint, fsys vfs.FS, root, path string) error {
+	fullPath := filepath.Join(root, filepath.FromSlash(path))
+	info, err := fsys.Stat(fullPath)
+	if err != nil || info.IsDir() || !Indexable(info.Name()) {
+		c.Remove(userID, path)
+		return nil
+	}
+
+	if err := c.limiter.Wait(ctx); err != nil {
+		return err
+	}
+
+	doc := Document{UserID: userID, Path: path}
+	c.db.Where(&doc).First(&doc)
+	doc.Size = info.Size()
+	doc.ModTime = info.ModTime().UTC()
+	doc.Error = ""
+
+	text, err := Extract(fsys, fullPath)
+	if err != nil {
+		doc.Error = err.Error()
+	}
+
+	err = c.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&doc).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec("DELETE FROM search_content WHERE rowid = ?", doc.ID).Error; err != nil {
+			return err
+		}
+		if doc.Error != "" || strings.TrimSpace(text) == "" {
+			return nil
+		}
+		return tx.Exec("INSERT INTO search_content(rowid, body) VALUES (?, ?)", doc.ID, text).Error
+	})
+	if err != nil {
+		log.Printf("Search: failed to index content of %s: %v", fullPath, err)
+	}
+	return nil
+}
+
+// Remove drops the content of path and everything below it
+func (c *Content) Remove(userID uint, path string) {
+	c.deleteDocuments(c.db.Where("user_id = ? AND (path = ? OR path LIKE ? ESCAPE '\\')", userID, path, likePrefix(path)))
+}
+
+func (c *Content) deleteDocuments(scope *gorm.DB) {
+	var ids []uint
+	if err := scope.Model(&Document{}).Pluck("id", &ids).Error; err != nil || len(ids) == 0 {
+		return
+	}
+	c.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("DELETE FROM search_content WHERE rowid IN ?", ids).Error; err != nil {
+			return err
+		}
+		return tx.Where("id IN ?", ids).Delete(&Document{}).Error
+	})
+}
+
+// Search returns one page of the owners' documents containing every word
+// of text (the last word may be a prefix), best matches first, and the
+// total number of matches. prefix limits results to a directory.
+func (c *Content) Search(owners []uint, text, prefix string, offset, limit int) ([]Hit, int64, error) {
+	match := ftsQuery(text)
+	if match == "" {
+		return nil, 0, nil
+	}
+
+	where := "search_content MATCH ? AND d.user_id IN ?"
+	args := []interface{}{match, owners}
+	if prefix = strings.TrimSuffix(prefix, "/"); prefix != "" {
+		where += " AND d.path LIKE ? ESCAPE '\\'"
+		args = append(args, likePrefix(prefix))
+	}
+	from := " FROM search_content JOIN search_documents d ON d.id = search_content.rowid WHERE " + where
+
+	var total int64
+	if err := c.db.Raw("SELECT count(*)"+from, args...).Scan(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var rows []struct {
+		UserID  uint
+		Path    string
+		Snippet string
+	}
+	err := c.db.Raw("SELECT d.user_id AS user_id, d.path AS path, snippet(search_content, 0, ?, ?, '…', 24) AS snippet"+from+
+		" ORDER BY rank LIMIT ? OFFSET ?", append([]interface{}{markOpen, markClose}, append(args, limit, offset)...)...).
+		Scan(&rows).Error
+	if err != nil {
+		return nil, 0, err
+	}
+
+	hits := make([]Hit, len(rows))
+	for i, r := range rows {
+		snippet := html.EscapeString(r.Snippet)
+		snippet = strings.NewReplacer(markOpen, "<mark>", markClose, "</mark>").Replace(snippet)
+		hits[i] = Hit{UserID: r.UserID, Path: r.Path, Snippet: snippet}
+	}
+	return hits, total, nil
+}
+
+// ftsQuery turns user input into an FTS5 query matching all words, the
+// last one as a prefix, with every word quoted so operators are literal
+func ftsQuery(text string) string {
+	words := strings.Fields(text)
+	for i, w := range words {
+		words[i] = `"` + strings.ReplaceAll(w, `"`, `""`) + `"`
+	}
+	if len(words) == 0 {
+		return ""
+	}
+	words[len(words)-1] += "*"
+	return strings.Join(words, " ")
+}
@@ -0,0 +1,474 @@
+package search
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"encoding/xml"
+	"errors"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/satufile/satufile/files"
+	"github.com/satufile/satufile/vfs"
+)
+
+const (
+	// maxSourceBytes caps how much of a file is read for extraction
+	maxSourceBytes = 32 << 20
+	// maxTextBytes caps the text stored per file
+	maxTextBytes = 2 << 20
+)
+
+// ErrUnsupported means the file's content cannot be indexed
+var ErrUnsupported = errors.New("unsupported content")
+
+// officeExtensions lists the zipped XML formats text is extracted from
+var officeExtensions = map[string]bool{
+	".docx": true, ".xlsx": true, ".pptx": true,
+	".odt": true, ".ods": true, ".odp": true,
+}
+
+// Indexable reports whether the content of a file named name is indexed
+func Indexable(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	switch files.DetectType(ext) {
+	case "text", "pdf":
+		return true
+	}
+	return officeExtensions[ext]
+}
+
+// Extract returns the plain text of a text, PDF or Office file on fsys
+func Extract(fsys vfs.FS, path string) (string, error) {
+	ext := strings.ToLower(filepath.Ext(path))
+	var text string
+	var err error
+	switch {
+	case officeExtensions[ext]:
+		text, err = extractOffice(fsys, path, ext)
+	case files.DetectType(ext) == "pdf":
+		text, err = extractPDF(fsys, path)
+	case files.DetectType(ext) == "text":
+		text, err = extractText(fsys, path)
+	default:
+		return "", ErrUnsupported
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(text) > maxTextBytes {
+		text = strings.ToValidUTF8(text[:maxTextBytes], "")
+	}
+	return text, nil
+}
+
+func readSource(fsys vfs.FS, path string) ([]byte, error) {
+	f, err := fsys.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(io.LimitReader(f, maxSourceBytes))
+}
+
+func extractText(fsys vfs.FS, path string) (string, error) {
+	data, err := readSource(fsys, path)
+	if err != nil {
+		return "", err
+	}
+	// Binary files sometimes carry text extensions
+	if bytes.IndexByte(data[:min(len(data), 8192)], 0) >= 0 {
+		return "", ErrUnsupported
+	}
+	return strings.ToValidUTF8(string(data), " "), nil
+}
+
+// extractOffice collects the text runs of OOXML and OpenDocument files
+func extractOffice(fsys vfs.FS, path, ext string) (string, error) {
+	f, err := fsys.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	ra, ok := f.(io.ReaderAt)
+	if !ok {
+		ra = &seekReaderAt{f: f}
+	}
+	zr, err := zip.NewReader(ra, info.Size())
+	if err != nil {
+		return "", err
+	}
+
+	var parts []*zip.File
+	for _, f := range zr.File {
+		switch ext {
+		case ".docx":
+			if f.Name == "word/document.xml" || strings.HasPrefix(f.Name, "word/header") || strings.HasPrefix(f.Name, "word/footer") {
+				parts = append(parts, f)
+			}
+		case ".xlsx":
+			if f.Name == "xl/sharedStrings.xml" {
+				parts = append(parts, f)
+			}
+		case ".pptx":
+			if strings.HasPrefix(f.Name, "ppt/slides/slide") && strings.HasSuffix(f.Name, ".xml") {
+				parts = append(parts, f)
+			}
+		default: // OpenDocument
+			if f.Name == "content.xml" {
+				parts = append(parts, f)
+			}
+		}
+	}
+	sort.Slice(parts, func(i, j int) bool { return naturalLess(parts[i].Name, parts[j].Name) })
+
+	// OOXML keeps text in <t> elements; OpenDocument in any element
+	onlyT := !strings.HasPrefix(ext, ".od")
+
+	var b strings.Builder
+	budget := int64(maxSourceBytes)
+	for _, f := range parts {
+		rc, err := f.Open()
+		if err != nil {
+			continue
+		}
+		lr := &io.LimitedReader{R: rc, N: budget}
+		xmlText(&b, lr, onlyT)
+		budget = lr.N
+		rc.Close()
+		if budget <= 0 || b.Len() > maxTextBytes {
+			break
+		}
+	}
+	return b.String(), nil
+}
+
+// seekReaderAt reads at offsets of a file without ReadAt, one read at a
+// time
+type seekReaderAt struct {
+	f vfs.File
+}
+
+func (r *seekReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if _, err := r.f.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(r.f, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// xmlText appends character data to b, breaking lines at paragraphs
+func xmlText(b *strings.Builder, r io.Reader, onlyT bool) {
+	dec := xml.NewDecoder(r)
+	depthT := 0
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if t.Name.Local == "t" {
+				depthT++
+			}
+			if t.Name.Local == "tab" || t.Name.Local == "s" {
+				b.WriteByte(' ')
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "t":
+				depthT--
+			case "p", "h", "si", "br":
+				b.WriteByte('\n')
+			}
+		case xml.CharData:
+			if !onlyT || depthT > 0 {
+				b.Write(t)
+			}
+		}
+	}
+}
+
+// naturalLess orders slide2.xml before slide10.xml
+func naturalLess(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+// extractPDF pulls the strings shown by text operators out of a PDF's
+// content streams. It handles uncompressed and FlateDecode streams with
+// simple (single-byte or UTF-16) strings, which covers most documents
+// produced by office software; glyph-indexed fonts yield nothing.
+func extractPDF(fsys vfs.FS, path string) (string, error) {
+	data, err := readSource(fsys, path)
+	if err != nil {
+		return "", err
+	}
+	if !bytes.HasPrefix(data, []byte("%PDF")) {
+		return "", ErrUnsupported
+	}
+
+	var b strings.Builder
+	rest := data
+	for {
+		i := bytes.Index(rest, []byte("stream"))
+		if i < 0 {
+			break
+		}
+		// Skip "endstream"
+		if i >= 3 && string(rest[i-3:i]) == "end" {
+			rest = rest[i+6:]
+			continue
+		}
+
+		dict := rest[max(0, i-1024):i]
+		if k := bytes.LastIndex(dict, []byte("<<")); k >= 0 {
+			dict = dict[k:]
+		}
+		body := rest[i+6:]
+		body = bytes.TrimLeft(body, "\r\n")
+		end := bytes.Index(body, []byte("endstream"))
+		if end < 0 {
+			break
+		}
+		stream := body[:end]
+		rest = body[end+9:]
+
+		switch {
+		case bytes.Contains(dict, []byte("/FlateDecode")):
+			zr, err := zlib.NewReader(bytes.NewReader(stream))
+			if err != nil {
+				continue
+			}
+			stream, _ = io.ReadAll(io.LimitReader(zr, maxSourceBytes)) // keep partial output
+			zr.Close()
+		case bytes.Contains(dict, []byte("/Filter")):
+			continue // images and other encodings carry no text
+		}
+
+		pdfText(&b, stream)
+		if b.Len() > maxTextBytes {
+			break
+		}
+	}
+	return b.String(), nil
+}
+
+// pdfText interprets the text operators of a content stream
+func pdfText(b *strings.Builder, s []byte) {
+	var operands []string
+	inText := false
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '(':
+			str, n := pdfLiteral(s[i:])
+			operands = append(operands, str)
+			i += n
+		case c == '<' && i+1 < len(s) && s[i+1] != '<':
+			str, n := pdfHex(s[i:])
+			operands = append(operands, str)
+			i += n
+		case c == '[':
+			operands = append(operands, "[")
+			i++
+		case c == ']':
+			// Collapse the array into one operand for TJ
+			var parts []string
+			for len(operands) > 0 && operands[len(operands)-1] != "[" {
+				parts = append([]string{operands[len(operands)-1]}, parts...)
+				operands = operands[:len(operands)-1]
+			}
+			if len(operands) > 0 {
+				operands = operands[:len(operands)-1]
+			}
+			operands = append(operands, strings.Join(parts, ""))
+			i++
+		case c == '%':
+			for i < len(s) && s[i] != '\n' && s[i] != '\r' {
+				i++
+			}
+		case c == '-' || c == '.' || (c >= '0' && c <= '9'):
+			j := i + 1
+			for j < len(s) && (s[j] == '.' || (s[j] >= '0' && s[j] <= '9')) {
+				j++
+			}
+			// Wide negative kerning inside TJ arrays separates words
+			if v, err := strconv.ParseFloat(string(s[i:j]), 64); err == nil && v < -150 && containsOpen(operands) {
+				operands = append(operands, " ")
+			}
+			i = j
+		case isPDFRegular(c):
+			j := i
+			for j < len(s) && isPDFRegular(s[j]) {
+				j++
+			}
+			op := string(s[i:j])
+			i = j
+			switch op {
+			case "BT":
+				inText = true
+			case "ET":
+				inText = false
+				b.WriteByte('\n')
+			case "Tj", "TJ", "'", "\"":
+				if inText && len(operands) > 0 {
+					if op == "'" || op == "\"" {
+						b.WriteByte('\n')
+					}
+					b.WriteString(operands[len(operands)-1])
+				}
+			case "Td", "TD", "T*", "Tm":
+				if inText {
+					b.WriteByte(' ')
+				}
+			}
+			if op != "" && op[0] != '/' {
+				operands = operands[:0]
+			}
+		default:
+			i++
+		}
+	}
+}
+
+func containsOpen(operands []string) bool {
+	for _, o := range operands {
+		if o == "[" {
+			return true
+		}
+	}
+	return false
+}
+
+func isPDFRegular(c byte) bool {
+	return c > ' ' && !strings.ContainsRune("()<>[]{}%", rune(c)) && c < 0x7f
+}
+
+// pdfLiteral decodes a (literal string) and returns the bytes consumed
+func pdfLiteral(s []byte) (string, int) {
+	var out []byte
+	depth := 0
+	i := 0
+	for ; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '(':
+			depth++
+			if depth == 1 {
+				continue
+			}
+		case ')':
+			depth--
+			if depth == 0 {
+				return pdfString(out), i + 1
+			}
+		case '\\':
+			i++
+			if i >= len(s) {
+				break
+			}
+			switch e := s[i]; e {
+			case 'n':
+				out = append(out, '\n')
+			case 'r', 't', 'b', 'f':
+				out = append(out, ' ')
+			case '\r', '\n':
+				// line continuation
+			default:
+				if e >= '0' && e <= '7' {
+					v := 0
+					for k := 0; k < 3 && i < len(s) && s[i] >= '0' && s[i] <= '7'; k++ {
+						v = v*8 + int(s[i]-'0')
+						i++
+					}
+					i--
+					out = append(out, byte(v))
+				} else {
+					out = append(out, e)
+				}
+			}
+			continue
+		}
+		out = append(out, c)
+	}
+	return pdfString(out), i
+}
+
+// pdfHex decodes a <hex string> and returns the bytes consumed
+func pdfHex(s []byte) (string, int) {
+	end := bytes.IndexByte(s, '>')
+	if end < 0 {
+		return "", len(s)
+	}
+	var out []byte
+	var hi byte
+	half := false
+	for _, c := range s[1:end] {
+		var v byte
+		switch {
+		case c >= '0' && c <= '9':
+			v = c - '0'
+		case c >= 'a' && c <= 'f':
+			v = c - 'a' + 10
+		case c >= 'A' && c <= 'F':
+			v = c - 'A' + 10
+		default:
+			continue
+		}
+		if half {
+			out = append(out, hi<<4|v)
+		} else {
+			hi = v
+		}
+		half = !half
+	}
+	if half {
+		out = append(out, hi<<4)
+	}
+	return pdfString(out), end + 1
+}
+
+// pdfString converts string bytes (UTF-16BE with BOM, or a single-byte
+// encoding) to text, dropping control characters
+func pdfString(raw []byte) string {
+	var runes []rune
+	if len(raw) >= 2 && raw[0] == 0xfe && raw[1] == 0xff {
+		u := make([]uint16, 0, len(raw)/2)
+		for i := 2; i+1 < len(raw); i += 2 {
+			u = append(u, uint16(raw[i])<<8|uint16(raw[i+1]))
+		}
+		runes = utf16.Decode(u)
+	} else if utf8.Valid(raw) {
+		runes = []rune(string(raw))
+	} else {
+		runes = make([]rune, len(raw))
+		for i, c := range raw {
+			runes[i] = rune(c) // Latin-1 approximation of PDFDocEncoding
+		}
+	}
+
+	var b strings.Builder
+	for _, r := range runes {
+		if unicode.IsPrint(r) || r == '\n' {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,382 @@
+// Package search keeps a persistent index of every user's files so that
+// searches do not have to walk the partitions. The index is rebuilt at
+// startup and kept current from filesystem events and API changes.
+package search
+
+import (
+	"io/fs"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/satufile/satufile/files"
+	"github.com/satufile/satufile/users"
+	"github.com/satufile/satufile/vfs"
+)
+
+// batchSize is the number of entries written per statement during a rebuild
+const batchSize = 500
+
+// Entry is one indexed file or directory
+type Entry struct {
+	ID        uint      `gorm:"primaryKey"`
+	UserID    uint      `gorm:"uniqueIndex:idx_search_path"`
+	Path      string    `gorm:"uniqueIndex:idx_search_path"` // relative to the partition, e.g. /Documents/a.txt
+	Name      string    `gorm:"index"`
+	NameLower string    `gorm:"index"`
+	Extension string    `gorm:"index"` // lowercase, with the dot
+	Type      string    `gorm:"index"` // files.DetectType, or "dir"
+	Size      int64     `gorm:"index"`
+	ModTime   time.Time `gorm:"index"`
+	Mode      uint32
+	IsDir     bool
+	Scan      int64 // rebuild generation that last saw the entry
+}
+
+// TableName specifies the table name for GORM
+func (Entry) TableName() string {
+	return "search_entries"
+}
+
+// FileInfo converts the entry to the API representation
+func (e *Entry) FileInfo() *files.FileInfo {
+	info := &files.FileInfo{
+		Path:      e.Path,
+		Name:      e.Name,
+		Size:      e.Size,
+		Extension: filepath.Ext(e.Name),
+		ModTime:   e.ModTime,
+		Mode:      fs.FileMode(e.Mode),
+		IsDir:     e.IsDir,
+	}
+	if !e.IsDir {
+		info.Type = e.Type
+	}
+	return info
+}
+
+// Index maintains the entries of every tracked partition
+type Index struct {
+	db      *gorm.DB
+	content *Content // nil when content search is disabled
+
+	mu    sync.RWMutex
+	roots map[uint]tracked // user ID -> partition root
+}
+
+// tracked is a partition root and the filesystem it is on
+type tracked struct {
+	fs   vfs.FS
+	root string
+}
+
+// NewIndex creates an index stored in db
+func NewIndex(db *gorm.DB) (*Index, error) {
+	if err := db.AutoMigrate(&Entry{}); err != nil {
+		return nil, err
+	}
+	return &Index{db: db, roots: make(map[uint]tracked)}, nil
+}
+
+// SetContent makes the index keep c in step with file changes
+func (x *Index) SetContent(c *Content) {
+	x.content = c
+}
+
+// Content returns the content index, or nil when it is disabled
+func (x *Index) Content() *Content {
+	return x.content
+}
+
+// Track makes the index follow changes below a user's partition root on
+// fsys
+func (x *Index) Track(userID uint, fsys vfs.FS, root string) {
+	if root == "" {
+		return
+	}
+	x.mu.Lock()
+	x.roots[userID] = tracked{fs: fsys, root: filepath.Clean(root)}
+	x.mu.Unlock()
+}
+
+// Ensure indexes a partition the index does not follow yet, such as one
+// set up after startup
+func (x *Index) Ensure(userID uint, fsys vfs.FS, root string) error {
+	x.mu.RLock()
+	_, ok := x.roots[userID]
+	x.mu.RUnlock()
+	if ok || root == "" {
+		return nil
+	}
+
+	x.Track(userID, fsys, root)
+	_, err := x.Rebuild(userID, fsys, root)
+	return err
+}
+
+// Build tracks and rebuilds the partition of every user in userRepo
+func (x *Index) Build(userRepo *users.Repository) {
+	allUsers, err := userRepo.List()
+	if err != nil {
+		log.Printf("Search: failed to list users: %v", err)
+		return
+	}
+	// Track everyone first so Ensure does not start a second rebuild
+	for _, u := range allUsers {
+		x.Track(u.ID, u.FS(), u.Root())
+	}
+
+	for _, u := range allUsers {
+		if u.StoragePath == "" {
+			continue
+		}
+
+		start := time.Now()
+		n, err := x.Rebuild(u.ID, u.FS(), u.Root())
+		if err != nil {
+			log.Printf("Search: failed to index user %s: %v", u.Username, err)
+			continue
+		}
+		log.Printf("Search: indexed %d entries of user %s in %s", n, u.Username, time.Since(start).Round(time.Millisecond))
+	}
+}
+
+// Rebuild walks a partition and replaces its entries, returning how many
+// were indexed. Searches keep working on the old entries meanwhile.
+func (x *Index) Rebuild(userID uint, fsys vfs.FS, root string) (int, error) {
+	scan := time.Now().UnixNano()
+	n, err := x.walk(userID, fsys, root, "/", scan)
+	if err != nil {
+		return n, err
+	}
+	// Anything the walk did not see is gone
+	err = x.db.Where("user_id = ? AND scan < ?", userID, scan).Delete(&Entry{}).Error
+	if err == nil && x.content != nil {
+		x.content.Sync(userID, fsys, root)
+	}
+	return n, err
+}
+
+// walk upserts every entry below rel (inclusive unless it is the root)
+func (x *Index) walk(userID uint, fsys vfs.FS, root, rel string, scan int64) (int, error) {
+	var batch []Entry
+	n := 0
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := x.upsert(batch)
+		n += len(batch)
+		batch = batch[:0]
+		return err
+	}
+
+	start := filepath.Join(root, rel)
+	err := vfs.WalkDir(fsys, start, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil // Ignore errors accessing specific files
+		}
+		if path == root {
+			return nil
+		}
+
+		relPath := "/" + filepath.ToSlash(strings.TrimPrefix(path, root+string(filepath.Separator)))
+		if files.IsReserved(relPath) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		batch = append(batch, newEntry(userID, relPath, info, scan))
+		if len(batch) >= batchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+	return n, flush()
+}
+
+func newEntry(userID uint, relPath string, info fs.FileInfo, scan int64) Entry {
+	e := Entry{
+		UserID:    userID,
+		Path:      relPath,
+		Name:      info.Name(),
+		NameLower: strings.ToLower(info.Name()),
+		Extension: strings.ToLower(filepath.Ext(info.Name())),
+		Size:      info.Size(),
+		ModTime:   info.ModTime().UTC(), // stored as text, so keep one zone for comparisons
+		Mode:      uint32(info.Mode()),
+		IsDir:     info.IsDir(),
+		Scan:      scan,
+	}
+	if e.IsDir {
+		e.Type = "dir"
+		e.Extension = ""
+	} else {
+		e.Type = files.DetectType(filepath.Ext(info.Name()))
+	}
+	return e
+}
+
+func (x *Index) upsert(entries []Entry) error {
+	return x.db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "user_id"}, {Name: "path"}},
+		DoUpdates: clause.AssignmentColumns([]string{
+			"name", "name_lower", "extension", "type", "size", "mod_time", "mode", "is_dir", "scan",
+		}),
+	}).Create(&entries).Error
+}
+
+// relative returns path relative to root as "/a/b", or false if it is not
+// at or below root
+func relative(root, path string) (string, bool) {
+	if path == root {
+		return "/", true
+	}
+	if rest, ok := strings.CutPrefix(path, root+string(filepath.Separator)); ok {
+		return "/" + filepath.ToSlash(rest), true
+	}
+	return "", false
+}
+
+// Update refreshes the entry for an absolute path on the local disk after
+// it was created, changed, moved or removed. Directories are re-indexed
+// with their contents, through the partition's filesystem so encrypted
+// files are read decrypted. Paths outside tracked partitions are ignored.
+func (x *Index) Update(path string) {
+	path = filepath.Clean(path)
+
+	x.mu.RLock()
+	var userID uint
+	var t tracked
+	rel, ok := "", false
+	for id, candidate := range x.roots {
+		if !vfs.IsLocal(vfs.Base(candidate.fs)) {
+			continue
+		}
+		if rel, ok = relative(candidate.root, path); ok {
+			userID, t = id, candidate
+			break
+		}
+	}
+	x.mu.RUnlock()
+
+	if ok {
+		x.refresh(userID, t, rel)
+	}
+}
+
+// Refresh is Update for a path on the filesystem of a user's partition,
+// whichever backend it is on
+func (x *Index) Refresh(userID uint, path string) {
+	x.mu.RLock()
+	t, ok := x.roots[userID]
+	x.mu.RUnlock()
+	if !ok {
+		return
+	}
+	if rel, ok := relative(t.root, filepath.Clean(path)); ok {
+		x.refresh(userID, t, rel)
+	}
+}
+
+// refresh re-indexes rel below a tracked partition
+func (x *Index) refresh(userID uint, t tracked, rel string) {
+	if files.IsReserved(rel) {
+		return
+	}
+	fsys, root := t.fs, t.root
+	path := filepath.Join(root, rel)
+
+	info, err := fsys.Lstat(path)
+	if err != nil {
+		x.remove(userID, rel)
+		if x.content != nil {
+			x.content.Remove(userID, rel)
+		}
+		return
+	}
+
+	// Parents may have been created along with the path (mkdir -p), and
+	// their modification times changed anyway
+	scan := time.Now().UnixNano()
+	var entries []Entry
+	for dir := rel; dir != "/"; dir = filepath.ToSlash(filepath.Dir(dir)) {
+		dirInfo := info
+		if dir != rel {
+			if dirInfo, err = fsys.Lstat(filepath.Join(root, dir)); err != nil {
+				break
+			}
+		}
+		entries = append(entries, newEntry(userID, dir, dirInfo, scan))
+	}
+	if len(entries) > 0 {
+		if err := x.upsert(entries); err != nil {
+			log.Printf("Search: failed to index %s: %v", path, err)
+			return
+		}
+	}
+	if !info.IsDir() {
+		if x.content != nil {
+			x.content.Enqueue(userID, fsys, root, rel)
+		}
+		return
+	}
+
+	// Re-walk the directory and drop descendants that no longer exist
+	if _, err := x.walk(userID, fsys, root, rel, scan); err != nil {
+		log.Printf("Search: failed to index %s: %v", path, err)
+		return
+	}
+	x.db.Where("user_id = ? AND path LIKE ? ESCAPE '\\' AND scan < ?", userID, likePrefix(rel), scan).Delete(&Entry{})
+	if x.content != nil {
+		x.content.Sync(userID, fsys, root)
+	}
+}
+
+// Forget stops following a user's partition and drops all of their
+// entries and content, once the user is deleted
+func (x *Index) Forget(userID uint) error {
+	x.mu.Lock()
+	delete(x.roots, userID)
+	x.mu.Unlock()
+
+	if x.content != nil {
+		x.content.deleteDocuments(x.db.Where("user_id = ?", userID))
+	}
+	return x.db.Where("user_id = ?", userID).Delete(&Entry{}).Error
+}
+
+// remove drops a path and everything below it
+func (x *Index) remove(userID uint, rel string) {
+	err := x.db.Where("user_id = ? AND (path = ? OR path LIKE ? ESCAPE '\\')", userID, rel, likePrefix(rel)).
+		Delete(&Entry{}).Error
+	if err != nil {
+		log.Printf("Search: failed to remove %s: %v", rel, err)
+	}
+}
+
+// likePrefix returns a LIKE pattern matching everything below dir
+func likePrefix(dir string) string {
+	dir = strings.TrimSuffix(dir, "/")
+	return escapeLike(dir) + "/%"
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
@@ -0,0 +1,75 @@
+package search
+
+import (
+	"strings"
+	"time"
+)
+
+// Query filters indexed entries; zero values do not filter
+type Query struct {
+	Name       string   // case-insensitive substring of the file name
+	Type       string   // files.DetectType value, or "dir"
+	Extensions []string // with or without the leading dot
+	MinSize    int64
+	MaxSize    int64 // 0 means no upper bound
+	After      time.Time
+	Before     time.Time
+	Prefix     string // only entries below this directory
+	Offset     int
+	Limit      int
+}
+
+// Filtered reports whether q has any filter besides the name
+func (q Query) Filtered() bool {
+	return q.Type != "" || len(q.Extensions) > 0 || q.MinSize > 0 || q.MaxSize > 0 ||
+		!q.After.IsZero() || !q.Before.IsZero() || q.Prefix != ""
+}
+
+// Search returns one page of the entries of the owners (users or other
+// keys passed to Track) matching q, ordered by path, and the total number
+// of matches
+func (x *Index) Search(owners []uint, q Query) ([]Entry, int64, error) {
+	db := x.db.Model(&Entry{}).Where("user_id IN ?", owners)
+
+	if q.Name != "" {
+		db = db.Where("name_lower LIKE ? ESCAPE '\\'", "%"+escapeLike(strings.ToLower(q.Name))+"%")
+	}
+	if q.Type != "" {
+		db = db.Where("type = ?", q.Type)
+	}
+	if len(q.Extensions) > 0 {
+		exts := make([]string, len(q.Extensions))
+		for i, ext := range q.Extensions {
+			exts[i] = "." + strings.TrimPrefix(strings.ToLower(ext), ".")
+		}
+		db = db.Where("extension IN ?", exts)
+	}
+	if q.MinSize > 0 {
+		db = db.Where("size >= ?", q.MinSize)
+	}
+	if q.MaxSize > 0 {
+		db = db.Where("size <= ?", q.MaxSize)
+	}
+	if !q.After.IsZero() {
+		db = db.Where("mod_time >= ?", q.After.UTC())
+	}
+	if !q.Before.IsZero() {
+		db = db.Where("mod_time < ?", q.Before.UTC())
+	}
+	if prefix := strings.TrimSuffix(q.Prefix, "/"); prefix != "" {
+		db = db.Where("path LIKE ? ESCAPE '\\'", likePrefix(prefix))
+	}
+
+	var total int64
+	if err := db.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var entries []Entry
+	db = db.Order("path, user_id").Offset(q.Offset)
+	if q.Limit > 0 {
+		db = db.Limit(q.Limit)
+	}
+	err := db.Find(&entries).Error
+	return entries, total, err
+}
@@ -3,7 +3,34 @@ package share
 import (
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
 	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Link types
+const (
+	TypeFile   = "file"   // a single file
+	TypeFolder = "folder" // a folder visitors can browse and download
+	TypeUpload = "upload" // a folder visitors can only upload into
+)
+
+// Link modes
+const (
+	ModeDownload = "download" // visitors may view and download
+	ModeView     = "view"     // visitors may only view
+)
+
+var (
+	ErrNotFound      = errors.New("share link not found")
+	ErrExpired       = errors.New("share link expired")
+	ErrDownloadLimit = errors.New("share link download limit reached")
+	ErrUploadLimit   = errors.New("share link upload limit reached")
 )
 
 // Link represents a share link
@@ -11,10 +38,132 @@ type Link struct {
 	ID        string    `json:"id" gorm:"primaryKey"`
 	Token     string    `json:"token" gorm:"uniqueIndex;not null"`
 	Path      string    `json:"path" gorm:"index;not null"`
-	Type      string    `json:"type" gorm:"not null"` // "file" or "folder"
+	Type      string    `json:"type" gorm:"not null"` // TypeFile, TypeFolder or TypeUpload
 	ExpiresAt time.Time `json:"expires_at" gorm:"index"`
 	CreatedAt time.Time `json:"created_at" gorm:"autoCreateTime"`
-	// Add more fields as needed: permissions, max downloads, etc.
+	// OwnerID is the user whose files Path is relative to; links created
+	// before links had owners have 0 and resolve against the data directory
+	OwnerID       uint  `json:"owner_id,omitempty" gorm:"index;default:0"`
+	Downloads     int   `json:"downloads" gorm:"default:0"`
+	Uploads       int   `json:"uploads" gorm:"default:0"`
+	UploadedBytes int64 `json:"uploaded_bytes" gorm:"default:0"`
+	Options       `gorm:"embedded"`
+}
+
+// Options restrict what the visitors of a link may do
+type Options struct {
+	PasswordHash string `json:"-"`
+	HasPassword  bool   `json:"has_password"`
+	MaxDownloads int    `json:"max_downloads"`         // 0 = unlimited
+	Mode         string `json:"mode"`                  // ModeDownload (also when empty) or ModeView
+	AllowedIPs   string `json:"allowed_ips,omitempty"` // comma-separated addresses or CIDR ranges; empty allows all
+	// Caps on what visitors may upload through an upload link; 0 = unlimited
+	MaxUploads     int   `json:"max_uploads"`
+	MaxUploadBytes int64 `json:"max_upload_bytes"`
+}
+
+// SetPassword protects the link with password, or removes the protection
+// if it is empty
+func (o *Options) SetPassword(password string) error {
+	if password == "" {
+		o.PasswordHash, o.HasPassword = "", false
+		return nil
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	o.PasswordHash, o.HasPassword = string(hash), true
+	return nil
+}
+
+// CheckPassword reports whether password unlocks the link
+func (o *Options) CheckPassword(password string) bool {
+	return o.HasPassword && bcrypt.CompareHashAndPassword([]byte(o.PasswordHash), []byte(password)) == nil
+}
+
+// CanDownload reports whether the link's mode allows downloads
+func (o *Options) CanDownload() bool {
+	return o.Mode != ModeView
+}
+
+// AllowsIP reports whether a visitor at ip may use the link
+func (o *Options) AllowsIP(ip net.IP) bool {
+	if o.AllowedIPs == "" {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, entry := range strings.Split(o.AllowedIPs, ",") {
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+		} else if allowed := net.ParseIP(entry); allowed != nil && allowed.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the mode, limit and address list, normalising the list
+func (o *Options) Validate() error {
+	if o.Mode == "" {
+		o.Mode = ModeDownload
+	}
+	if o.Mode != ModeDownload && o.Mode != ModeView {
+		return fmt.Errorf("invalid mode %q, must be %q or %q", o.Mode, ModeDownload, ModeView)
+	}
+	if o.MaxDownloads < 0 || o.MaxUploads < 0 || o.MaxUploadBytes < 0 {
+		return errors.New("limits must not be negative")
+	}
+
+	var entries []string
+	for _, entry := range strings.Split(o.AllowedIPs, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			entry = network.String()
+		} else if ip := net.ParseIP(entry); ip != nil {
+			entry = ip.String()
+		} else {
+			return fmt.Errorf("invalid address %q in allowed_ips", entry)
+		}
+		entries = append(entries, entry)
+	}
+	o.AllowedIPs = strings.Join(entries, ",")
+	return nil
+}
+
+// AcceptsUpload checks an upload of size bytes against the link's caps.
+// Uploads in progress are not reserved, so RecordUpload checks again when
+// an upload completes.
+func (l *Link) AcceptsUpload(size int64) error {
+	if l.Type != TypeUpload {
+		return errors.New("share link does not accept uploads")
+	}
+	if l.MaxUploads > 0 && l.Uploads >= l.MaxUploads {
+		return ErrUploadLimit
+	}
+	if l.MaxUploadBytes > 0 && l.UploadedBytes+size > l.MaxUploadBytes {
+		return ErrUploadLimit
+	}
+	return nil
+}
+
+// DownloadsLeft returns how many more downloads the link allows, or -1 if
+// it has no limit
+func (l *Link) DownloadsLeft() int {
+	if l.MaxDownloads == 0 {
+		return -1
+	}
+	if l.Downloads >= l.MaxDownloads {
+		return 0
+	}
+	return l.MaxDownloads - l.Downloads
 }
 
 // NewLink creates a new share link
@@ -43,6 +192,7 @@ func NewLink(path string, linkType string, expiresHours int) (*Link, error) {
 		Type:      linkType,
 		ExpiresAt: expiresAt,
 		CreatedAt: time.Now(),
+		Options:   Options{Mode: ModeDownload},
 	}, nil
 }
 
@@ -71,4 +221,51 @@ type StorageBackend interface {
 	DeleteLink(token string) error
 	ListLinks() ([]*Link, error)
 	UpdateLink(token string, expiresAt time.Time) error
+	UpdateLinkPath(token string, path string) error
+	UpdateLinkOptions(token string, options Options) error
+	// RecordDownload counts a download, failing with ErrDownloadLimit
+	// once the link's limit is used up. It is atomic, so concurrent
+	// downloads cannot exceed the limit.
+	RecordDownload(token string) error
+	// RecordUpload counts an upload of size bytes, failing with
+	// ErrUploadLimit if it would exceed the link's caps. It is atomic like
+	// RecordDownload.
+	RecordUpload(token string, size int64) error
+}
+
+// RelocateLinks rewrites the links of owner that point at oldPath, or at
+// anything below it, so they follow the item to newPath after a move or
+// rename. With shared set, both paths are in a place every owner sees
+// under the same path, such as a space, and the links of every owner
+// follow.
+func RelocateLinks(s StorageBackend, owner uint, shared bool, oldPath, newPath string) error {
+	links, err := s.ListLinks()
+	if err != nil {
+		return err
+	}
+
+	oldPath = filepath.Clean("/" + oldPath)
+	newPath = filepath.Clean("/" + newPath)
+
+	for _, link := range links {
+		if !shared && link.OwnerID != owner {
+			continue
+		}
+		linkPath := filepath.Clean("/" + link.Path)
+
+		var target string
+		switch {
+		case linkPath == oldPath:
+			target = newPath
+		case strings.HasPrefix(linkPath, oldPath+"/"):
+			target = filepath.Join(newPath, strings.TrimPrefix(linkPath, oldPath))
+		default:
+			continue
+		}
+
+		if err := s.UpdateLinkPath(link.Token, target); err != nil {
+			return err
+		}
+	}
+	return nil
 }
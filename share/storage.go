@@ -35,12 +35,12 @@ func (s *MemoryStorage) GetLink(token string) (*Link, error) {
 
 	link, exists := s.links[token]
 	if !exists {
-		return nil, errors.New("share link not found")
+		return nil, ErrNotFound
 	}
 
 	if link.ExpiresAt.Before(time.Now()) {
 		delete(s.links, token)
-		return nil, errors.New("share link expired")
+		return nil, ErrExpired
 	}
 
 	return link, nil
@@ -71,12 +71,73 @@ func (s *MemoryStorage) UpdateLink(token string, expiresAt time.Time) error {
 
 	link, exists := s.links[token]
 	if !exists {
-		return errors.New("share link not found")
+		return ErrNotFound
 	}
 	link.ExpiresAt = expiresAt
 	return nil
 }
 
+func (s *MemoryStorage) UpdateLinkPath(token string, path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	link, exists := s.links[token]
+	if !exists {
+		return ErrNotFound
+	}
+	link.Path = path
+	return nil
+}
+
+func (s *MemoryStorage) UpdateLinkOptions(token string, options Options) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	link, exists := s.links[token]
+	if !exists {
+		return ErrNotFound
+	}
+	link.Options = options
+	return nil
+}
+
+func (s *MemoryStorage) RecordDownload(token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	link, exists := s.links[token]
+	if !exists {
+		return ErrNotFound
+	}
+	if link.ExpiresAt.Before(time.Now()) {
+		return ErrExpired
+	}
+	if link.MaxDownloads > 0 && link.Downloads >= link.MaxDownloads {
+		return ErrDownloadLimit
+	}
+	link.Downloads++
+	return nil
+}
+
+func (s *MemoryStorage) RecordUpload(token string, size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	link, exists := s.links[token]
+	if !exists {
+		return ErrNotFound
+	}
+	if link.ExpiresAt.Before(time.Now()) {
+		return ErrExpired
+	}
+	if err := link.AcceptsUpload(size); err != nil {
+		return err
+	}
+	link.Uploads++
+	link.UploadedBytes += size
+	return nil
+}
+
 // DBStorage implements StorageBackend using database
 type DBStorage struct {
 	db *gorm.DB
@@ -105,7 +166,7 @@ func (s *DBStorage) GetLink(token string) (*Link, error) {
 	err := s.db.Where("token = ?", token).First(&link).Error
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return nil, errors.New("share link not found")
+			return nil, ErrNotFound
 		}
 		return nil, err
 	}
@@ -114,7 +175,7 @@ func (s *DBStorage) GetLink(token string) (*Link, error) {
 	if link.ExpiresAt.Before(time.Now()) {
 		// Delete expired link
 		s.DeleteLink(token)
-		return nil, errors.New("share link expired")
+		return nil, ErrExpired
 	}
 
 	return &link, nil
@@ -163,7 +224,91 @@ func (s *DBStorage) UpdateLink(token string, expiresAt time.Time) error {
 		return result.Error
 	}
 	if result.RowsAffected == 0 {
-		return errors.New("share link not found")
+		return ErrNotFound
+	}
+	return nil
+}
+
+// UpdateLinkPath points a share link at a new path
+func (s *DBStorage) UpdateLinkPath(token string, path string) error {
+	if s.db == nil {
+		return errors.New("database not initialized")
+	}
+	result := s.db.Model(&Link{}).Where("token = ?", token).Update("path", path)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// UpdateLinkOptions replaces a share link's restrictions
+func (s *DBStorage) UpdateLinkOptions(token string, options Options) error {
+	if s.db == nil {
+		return errors.New("database not initialized")
+	}
+	result := s.db.Model(&Link{}).Where("token = ?", token).Select("password_hash", "has_password", "max_downloads", "mode", "allowed_ips", "max_uploads", "max_upload_bytes").Updates(&Link{Options: options})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
 	}
 	return nil
 }
+
+// RecordDownload counts a download in a single conditional UPDATE, so the
+// limit holds however many downloads race for the last slot
+func (s *DBStorage) RecordDownload(token string) error {
+	if s.db == nil {
+		return errors.New("database not initialized")
+	}
+	result := s.db.Model(&Link{}).
+		Where("token = ? AND expires_at > ? AND (max_downloads = 0 OR downloads < max_downloads)", token, time.Now()).
+		UpdateColumn("downloads", gorm.Expr("downloads + 1"))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 1 {
+		return nil
+	}
+
+	// Tell the reasons apart for the caller
+	if _, err := s.GetLink(token); err != nil {
+		return err
+	}
+	return ErrDownloadLimit
+}
+
+// RecordUpload counts an upload in a single conditional UPDATE, like
+// RecordDownload
+func (s *DBStorage) RecordUpload(token string, size int64) error {
+	if s.db == nil {
+		return errors.New("database not initialized")
+	}
+	result := s.db.Model(&Link{}).
+		Where("token = ? AND type = ? AND expires_at > ?", token, TypeUpload, time.Now()).
+		Where("max_uploads = 0 OR uploads < max_uploads").
+		Where("max_upload_bytes = 0 OR uploaded_bytes + ? <= max_upload_bytes", size).
+		UpdateColumns(map[string]interface{}{
+			"uploads":        gorm.Expr("uploads + 1"),
+			"uploaded_bytes": gorm.Expr("uploaded_bytes + ?", size),
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 1 {
+		return nil
+	}
+
+	link, err := s.GetLink(token)
+	if err != nil {
+		return err
+	}
+	if err := link.AcceptsUpload(size); err != nil {
+		return err
+	}
+	return ErrUploadLimit
+}
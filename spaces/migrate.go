@@ -0,0 +1,29 @@
+package spaces
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+
+	"github.com/satufile/satufile/files"
+	"github.com/satufile/satufile/vfs"
+)
+
+// MoveAside renames what a partition holds at the mount point, such as a
+// folder named Spaces made before spaces existed, so it stays reachable.
+// It returns the new name, or "" if there was nothing to move.
+func MoveAside(fsys vfs.FS, root string) (string, error) {
+	old := filepath.Join(root, MountDir)
+	if _, err := fsys.Lstat(old); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	target := files.AvailableName(fsys, filepath.Join(root, MountDir+" (personal)"))
+	if err := fsys.Rename(old, target); err != nil {
+		return "", err
+	}
+	return filepath.Base(target), nil
+}
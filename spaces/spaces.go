@@ -0,0 +1,296 @@
+// Package spaces manages shared folders. A space lives outside every
+// personal partition, has its own quota and is mounted at /Spaces/{name}
+// in the tree of each user its access control list admits.
+package spaces
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/satufile/satufile/system/partition"
+)
+
+// MountDir is the top-level folder spaces are mounted below. It is a
+// reserved folder in every partition (see MoveAside).
+const MountDir = "Spaces"
+
+// KeyBase offsets space IDs into keys for data stored per user ID, such
+// as search entries and preview caches, so they never meet a user's
+const KeyBase = 1 << 31
+
+var (
+	// ErrNotFound is returned for spaces that do not exist or that the
+	// user may not read
+	ErrNotFound = errors.New("space not found")
+	// ErrExists is returned when a name is already taken
+	ErrExists = errors.New("a space with that name already exists")
+	// ErrInvalid wraps input that cannot be applied to a space
+	ErrInvalid = errors.New("invalid space")
+)
+
+// Space is a shared folder
+type Space struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	Name      string    `json:"name" gorm:"uniqueIndex;not null;size:100"`
+	QuotaGb   int       `json:"quotaGb"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// TableName specifies the table name for GORM
+func (Space) TableName() string {
+	return "spaces"
+}
+
+// Key returns the space's key for per-owner data
+func (s *Space) Key() uint {
+	return KeyBase + s.ID
+}
+
+// Access is what a member may do in a space. Every other right implies
+// Read, since a space that cannot be read is not mounted.
+type Access struct {
+	Read   bool `json:"read"`   // list, download and search
+	Write  bool `json:"write"`  // create, modify, rename and move
+	Delete bool `json:"delete"` // move to the trash
+	Share  bool `json:"share"`  // create share links
+}
+
+// None reports whether a grants nothing
+func (a Access) None() bool {
+	return !a.Read && !a.Write && !a.Delete && !a.Share
+}
+
+func (a Access) union(b Access) Access {
+	return Access{
+		Read:   a.Read || b.Read,
+		Write:  a.Write || b.Write,
+		Delete: a.Delete || b.Delete,
+		Share:  a.Share || b.Share,
+	}
+}
+
+// Entry is one line of a space's access control list, for either a user
+// or a group
+type Entry struct {
+	ID      uint `json:"id" gorm:"primaryKey"`
+	SpaceID uint `json:"spaceId" gorm:"uniqueIndex:idx_space_acl"`
+	UserID  uint `json:"userId,omitempty" gorm:"uniqueIndex:idx_space_acl"`
+	GroupID uint `json:"groupId,omitempty" gorm:"uniqueIndex:idx_space_acl"`
+	Access  `gorm:"embedded"`
+}
+
+// TableName specifies the table name for GORM
+func (Entry) TableName() string {
+	return "space_acl"
+}
+
+// Membership is a space as seen by one user
+type Membership struct {
+	Space
+	Access Access `json:"access"`
+}
+
+// BaseDir returns the folder holding the spaces of a server whose root
+// directory is root, next to the partitions
+func BaseDir(root string) string {
+	return filepath.Join(filepath.Dir(partition.BasePath(root)), "spaces")
+}
+
+// Store keeps spaces and their access control lists
+type Store struct {
+	db     *gorm.DB
+	base   string
+	groups func(userID uint) []uint // optional, the groups a user belongs to
+}
+
+// NewStore creates a store keeping space folders below base
+func NewStore(db *gorm.DB, base string) (*Store, error) {
+	if err := db.AutoMigrate(&Space{}, &Entry{}); err != nil {
+		return nil, err
+	}
+	return &Store{db: db, base: base}, nil
+}
+
+// SetGroups makes group entries apply to the users groups reports as
+// members
+func (s *Store) SetGroups(groups func(userID uint) []uint) {
+	s.groups = groups
+}
+
+// Dir returns the folder of the space with id
+func (s *Store) Dir(id uint) string {
+	return filepath.Join(s.base, fmt.Sprint(id))
+}
+
+// List returns every space by name
+func (s *Store) List() ([]Space, error) {
+	var list []Space
+	err := s.db.Order("name").Find(&list).Error
+	return list, err
+}
+
+// Get returns the space with id
+func (s *Store) Get(id uint) (*Space, error) {
+	var sp Space
+	err := s.db.First(&sp, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrNotFound
+	}
+	return &sp, err
+}
+
+// Create stores a space and creates its folder
+func (s *Store) Create(name string, quotaGb int) (*Space, error) {
+	sp := &Space{Name: name, QuotaGb: quotaGb}
+	if err := s.validate(sp); err != nil {
+		return nil, err
+	}
+	if err := s.db.Create(sp).Error; err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(s.Dir(sp.ID), partition.DirPermissions); err != nil {
+		s.db.Delete(sp)
+		return nil, fmt.Errorf("failed to create space folder: %w", err)
+	}
+	return sp, nil
+}
+
+// Update saves a renamed or resized space. Its folder is named by ID, so
+// renaming moves nothing.
+func (s *Store) Update(sp *Space) error {
+	if err := s.validate(sp); err != nil {
+		return err
+	}
+	return s.db.Save(sp).Error
+}
+
+// validate checks a space's name and quota
+func (s *Store) validate(sp *Space) error {
+	sp.Name = strings.TrimSpace(sp.Name)
+	if sp.Name == "" || len(sp.Name) > 100 || strings.HasPrefix(sp.Name, ".") ||
+		strings.ContainsAny(sp.Name, "/\\:*?\"<>|") {
+		return fmt.Errorf("%w: name must be 1-100 characters, not start with '.' and not contain /\\:*?\"<>|", ErrInvalid)
+	}
+	if err := partition.ValidateQuota(sp.QuotaGb); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+
+	var count int64
+	s.db.Model(&Space{}).Where("name = ? AND id <> ?", sp.Name, sp.ID).Count(&count)
+	if count > 0 {
+		return ErrExists
+	}
+	return nil
+}
+
+// Delete removes a space, its access control list and its folder
+func (s *Store) Delete(id uint) error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("space_id = ?", id).Delete(&Entry{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&Space{}, id).Error
+	})
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(s.Dir(id))
+}
+
+// Entries returns a space's access control list
+func (s *Store) Entries(spaceID uint) ([]Entry, error) {
+	var list []Entry
+	err := s.db.Where("space_id = ?", spaceID).Order("group_id, user_id").Find(&list).Error
+	return list, err
+}
+
+// Grant sets the access of e's user or group, replacing any previous
+// entry. An entry granting nothing is removed.
+func (s *Store) Grant(e Entry) error {
+	if (e.UserID == 0) == (e.GroupID == 0) {
+		return fmt.Errorf("%w: an entry needs either a user or a group", ErrInvalid)
+	}
+	if e.Write || e.Delete || e.Share {
+		e.Read = true
+	}
+
+	scope := s.db.Where("space_id = ? AND user_id = ? AND group_id = ?", e.SpaceID, e.UserID, e.GroupID)
+	if e.None() {
+		return scope.Delete(&Entry{}).Error
+	}
+	e.ID = 0
+	return s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "space_id"}, {Name: "user_id"}, {Name: "group_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"read", "write", "delete", "share"}),
+	}).Create(&e).Error
+}
+
+// Memberships returns the spaces userID may read, with the access that
+// the user's own and group entries add up to
+func (s *Store) Memberships(userID uint) ([]Membership, error) {
+	query := s.db.Where("user_id = ?", userID)
+	if s.groups != nil {
+		if groups := s.groups(userID); len(groups) > 0 {
+			query = s.db.Where("user_id = ? OR group_id IN ?", userID, groups)
+		}
+	}
+	var entries []Entry
+	if err := query.Find(&entries).Error; err != nil {
+		return nil, err
+	}
+
+	access := make(map[uint]Access)
+	for _, e := range entries {
+		access[e.SpaceID] = access[e.SpaceID].union(e.Access)
+	}
+	ids := make([]uint, 0, len(access))
+	for id, a := range access {
+		if a.Read {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	var list []Space
+	if err := s.db.Where("id IN ?", ids).Order("name").Find(&list).Error; err != nil {
+		return nil, err
+	}
+	members := make([]Membership, len(list))
+	for i, sp := range list {
+		members[i] = Membership{Space: sp, Access: access[sp.ID]}
+	}
+	return members, nil
+}
+
+// Lookup returns the space named name if userID may read it
+func (s *Store) Lookup(userID uint, name string) (*Membership, error) {
+	return s.find(userID, func(m *Membership) bool { return m.Name == name })
+}
+
+// Member returns the space with id if userID may read it
+func (s *Store) Member(userID, id uint) (*Membership, error) {
+	return s.find(userID, func(m *Membership) bool { return m.ID == id })
+}
+
+func (s *Store) find(userID uint, match func(*Membership) bool) (*Membership, error) {
+	members, err := s.Memberships(userID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range members {
+		if match(&members[i]) {
+			return &members[i], nil
+		}
+	}
+	return nil, ErrNotFound
+}
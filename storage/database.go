@@ -4,6 +4,7 @@ import (
 	"log"
 	"os"
 
+	"github.com/satufile/satufile/checksum"
 	"github.com/satufile/satufile/share"
 	"github.com/satufile/satufile/trash"
 	"github.com/satufile/satufile/users"
@@ -48,7 +49,7 @@ func Connect(cfg *Config) error {
 	}
 
 	// Auto-migrate models
-	err = DB.AutoMigrate(&share.Link{}, &users.User{}, &users.LoginAttempt{}, &trash.TrashItem{})
+	err = DB.AutoMigrate(&share.Link{}, &users.User{}, &users.LoginAttempt{}, &trash.TrashItem{}, &trash.Purge{}, &checksum.Record{})
 	if err != nil {
 		log.Printf("Warning: failed to migrate models: %v", err)
 	}
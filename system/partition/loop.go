@@ -0,0 +1,237 @@
+package partition
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// imagesDir holds the images of loop partitions, next to the partitions.
+// Usernames start with a letter or digit, so no partition is named like it.
+const imagesDir = ".images"
+
+// imagePath returns where the image of the partition at fullPath is
+func imagePath(fullPath string) string {
+	return filepath.Join(filepath.Dir(fullPath), imagesDir, filepath.Base(fullPath)+".img")
+}
+
+// run runs a system command, with its output in the error
+func run(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil && len(out) > 0 {
+		return fmt.Errorf("%s: %v: %s", name, err, strings.TrimSpace(string(out)))
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+// mounted reports whether a filesystem is mounted at path
+func mounted(path string) bool {
+	var st, parent syscall.Stat_t
+	if syscall.Stat(path, &st) != nil || syscall.Stat(filepath.Dir(path), &parent) != nil {
+		return false
+	}
+	return st.Dev != parent.Dev
+}
+
+// createImage creates a sparse ext4 image of size bytes for the partition
+// at fullPath and mounts it there
+func createImage(fullPath string, size int64) error {
+	img := imagePath(fullPath)
+	if err := os.MkdirAll(filepath.Dir(img), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(img, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(size)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	// No blocks are reserved for root: the whole size is the user's
+	if err == nil {
+		err = run("mkfs.ext4", "-q", "-F", "-m", "0", img)
+	}
+	if err == nil {
+		err = os.MkdirAll(fullPath, DirPermissions)
+	}
+	if err == nil {
+		if err = mountImage(fullPath); err != nil {
+			os.Remove(fullPath)
+		}
+	}
+	if err != nil {
+		os.Remove(img)
+		return err
+	}
+	return os.Chmod(fullPath, DirPermissions)
+}
+
+func mountImage(fullPath string) error {
+	return run("mount", "-o", "loop,nosuid,nodev", imagePath(fullPath), fullPath)
+}
+
+func unmountImage(fullPath string) error {
+	if !mounted(fullPath) {
+		return nil
+	}
+	return run("umount", fullPath)
+}
+
+// loopDevice returns the loop device the image at img is attached to
+func loopDevice(img string) (string, error) {
+	out, err := exec.Command("losetup", "-j", img).Output()
+	if err != nil {
+		return "", fmt.Errorf("losetup: %w", err)
+	}
+	dev, _, ok := strings.Cut(string(out), ":")
+	if !ok {
+		return "", fmt.Errorf("no loop device for %s", img)
+	}
+	return dev, nil
+}
+
+// resizeImage changes the size of a loop partition's image and
+// filesystem. Growing works while mounted where the kernel allows it;
+// otherwise the partition is unmounted meanwhile.
+func resizeImage(fullPath string, size int64) error {
+	img := imagePath(fullPath)
+	info, err := os.Stat(img)
+	if err != nil {
+		return err
+	}
+	if size == info.Size() {
+		return nil
+	}
+
+	if size > info.Size() && mounted(fullPath) && growOnline(img, size) == nil {
+		return nil
+	}
+
+	wasMounted := mounted(fullPath)
+	if err := unmountImage(fullPath); err != nil {
+		return err
+	}
+	err = resizeOffline(img, size, info.Size())
+	if wasMounted {
+		if merr := mountImage(fullPath); err == nil {
+			err = merr
+		}
+	}
+	return err
+}
+
+// growOnline grows a mounted image and its filesystem. On failure the
+// image is left at its size for resizeOffline to try.
+func growOnline(img string, size int64) error {
+	info, err := os.Stat(img)
+	if err != nil {
+		return err
+	}
+	dev, err := loopDevice(img)
+	if err != nil {
+		return err
+	}
+	if err := os.Truncate(img, size); err != nil {
+		return err
+	}
+	err = run("losetup", "-c", dev)
+	if err == nil {
+		err = run("resize2fs", dev)
+	}
+	if err != nil {
+		os.Truncate(img, info.Size())
+		run("losetup", "-c", dev)
+	}
+	return err
+}
+
+// resizeOffline resizes an unmounted image from its current size
+func resizeOffline(img string, size, current int64) error {
+	if err := fsck(img, "-p"); err != nil {
+		return err
+	}
+	if size > current {
+		if err := os.Truncate(img, size); err != nil {
+			return err
+		}
+	}
+	// Fails, changing nothing, if the files do not fit
+	if err := run("resize2fs", img, fmt.Sprintf("%dK", size>>10)); err != nil {
+		if size > current {
+			os.Truncate(img, current)
+		}
+		return err
+	}
+	return os.Truncate(img, size)
+}
+
+// checkImage checks and repairs a loop partition's filesystem
+func checkImage(fullPath string) (string, error) {
+	wasMounted := mounted(fullPath)
+	if err := unmountImage(fullPath); err != nil {
+		return "", err
+	}
+	out, err := exec.Command("e2fsck", "-f", "-y", imagePath(fullPath)).CombinedOutput()
+	err = fsckError(err)
+	if wasMounted {
+		if merr := mountImage(fullPath); err == nil {
+			err = merr
+		}
+	}
+	return string(out), err
+}
+
+func fsck(img, mode string) error {
+	out, err := exec.Command("e2fsck", "-f", mode, img).CombinedOutput()
+	if err = fsckError(err); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// fsckError drops e2fsck's exit codes that mean errors were corrected
+func fsckError(err error) error {
+	var exit *exec.ExitError
+	if errors.As(err, &exit) && exit.ExitCode() <= 2 {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("e2fsck: %w", err)
+	}
+	return nil
+}
+
+// Mount mounts the images of loop partitions that are not mounted, as
+// after a reboot, and returns how many it mounted
+func (m *Manager) Mount() (int, error) {
+	images, err := filepath.Glob(filepath.Join(m.dir(), imagesDir, "*.img"))
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	var errs []error
+	for _, img := range images {
+		fullPath := filepath.Join(m.dir(), strings.TrimSuffix(filepath.Base(img), ".img"))
+		if mounted(fullPath) {
+			continue
+		}
+		if err := os.MkdirAll(fullPath, DirPermissions); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := mountImage(fullPath); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		n++
+	}
+	return n, errors.Join(errs...)
+}
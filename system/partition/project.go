@@ -0,0 +1,104 @@
+package partition
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// projectsFile lists the project of each partition as id:path lines, as
+// in /etc/projects. IDs are never reused, since archived partitions keep
+// theirs.
+const projectsFile = ".projects"
+
+// firstProject is the ID of the first partition's project, leaving lower
+// ones to the administrator
+const firstProject = 10000
+
+// createProject creates the partition at fullPath as a new project
+// limited to size bytes
+func (m *Manager) createProject(fullPath string, size int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	list := filepath.Join(m.dir(), projectsFile)
+	id, err := nextProject(list)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(fullPath, DirPermissions); err != nil {
+		return err
+	}
+	err = setProjectID(fullPath, id)
+	if err == nil {
+		if err = setProjectLimit(fullPath, id, size); err != nil {
+			setProjectID(fullPath, 0)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(list, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%d:%s\n", id, fullPath)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// nextProject returns the ID after the highest one in the projects file
+func nextProject(list string) (uint32, error) {
+	f, err := os.Open(list)
+	if os.IsNotExist(err) {
+		return firstProject, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	next := uint32(firstProject)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		field, _, _ := strings.Cut(scanner.Text(), ":")
+		if id, err := strconv.ParseUint(field, 10, 32); err == nil && uint32(id) >= next {
+			next = uint32(id) + 1
+		}
+	}
+	return next, scanner.Err()
+}
+
+// blockDevice returns the device of the filesystem path is on, which
+// quotas are set on
+func blockDevice(path string) (string, error) {
+	data, err := os.ReadFile("/proc/self/mounts")
+	if err != nil {
+		return "", err
+	}
+	unescape := strings.NewReplacer(`\040`, " ", `\011`, "\t", `\134`, `\`)
+	device, best := "", ""
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		mount := unescape.Replace(fields[1])
+		if path != mount && !strings.HasPrefix(path, strings.TrimSuffix(mount, "/")+"/") {
+			continue
+		}
+		if len(mount) > len(best) {
+			device, best = unescape.Replace(fields[0]), mount
+		}
+	}
+	if device == "" {
+		return "", fmt.Errorf("no filesystem found for %s", path)
+	}
+	return device, nil
+}
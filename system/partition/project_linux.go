@@ -0,0 +1,101 @@
+//go:build linux
+
+package partition
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// From linux/fs.h and linux/quota.h
+const (
+	fsIocGetXattr      = 0x801c581f // FS_IOC_FSGETXATTR
+	fsIocSetXattr      = 0x401c5820 // FS_IOC_FSSETXATTR
+	fsXflagProjInherit = 0x200      // FS_XFLAG_PROJINHERIT
+
+	qSetQuota  = 0x800008 // Q_SETQUOTA
+	prjQuota   = 2        // PRJQUOTA
+	qifBLimits = 1        // QIF_BLIMITS
+)
+
+// fsxattr is struct fsxattr
+type fsxattr struct {
+	Xflags     uint32
+	Extsize    uint32
+	Nextents   uint32
+	Projid     uint32
+	Cowextsize uint32
+	Pad        [8]byte
+}
+
+// ifDqblk is struct if_dqblk; limits are in KiB
+type ifDqblk struct {
+	BHardLimit uint64
+	BSoftLimit uint64
+	CurSpace   uint64
+	IHardLimit uint64
+	ISoftLimit uint64
+	CurInodes  uint64
+	BTime      uint64
+	ITime      uint64
+	Valid      uint32
+	_          [4]byte
+}
+
+func fsxattrIoctl(path string, req uintptr, attr *fsxattr) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), req, uintptr(unsafe.Pointer(attr))); errno != 0 {
+		return &os.PathError{Op: "ioctl", Path: path, Err: errno}
+	}
+	return nil
+}
+
+// projectID returns the project the directory at path belongs to
+func projectID(path string) (uint32, error) {
+	var attr fsxattr
+	if err := fsxattrIoctl(path, fsIocGetXattr, &attr); err != nil {
+		return 0, err
+	}
+	return attr.Projid, nil
+}
+
+// setProjectID puts the directory at path, and whatever is later created
+// in it, in project id; 0 takes it out
+func setProjectID(path string, id uint32) error {
+	var attr fsxattr
+	if err := fsxattrIoctl(path, fsIocGetXattr, &attr); err != nil {
+		return err
+	}
+	attr.Projid = id
+	if id != 0 {
+		attr.Xflags |= fsXflagProjInherit
+	} else {
+		attr.Xflags &^= fsXflagProjInherit
+	}
+	return fsxattrIoctl(path, fsIocSetXattr, &attr)
+}
+
+// setProjectLimit limits project id, on the filesystem of path, to size
+// bytes
+func setProjectLimit(path string, id uint32, size int64) error {
+	device, err := blockDevice(path)
+	if err != nil {
+		return err
+	}
+	special, err := syscall.BytePtrFromString(device)
+	if err != nil {
+		return err
+	}
+	limit := uint64(size) >> 10
+	dq := ifDqblk{BHardLimit: limit, BSoftLimit: limit, Valid: qifBLimits}
+	cmd := uintptr(qSetQuota<<8 | prjQuota)
+	if _, _, errno := syscall.Syscall6(syscall.SYS_QUOTACTL, cmd, uintptr(unsafe.Pointer(special)), uintptr(id), uintptr(unsafe.Pointer(&dq)), 0, 0); errno != 0 {
+		return &os.PathError{Op: "quotactl", Path: device, Err: errno}
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package partition
+
+import "errors"
+
+var errNoProjects = errors.New("project quotas are only supported on Linux")
+
+func projectID(path string) (uint32, error) {
+	return 0, errNoProjects
+}
+
+func setProjectID(path string, id uint32) error {
+	return errNoProjects
+}
+
+func setProjectLimit(path string, id uint32, size int64) error {
+	return errNoProjects
+}
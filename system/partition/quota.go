@@ -0,0 +1,182 @@
+package partition
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// QuotaMode is how the size of a partition is enforced
+type QuotaMode string
+
+const (
+	// QuotaSoft checks the partition's usage by walking it before writes
+	QuotaSoft QuotaMode = "soft"
+	// QuotaLoop stores each partition in an ext4 image of its size,
+	// mounted over a loop device. Needs root and e2fsprogs.
+	QuotaLoop QuotaMode = "loop"
+	// QuotaProject limits each partition with an XFS or ext4 project
+	// quota. The filesystem of the partitions must be mounted with
+	// prjquota, and the server must run as root.
+	QuotaProject QuotaMode = "project"
+)
+
+var (
+	// ErrNotLoop is returned for operations on a partition's own
+	// filesystem when it has none
+	ErrNotLoop = errors.New("partition has no filesystem of its own")
+	// ErrNotMounted means the image of a loop partition is not mounted
+	ErrNotMounted = errors.New("partition is not mounted")
+)
+
+var (
+	modeMu    sync.RWMutex
+	quotaMode = QuotaSoft
+)
+
+// ParseQuotaMode parses soft, loop or project; empty means soft
+func ParseQuotaMode(s string) (QuotaMode, error) {
+	switch mode := QuotaMode(s); mode {
+	case "":
+		return QuotaSoft, nil
+	case QuotaSoft, QuotaLoop, QuotaProject:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown quota mode %q, must be soft, loop or project", s)
+}
+
+// SetQuotaMode sets how new partitions are limited. Existing partitions
+// keep the mode they were created with.
+func SetQuotaMode(mode QuotaMode) {
+	modeMu.Lock()
+	defer modeMu.Unlock()
+	quotaMode = mode
+}
+
+// CurrentQuotaMode returns the mode new partitions are created with
+func CurrentQuotaMode() QuotaMode {
+	modeMu.RLock()
+	defer modeMu.RUnlock()
+	return quotaMode
+}
+
+// ModeOf returns how the partition at fullPath is limited: loop if it has
+// an image, project if it belongs to a project, soft otherwise
+func ModeOf(fullPath string) QuotaMode {
+	if _, err := os.Stat(imagePath(fullPath)); err == nil {
+		return QuotaLoop
+	}
+	if id, err := projectID(fullPath); err == nil && id != 0 {
+		return QuotaProject
+	}
+	return QuotaSoft
+}
+
+// HardUsage returns the bytes used in a partition the kernel limits, and
+// how many it may still take
+func HardUsage(fullPath string) (used, avail int64, err error) {
+	if ModeOf(fullPath) == QuotaLoop && !mounted(fullPath) {
+		return 0, 0, ErrNotMounted
+	}
+	// Project quotas are reported as the size of their directories
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(fullPath, &st); err != nil {
+		return 0, 0, err
+	}
+	bsize := int64(st.Bsize)
+	return int64(st.Blocks-st.Bfree) * bsize, int64(st.Bavail) * bsize, nil
+}
+
+// IsFull reports whether err means a write ran out of space, as when a
+// partition reaches the limit the kernel enforces
+func IsFull(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT)
+}
+
+// allocate creates the directory of a new partition of size bytes,
+// limited as the quota mode asks. An existing directory is left as it
+// is. When the limit cannot be set up, e.g. without root or on a
+// filesystem without project quotas, the partition falls back to soft
+// quota.
+func (m *Manager) allocate(fullPath string, size int64) {
+	mode := CurrentQuotaMode()
+	if mode == QuotaSoft {
+		return
+	}
+	if _, err := os.Lstat(fullPath); err == nil {
+		return
+	}
+
+	var err error
+	switch mode {
+	case QuotaLoop:
+		err = createImage(fullPath, size)
+	case QuotaProject:
+		err = m.createProject(fullPath, size)
+	}
+	if err != nil {
+		log.Printf("Partition: %s quota unavailable for %s, using soft quota: %v", mode, fullPath, err)
+	}
+}
+
+// Resize changes the size of the partition at fullPath to sizeGb. Soft
+// partitions are only limited by their allocation, so nothing changes on
+// disk for them.
+func (m *Manager) Resize(fullPath string, sizeGb int) error {
+	size := int64(sizeGb) << 30
+	switch ModeOf(fullPath) {
+	case QuotaLoop:
+		return resizeImage(fullPath, size)
+	case QuotaProject:
+		id, err := projectID(fullPath)
+		if err != nil {
+			return err
+		}
+		return setProjectLimit(fullPath, id, size)
+	}
+	return nil
+}
+
+// Check checks and repairs the filesystem of a loop partition, returning
+// the checker's report. The partition is unmounted meanwhile, so nothing
+// may be using it.
+func (m *Manager) Check(fullPath string) (string, error) {
+	if ModeOf(fullPath) != QuotaLoop {
+		return "", ErrNotLoop
+	}
+	return checkImage(fullPath)
+}
+
+// Archive moves the partition at fullPath to dest and returns where it
+// went. A loop partition is unmounted and its image moved to dest.img.
+func (m *Manager) Archive(fullPath, dest string) (string, error) {
+	if ModeOf(fullPath) != QuotaLoop {
+		return dest, os.Rename(fullPath, dest)
+	}
+	if err := unmountImage(fullPath); err != nil {
+		return "", err
+	}
+	dest += ".img"
+	if err := os.Rename(imagePath(fullPath), dest); err != nil {
+		mountImage(fullPath)
+		return "", err
+	}
+	return dest, os.Remove(fullPath)
+}
+
+// Remove deletes the partition at fullPath, with its image if it has one
+func (m *Manager) Remove(fullPath string) error {
+	if ModeOf(fullPath) != QuotaLoop {
+		return os.RemoveAll(fullPath)
+	}
+	if err := unmountImage(fullPath); err != nil {
+		return err
+	}
+	if err := os.Remove(imagePath(fullPath)); err != nil {
+		return err
+	}
+	return os.Remove(fullPath)
+}
@@ -0,0 +1,169 @@
+package partition
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/satufile/satufile/vfs"
+)
+
+// requireLoop skips the test unless loop partitions can be created here
+func requireLoop(t *testing.T) {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("loop partitions need root")
+	}
+	for _, tool := range []string{"mkfs.ext4", "e2fsck", "resize2fs", "losetup", "mount"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not found", tool)
+		}
+	}
+}
+
+func withQuotaMode(t *testing.T, mode QuotaMode) {
+	SetQuotaMode(mode)
+	t.Cleanup(func() { SetQuotaMode(QuotaSoft) })
+}
+
+func TestLoopPartition(t *testing.T) {
+	requireLoop(t)
+	withQuotaMode(t, QuotaLoop)
+	m := NewManager(t.TempDir())
+	fullPath := m.GetStoragePath("alice")
+
+	m.allocate(fullPath, 32<<20)
+	if ModeOf(fullPath) != QuotaLoop || !mounted(fullPath) {
+		t.Skip("loop devices are not available")
+	}
+	t.Cleanup(func() { unmountImage(fullPath) })
+	if err := Provision(vfs.Local, fullPath); err != nil {
+		t.Fatal(err)
+	}
+
+	// The kernel stops writes at the size, and CheckQuota sees the limit
+	data := bytes.Repeat([]byte("x"), 40<<20)
+	file := filepath.Join(fullPath, "Documents", "big.bin")
+	if err := os.WriteFile(file, data, 0644); !IsFull(err) {
+		t.Fatalf("Expected the write to run out of space, got %v", err)
+	}
+	os.Remove(file)
+	if err := CheckQuota(vfs.Local, fullPath, 1, 40<<20); err == nil {
+		t.Error("Expected CheckQuota to refuse more than the partition holds")
+	}
+	if err := CheckQuota(vfs.Local, fullPath, 1, 1<<20); err != nil {
+		t.Errorf("Expected room for 1 MiB: %v", err)
+	}
+
+	// Growing works while mounted
+	if err := resizeImage(fullPath, 64<<20); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		t.Fatalf("Expected the file to fit after growing: %v", err)
+	}
+	if used, _, err := HardUsage(fullPath); err != nil || used < int64(len(data)) {
+		t.Errorf("Expected the usage from the filesystem, got %d %v", used, err)
+	}
+
+	// Shrinking below the usage fails and keeps the files
+	if err := resizeImage(fullPath, 16<<20); err == nil {
+		t.Error("Expected shrinking below the usage to fail")
+	}
+	if !mounted(fullPath) {
+		t.Fatal("Expected the partition mounted again")
+	}
+	os.Remove(file)
+	if err := resizeImage(fullPath, 24<<20); err != nil {
+		t.Fatalf("Shrinking failed: %v", err)
+	}
+	if info, _ := os.Stat(imagePath(fullPath)); info.Size() != 24<<20 {
+		t.Errorf("Expected the image shrunk, got %d bytes", info.Size())
+	}
+
+	if _, err := m.Check(fullPath); err != nil {
+		t.Errorf("Check failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(fullPath, "README.txt")); err != nil || !mounted(fullPath) {
+		t.Errorf("Expected the partition back after the check: %v", err)
+	}
+
+	// After a reboot the images are mounted again
+	unmountImage(fullPath)
+	if n, err := m.Mount(); err != nil || n != 1 || !mounted(fullPath) {
+		t.Errorf("Expected the partition mounted, got %d %v", n, err)
+	}
+
+	// Archiving keeps the image
+	dest := filepath.Join(t.TempDir(), "alice-archived")
+	archived, err := m.Archive(fullPath, dest)
+	if err != nil || archived != dest+".img" {
+		t.Fatalf("Archive failed: %q %v", archived, err)
+	}
+	if _, err := os.Stat(fullPath); !os.IsNotExist(err) {
+		t.Errorf("Expected the mount point removed, got %v", err)
+	}
+	if _, err := os.Stat(archived); err != nil {
+		t.Errorf("Expected the archived image: %v", err)
+	}
+}
+
+func TestQuotaFallback(t *testing.T) {
+	// Without the tools the partition is created with soft quota
+	t.Setenv("PATH", "")
+	withQuotaMode(t, QuotaLoop)
+	m := NewManager(t.TempDir())
+
+	fullPath, err := m.InitializeStorage("bob", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := ModeOf(fullPath); mode != QuotaSoft {
+		t.Errorf("Expected soft quota, got %s", mode)
+	}
+	if _, err := os.Stat(filepath.Join(fullPath, "README.txt")); err != nil {
+		t.Errorf("Expected the partition provisioned: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(fullPath), imagesDir, "bob.img")); !os.IsNotExist(err) {
+		t.Errorf("Expected no image left behind, got %v", err)
+	}
+	if err := m.Resize(fullPath, 2); err != nil {
+		t.Errorf("Resizing a soft partition should only change its allocation: %v", err)
+	}
+	if _, err := m.Check(fullPath); err != ErrNotLoop {
+		t.Errorf("Expected ErrNotLoop, got %v", err)
+	}
+}
+
+func TestProjectPartition(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("project quotas need root")
+	}
+	withQuotaMode(t, QuotaProject)
+	base := t.TempDir()
+	m := NewManager(base)
+	fullPath := m.GetStoragePath("carol")
+
+	m.allocate(fullPath, 8<<20)
+	if ModeOf(fullPath) != QuotaProject {
+		t.Skip("the filesystem of the test folder has no project quotas")
+	}
+	id, _ := projectID(fullPath)
+	if next, _ := nextProject(filepath.Join(base, projectsFile)); next != id+1 {
+		t.Errorf("Expected project %d recorded, next is %d", id, next)
+	}
+
+	file := filepath.Join(fullPath, "big.bin")
+	if err := os.WriteFile(file, bytes.Repeat([]byte("x"), 16<<20), 0644); !IsFull(err) {
+		t.Fatalf("Expected the project quota to stop the write, got %v", err)
+	}
+	os.Remove(file)
+	if err := m.Resize(fullPath, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, bytes.Repeat([]byte("x"), 16<<20), 0644); err != nil {
+		t.Errorf("Expected the file to fit after resizing: %v", err)
+	}
+}
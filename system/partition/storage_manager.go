@@ -2,9 +2,14 @@ package partition
 
 import (
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+
+	"github.com/satufile/satufile/files"
+	"github.com/satufile/satufile/vfs"
 )
 
 const (
@@ -56,16 +61,30 @@ If you need assistance, please contact your system administrator.
 type StorageManager interface {
 	InitializeStorage(username string, sizeGb int) (string, error)
 	GetStoragePath(username string) string
+	Resize(fullPath string, sizeGb int) error
+	Archive(fullPath, dest string) (string, error)
+	Remove(fullPath string) error
 }
 
 // Manager handles storage creation and management
 type Manager struct {
 	basePath string
+	mu       sync.Mutex // serializes project ID allocation
 }
 
 // Ensure Manager implements StorageManager
 var _ StorageManager = (*Manager)(nil)
 
+// BasePath returns the folder holding the partitions of a server whose
+// root directory is root
+func BasePath(root string) string {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		absRoot = root // Fallback
+	}
+	return filepath.Join(absRoot, "data", "cloud-storage")
+}
+
 // NewManager creates a new storage manager
 func NewManager(basePath string) *Manager {
 	if basePath == "" {
@@ -76,52 +95,61 @@ func NewManager(basePath string) *Manager {
 	}
 }
 
-// InitializeStorage initializes storage for a user (creates directory structure)
+// InitializeStorage initializes storage for a user (creates directory
+// structure), limited to sizeGb by the kernel if the quota mode asks for it
 func (m *Manager) InitializeStorage(username string, sizeGb int) (string, error) {
-	// Sanitize username to prevent path traversal
-	safeUsername := sanitizeUsername(username)
+	// Sanitized to prevent path traversal
+	fullPath := m.GetStoragePath(username)
 
-	var fullPath string
-	// If basePath is absolute, use it directly
-	if filepath.IsAbs(m.basePath) {
-		fullPath = filepath.Join(m.basePath, safeUsername)
-	} else {
-		// Otherwise treat as relative (shouldn't happen with correct config, but fallback)
-		cwd, _ := os.Getwd()
-		fullPath = filepath.Join(cwd, m.basePath, safeUsername)
+	m.allocate(fullPath, int64(sizeGb)<<30)
+	if err := Provision(vfs.Local, fullPath); err != nil {
+		return "", err
 	}
+	return fullPath, nil
+}
 
+// Provision creates a partition at fullPath on fsys with the default
+// folders and README
+func Provision(fsys vfs.FS, fullPath string) error {
 	// Create the directory with proper permissions
-	err := os.MkdirAll(fullPath, DirPermissions)
-	if err != nil {
-		return "", fmt.Errorf("failed to create directory: %w", err)
+	if err := fsys.MkdirAll(fullPath, DirPermissions); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
 	}
 
 	// Create default folders
 	for _, folder := range DefaultFolders {
 		folderPath := filepath.Join(fullPath, folder)
-		if err := os.MkdirAll(folderPath, DirPermissions); err != nil {
-			return "", fmt.Errorf("failed to create folder %s: %w", folder, err)
+		if err := fsys.MkdirAll(folderPath, DirPermissions); err != nil {
+			return fmt.Errorf("failed to create folder %s: %w", folder, err)
 		}
 	}
 
 	// Create README file
 	readmePath := filepath.Join(fullPath, "README.txt")
-	if err := os.WriteFile(readmePath, []byte(READMEContent), 0644); err != nil {
-		return "", fmt.Errorf("failed to create README: %w", err)
+	if err := vfs.WriteFile(fsys, readmePath, []byte(READMEContent)); err != nil {
+		return fmt.Errorf("failed to create README: %w", err)
 	}
+	return nil
+}
 
-	return fullPath, nil
+// BackendPath returns where a user's partition goes on a storage backend
+// other than the local disk
+func BackendPath(username string) string {
+	return "/" + sanitizeUsername(username)
 }
 
 // GetStoragePath returns the path to a user's storage
 func (m *Manager) GetStoragePath(username string) string {
-	safeUsername := sanitizeUsername(username)
+	return filepath.Join(m.dir(), sanitizeUsername(username))
+}
+
+// dir returns the absolute folder holding the partitions
+func (m *Manager) dir() string {
 	if filepath.IsAbs(m.basePath) {
-		return filepath.Join(m.basePath, safeUsername)
+		return m.basePath
 	}
 	cwd, _ := os.Getwd()
-	return filepath.Join(cwd, m.basePath, safeUsername)
+	return filepath.Join(cwd, m.basePath)
 }
 
 // sanitizeUsername cleans a username to prevent path traversal attacks
@@ -168,39 +196,93 @@ func ValidateQuota(requestedGb int) error {
 	return nil
 }
 
-// CalculateStorageUsage calculates the storage usage for a partition
-func CalculateStorageUsage(storagePath string) (usedGb float64, err error) {
+// CalculateStorageUsage calculates the storage usage for a partition. The
+// kernel keeps count for partitions it limits, so those are not walked.
+func CalculateStorageUsage(fsys vfs.FS, storagePath string) (usedGb float64, err error) {
+	var totalSize int64
+	if vfs.IsLocal(fsys) && ModeOf(storagePath) != QuotaSoft {
+		totalSize, _, err = HardUsage(storagePath)
+	} else {
+		totalSize, err = walkUsage(fsys, storagePath, true)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// Convert bytes to GB
+	return float64(totalSize) / (1024 * 1024 * 1024), nil
+}
+
+// DiskUsage returns the bytes used below path, ignoring unreadable entries
+func DiskUsage(fsys vfs.FS, path string) int64 {
+	size, _ := walkUsage(fsys, path, false)
+	return size
+}
+
+// walkUsage sums file sizes below root. Files hardlinked several times
+// (deduplicated uploads) take up space once, so each inode is counted once.
+func walkUsage(fsys vfs.FS, root string, strict bool) (int64, error) {
 	var totalSize int64
+	seen := make(map[files.FileID]bool)
 
-	err = filepath.Walk(storagePath, func(path string, info os.FileInfo, err error) error {
+	err := vfs.WalkDir(fsys, root, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
-			return err
+			if strict {
+				return err
+			}
+			return nil
 		}
-		if !info.IsDir() {
-			totalSize += info.Size()
+		if d.IsDir() {
+			return nil
 		}
+		info, err := d.Info()
+		if err != nil {
+			if strict {
+				return err
+			}
+			return nil
+		}
+		if id, nlink, ok := files.LinkInfo(info); ok && nlink > 1 {
+			if seen[id] {
+				return nil
+			}
+			seen[id] = true
+		}
+		totalSize += info.Size()
 		return nil
 	})
+	return totalSize, err
+}
 
+// CheckQuota verifies if adding bytesToAdd to the storagePath on fsys will
+// exceed maxGb. Partitions the kernel limits are checked against the space
+// it has left; a write racing past the check still fails with IsFull.
+func CheckQuota(fsys vfs.FS, storagePath string, maxGb int, bytesToAdd int64) error {
+	avail, err := Available(fsys, storagePath, maxGb)
 	if err != nil {
-		return 0, err
+		return err
 	}
-
-	// Convert bytes to GB
-	return float64(totalSize) / (1024 * 1024 * 1024), nil
+	if bytesToAdd > avail {
+		return fmt.Errorf("storage quota exceeded: allocated %d GB, %.2f GB left", maxGb, float64(avail)/(1024*1024*1024))
+	}
+	return nil
 }
 
-// CheckQuota verifies if adding bytesToAdd to the storagePath will exceed maxGb
-func CheckQuota(storagePath string, maxGb int, bytesToAdd int64) error {
-	usedGb, err := CalculateStorageUsage(storagePath)
-	if err != nil {
-		return fmt.Errorf("failed to calculate storage usage: %w", err)
+// Available returns how many bytes can still be added to the storagePath
+// on fsys before it exceeds maxGb, for writes whose size is not known up
+// front
+func Available(fsys vfs.FS, storagePath string, maxGb int) (int64, error) {
+	if vfs.IsLocal(fsys) && ModeOf(storagePath) != QuotaSoft {
+		_, avail, err := HardUsage(storagePath)
+		if err != nil {
+			return 0, fmt.Errorf("failed to calculate storage usage: %w", err)
+		}
+		return avail, nil
 	}
 
-	newUsedGb := usedGb + (float64(bytesToAdd) / (1024 * 1024 * 1024))
-	if newUsedGb > float64(maxGb) {
-		return fmt.Errorf("storage quota exceeded: allocated %d GB, requested operation would result in %.2f GB", maxGb, newUsedGb)
+	used, err := walkUsage(fsys, storagePath, true)
+	if err != nil {
+		return 0, fmt.Errorf("failed to calculate storage usage: %w", err)
 	}
-
-	return nil
+	return max(int64(maxGb)*1024*1024*1024-used, 0), nil
 }
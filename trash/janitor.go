@@ -0,0 +1,248 @@
+package trash
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/satufile/satufile/system/partition"
+	"github.com/satufile/satufile/users"
+	"github.com/satufile/satufile/versions"
+	"github.com/satufile/satufile/vfs"
+)
+
+// Purge reasons
+const (
+	ReasonExpired = "expired" // older than the retention period
+	ReasonQuota   = "quota"   // removed to free space near the quota
+)
+
+// DefaultQuotaThreshold is the share of a user's allocation above which
+// the janitor starts purging the oldest trash items
+const DefaultQuotaThreshold = 0.9
+
+// Purge records a trash item that was permanently deleted by the janitor
+type Purge struct {
+	ID           uint      `json:"id" gorm:"primaryKey"`
+	UserID       uint      `json:"user_id" gorm:"index"`
+	ItemID       uint      `json:"item_id"`
+	OriginalPath string    `json:"original_path"`
+	Name         string    `json:"name"`
+	FileSize     int64     `json:"file_size"`
+	IsDirectory  bool      `json:"is_directory"`
+	DeletedAt    time.Time `json:"deleted_at"`
+	PurgedAt     time.Time `json:"purged_at" gorm:"index"`
+	Reason       string    `json:"reason"`
+}
+
+// Policy configures the janitor
+type Policy struct {
+	// Retention is how long items stay in the trash; 0 keeps them forever.
+	// Users can override it with TrashRetentionDays, or keep theirs with
+	// users.KeepForever.
+	Retention time.Duration
+	// QuotaThreshold is the fraction (0-1] of StorageAllocationGb above
+	// which the oldest items are purged; 0 disables quota purging
+	QuotaThreshold float64
+}
+
+// Janitor permanently deletes expired trash items in the background
+type Janitor struct {
+	db       *gorm.DB
+	userRepo *users.Repository
+	policy   Policy
+	spaceDir func(spaceID uint) string // optional, the folder of a shared space
+
+	mu sync.Mutex // serialises passes
+}
+
+// NewJanitor creates a janitor for every user known to userRepo
+func NewJanitor(db *gorm.DB, userRepo *users.Repository, policy Policy) *Janitor {
+	return &Janitor{
+		db:       db,
+		userRepo: userRepo,
+		policy:   policy,
+	}
+}
+
+// Policy returns the janitor's server-wide policy
+func (j *Janitor) Policy() Policy {
+	return j.policy
+}
+
+// SetSpaceDirs lets the janitor find the trash of shared spaces; items
+// deleted from a space are kept until then
+func (j *Janitor) SetSpaceDirs(dir func(spaceID uint) string) {
+	j.spaceDir = dir
+}
+
+// Run purges every interval until stop is closed
+func (j *Janitor) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := j.PurgeAll(); err != nil {
+			log.Printf("Trash janitor: %v", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// PurgeAll runs one pass over every user and returns what was removed
+func (j *Janitor) PurgeAll() ([]Purge, error) {
+	allUsers, err := j.userRepo.List()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list users: %w", err)
+	}
+
+	var purged []Purge
+	for i := range allUsers {
+		p, err := j.PurgeUser(&allUsers[i])
+		purged = append(purged, p...)
+		if err != nil {
+			log.Printf("Trash janitor: user %s: %v", allUsers[i].Username, err)
+		}
+	}
+	return purged, nil
+}
+
+// PurgeUser removes the user's expired items, then the oldest remaining
+// ones while the partition is above the quota threshold
+func (j *Janitor) PurgeUser(user *users.User) ([]Purge, error) {
+	root, fsys := user.Root(), user.FS()
+	if root == "" {
+		return nil, nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var purged []Purge
+
+	retention := j.policy.Retention
+	switch {
+	case user.TrashRetentionDays == users.KeepForever:
+		retention = 0
+	case user.TrashRetentionDays > 0:
+		retention = time.Duration(user.TrashRetentionDays) * 24 * time.Hour
+	}
+	if retention > 0 {
+		var expired []TrashItem
+		cutoff := time.Now().Add(-retention)
+		if err := j.db.Where("user_id = ? AND deleted_at < ?", user.ID, cutoff).Order("deleted_at asc").Find(&expired).Error; err != nil {
+			return nil, err
+		}
+		for _, item := range expired {
+			itemFS, itemRoot := fsys, root
+			if item.SpaceID != 0 {
+				if j.spaceDir == nil {
+					continue
+				}
+				itemFS, itemRoot = vfs.Local, j.spaceDir(item.SpaceID)
+			}
+			p, err := j.remove(itemFS, itemRoot, item, ReasonExpired)
+			if err != nil {
+				return purged, err
+			}
+			purged = append(purged, *p)
+		}
+	}
+
+	if j.policy.QuotaThreshold <= 0 || user.StorageAllocationGb <= 0 {
+		return purged, nil
+	}
+
+	usedGb, err := partition.CalculateStorageUsage(fsys, user.StoragePath)
+	if err != nil {
+		return purged, err
+	}
+	limitGb := float64(user.StorageAllocationGb) * j.policy.QuotaThreshold
+	if usedGb < limitGb {
+		return purged, nil
+	}
+
+	// Items in spaces count against the space's pool, not the partition
+	var items []TrashItem
+	if err := j.db.Where("user_id = ? AND space_id = 0", user.ID).Order("deleted_at asc").Find(&items).Error; err != nil {
+		return purged, err
+	}
+	for _, item := range items {
+		if usedGb < limitGb {
+			break
+		}
+		size := itemSize(fsys, filepath.Join(root, ".trash", fmt.Sprint(item.ID)))
+		p, err := j.remove(fsys, root, item, ReasonQuota)
+		if err != nil {
+			return purged, err
+		}
+		purged = append(purged, *p)
+		usedGb -= float64(size) / (1024 * 1024 * 1024)
+	}
+	return purged, nil
+}
+
+// remove deletes an item's data below root on fsys and its row, and
+// records the purge
+func (j *Janitor) remove(fsys vfs.FS, root string, item TrashItem, reason string) (*Purge, error) {
+	trashPath := filepath.Join(root, ".trash", fmt.Sprint(item.ID))
+	if err := fsys.RemoveAll(trashPath); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to delete %s: %w", item.Name, err)
+	}
+
+	p := &Purge{
+		UserID:       item.UserID,
+		ItemID:       item.ID,
+		OriginalPath: item.OriginalPath,
+		Name:         item.Name,
+		FileSize:     item.FileSize,
+		IsDirectory:  item.IsDirectory,
+		DeletedAt:    item.DeletedAt,
+		PurgedAt:     time.Now(),
+		Reason:       reason,
+	}
+
+	err := j.db.Transaction(func(tx *gorm.DB) error {
+		if item.SpaceID == 0 {
+			if err := versions.Discard(tx, root, item.UserID, ItemPath(item.ID)); err != nil {
+				return err
+			}
+		}
+		if err := tx.Delete(&TrashItem{}, item.ID).Error; err != nil {
+			return err
+		}
+		return tx.Create(p).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Trash janitor: purged %q of user %d (%s)", item.OriginalPath, item.UserID, reason)
+	return p, nil
+}
+
+// itemSize returns the bytes a trashed file or folder occupies
+func itemSize(fsys vfs.FS, path string) int64 {
+	var size int64
+	vfs.WalkDir(fsys, path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
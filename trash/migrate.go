@@ -0,0 +1,43 @@
+package trash
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gorm.io/gorm"
+)
+
+// AssignOwners backfills UserID on trash rows created before items were
+// scoped to users. A row belongs to the partition whose .trash folder
+// holds its data; rows found in no partition are left unassigned, which
+// hides them from every user.
+func AssignOwners(db *gorm.DB, partitions map[uint]string) (assigned, orphaned int, err error) {
+	var items []TrashItem
+	if err := db.Where("user_id = ?", 0).Find(&items).Error; err != nil {
+		return 0, 0, err
+	}
+
+	for _, item := range items {
+		owner := uint(0)
+		for userID, root := range partitions {
+			if root == "" {
+				continue
+			}
+			if _, err := os.Lstat(filepath.Join(root, ".trash", fmt.Sprint(item.ID))); err == nil {
+				owner = userID
+				break
+			}
+		}
+
+		if owner == 0 {
+			orphaned++
+			continue
+		}
+		if err := db.Model(&TrashItem{}).Where("id = ?", item.ID).Update("user_id", owner).Error; err != nil {
+			return assigned, orphaned, err
+		}
+		assigned++
+	}
+	return assigned, orphaned, nil
+}
@@ -1,14 +1,24 @@
 package trash
 
 import (
+	"fmt"
 	"time"
 )
 
+// TrashItem is a soft-deleted file or folder, stored at .trash/{ID} in
+// its owner's partition, or in the shared space it was deleted from
 type TrashItem struct {
 	ID           uint      `json:"id" gorm:"primaryKey"`
-	OriginalPath string    `json:"original_path" gorm:"not null"`
+	UserID       uint      `json:"-" gorm:"index"`                            // Owner; 0 for legacy rows not yet assigned
+	SpaceID      uint      `json:"space_id,omitempty" gorm:"index;default:0"` // 0 for items of the owner's partition
+	OriginalPath string    `json:"original_path" gorm:"not null"`             // relative to the partition or space
 	DeletedAt    time.Time `json:"deleted_at" gorm:"autoCreateTime"`
 	FileSize     int64     `json:"file_size"`
 	IsDirectory  bool      `json:"is_directory"`
 	Name         string    `json:"name"`
 }
+
+// ItemPath returns where a trash item lives, relative to its partition
+func ItemPath(id uint) string {
+	return fmt.Sprintf("/.trash/%d", id)
+}
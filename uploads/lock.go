@@ -0,0 +1,32 @@
+package uploads
+
+import "sync"
+
+// sessionLocks serialises requests touching the same upload session
+var (
+	sessionLocks   = make(map[string]*sync.Mutex)
+	sessionLocksMu sync.Mutex
+)
+
+// Lock waits for other requests on session id to finish and returns the
+// function releasing it
+func Lock(id string) func() {
+	sessionLocksMu.Lock()
+	l, ok := sessionLocks[id]
+	if !ok {
+		l = &sync.Mutex{}
+		sessionLocks[id] = l
+	}
+	sessionLocksMu.Unlock()
+
+	l.Lock()
+	return l.Unlock
+}
+
+// Forget drops the lock of a session that is done with, once it completed
+// or was deleted
+func Forget(id string) {
+	sessionLocksMu.Lock()
+	delete(sessionLocks, id)
+	sessionLocksMu.Unlock()
+}
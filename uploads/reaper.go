@@ -0,0 +1,125 @@
+package uploads
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// TempBase returns the directory holding the chunk folders of every
+// upload session
+func TempBase() string {
+	return filepath.Join(os.TempDir(), "satufile-uploads")
+}
+
+// OrphanGrace is how long a temp dir without a session is left alone:
+// uploads create their dir right before their session, so a reaper
+// running in between must not take it for a leftover
+const OrphanGrace = time.Hour
+
+// ReapResult reports what a reaper pass cleaned up
+type ReapResult struct {
+	Expired        int   `json:"expired"`         // expired sessions deleted
+	Failed         int   `json:"failed"`          // active sessions whose chunks vanished
+	Orphans        int   `json:"orphans"`         // temp dirs without a session
+	ReclaimedBytes int64 `json:"reclaimed_bytes"` // chunk data removed from disk
+}
+
+// Reap deletes expired sessions with their chunks and locks, marks active
+// sessions failed when their temp dir has disappeared and removes chunk
+// folders left behind by sessions that no longer exist (e.g. after a
+// crash) once they are older than OrphanGrace
+func Reap(s StorageBackend, tempBase string) (*ReapResult, error) {
+	result := &ReapResult{}
+
+	expired, err := s.ListExpiredSessions()
+	if err != nil {
+		return nil, err
+	}
+	for _, session := range expired {
+		if session.TempDir != "" {
+			result.ReclaimedBytes += dirSize(session.TempDir)
+			os.RemoveAll(session.TempDir)
+		}
+		if err := s.DeleteSession(session.ID); err != nil {
+			return result, err
+		}
+		Forget(session.ID)
+		result.Expired++
+	}
+
+	active, err := s.ListActiveSessions()
+	if err != nil {
+		return result, err
+	}
+	for _, session := range active {
+		if _, err := os.Stat(session.TempDir); !os.IsNotExist(err) {
+			continue
+		}
+		session.Status = "failed"
+		if err := s.UpdateSession(session); err != nil {
+			return result, err
+		}
+		result.Failed++
+	}
+
+	entries, err := os.ReadDir(tempBase)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return result, nil
+		}
+		return result, err
+	}
+	for _, entry := range entries {
+		if info, err := entry.Info(); err != nil || time.Since(info.ModTime()) < OrphanGrace {
+			continue
+		}
+		if _, err := s.GetSession(entry.Name()); !errors.Is(err, gorm.ErrRecordNotFound) {
+			continue
+		}
+		path := filepath.Join(tempBase, entry.Name())
+		result.ReclaimedBytes += dirSize(path)
+		os.RemoveAll(path)
+		result.Orphans++
+	}
+
+	return result, nil
+}
+
+// RunReaper reaps every interval until stop is closed
+func RunReaper(s StorageBackend, tempBase string, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			result, err := Reap(s, tempBase)
+			if err != nil {
+				log.Printf("Upload reaper: %v", err)
+			}
+			if result != nil && (result.Expired > 0 || result.Failed > 0 || result.Orphans > 0) {
+				log.Printf("Upload reaper: %d expired, %d failed, %d orphaned, %d bytes reclaimed",
+					result.Expired, result.Failed, result.Orphans, result.ReclaimedBytes)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// dirSize returns the total size of the files below path
+func dirSize(path string) int64 {
+	var size int64
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
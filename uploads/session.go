@@ -18,9 +18,21 @@ type Session struct {
 	TempDir        string    `json:"temp_dir" gorm:"not null"`          // Temporary directory for chunks
 	CreatedAt      time.Time `json:"created_at" gorm:"autoCreateTime"`
 	UpdatedAt      time.Time `json:"updated_at" gorm:"autoUpdateTime"`
-	ExpiresAt      time.Time `json:"expires_at" gorm:"index"` // Auto-cleanup after 24h
+	ExpiresAt      time.Time `json:"expires_at" gorm:"index"`           // Auto-cleanup after 24h
+	UserID         uint      `json:"-" gorm:"index"`                    // Owner
+	Protocol       string    `json:"protocol" gorm:"default:'chunked'"` // chunked or tus
+	Metadata       string    `json:"-"`                                 // Raw tus Upload-Metadata
+	SHA256         string    `json:"sha256,omitempty"`                  // Expected whole-file digest (hex)
+	CRC32C         string    `json:"crc32c,omitempty"`                  // Expected whole-file digest (hex)
+	ShareToken     string    `json:"-" gorm:"index"`                    // Upload link an anonymous upload came through
 }
 
+// Upload protocols
+const (
+	ProtocolChunked = "chunked" // /api/uploads with fixed-size ?chunk=N parts
+	ProtocolTus     = "tus"     // tus 1.0, one part per request named by its offset
+)
+
 // StorageBackend defines interface for upload session storage
 type StorageBackend interface {
 	CreateSession(session *Session) error
@@ -28,6 +40,7 @@ type StorageBackend interface {
 	UpdateSession(session *Session) error
 	DeleteSession(id string) error
 	ListExpiredSessions() ([]*Session, error)
+	ListActiveSessions() ([]*Session, error)
 }
 
 // Ensure table name
@@ -1,6 +1,8 @@
 package uploads
 
 import (
+	"time"
+
 	"gorm.io/gorm"
 )
 
@@ -46,6 +48,14 @@ func (s *Storage) DeleteSession(id string) error {
 // ListExpiredSessions returns all expired sessions
 func (s *Storage) ListExpiredSessions() ([]*Session, error) {
 	var sessions []*Session
-	err := s.db.Where("expires_at < ?", gorm.Expr("datetime('now')")).Find(&sessions).Error
+	// Compare against a Go time so the stored format and timezone match
+	err := s.db.Where("expires_at < ?", time.Now()).Find(&sessions).Error
+	return sessions, err
+}
+
+// ListActiveSessions returns sessions that are still uploading or paused
+func (s *Storage) ListActiveSessions() ([]*Session, error) {
+	var sessions []*Session
+	err := s.db.Where("status IN ?", []string{"uploading", "paused"}).Find(&sessions).Error
 	return sessions, err
 }
@@ -1,9 +1,15 @@
 package users
 
 import (
+	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
 	"gorm.io/gorm"
+
+	"github.com/satufile/satufile/encryption"
+	"github.com/satufile/satufile/vfs"
 )
 
 // User represents a user in the system
@@ -29,13 +35,27 @@ type User struct {
 	SetupStep          string         `gorm:"default:'password'" json:"setupStep"`
 	IsDefaultPassword  bool           `gorm:"default:true" json:"isDefaultPassword"`
 	StoragePath        string         `gorm:"size:500" json:"storagePath,omitempty"`
+	Backend            string         `gorm:"size:64" json:"backend,omitempty"` // storage backend StoragePath is on; empty for the local disk
+	DataKey            []byte         `json:"-"`                                // wrapped key the partition is encrypted with; nil if it is not
 	StorageAllocationGb int           `json:"storageAllocationGb,omitempty"`
+	TrashRetentionDays int            `gorm:"default:0" json:"trashRetentionDays"` // 0 = server default, KeepForever = never purge by age
+	VersionCount       int            `gorm:"default:0" json:"versionCount"`       // 0 = server default
+	VersionRetentionDays int          `gorm:"default:0" json:"versionRetentionDays"` // 0 = server default
 
 	CreatedAt          time.Time      `json:"createdAt"`
 	UpdatedAt          time.Time      `json:"updatedAt"`
 	DeletedAt          gorm.DeletedAt `gorm:"index" json:"-"`
+
+	// Filled in by the repository when the user is loaded
+	Roles     []string     `gorm:"-" json:"roles,omitempty"`  // names, direct and through groups
+	Groups    []string     `gorm:"-" json:"groups,omitempty"` // names
+	effective *Permissions // see EffectivePerm
 }
 
+// KeepForever as TrashRetentionDays keeps the user's trash items however
+// long the server retains them
+const KeepForever = -1
+
 // LoginAttempt tracks login history for security auditing and brute force protection
 type LoginAttempt struct {
 	ID        uint      `gorm:"primaryKey"`
@@ -57,11 +77,84 @@ type Permissions struct {
 	Download bool `gorm:"default:true" json:"download"`
 }
 
+// permissionFields maps permission names to their fields
+var permissionFields = map[string]func(*Permissions) *bool{
+	"admin":    func(p *Permissions) *bool { return &p.Admin },
+	"execute":  func(p *Permissions) *bool { return &p.Execute },
+	"create":   func(p *Permissions) *bool { return &p.Create },
+	"rename":   func(p *Permissions) *bool { return &p.Rename },
+	"modify":   func(p *Permissions) *bool { return &p.Modify },
+	"delete":   func(p *Permissions) *bool { return &p.Delete },
+	"share":    func(p *Permissions) *bool { return &p.Share },
+	"download": func(p *Permissions) *bool { return &p.Download },
+}
+
+// Field returns the flag of the named permission, or nil if the name is
+// unknown
+func (p *Permissions) Field(name string) *bool {
+	field, ok := permissionFields[strings.ToLower(name)]
+	if !ok {
+		return nil
+	}
+	return field(p)
+}
+
+// PermissionNames returns the names Field accepts
+func PermissionNames() []string {
+	names := make([]string, 0, len(permissionFields))
+	for name := range permissionFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// union grants what either p or o grants
+func (p Permissions) union(o Permissions) Permissions {
+	for _, field := range permissionFields {
+		if *field(&o) {
+			*field(&p) = true
+		}
+	}
+	return p
+}
+
 // TableName specifies the table name for GORM
 func (User) TableName() string {
 	return "users"
 }
 
+// Root returns the folder the user sees as "/": their partition, or the
+// Scope folder inside it. Files, trash and versions all live below it;
+// quotas are still measured on the whole partition.
+func (u *User) Root() string {
+	if u.StoragePath == "" {
+		return ""
+	}
+	return filepath.Join(u.StoragePath, filepath.Clean("/"+u.Scope))
+}
+
+// FS returns the filesystem the user's partition is on, decrypting it if
+// it is encrypted. A backend that is no longer configured, or a missing
+// master key, fails every operation.
+func (u *User) FS() vfs.FS {
+	fsys := vfs.Lookup(u.Backend)
+	if u.DataKey != nil {
+		return encryption.FS(fsys, u.DataKey)
+	}
+	return fsys
+}
+
+// EffectivePerm returns the permissions the user acts with: what their
+// roles and groups grant, or Perm if they have none, with their overrides
+// applied. Users that did not come from the repository get Perm.
+func (u *User) EffectivePerm() Permissions {
+	if u.effective == nil {
+		return u.Perm
+	}
+	return *u.effective
+}
+
 // UserInfo is a safe representation of user for API responses
 type UserInfo struct {
 	ID                 uint        `json:"id"`
@@ -73,12 +166,20 @@ type UserInfo struct {
 	HideDotfiles       bool        `json:"hideDotfiles"`
 	SingleClick        bool        `json:"singleClick"`
 	MustChangePassword bool        `json:"mustChangePassword"`
-	Perm               Permissions `json:"perm"`
+	Perm               Permissions `json:"perm"`          // the user's own flags
+	EffectivePerm      Permissions `json:"effectivePerm"` // what they may actually do
+	Roles              []string    `json:"roles"`
+	Groups             []string    `json:"groups"`
 	ForceSetup         bool        `json:"forceSetup"`
 	IsDefaultPassword  bool        `json:"isDefaultPassword"`
 	SetupStep          string      `json:"setupStep,omitempty"`
 	StoragePath        string      `json:"storagePath,omitempty"`
+	Backend            string      `json:"backend,omitempty"`
+	Encrypted          bool        `json:"encrypted,omitempty"`
 	StorageAllocationGb int        `json:"storageAllocationGb,omitempty"`
+	TrashRetentionDays int         `json:"trashRetentionDays"`
+	VersionCount       int         `json:"versionCount"`
+	VersionRetentionDays int       `json:"versionRetentionDays"`
 	CreatedAt          time.Time   `json:"createdAt"`
 }
 
@@ -95,11 +196,26 @@ func (u *User) ToInfo() *UserInfo {
 		SingleClick:        u.SingleClick,
 		MustChangePassword: u.MustChangePassword,
 		Perm:               u.Perm,
+		EffectivePerm:      u.EffectivePerm(),
+		Roles:              nonNil(u.Roles),
+		Groups:             nonNil(u.Groups),
 		ForceSetup:         u.ForceSetup,
 		IsDefaultPassword:  u.IsDefaultPassword,
 		SetupStep:          u.SetupStep,
 		StoragePath:        u.StoragePath,
+		Backend:            u.Backend,
+		Encrypted:          u.DataKey != nil,
 		StorageAllocationGb: u.StorageAllocationGb,
+		TrashRetentionDays: u.TrashRetentionDays,
+		VersionCount:       u.VersionCount,
+		VersionRetentionDays: u.VersionRetentionDays,
 		CreatedAt:          u.CreatedAt,
 	}
 }
+
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
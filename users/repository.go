@@ -22,9 +22,13 @@ func NewRepository(db *gorm.DB) *Repository {
 	return &Repository{db: db}
 }
 
-// Migrate runs database migrations for users table
+// Migrate runs database migrations for users table and the roles and
+// groups that make up their permissions
 func (r *Repository) Migrate() error {
-	return r.db.AutoMigrate(&User{}, &LoginAttempt{})
+	if err := r.db.AutoMigrate(&User{}, &LoginAttempt{}); err != nil {
+		return err
+	}
+	return r.migrateRoles()
 }
 
 // Create creates a new user
@@ -49,7 +53,10 @@ func (r *Repository) GetByID(id uint) (*User, error) {
 	if errors.Is(err, gorm.ErrRecordNotFound) {
 		return nil, ErrUserNotFound
 	}
-	return &user, err
+	if err != nil {
+		return nil, err
+	}
+	return &user, r.resolve(&user)
 }
 
 // GetByUsername finds a user by username
@@ -59,7 +66,10 @@ func (r *Repository) GetByUsername(username string) (*User, error) {
 	if errors.Is(err, gorm.ErrRecordNotFound) {
 		return nil, ErrUserNotFound
 	}
-	return &user, err
+	if err != nil {
+		return nil, err
+	}
+	return &user, r.resolve(&user)
 }
 
 // GetByEmail finds a user by email
@@ -69,7 +79,10 @@ func (r *Repository) GetByEmail(email string) (*User, error) {
 	if errors.Is(err, gorm.ErrRecordNotFound) {
 		return nil, ErrUserNotFound
 	}
-	return &user, err
+	if err != nil {
+		return nil, err
+	}
+	return &user, r.resolve(&user)
 }
 
 // Update updates an existing user
@@ -85,8 +98,15 @@ func (r *Repository) Delete(id uint) error {
 // List returns all users
 func (r *Repository) List() ([]User, error) {
 	var users []User
-	err := r.db.Find(&users).Error
-	return users, err
+	if err := r.db.Find(&users).Error; err != nil {
+		return nil, err
+	}
+	for i := range users {
+		if err := r.resolve(&users[i]); err != nil {
+			return nil, err
+		}
+	}
+	return users, nil
 }
 
 // Count returns the number of users
@@ -0,0 +1,410 @@
+package users
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrRoleNotFound      = errors.New("role not found")
+	ErrGroupNotFound     = errors.New("group not found")
+	ErrNameTaken         = errors.New("name is already taken")
+	ErrInvalidName       = errors.New("name must be 1-50 characters")
+	ErrUnknownPermission = errors.New("unknown permission")
+)
+
+// Role is a named permission template, such as viewer, editor or admin
+type Role struct {
+	ID          uint        `gorm:"primaryKey" json:"id"`
+	Name        string      `gorm:"uniqueIndex;not null;size:50" json:"name"`
+	Description string      `gorm:"size:255" json:"description"`
+	Perm        Permissions `gorm:"embedded;embeddedPrefix:perm_" json:"perm"`
+	CreatedAt   time.Time   `json:"createdAt"`
+	UpdatedAt   time.Time   `json:"updatedAt"`
+}
+
+// TableName specifies the table name for GORM
+func (Role) TableName() string {
+	return "roles"
+}
+
+// Group collects users that share roles
+type Group struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	Name        string    `gorm:"uniqueIndex;not null;size:50" json:"name"`
+	Description string    `gorm:"size:255" json:"description"`
+	Roles       []uint    `gorm:"-" json:"roles"`   // role IDs
+	Members     []uint    `gorm:"-" json:"members"` // user IDs
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// TableName specifies the table name for GORM
+func (Group) TableName() string {
+	return "user_groups"
+}
+
+// UserRole gives a role to a user directly
+type UserRole struct {
+	UserID uint `gorm:"primaryKey"`
+	RoleID uint `gorm:"primaryKey;index"`
+}
+
+// GroupRole gives a role to every member of a group
+type GroupRole struct {
+	GroupID uint `gorm:"primaryKey"`
+	RoleID  uint `gorm:"primaryKey;index"`
+}
+
+// GroupMember puts a user in a group
+type GroupMember struct {
+	GroupID uint `gorm:"primaryKey"`
+	UserID  uint `gorm:"primaryKey;index"`
+}
+
+// PermissionOverride grants or withholds one permission from a user
+// whatever their roles say
+type PermissionOverride struct {
+	UserID uint   `gorm:"primaryKey"`
+	Name   string `gorm:"primaryKey;size:20"`
+	Allow  bool
+}
+
+// Access is what a user's effective permissions are made of
+type Access struct {
+	Roles     []uint          `json:"roles"`     // role IDs given directly
+	Groups    []uint          `json:"groups"`    // group IDs
+	Overrides map[string]bool `json:"overrides"` // permission name -> granted
+}
+
+// DefaultRoles are created along with the roles table
+func DefaultRoles() []Role {
+	return []Role{
+		{Name: "viewer", Description: "Browse and download files", Perm: Permissions{Download: true}},
+		{Name: "editor", Description: "Manage and share files", Perm: Permissions{
+			Create: true, Rename: true, Modify: true, Delete: true, Share: true, Download: true,
+		}},
+		{Name: "admin", Description: "Everything, including user management", Perm: Permissions{
+			Admin: true, Execute: true, Create: true, Rename: true, Modify: true, Delete: true, Share: true, Download: true,
+		}},
+	}
+}
+
+// migrateRoles creates the role tables, seeding DefaultRoles into an
+// empty one
+func (r *Repository) migrateRoles() error {
+	if err := r.db.AutoMigrate(&Role{}, &Group{}, &UserRole{}, &GroupRole{}, &GroupMember{}, &PermissionOverride{}); err != nil {
+		return err
+	}
+	var count int64
+	if err := r.db.Model(&Role{}).Count(&count).Error; err != nil || count > 0 {
+		return err
+	}
+	for _, role := range DefaultRoles() {
+		if err := r.SaveRole(&role); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolve works out the user's effective permissions: the union of the
+// roles given to them and their groups, or their own flags if they have
+// none, with their overrides applied last
+func (r *Repository) resolve(u *User) error {
+	var groupIDs []uint
+	if err := r.db.Model(&GroupMember{}).Where("user_id = ?", u.ID).Pluck("group_id", &groupIDs).Error; err != nil {
+		return err
+	}
+	query := r.db.Where("id IN (?)", r.db.Model(&UserRole{}).Select("role_id").Where("user_id = ?", u.ID))
+	if len(groupIDs) > 0 {
+		query = query.Or("id IN (?)", r.db.Model(&GroupRole{}).Select("role_id").Where("group_id IN ?", groupIDs))
+	}
+	var roles []Role
+	if err := query.Order("name").Find(&roles).Error; err != nil {
+		return err
+	}
+
+	perm := u.Perm
+	u.Roles, u.Groups = nil, nil
+	if len(roles) > 0 {
+		perm = Permissions{}
+		for _, role := range roles {
+			perm = perm.union(role.Perm)
+			u.Roles = append(u.Roles, role.Name)
+		}
+	}
+	if len(groupIDs) > 0 {
+		if err := r.db.Model(&Group{}).Where("id IN ?", groupIDs).Order("name").Pluck("name", &u.Groups).Error; err != nil {
+			return err
+		}
+	}
+
+	var overrides []PermissionOverride
+	if err := r.db.Where("user_id = ?", u.ID).Find(&overrides).Error; err != nil {
+		return err
+	}
+	for _, o := range overrides {
+		if field := perm.Field(o.Name); field != nil {
+			*field = o.Allow
+		}
+	}
+	u.effective = &perm
+	return nil
+}
+
+// checkName trims name and validates it for a role or group
+func checkName(db *gorm.DB, model interface{}, id uint, name *string) error {
+	*name = strings.TrimSpace(*name)
+	if *name == "" || len(*name) > 50 {
+		return ErrInvalidName
+	}
+	var count int64
+	db.Model(model).Where("name = ? AND id <> ?", *name, id).Count(&count)
+	if count > 0 {
+		return ErrNameTaken
+	}
+	return nil
+}
+
+// checkRoles fails unless every ID names a role
+func (r *Repository) checkRoles(ids []uint) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	var count int64
+	if err := r.db.Model(&Role{}).Where("id IN ?", ids).Count(&count).Error; err != nil {
+		return err
+	}
+	if int(count) != len(unique(ids)) {
+		return ErrRoleNotFound
+	}
+	return nil
+}
+
+func unique(ids []uint) []uint {
+	seen := make(map[uint]bool, len(ids))
+	out := ids[:0:0]
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+// ListRoles returns every role by name
+func (r *Repository) ListRoles() ([]Role, error) {
+	var roles []Role
+	err := r.db.Order("name").Find(&roles).Error
+	return roles, err
+}
+
+// GetRole finds a role by ID
+func (r *Repository) GetRole(id uint) (*Role, error) {
+	var role Role
+	err := r.db.First(&role, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrRoleNotFound
+	}
+	return &role, err
+}
+
+// SaveRole creates a role, or updates it if it has an ID
+func (r *Repository) SaveRole(role *Role) error {
+	if err := checkName(r.db, &Role{}, role.ID, &role.Name); err != nil {
+		return err
+	}
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if role.ID == 0 {
+			// gorm applies column defaults to false permissions on create,
+			// so write the intended values back
+			saved := *role
+			if err := tx.Create(role).Error; err != nil {
+				return err
+			}
+			role.Perm = saved.Perm
+		}
+		return tx.Save(role).Error
+	})
+}
+
+// DeleteRole removes a role from everyone holding it
+func (r *Repository) DeleteRole(id uint) error {
+	if _, err := r.GetRole(id); err != nil {
+		return err
+	}
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("role_id = ?", id).Delete(&UserRole{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("role_id = ?", id).Delete(&GroupRole{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&Role{}, id).Error
+	})
+}
+
+// ListGroups returns every group by name with its roles and members
+func (r *Repository) ListGroups() ([]Group, error) {
+	var groups []Group
+	if err := r.db.Order("name").Find(&groups).Error; err != nil {
+		return nil, err
+	}
+	for i := range groups {
+		if err := r.fillGroup(&groups[i]); err != nil {
+			return nil, err
+		}
+	}
+	return groups, nil
+}
+
+// GetGroup finds a group by ID
+func (r *Repository) GetGroup(id uint) (*Group, error) {
+	var group Group
+	err := r.db.First(&group, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrGroupNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &group, r.fillGroup(&group)
+}
+
+func (r *Repository) fillGroup(g *Group) error {
+	g.Roles, g.Members = []uint{}, []uint{}
+	if err := r.db.Model(&GroupRole{}).Where("group_id = ?", g.ID).Order("role_id").Pluck("role_id", &g.Roles).Error; err != nil {
+		return err
+	}
+	return r.db.Model(&GroupMember{}).Where("group_id = ?", g.ID).Order("user_id").Pluck("user_id", &g.Members).Error
+}
+
+// SaveGroup creates a group, or updates it if it has an ID, giving it
+// exactly g.Roles. Members are managed with AddMember and RemoveMember.
+func (r *Repository) SaveGroup(g *Group) error {
+	if err := checkName(r.db, &Group{}, g.ID, &g.Name); err != nil {
+		return err
+	}
+	g.Roles = unique(g.Roles)
+	if err := r.checkRoles(g.Roles); err != nil {
+		return err
+	}
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(g).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("group_id = ?", g.ID).Delete(&GroupRole{}).Error; err != nil {
+			return err
+		}
+		for _, id := range g.Roles {
+			if err := tx.Create(&GroupRole{GroupID: g.ID, RoleID: id}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return r.fillGroup(g)
+}
+
+// DeleteGroup removes a group; its members lose the roles it gave them
+func (r *Repository) DeleteGroup(id uint) error {
+	if _, err := r.GetGroup(id); err != nil {
+		return err
+	}
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("group_id = ?", id).Delete(&GroupRole{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("group_id = ?", id).Delete(&GroupMember{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&Group{}, id).Error
+	})
+}
+
+// AddMember puts a user in a group; adding a member twice is harmless
+func (r *Repository) AddMember(groupID, userID uint) error {
+	if _, err := r.GetGroup(groupID); err != nil {
+		return err
+	}
+	if _, err := r.GetByID(userID); err != nil {
+		return err
+	}
+	return r.db.Where(&GroupMember{GroupID: groupID, UserID: userID}).FirstOrCreate(&GroupMember{}).Error
+}
+
+// RemoveMember takes a user out of a group
+func (r *Repository) RemoveMember(groupID, userID uint) error {
+	if _, err := r.GetGroup(groupID); err != nil {
+		return err
+	}
+	return r.db.Where("group_id = ? AND user_id = ?", groupID, userID).Delete(&GroupMember{}).Error
+}
+
+// GroupIDs returns the groups a user belongs to
+func (r *Repository) GroupIDs(userID uint) []uint {
+	var ids []uint
+	r.db.Model(&GroupMember{}).Where("user_id = ?", userID).Order("group_id").Pluck("group_id", &ids)
+	return ids
+}
+
+// GetAccess returns the roles, groups and overrides of a user
+func (r *Repository) GetAccess(userID uint) (*Access, error) {
+	a := &Access{Roles: []uint{}, Groups: r.GroupIDs(userID), Overrides: map[string]bool{}}
+	if a.Groups == nil {
+		a.Groups = []uint{}
+	}
+	if err := r.db.Model(&UserRole{}).Where("user_id = ?", userID).Order("role_id").Pluck("role_id", &a.Roles).Error; err != nil {
+		return nil, err
+	}
+	var overrides []PermissionOverride
+	if err := r.db.Where("user_id = ?", userID).Find(&overrides).Error; err != nil {
+		return nil, err
+	}
+	for _, o := range overrides {
+		a.Overrides[o.Name] = o.Allow
+	}
+	return a, nil
+}
+
+// SetAccess replaces the roles given directly to a user and their
+// overrides; group memberships are left alone
+func (r *Repository) SetAccess(userID uint, roles []uint, overrides map[string]bool) error {
+	roles = unique(roles)
+	if err := r.checkRoles(roles); err != nil {
+		return err
+	}
+	for name := range overrides {
+		if (&Permissions{}).Field(name) == nil {
+			return ErrUnknownPermission
+		}
+	}
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&UserRole{}).Error; err != nil {
+			return err
+		}
+		for _, id := range roles {
+			if err := tx.Create(&UserRole{UserID: userID, RoleID: id}).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Where("user_id = ?", userID).Delete(&PermissionOverride{}).Error; err != nil {
+			return err
+		}
+		for name, allow := range overrides {
+			o := &PermissionOverride{UserID: userID, Name: strings.ToLower(name), Allow: allow}
+			if err := tx.Create(o).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,384 @@
+// Package versions keeps the previous contents of overwritten files.
+// Before a file is replaced, its old data is hardlinked to .versions/{id}
+// below the owner's root (so it counts toward the quota without being
+// copied) and recorded with the path the file currently lives at.
+package versions
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/satufile/satufile/users"
+)
+
+// Dir is the version folder at the root of each partition
+const Dir = ".versions"
+
+// ErrNotFound is returned for versions that do not exist or belong to
+// another user
+var ErrNotFound = errors.New("version not found")
+
+// Version is a previous content of a file
+type Version struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	UserID    uint      `json:"-" gorm:"index:idx_version_path"`
+	Path      string    `json:"path" gorm:"index:idx_version_path"` // Where the file lives now; /.trash/{id}/... once trashed
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"modified"`                      // Modification time of the old content
+	CreatedAt time.Time `json:"created" gorm:"autoCreateTime"` // When it was replaced
+}
+
+// TableName specifies the table name for GORM
+func (Version) TableName() string {
+	return "file_versions"
+}
+
+// Policy limits how many versions are kept
+type Policy struct {
+	// Count is the number of versions kept per file; 0 disables versioning.
+	// Users can override it with VersionCount.
+	Count int
+	// MaxAge removes versions older than this; 0 keeps them forever.
+	// Users can override it with VersionRetentionDays.
+	MaxAge time.Duration
+}
+
+// Store records versions and prunes them by policy
+type Store struct {
+	db     *gorm.DB
+	policy Policy
+
+	mu sync.Mutex // serialises changes to the version folders
+}
+
+// NewStore creates a store with the server-wide policy
+func NewStore(db *gorm.DB, policy Policy) (*Store, error) {
+	if err := db.AutoMigrate(&Version{}); err != nil {
+		return nil, err
+	}
+	return &Store{db: db, policy: policy}, nil
+}
+
+// Policy returns the user's effective policy
+func (s *Store) Policy(user *users.User) Policy {
+	p := s.policy
+	if user.VersionCount > 0 {
+		p.Count = user.VersionCount
+	}
+	if user.VersionRetentionDays > 0 {
+		p.MaxAge = time.Duration(user.VersionRetentionDays) * 24 * time.Hour
+	}
+	return p
+}
+
+// BlobPath returns where a version's data is stored
+func BlobPath(root string, id uint) string {
+	return filepath.Join(root, Dir, fmt.Sprint(id))
+}
+
+// Keep preserves the current content of path (relative to the user's
+// root) before it is replaced. It returns nil if there is nothing to
+// keep: the file does not exist, is a folder, or versioning is off.
+func (s *Store) Keep(user *users.User, path string) (*Version, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.keep(user, path)
+}
+
+// keep implements Keep; the caller holds mu
+func (s *Store) keep(user *users.User, path string) (*Version, error) {
+	if s.Policy(user).Count <= 0 {
+		return nil, nil
+	}
+
+	root := user.Root()
+	fullPath := filepath.Join(root, path)
+	info, err := os.Lstat(fullPath)
+	if err != nil || !info.Mode().IsRegular() {
+		return nil, nil
+	}
+
+	if err := os.MkdirAll(filepath.Join(root, Dir), 0755); err != nil {
+		return nil, err
+	}
+
+	v := &Version{
+		UserID:  user.ID,
+		Path:    path,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}
+	if err := s.db.Create(v).Error; err != nil {
+		return nil, err
+	}
+	if err := os.Link(fullPath, BlobPath(root, v.ID)); err != nil {
+		s.db.Delete(v)
+		return nil, fmt.Errorf("failed to keep version: %w", err)
+	}
+
+	if err := s.prune(user, path); err != nil {
+		log.Printf("Versions: failed to prune %s: %v", path, err)
+	}
+	return v, nil
+}
+
+// List returns the versions of path, newest first
+func (s *Store) List(userID uint, path string) ([]Version, error) {
+	var list []Version
+	err := s.db.Where("user_id = ? AND path = ?", userID, path).Order("created_at desc, id desc").Find(&list).Error
+	return list, err
+}
+
+// Get returns one of the user's versions
+func (s *Store) Get(userID, id uint) (*Version, error) {
+	var v Version
+	if err := s.db.Where("user_id = ?", userID).First(&v, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &v, nil
+}
+
+// Restore puts a version's content back at its file's path. The content
+// being replaced is kept as a new version, so a restore can be undone.
+func (s *Store) Restore(user *users.User, id uint) (*Version, error) {
+	v, err := s.Get(user.ID, id)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Take the version out first so keeping the current content cannot
+	// prune it
+	root := user.Root()
+	blob := BlobPath(root, v.ID)
+	pending := blob + ".restore"
+	if err := os.Rename(blob, pending); err != nil {
+		return nil, err
+	}
+	if err := s.db.Delete(v).Error; err != nil {
+		os.Rename(pending, blob)
+		return nil, err
+	}
+	undo := func() {
+		os.Rename(pending, blob)
+		s.db.Create(v)
+	}
+
+	kept, err := s.keep(user, v.Path)
+	if err != nil {
+		undo()
+		return nil, err
+	}
+
+	fullPath := filepath.Join(root, v.Path)
+	err = os.MkdirAll(filepath.Dir(fullPath), 0755)
+	if err == nil {
+		err = os.Rename(pending, fullPath)
+	}
+	if err != nil {
+		if kept != nil {
+			s.remove(root, *kept)
+		}
+		undo()
+		return nil, err
+	}
+	return v, nil
+}
+
+// Delete removes one of the user's versions
+func (s *Store) Delete(user *users.User, id uint) error {
+	v, err := s.Get(user.ID, id)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.remove(user.Root(), *v)
+}
+
+// DeleteOlder removes the versions of path beyond the newest keep (if not
+// negative) and those replaced before before (if not zero), and returns
+// how many were removed
+func (s *Store) DeleteOlder(user *users.User, path string, keep int, before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.trim(user, path, keep, before)
+}
+
+// prune applies the user's policy to the versions of path
+func (s *Store) prune(user *users.User, path string) error {
+	p := s.Policy(user)
+	var cutoff time.Time
+	if p.MaxAge > 0 {
+		cutoff = time.Now().Add(-p.MaxAge)
+	}
+	_, err := s.trim(user, path, p.Count, cutoff)
+	return err
+}
+
+// trim removes the versions of path beyond the newest keep (if not
+// negative) and those created before cutoff (if not zero)
+func (s *Store) trim(user *users.User, path string, keep int, cutoff time.Time) (int, error) {
+	list, err := s.List(user.ID, path)
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for i, v := range list {
+		if (keep < 0 || i < keep) && (cutoff.IsZero() || !v.CreatedAt.Before(cutoff)) {
+			continue
+		}
+		if err := s.remove(user.Root(), v); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// remove deletes a version's data and row
+func (s *Store) remove(root string, v Version) error {
+	if err := os.Remove(BlobPath(root, v.ID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return s.db.Delete(&Version{}, v.ID).Error
+}
+
+// PruneUser removes the user's expired versions and rows whose data is
+// gone, and returns how many were removed
+func (s *Store) PruneUser(user *users.User) (int, error) {
+	root := user.Root()
+	if root == "" {
+		return 0, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var list []Version
+	if err := s.db.Where("user_id = ?", user.ID).Find(&list).Error; err != nil {
+		return 0, err
+	}
+
+	var cutoff time.Time
+	if p := s.Policy(user); p.MaxAge > 0 {
+		cutoff = time.Now().Add(-p.MaxAge)
+	}
+
+	removed := 0
+	for _, v := range list {
+		expired := !cutoff.IsZero() && v.CreatedAt.Before(cutoff)
+		if _, err := os.Lstat(BlobPath(root, v.ID)); !expired && err == nil {
+			continue
+		}
+		if err := s.remove(root, v); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// Run prunes every user's versions every interval until stop is closed
+func (s *Store) Run(userRepo *users.Repository, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			allUsers, err := userRepo.List()
+			if err != nil {
+				log.Printf("Versions: failed to list users: %v", err)
+				continue
+			}
+			for i := range allUsers {
+				removed, err := s.PruneUser(&allUsers[i])
+				if err != nil {
+					log.Printf("Versions: user %s: %v", allUsers[i].Username, err)
+				}
+				if removed > 0 {
+					log.Printf("Versions: removed %d old versions of user %s", removed, allUsers[i].Username)
+				}
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Relocate points the versions of from (a file, or every file below a
+// folder) at to, after the item was renamed, moved, trashed or restored.
+// Paths listed in except, and their contents, stayed where they were.
+func Relocate(db *gorm.DB, userID uint, from, to string, except ...string) error {
+	var list []Version
+	if err := db.Where("user_id = ? AND (path = ? OR path LIKE ? ESCAPE '\\')", userID, from, likePrefix(from)).Find(&list).Error; err != nil {
+		return err
+	}
+
+	for _, v := range list {
+		if within(v.Path, except) {
+			continue
+		}
+		newPath := to + strings.TrimPrefix(v.Path, from)
+		if err := db.Model(&Version{}).Where("id = ?", v.ID).Update("path", newPath).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Discard deletes the versions of path and everything below it, once the
+// item itself is permanently deleted
+func Discard(db *gorm.DB, root string, userID uint, path string) error {
+	var list []Version
+	if err := db.Where("user_id = ? AND (path = ? OR path LIKE ? ESCAPE '\\')", userID, path, likePrefix(path)).Find(&list).Error; err != nil {
+		return err
+	}
+
+	for _, v := range list {
+		if err := os.Remove(BlobPath(root, v.ID)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := db.Delete(&Version{}, v.ID).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// within reports whether path is one of dirs or lies below one
+func within(path string, dirs []string) bool {
+	for _, d := range dirs {
+		if path == d || strings.HasPrefix(path, strings.TrimSuffix(d, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func likePrefix(dir string) string {
+	dir = strings.TrimSuffix(dir, "/")
+	return escapeLike(dir) + "/%"
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
@@ -0,0 +1,62 @@
+package vfs
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Local is the local disk. Names are OS paths.
+var Local FS = local{}
+
+type local struct{}
+
+// IsLocal reports whether fsys is the local disk, where features that
+// need real files (hardlinks, inotify, the checksum cache) are available
+func IsLocal(fsys FS) bool {
+	_, ok := fsys.(local)
+	return ok
+}
+
+func (local) Stat(name string) (fs.FileInfo, error)  { return os.Stat(name) }
+func (local) Lstat(name string) (fs.FileInfo, error) { return os.Lstat(name) }
+
+func (local) ReadDir(name string) ([]fs.DirEntry, error) { return os.ReadDir(name) }
+
+func (local) Open(name string) (File, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Create unlinks an existing file before creating a new one, so
+// hardlinked (deduplicated) copies of it elsewhere are never modified
+func (local) Create(name string) (io.WriteCloser, error) {
+	if info, err := os.Lstat(name); err == nil && info.Mode().IsRegular() {
+		if err := os.Remove(name); err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (local) MkdirAll(name string, perm fs.FileMode) error { return os.MkdirAll(name, perm) }
+func (local) Remove(name string) error                     { return os.Remove(name) }
+func (local) RemoveAll(name string) error                  { return os.RemoveAll(name) }
+func (local) Rename(oldname, newname string) error         { return os.Rename(oldname, newname) }
+
+func (local) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+func (local) walkDir(root string, fn fs.WalkDirFunc) error {
+	return filepath.WalkDir(root, fn)
+}
@@ -0,0 +1,128 @@
+package vfs
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"sync"
+)
+
+// Config configures a named backend. Type is "local", "s3" or "sftp";
+// the options of the other types are ignored.
+type Config struct {
+	Type       string `mapstructure:"type"`
+	S3Config   `mapstructure:",squash"`
+	SFTPConfig `mapstructure:",squash"`
+}
+
+var (
+	mu       sync.RWMutex
+	backends = map[string]FS{}
+)
+
+// New returns the filesystem a configuration describes
+func New(cfg Config) (FS, error) {
+	switch cfg.Type {
+	case "", "local":
+		return Local, nil
+	case "s3":
+		return NewS3(cfg.S3Config)
+	case "sftp":
+		return NewSFTP(cfg.SFTPConfig)
+	default:
+		return nil, fmt.Errorf("unknown backend type %q", cfg.Type)
+	}
+}
+
+// Configure replaces the configured backends. Nothing is replaced when
+// any configuration is invalid.
+func Configure(configs map[string]Config) error {
+	configured := make(map[string]FS, len(configs))
+	for name, cfg := range configs {
+		if name == "" || name == "local" {
+			return fmt.Errorf("backend name %q is reserved", name)
+		}
+		fsys, err := New(cfg)
+		if err != nil {
+			return fmt.Errorf("backend %s: %w", name, err)
+		}
+		configured[name] = fsys
+	}
+
+	mu.Lock()
+	backends = configured
+	mu.Unlock()
+	return nil
+}
+
+// Register adds or replaces one backend
+func Register(name string, fsys FS) {
+	mu.Lock()
+	defer mu.Unlock()
+	backends[name] = fsys
+}
+
+// Get returns a configured backend; "" and "local" are the local disk
+func Get(name string) (FS, error) {
+	if name == "" || name == "local" {
+		return Local, nil
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+	fsys, ok := backends[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown storage backend %q", name)
+	}
+	return fsys, nil
+}
+
+// Names lists the configured backends, "local" included
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := []string{"local"}
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names[1:])
+	return names
+}
+
+// Lookup is Get for callers with nowhere to report an error: an unknown
+// backend is a filesystem all of whose operations fail
+func Lookup(name string) FS {
+	fsys, err := Get(name)
+	if err != nil {
+		return Unavailable(err)
+	}
+	return fsys
+}
+
+// Unavailable returns a filesystem all of whose operations fail with err
+func Unavailable(err error) FS {
+	return unavailable{err}
+}
+
+// unavailable is a backend that cannot be used
+type unavailable struct{ err error }
+
+func (u unavailable) Stat(name string) (fs.FileInfo, error) {
+	return nil, pathError("stat", name, u.err)
+}
+func (u unavailable) Lstat(name string) (fs.FileInfo, error) {
+	return nil, pathError("lstat", name, u.err)
+}
+func (u unavailable) ReadDir(name string) ([]fs.DirEntry, error) {
+	return nil, pathError("readdir", name, u.err)
+}
+func (u unavailable) Open(name string) (File, error) { return nil, pathError("open", name, u.err) }
+func (u unavailable) Create(name string) (io.WriteCloser, error) {
+	return nil, pathError("create", name, u.err)
+}
+func (u unavailable) MkdirAll(name string, _ fs.FileMode) error {
+	return pathError("mkdir", name, u.err)
+}
+func (u unavailable) Remove(name string) error       { return pathError("remove", name, u.err) }
+func (u unavailable) RemoveAll(name string) error    { return pathError("removeall", name, u.err) }
+func (u unavailable) Rename(oldname, _ string) error { return pathError("rename", oldname, u.err) }
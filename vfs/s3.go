@@ -0,0 +1,763 @@
+package vfs
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// minPartSize is the smallest part S3 accepts but for the last one
+	minPartSize = 5 << 20
+	// defaultPartSize is how much of a file is buffered per part
+	defaultPartSize = 16 << 20
+)
+
+// copyLimit is the largest object a single CopyObject may copy; larger
+// ones are copied part by part
+var copyLimit int64 = 5 << 30
+
+// S3Config configures a bucket of an S3-compatible object store
+type S3Config struct {
+	Endpoint  string `mapstructure:"endpoint"` // e.g. https://s3.eu-west-1.amazonaws.com or http://minio:9000
+	Region    string `mapstructure:"region"`   // defaults to us-east-1
+	Bucket    string `mapstructure:"bucket"`
+	Prefix    string `mapstructure:"prefix"` // key prefix names are stored below
+	AccessKey string `mapstructure:"access_key"`
+	SecretKey string `mapstructure:"secret_key"`
+	// PartSize is the size of multipart upload parts, at least 5 MiB
+	PartSize int64 `mapstructure:"part_size"`
+}
+
+// s3FS stores files as objects and directories as "name/" marker
+// objects, addressing the bucket path-style
+type s3FS struct {
+	cfg      S3Config
+	endpoint *url.URL
+	client   *http.Client
+}
+
+// NewS3 returns the bucket described by cfg as a filesystem
+func NewS3(cfg S3Config) (FS, error) {
+	if cfg.Bucket == "" {
+		return nil, errors.New("s3: bucket is required")
+	}
+	endpoint, err := url.Parse(strings.TrimSuffix(cfg.Endpoint, "/"))
+	if err != nil || endpoint.Host == "" || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+		return nil, fmt.Errorf("s3: invalid endpoint %q", cfg.Endpoint)
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.PartSize == 0 {
+		cfg.PartSize = defaultPartSize
+	}
+	if cfg.PartSize < minPartSize {
+		return nil, fmt.Errorf("s3: part size must be at least %d bytes", minPartSize)
+	}
+	cfg.Prefix = strings.Trim(cfg.Prefix, "/")
+	return &s3FS{cfg: cfg, endpoint: endpoint, client: http.DefaultClient}, nil
+}
+
+// key returns the object key of a name
+func (s *s3FS) key(name string) string {
+	return strings.TrimPrefix(path.Join(s.cfg.Prefix, path.Clean("/"+name)), "/")
+}
+
+// dirPrefix returns the prefix of the keys inside the directory at key
+func dirPrefix(key string) string {
+	if key == "" {
+		return ""
+	}
+	return key + "/"
+}
+
+func (s *s3FS) Stat(name string) (fs.FileInfo, error) {
+	key := s.key(name)
+	if key == s.cfg.Prefix {
+		return dirInfo("/", time.Time{}), nil
+	}
+
+	info, err := s.head(key)
+	if err == nil {
+		return info, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, pathError("stat", name, err)
+	}
+
+	// Directories exist as long as a marker or anything below them does
+	list, err := s.list(dirPrefix(key), "", 1, "")
+	if err != nil {
+		return nil, pathError("stat", name, err)
+	}
+	if len(list.Contents) == 0 {
+		return nil, pathError("stat", name, fs.ErrNotExist)
+	}
+	return dirInfo(baseName(name), list.Contents[0].LastModified), nil
+}
+
+func (s *s3FS) Lstat(name string) (fs.FileInfo, error) {
+	return s.Stat(name)
+}
+
+func (s *s3FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	prefix := dirPrefix(s.key(name))
+
+	var entries []fs.DirEntry
+	dirs := make(map[string]bool)
+	found := prefix == dirPrefix(s.cfg.Prefix) // the root always exists
+	token := ""
+	for {
+		list, err := s.list(prefix, "/", 1000, token)
+		if err != nil {
+			return nil, pathError("readdir", name, err)
+		}
+		for _, p := range list.CommonPrefixes {
+			found = true
+			dir := strings.TrimSuffix(strings.TrimPrefix(p.Prefix, prefix), "/")
+			if dir != "" && !dirs[dir] {
+				dirs[dir] = true
+				entries = append(entries, fs.FileInfoToDirEntry(dirInfo(dir, time.Time{})))
+			}
+		}
+		for _, obj := range list.Contents {
+			found = true
+			if obj.Key == prefix {
+				continue // the directory's own marker
+			}
+			entries = append(entries, fs.FileInfoToDirEntry(&fileInfo{
+				name:    strings.TrimPrefix(obj.Key, prefix),
+				size:    obj.Size,
+				mode:    0644,
+				modTime: obj.LastModified,
+			}))
+		}
+		if !list.IsTruncated {
+			break
+		}
+		token = list.NextContinuationToken
+	}
+
+	if !found {
+		if _, err := s.head(s.key(name)); err == nil {
+			return nil, pathError("readdir", name, ErrNotDir)
+		}
+		return nil, pathError("readdir", name, fs.ErrNotExist)
+	}
+
+	// A name used for both a file and a directory lists as the directory
+	kept := entries[:0]
+	for _, e := range entries {
+		if e.IsDir() || !dirs[e.Name()] {
+			kept = append(kept, e)
+		}
+	}
+	sortEntries(kept)
+	return kept, nil
+}
+
+func (s *s3FS) Open(name string) (File, error) {
+	info, err := s.head(s.key(name))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			if dir, err := s.Stat(name); err == nil && dir.IsDir() {
+				return nil, pathError("open", name, errors.New("is a directory"))
+			}
+		}
+		return nil, pathError("open", name, err)
+	}
+	return &s3File{fs: s, key: s.key(name), info: info}, nil
+}
+
+func (s *s3FS) Create(name string) (io.WriteCloser, error) {
+	if path.Clean("/"+name) == "/" {
+		return nil, pathError("create", name, fs.ErrInvalid)
+	}
+	return &s3Writer{fs: s, key: s.key(name)}, nil
+}
+
+func (s *s3FS) MkdirAll(name string, perm fs.FileMode) error {
+	if info, err := s.Stat(name); err == nil {
+		if !info.IsDir() {
+			return pathError("mkdir", name, ErrNotDir)
+		}
+		return nil
+	}
+
+	dir := "/"
+	for _, elem := range strings.Split(strings.Trim(path.Clean("/"+name), "/"), "/") {
+		dir = path.Join(dir, elem)
+		info, err := s.Stat(dir)
+		if err == nil {
+			if !info.IsDir() {
+				return pathError("mkdir", dir, ErrNotDir)
+			}
+			continue
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if err := s.put(dirPrefix(s.key(dir)), nil, nil); err != nil {
+			return pathError("mkdir", dir, err)
+		}
+	}
+	return nil
+}
+
+func (s *s3FS) Remove(name string) error {
+	key := s.key(name)
+	if key == s.cfg.Prefix {
+		return pathError("remove", name, fs.ErrInvalid)
+	}
+	if _, err := s.head(key); err == nil {
+		return pathError("remove", name, s.delete(key))
+	}
+
+	list, err := s.list(dirPrefix(key), "", 2, "")
+	if err != nil {
+		return pathError("remove", name, err)
+	}
+	switch {
+	case len(list.Contents) == 0:
+		return pathError("remove", name, fs.ErrNotExist)
+	case len(list.Contents) > 1 || list.Contents[0].Key != dirPrefix(key):
+		return pathError("remove", name, ErrNotEmpty)
+	}
+	return pathError("remove", name, s.delete(dirPrefix(key)))
+}
+
+func (s *s3FS) RemoveAll(name string) error {
+	key := s.key(name)
+	if key != s.cfg.Prefix {
+		if err := s.delete(key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return pathError("removeall", name, err)
+		}
+	}
+	keys, err := s.listAll(dirPrefix(key))
+	if err != nil {
+		return pathError("removeall", name, err)
+	}
+	for _, k := range keys {
+		if err := s.delete(k.Key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return pathError("removeall", name, err)
+		}
+	}
+	return nil
+}
+
+// Rename copies and deletes, object by object for directories. It is not
+// atomic: an interrupted rename leaves objects in both places.
+func (s *s3FS) Rename(oldname, newname string) error {
+	oldKey, newKey := s.key(oldname), s.key(newname)
+	if oldKey == newKey {
+		return nil
+	}
+	if oldKey == s.cfg.Prefix || strings.HasPrefix(newKey, dirPrefix(oldKey)) {
+		return pathError("rename", oldname, fs.ErrInvalid)
+	}
+
+	if info, err := s.head(oldKey); err == nil {
+		if err := s.copy(oldKey, newKey, info.Size()); err != nil {
+			return pathError("rename", oldname, err)
+		}
+		return pathError("rename", oldname, s.delete(oldKey))
+	}
+
+	objects, err := s.listAll(dirPrefix(oldKey))
+	if err != nil {
+		return pathError("rename", oldname, err)
+	}
+	if len(objects) == 0 {
+		return pathError("rename", oldname, fs.ErrNotExist)
+	}
+	for _, obj := range objects {
+		target := dirPrefix(newKey) + strings.TrimPrefix(obj.Key, dirPrefix(oldKey))
+		if err := s.copy(obj.Key, target, obj.Size); err != nil {
+			return pathError("rename", oldname, err)
+		}
+	}
+	for _, obj := range objects {
+		if err := s.delete(obj.Key); err != nil {
+			return pathError("rename", oldname, err)
+		}
+	}
+	return nil
+}
+
+// s3File reads an object with ranged GETs, reopening the stream after
+// every seek
+type s3File struct {
+	fs   *s3FS
+	key  string
+	info *fileInfo
+	off  int64
+	body io.ReadCloser
+}
+
+func (f *s3File) Read(p []byte) (int, error) {
+	if f.off >= f.info.size {
+		return 0, io.EOF
+	}
+	if f.body == nil {
+		header := http.Header{"Range": {fmt.Sprintf("bytes=%d-", f.off)}}
+		resp, err := f.fs.do(http.MethodGet, f.key, nil, header, nil)
+		if err != nil {
+			return 0, pathError("read", f.key, err)
+		}
+		f.body = resp.Body
+		// Stores that ignore the range send everything
+		if resp.StatusCode == http.StatusOK && f.off > 0 {
+			if _, err := io.CopyN(io.Discard, f.body, f.off); err != nil {
+				return 0, pathError("read", f.key, err)
+			}
+		}
+	}
+	n, err := f.body.Read(p)
+	f.off += int64(n)
+	if err == io.EOF && f.off < f.info.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (f *s3File) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.info.size
+	}
+	if offset < 0 {
+		return 0, pathError("seek", f.key, fs.ErrInvalid)
+	}
+	if offset != f.off && f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *s3File) Close() error {
+	if f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	return nil
+}
+
+func (f *s3File) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+// s3Writer buffers a part at a time. Small files are stored with a single
+// PUT on Close; larger ones become multipart uploads as soon as the first
+// part is full, and are completed on Close.
+type s3Writer struct {
+	fs       *s3FS
+	key      string
+	buf      bytes.Buffer
+	uploadID string
+	parts    []completedPart
+	err      error
+	closed   bool
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.closed {
+		return 0, fs.ErrClosed
+	}
+	w.buf.Write(p)
+	for int64(w.buf.Len()) >= w.fs.cfg.PartSize {
+		if err := w.flushPart(w.buf.Next(int(w.fs.cfg.PartSize))); err != nil {
+			w.fail(err)
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (w *s3Writer) Close() error {
+	if w.closed {
+		return w.err
+	}
+	w.closed = true
+	if w.err != nil {
+		return w.err
+	}
+
+	if w.uploadID == "" {
+		w.err = w.fs.put(w.key, w.buf.Bytes(), nil)
+		return w.err
+	}
+	if w.buf.Len() > 0 {
+		if err := w.flushPart(w.buf.Bytes()); err != nil {
+			w.fail(err)
+			return err
+		}
+	}
+	if err := w.fs.completeUpload(w.key, w.uploadID, w.parts); err != nil {
+		w.fail(err)
+		return err
+	}
+	return nil
+}
+
+// flushPart uploads data as the next part, starting the upload if needed
+func (w *s3Writer) flushPart(data []byte) error {
+	if w.uploadID == "" {
+		id, err := w.fs.createUpload(w.key)
+		if err != nil {
+			return err
+		}
+		w.uploadID = id
+	}
+
+	number := len(w.parts) + 1
+	resp, err := w.fs.do(http.MethodPut, w.key, partQuery(w.uploadID, number), nil, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	w.parts = append(w.parts, completedPart{PartNumber: number, ETag: resp.Header.Get("ETag")})
+	return nil
+}
+
+// fail records err and abandons the multipart upload, if any
+func (w *s3Writer) fail(err error) {
+	w.err = err
+	if w.uploadID != "" {
+		w.fs.abortUpload(w.key, w.uploadID)
+	}
+}
+
+// S3 API
+
+type listResult struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []listObject
+	CommonPrefixes        []struct{ Prefix string }
+}
+
+type listObject struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+type completedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+// s3Error is an error response of the object store
+type s3Error struct {
+	Status  int    `xml:"-"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("s3: %s (%d)", e.Code, e.Status)
+	}
+	return fmt.Sprintf("s3: %s: %s", e.Code, e.Message)
+}
+
+func (e *s3Error) Is(target error) bool {
+	return target == fs.ErrNotExist && (e.Status == http.StatusNotFound || e.Code == "NoSuchKey")
+}
+
+func partQuery(uploadID string, number int) url.Values {
+	return url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+}
+
+// head describes the object at key
+func (s *s3FS) head(key string) (*fileInfo, error) {
+	if key == "" {
+		return nil, fs.ErrNotExist
+	}
+	resp, err := s.do(http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &fileInfo{name: path.Base(key), size: resp.ContentLength, mode: 0644, modTime: modTime}, nil
+}
+
+// list returns up to max keys below prefix, folding keys that contain
+// delimiter after the prefix into common prefixes
+func (s *s3FS) list(prefix, delimiter string, max int, token string) (*listResult, error) {
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}, "max-keys": {strconv.Itoa(max)}}
+	if delimiter != "" {
+		query.Set("delimiter", delimiter)
+	}
+	if token != "" {
+		query.Set("continuation-token", token)
+	}
+	result := &listResult{}
+	return result, s.doXML(http.MethodGet, "", query, nil, nil, result)
+}
+
+// listAll returns every object below prefix
+func (s *s3FS) listAll(prefix string) ([]listObject, error) {
+	var objects []listObject
+	token := ""
+	for {
+		list, err := s.list(prefix, "", 1000, token)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, list.Contents...)
+		if !list.IsTruncated {
+			return objects, nil
+		}
+		token = list.NextContinuationToken
+	}
+}
+
+func (s *s3FS) put(key string, data []byte, header http.Header) error {
+	resp, err := s.do(http.MethodPut, key, nil, header, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3FS) delete(key string) error {
+	resp, err := s.do(http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// copy copies an object of the given size within the bucket
+func (s *s3FS) copy(src, dst string, size int64) error {
+	source := http.Header{"X-Amz-Copy-Source": {"/" + s.cfg.Bucket + "/" + uriEncode(src, false)}}
+	if size <= copyLimit {
+		var result struct{ ETag string }
+		return s.doXML(http.MethodPut, dst, nil, source, nil, &result)
+	}
+
+	id, err := s.createUpload(dst)
+	if err != nil {
+		return err
+	}
+	var parts []completedPart
+	for start := int64(0); start < size; start += copyLimit {
+		end := min(start+copyLimit, size) - 1
+		header := source.Clone()
+		header.Set("X-Amz-Copy-Source-Range", fmt.Sprintf("bytes=%d-%d", start, end))
+
+		var result struct{ ETag string }
+		number := len(parts) + 1
+		if err := s.doXML(http.MethodPut, dst, partQuery(id, number), header, nil, &result); err != nil {
+			s.abortUpload(dst, id)
+			return err
+		}
+		parts = append(parts, completedPart{PartNumber: number, ETag: result.ETag})
+	}
+	if err := s.completeUpload(dst, id, parts); err != nil {
+		s.abortUpload(dst, id)
+		return err
+	}
+	return nil
+}
+
+func (s *s3FS) createUpload(key string) (string, error) {
+	var result struct{ UploadId string }
+	if err := s.doXML(http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil, &result); err != nil {
+		return "", err
+	}
+	return result.UploadId, nil
+}
+
+func (s *s3FS) completeUpload(key, uploadID string, parts []completedPart) error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	var result struct{ Key string }
+	return s.doXML(http.MethodPost, key, url.Values{"uploadId": {uploadID}}, nil, body, &result)
+}
+
+func (s *s3FS) abortUpload(key, uploadID string) {
+	if resp, err := s.do(http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil); err == nil {
+		resp.Body.Close()
+	}
+}
+
+// doXML sends a request and decodes its XML response into v. Some
+// operations report failures in the body of a 200 response.
+func (s *s3FS) doXML(method, key string, query url.Values, header http.Header, body []byte, v interface{}) error {
+	resp, err := s.do(method, key, query, header, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(data, []byte("<Error>")) {
+		e := &s3Error{Status: resp.StatusCode}
+		xml.Unmarshal(data, e)
+		return e
+	}
+	return xml.Unmarshal(data, v)
+}
+
+// do sends a signed request for the object at key, or for the bucket if
+// key is empty, returning an *s3Error for unsuccessful responses
+func (s *s3FS) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = s.endpoint.Path + "/" + s.cfg.Bucket + "/" + key
+	u.RawPath = s.endpoint.Path + "/" + uriEncode(s.cfg.Bucket, true) + "/" + uriEncode(key, false)
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	sum := sha256.Sum256(body)
+	if s.cfg.AccessKey != "" {
+		signV4(req, hex.EncodeToString(sum[:]), s.cfg.AccessKey, s.cfg.SecretKey, s.cfg.Region, time.Now())
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	e := &s3Error{Status: resp.StatusCode}
+	if data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<16)); err == nil {
+		xml.Unmarshal(data, e)
+	}
+	if e.Code == "" {
+		e.Code = http.StatusText(resp.StatusCode)
+	}
+	return nil, e
+}
+
+// signV4 adds AWS Signature Version 4 headers to req for the s3 service
+func signV4(req *http.Request, payloadHash, accessKey, secretKey, region string, now time.Time) {
+	stamp := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "range" || lower == "content-type" || lower == "content-md5" {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := stamp[:8] + "/" + region + "/s3/aws4_request"
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), stamp[:8])
+	for _, part := range []string{region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery encodes query sorted by key as signing requires
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode percent-encodes everything but unreserved characters, and
+// slashes unless encodeSlash is set
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
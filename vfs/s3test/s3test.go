@@ -0,0 +1,384 @@
+// Package s3test runs an in-memory S3-compatible object store for tests, a
+// stand-in for MinIO that covers what the vfs S3 backend uses: path-style
+// buckets, ListObjectsV2, ranged GETs, server-side copies and multipart
+// uploads, including S3's minimum part size.
+package s3test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MinPartSize is the smallest part accepted but for the last one
+const MinPartSize = 5 << 20
+
+// Credentials every request must be signed with
+const (
+	AccessKey = "s3test-access"
+	SecretKey = "s3test-secret"
+)
+
+type object struct {
+	data    []byte
+	etag    string
+	modTime time.Time
+}
+
+type upload struct {
+	bucket, key string
+	parts       map[int]*object
+}
+
+// Server is an S3 endpoint holding its objects in memory
+type Server struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	buckets map[string]map[string]*object
+	uploads map[string]*upload
+	nextID  int
+}
+
+// NewServer starts a server with the named, empty buckets
+func NewServer(buckets ...string) *Server {
+	s := &Server{buckets: make(map[string]map[string]*object), uploads: make(map[string]*upload)}
+	for _, b := range buckets {
+		s.buckets[b] = make(map[string]*object)
+	}
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+// Keys returns the keys stored in a bucket, sorted
+func (s *Server) Keys(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.buckets[bucket]))
+	for k := range s.buckets[bucket] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Uploads returns the number of multipart uploads neither completed nor
+// aborted
+func (s *Server) Uploads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.uploads)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential="+AccessKey+"/") {
+		writeError(w, http.StatusForbidden, "InvalidAccessKeyId")
+		return
+	}
+	sum := sha256.Sum256(body)
+	if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) {
+		writeError(w, http.StatusBadRequest, "XAmzContentSHA256Mismatch")
+		return
+	}
+
+	bucketName, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	query := r.URL.Query()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucket, ok := s.buckets[bucketName]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		s.list(w, bucket, query)
+	case key == "":
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		s.nextID++
+		id := strconv.Itoa(s.nextID)
+		s.uploads[id] = &upload{bucket: bucketName, key: key, parts: make(map[int]*object)}
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: bucketName, Key: key, UploadId: id})
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		s.complete(w, bucket, key, query.Get("uploadId"), body)
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		s.putPart(w, r, key, query, body)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		src, err := s.source(r)
+		if err != nil {
+			writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		obj := newObject(src.data)
+		bucket[key] = obj
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"CopyObjectResult"`
+			ETag    string
+		}{ETag: obj.etag})
+	case r.Method == http.MethodPut:
+		obj := newObject(body)
+		bucket[key] = obj
+		w.Header().Set("ETag", obj.etag)
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(s.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodDelete:
+		delete(bucket, key)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		obj, ok := bucket[key]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", obj.etag)
+		w.Header().Set("Last-Modified", obj.modTime.UTC().Format(http.TimeFormat))
+		data, status := obj.data, http.StatusOK
+		if rng := r.Header.Get("Range"); rng != "" {
+			start, end, ok := parseRange(rng, int64(len(obj.data)))
+			if !ok {
+				writeError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+				return
+			}
+			data, status = obj.data[start:end+1], http.StatusPartialContent
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(obj.data)))
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(status)
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+// list answers ListObjectsV2
+func (s *Server) list(w http.ResponseWriter, bucket map[string]*object, query url.Values) {
+	if query.Get("list-type") != "2" {
+		writeError(w, http.StatusNotImplemented, "NotImplemented")
+		return
+	}
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+	max := 1000
+	if v, err := strconv.Atoi(query.Get("max-keys")); err == nil && v < max {
+		max = v
+	}
+	after := query.Get("continuation-token")
+
+	keys := make([]string, 0, len(bucket))
+	for k := range bucket {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	type content struct {
+		Key          string
+		Size         int64
+		LastModified string
+		ETag         string
+	}
+	type commonPrefix struct{ Prefix string }
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Prefix                string
+		KeyCount              int
+		IsTruncated           bool
+		NextContinuationToken string         `xml:",omitempty"`
+		Contents              []content      `xml:"Contents"`
+		CommonPrefixes        []commonPrefix `xml:"CommonPrefixes"`
+	}{Prefix: prefix}
+
+	last := ""
+	for _, k := range keys {
+		entry, rolled := k, false
+		if delimiter != "" {
+			if i := strings.Index(k[len(prefix):], delimiter); i >= 0 {
+				entry, rolled = k[:len(prefix)+i+len(delimiter)], true
+			}
+		}
+		if entry <= after || entry == last {
+			continue
+		}
+		if result.KeyCount == max {
+			result.IsTruncated = true
+			result.NextContinuationToken = last
+			break
+		}
+		if !rolled {
+			obj := bucket[k]
+			result.Contents = append(result.Contents, content{
+				Key:          k,
+				Size:         int64(len(obj.data)),
+				LastModified: obj.modTime.UTC().Format("2006-01-02T15:04:05.000Z"),
+				ETag:         obj.etag,
+			})
+		} else {
+			result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: entry})
+		}
+		result.KeyCount++
+		last = entry
+	}
+	writeXML(w, result)
+}
+
+// putPart answers UploadPart and UploadPartCopy
+func (s *Server) putPart(w http.ResponseWriter, r *http.Request, key string, query url.Values, body []byte) {
+	up, ok := s.uploads[query.Get("uploadId")]
+	number, err := strconv.Atoi(query.Get("partNumber"))
+	if !ok || up.key != key || err != nil || number < 1 {
+		writeError(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+
+	if r.Header.Get("X-Amz-Copy-Source") == "" {
+		part := newObject(body)
+		up.parts[number] = part
+		w.Header().Set("ETag", part.etag)
+		return
+	}
+
+	src, err := s.source(r)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	data := src.data
+	if rng := r.Header.Get("X-Amz-Copy-Source-Range"); rng != "" {
+		start, end, ok := parseRange(rng, int64(len(data)))
+		if !ok {
+			writeError(w, http.StatusBadRequest, "InvalidArgument")
+			return
+		}
+		data = data[start : end+1]
+	}
+	part := newObject(data)
+	up.parts[number] = part
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"CopyPartResult"`
+		ETag    string
+	}{ETag: part.etag})
+}
+
+// complete answers CompleteMultipartUpload
+func (s *Server) complete(w http.ResponseWriter, bucket map[string]*object, key, id string, body []byte) {
+	up, ok := s.uploads[id]
+	if !ok || up.key != key {
+		writeError(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	var req struct {
+		Parts []struct {
+			PartNumber int
+			ETag       string
+		} `xml:"Part"`
+	}
+	if err := xml.Unmarshal(body, &req); err != nil || len(req.Parts) == 0 {
+		writeError(w, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+
+	var data []byte
+	for i, p := range req.Parts {
+		part, ok := up.parts[p.PartNumber]
+		if !ok || part.etag != p.ETag || (i > 0 && p.PartNumber <= req.Parts[i-1].PartNumber) {
+			writeError(w, http.StatusBadRequest, "InvalidPart")
+			return
+		}
+		if i < len(req.Parts)-1 && len(part.data) < MinPartSize {
+			writeError(w, http.StatusBadRequest, "EntityTooSmall")
+			return
+		}
+		data = append(data, part.data...)
+	}
+	delete(s.uploads, id)
+	bucket[key] = newObject(data)
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Key     string
+	}{Key: key})
+}
+
+// source returns the object named by X-Amz-Copy-Source
+func (s *Server) source(r *http.Request) (*object, error) {
+	src, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		return nil, err
+	}
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(src, "/"), "/")
+	obj, ok := s.buckets[bucket][key]
+	if !ok {
+		return nil, fmt.Errorf("no such key %s", src)
+	}
+	return obj, nil
+}
+
+func newObject(data []byte) *object {
+	sum := md5.Sum(data)
+	return &object{data: bytes.Clone(data), etag: `"` + hex.EncodeToString(sum[:]) + `"`, modTime: time.Now()}
+}
+
+// parseRange parses "bytes=start-" or "bytes=start-end" for a size
+func parseRange(header string, size int64) (int64, int64, bool) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return 0, 0, false
+	}
+	from, to, _ := strings.Cut(spec, "-")
+	start, err := strconv.ParseInt(from, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false
+	}
+	end := size - 1
+	if to != "" {
+		if end, err = strconv.ParseInt(to, 10, 64); err != nil || end < start {
+			return 0, 0, false
+		}
+		end = min(end, size-1)
+	}
+	return start, end, true
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: http.StatusText(status)})
+}
@@ -0,0 +1,279 @@
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// SFTPConfig configures a directory on an SFTP server
+type SFTPConfig struct {
+	Address    string `mapstructure:"address"` // host:port, the port defaults to 22
+	User       string `mapstructure:"user"`
+	Password   string `mapstructure:"password"`
+	PrivateKey string `mapstructure:"private_key"` // path of a private key file
+	// HostKey is the server's public key in authorized_keys format
+	HostKey               string `mapstructure:"host_key"`
+	InsecureIgnoreHostKey bool   `mapstructure:"insecure_ignore_host_key"`
+	// Root is the server directory names are resolved against
+	Root string `mapstructure:"root"`
+}
+
+// sftpFS keeps one SSH connection, opened on first use and again after
+// it was lost
+type sftpFS struct {
+	root string
+	dial func() (*sftp.Client, io.Closer, error)
+
+	mu     sync.Mutex
+	client *sftp.Client
+	conn   io.Closer
+}
+
+// NewSFTP returns the server directory described by cfg as a filesystem
+func NewSFTP(cfg SFTPConfig) (FS, error) {
+	if cfg.Address == "" || cfg.User == "" {
+		return nil, errors.New("sftp: address and user are required")
+	}
+	if _, _, err := net.SplitHostPort(cfg.Address); err != nil {
+		cfg.Address = net.JoinHostPort(cfg.Address, "22")
+	}
+
+	var auth []ssh.AuthMethod
+	if cfg.PrivateKey != "" {
+		pem, err := os.ReadFile(cfg.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("sftp: %w", err)
+		}
+		signer, err := ssh.ParsePrivateKey(pem)
+		if err != nil {
+			return nil, fmt.Errorf("sftp: private key: %w", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if cfg.Password != "" {
+		auth = append(auth, ssh.Password(cfg.Password))
+	}
+	if len(auth) == 0 {
+		return nil, errors.New("sftp: a password or private key is required")
+	}
+
+	hostKey := ssh.InsecureIgnoreHostKey()
+	if !cfg.InsecureIgnoreHostKey {
+		if cfg.HostKey == "" {
+			return nil, errors.New("sftp: host_key is required unless insecure_ignore_host_key is set")
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(cfg.HostKey))
+		if err != nil {
+			return nil, fmt.Errorf("sftp: host key: %w", err)
+		}
+		hostKey = ssh.FixedHostKey(key)
+	}
+
+	config := &ssh.ClientConfig{User: cfg.User, Auth: auth, HostKeyCallback: hostKey, Timeout: 10 * time.Second}
+	return &sftpFS{
+		root: path.Clean("/" + cfg.Root),
+		dial: func() (*sftp.Client, io.Closer, error) {
+			conn, err := ssh.Dial("tcp", cfg.Address, config)
+			if err != nil {
+				return nil, nil, err
+			}
+			client, err := sftp.NewClient(conn)
+			if err != nil {
+				conn.Close()
+				return nil, nil, err
+			}
+			return client, conn, nil
+		},
+	}, nil
+}
+
+// path returns the server path of a name
+func (s *sftpFS) path(name string) string {
+	return path.Join(s.root, path.Clean("/"+name))
+}
+
+// get returns the connected client, dialing if there is none
+func (s *sftpFS) get() (*sftp.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client == nil {
+		client, conn, err := s.dial()
+		if err != nil {
+			return nil, fmt.Errorf("sftp: %w", err)
+		}
+		s.client, s.conn = client, conn
+	}
+	return s.client, nil
+}
+
+// check drops the client when err says the connection is gone, so the
+// next call reconnects
+func (s *sftpFS) check(client *sftp.Client, err error) error {
+	if errors.Is(err, sftp.ErrSSHFxConnectionLost) {
+		s.mu.Lock()
+		if s.client == client {
+			s.client.Close()
+			if s.conn != nil {
+				s.conn.Close()
+			}
+			s.client, s.conn = nil, nil
+		}
+		s.mu.Unlock()
+	}
+	return err
+}
+
+// do runs fn with the client and wraps its error with op and name
+func (s *sftpFS) do(op, name string, fn func(*sftp.Client) error) error {
+	client, err := s.get()
+	if err != nil {
+		return pathError(op, name, err)
+	}
+	return pathError(op, name, s.check(client, fn(client)))
+}
+
+func (s *sftpFS) Stat(name string) (info fs.FileInfo, err error) {
+	err = s.do("stat", name, func(c *sftp.Client) error {
+		info, err = c.Stat(s.path(name))
+		return err
+	})
+	return info, err
+}
+
+func (s *sftpFS) Lstat(name string) (info fs.FileInfo, err error) {
+	err = s.do("lstat", name, func(c *sftp.Client) error {
+		info, err = c.Lstat(s.path(name))
+		return err
+	})
+	return info, err
+}
+
+func (s *sftpFS) ReadDir(name string) (entries []fs.DirEntry, err error) {
+	err = s.do("readdir", name, func(c *sftp.Client) error {
+		infos, err := c.ReadDir(s.path(name))
+		if err != nil {
+			return err
+		}
+		entries = make([]fs.DirEntry, len(infos))
+		for i, info := range infos {
+			entries[i] = fs.FileInfoToDirEntry(info)
+		}
+		sortEntries(entries)
+		return nil
+	})
+	return entries, err
+}
+
+func (s *sftpFS) Open(name string) (f File, err error) {
+	err = s.do("open", name, func(c *sftp.Client) error {
+		file, err := c.Open(s.path(name))
+		if err == nil {
+			f = file
+		}
+		return err
+	})
+	return f, err
+}
+
+func (s *sftpFS) Create(name string) (w io.WriteCloser, err error) {
+	err = s.do("create", name, func(c *sftp.Client) error {
+		file, err := c.Create(s.path(name))
+		if err == nil {
+			w = file
+		}
+		return err
+	})
+	return w, err
+}
+
+func (s *sftpFS) MkdirAll(name string, perm fs.FileMode) error {
+	return s.do("mkdir", name, func(c *sftp.Client) error {
+		return c.MkdirAll(s.path(name))
+	})
+}
+
+func (s *sftpFS) Remove(name string) error {
+	return s.do("remove", name, func(c *sftp.Client) error {
+		info, err := c.Lstat(s.path(name))
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return c.Remove(s.path(name))
+		}
+		entries, err := c.ReadDir(s.path(name))
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			return ErrNotEmpty
+		}
+		return c.RemoveDirectory(s.path(name))
+	})
+}
+
+func (s *sftpFS) RemoveAll(name string) error {
+	return s.do("removeall", name, func(c *sftp.Client) error {
+		if s.path(name) == s.root {
+			return errors.New("refusing to remove the root")
+		}
+		err := s.removeAll(c, s.path(name))
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	})
+}
+
+func (s *sftpFS) removeAll(c *sftp.Client, p string) error {
+	info, err := c.Lstat(p)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return c.Remove(p)
+	}
+	entries, err := c.ReadDir(p)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := s.removeAll(c, path.Join(p, entry.Name())); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return c.RemoveDirectory(p)
+}
+
+func (s *sftpFS) Rename(oldname, newname string) error {
+	return s.do("rename", oldname, func(c *sftp.Client) error {
+		// posix-rename replaces newname; servers without the extension
+		// refuse to overwrite, so the file is removed first there
+		oldpath, newpath := s.path(oldname), s.path(newname)
+		if _, ok := c.HasExtension("posix-rename@openssh.com"); ok {
+			return c.PosixRename(oldpath, newpath)
+		}
+		if info, err := c.Lstat(newpath); err == nil && !info.IsDir() {
+			if err := c.Remove(newpath); err != nil {
+				return err
+			}
+		}
+		return c.Rename(oldpath, newpath)
+	})
+}
+
+func (s *sftpFS) Chtimes(name string, atime, mtime time.Time) error {
+	return s.do("chtimes", name, func(c *sftp.Client) error {
+		return c.Chtimes(s.path(name), atime, mtime)
+	})
+}
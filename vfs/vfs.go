@@ -0,0 +1,215 @@
+// Package vfs abstracts the filesystems user partitions live on: the
+// local disk, S3-compatible object stores and SFTP servers. Names are
+// absolute slash-separated paths; on the local disk they are the OS paths
+// themselves, so a partition root such as /srv/data/alice means the same
+// on every backend.
+package vfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"time"
+)
+
+// FS is a tree of files and directories. Errors for missing names wrap
+// fs.ErrNotExist, so os.IsNotExist and errors.Is work on every backend.
+type FS interface {
+	// Stat describes the named file, following symbolic links
+	Stat(name string) (fs.FileInfo, error)
+	// Lstat describes the named file without following symbolic links
+	Lstat(name string) (fs.FileInfo, error)
+	// ReadDir lists a directory, sorted by name
+	ReadDir(name string) ([]fs.DirEntry, error)
+	// Open opens a file for reading
+	Open(name string) (File, error)
+	// Create creates or truncates a file for writing. The content is
+	// only guaranteed to be stored once Close returns without error.
+	Create(name string) (io.WriteCloser, error)
+	// MkdirAll creates a directory and any missing parents
+	MkdirAll(name string, perm fs.FileMode) error
+	// Remove removes a file or an empty directory
+	Remove(name string) error
+	// RemoveAll removes a file or directory tree; missing names are not
+	// an error
+	RemoveAll(name string) error
+	// Rename moves a file or directory tree, replacing a file at newname
+	Rename(oldname, newname string) error
+}
+
+// File is an open file, readable from any offset
+type File interface {
+	io.Reader
+	io.Seeker
+	io.Closer
+	Stat() (fs.FileInfo, error)
+}
+
+// Chtimer is implemented by filesystems that can set modification times
+type Chtimer interface {
+	Chtimes(name string, atime, mtime time.Time) error
+}
+
+// Chtimes sets the times of a file where the filesystem supports it, and
+// does nothing elsewhere
+func Chtimes(fsys FS, name string, atime, mtime time.Time) error {
+	if c, ok := fsys.(Chtimer); ok {
+		return c.Chtimes(name, atime, mtime)
+	}
+	return nil
+}
+
+// Layer is implemented by filesystems that store the files of another
+// one transformed, such as encrypted, under the same names
+type Layer interface {
+	FS
+	// Base returns the filesystem below the layer
+	Base() FS
+	// Over returns the same layer on top of another filesystem
+	Over(base FS) FS
+}
+
+// Base returns the filesystem below any layers of fsys
+func Base(fsys FS) FS {
+	for {
+		l, ok := fsys.(Layer)
+		if !ok {
+			return fsys
+		}
+		fsys = l.Base()
+	}
+}
+
+// Like returns base with the layers of fsys on top, so files kept on base
+// are stored the way fsys stores them
+func Like(fsys, base FS) FS {
+	l, ok := fsys.(Layer)
+	if !ok {
+		return base
+	}
+	return l.Over(Like(l.Base(), base))
+}
+
+// ErrNotDir is returned when a path is used as a directory but is a file
+var ErrNotDir = errors.New("not a directory")
+
+// ErrNotEmpty is returned by Remove for directories that still hold files
+var ErrNotEmpty = errors.New("directory not empty")
+
+// WalkDir walks the tree rooted at root like filepath.WalkDir, calling fn
+// with full names. Local trees are walked with filepath.WalkDir.
+func WalkDir(fsys FS, root string, fn fs.WalkDirFunc) error {
+	if l, ok := fsys.(local); ok {
+		return l.walkDir(root, fn)
+	}
+
+	info, err := fsys.Stat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = walkDir(fsys, root, fs.FileInfoToDirEntry(info), fn)
+	}
+	if errors.Is(err, fs.SkipDir) || errors.Is(err, fs.SkipAll) {
+		return nil
+	}
+	return err
+}
+
+func walkDir(fsys FS, name string, d fs.DirEntry, fn fs.WalkDirFunc) error {
+	if err := fn(name, d, nil); err != nil || !d.IsDir() {
+		if errors.Is(err, fs.SkipDir) && d.IsDir() {
+			err = nil
+		}
+		return err
+	}
+
+	entries, err := fsys.ReadDir(name)
+	if err != nil {
+		// Report the failure; fn may skip the directory or stop
+		if err = fn(name, d, err); err != nil {
+			if errors.Is(err, fs.SkipDir) {
+				err = nil
+			}
+			return err
+		}
+	}
+	for _, entry := range entries {
+		if err := walkDir(fsys, path.Join(name, entry.Name()), entry, fn); err != nil {
+			if errors.Is(err, fs.SkipDir) {
+				break
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadFile reads a whole file
+func ReadFile(fsys FS, name string) ([]byte, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// WriteFile writes data to a file, creating or truncating it
+func WriteFile(fsys FS, name string, data []byte) error {
+	w, err := fsys.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// sortEntries orders directory entries by name, as ReadDir promises
+func sortEntries(entries []fs.DirEntry) {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+}
+
+// fileInfo describes files of backends without native file info
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) Mode() fs.FileMode  { return fi.mode }
+func (fi *fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *fileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *fileInfo) Sys() interface{}   { return nil }
+
+// dirInfo describes a directory named name
+func dirInfo(name string, modTime time.Time) *fileInfo {
+	return &fileInfo{name: name, mode: fs.ModeDir | 0755, modTime: modTime}
+}
+
+// baseName is the name of the last element of a path, "/" for the root
+func baseName(name string) string {
+	if name = path.Clean("/" + name); name == "/" {
+		return "/"
+	}
+	return path.Base(name)
+}
+
+// pathError wraps err with the operation and name that caused it
+func pathError(op, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var pe *fs.PathError
+	if errors.As(err, &pe) {
+		return err
+	}
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
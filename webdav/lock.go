@@ -0,0 +1,220 @@
+package webdav
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultLockTimeout is used when the client does not ask for a timeout
+	DefaultLockTimeout = time.Hour
+	// MaxLockTimeout caps client-requested (and "Infinite") lock timeouts
+	MaxLockTimeout = 24 * time.Hour
+)
+
+var (
+	ErrLocked       = errors.New("resource is locked")
+	ErrNoSuchLock   = errors.New("no such lock")
+	ErrLockNotOwned = errors.New("lock token does not match resource")
+)
+
+// Lock describes an active WebDAV lock
+type Lock struct {
+	Token     string
+	Resource  string // Absolute filesystem path of the lock root
+	Href      string // URL of the lock root as seen by the client
+	Owner     string // Raw <D:owner> XML supplied by the client
+	Infinite  bool   // Depth: infinity
+	Exclusive bool
+	Timeout   time.Duration
+	ExpiresAt time.Time
+}
+
+// covers reports whether the lock applies to resource
+func (l *Lock) covers(resource string) bool {
+	if l.Resource == resource {
+		return true
+	}
+	return l.Infinite && isDescendant(l.Resource, resource)
+}
+
+// LockSystem is an in-memory store of WebDAV locks.
+// Resources are identified by absolute filesystem paths, which keeps
+// locks from different users' partitions apart.
+type LockSystem struct {
+	mu    sync.Mutex
+	locks map[string]*Lock // keyed by token
+}
+
+// NewLockSystem creates an empty lock system
+func NewLockSystem() *LockSystem {
+	return &LockSystem{
+		locks: make(map[string]*Lock),
+	}
+}
+
+// Create acquires a new lock on resource
+func (ls *LockSystem) Create(resource, href, owner string, infinite, exclusive bool, timeout time.Duration) (*Lock, error) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.purgeExpired()
+
+	for _, l := range ls.locks {
+		overlaps := l.covers(resource) || (infinite && isDescendant(resource, l.Resource))
+		if overlaps && (exclusive || l.Exclusive) {
+			return nil, ErrLocked
+		}
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+
+	timeout = clampTimeout(timeout)
+	lock := &Lock{
+		Token:     token,
+		Resource:  resource,
+		Href:      href,
+		Owner:     owner,
+		Infinite:  infinite,
+		Exclusive: exclusive,
+		Timeout:   timeout,
+		ExpiresAt: time.Now().Add(timeout),
+	}
+	ls.locks[token] = lock
+	return lock, nil
+}
+
+// Refresh extends the timeout of an existing lock covering resource
+func (ls *LockSystem) Refresh(resource, token string, timeout time.Duration) (*Lock, error) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.purgeExpired()
+
+	l, ok := ls.locks[token]
+	if !ok {
+		return nil, ErrNoSuchLock
+	}
+	if !l.covers(resource) {
+		return nil, ErrLockNotOwned
+	}
+
+	l.Timeout = clampTimeout(timeout)
+	l.ExpiresAt = time.Now().Add(l.Timeout)
+	return l, nil
+}
+
+// Unlock releases the lock identified by token
+func (ls *LockSystem) Unlock(resource, token string) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.purgeExpired()
+
+	l, ok := ls.locks[token]
+	if !ok {
+		return ErrNoSuchLock
+	}
+	if !l.covers(resource) {
+		return ErrLockNotOwned
+	}
+
+	delete(ls.locks, token)
+	return nil
+}
+
+// Confirm checks that every lock affecting resource (on the resource, an
+// ancestor with infinite depth, or a descendant) is matched by one of the
+// submitted tokens
+func (ls *LockSystem) Confirm(resource string, tokens []string) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.purgeExpired()
+
+	for _, l := range ls.locks {
+		if !l.covers(resource) && !isDescendant(resource, l.Resource) {
+			continue
+		}
+		if !containsToken(tokens, l.Token) {
+			return ErrLocked
+		}
+	}
+	return nil
+}
+
+// Discover returns the locks that apply to resource
+func (ls *LockSystem) Discover(resource string) []*Lock {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.purgeExpired()
+
+	var locks []*Lock
+	for _, l := range ls.locks {
+		if l.covers(resource) {
+			locks = append(locks, l)
+		}
+	}
+	return locks
+}
+
+// Release drops every lock on resource or below it, used after the
+// resource has been deleted or moved away
+func (ls *LockSystem) Release(resource string) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	for token, l := range ls.locks {
+		if l.Resource == resource || isDescendant(resource, l.Resource) {
+			delete(ls.locks, token)
+		}
+	}
+}
+
+func (ls *LockSystem) purgeExpired() {
+	now := time.Now()
+	for token, l := range ls.locks {
+		if now.After(l.ExpiresAt) {
+			delete(ls.locks, token)
+		}
+	}
+}
+
+func clampTimeout(timeout time.Duration) time.Duration {
+	if timeout <= 0 {
+		return DefaultLockTimeout
+	}
+	if timeout > MaxLockTimeout {
+		return MaxLockTimeout
+	}
+	return timeout
+}
+
+// isDescendant reports whether child lives strictly below parent
+func isDescendant(parent, child string) bool {
+	parent = strings.TrimSuffix(parent, "/")
+	return strings.HasPrefix(child, parent+"/")
+}
+
+func containsToken(tokens []string, token string) bool {
+	for _, t := range tokens {
+		if t == token {
+			return true
+		}
+	}
+	return false
+}
+
+// newToken generates an opaquelocktoken URI with a random (v4) UUID
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("opaquelocktoken:%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
@@ -0,0 +1,136 @@
+// Package webdav implements the protocol pieces of a WebDAV (RFC 4918)
+// server: request header parsing, PROPFIND/LOCK bodies, multistatus
+// responses and an in-memory lock system. The HTTP handler that maps
+// these onto a user's partition lives in routes/api.
+package webdav
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Depth values
+const (
+	DepthZero     = 0
+	DepthOne      = 1
+	DepthInfinity = -1
+)
+
+// ErrInvalidDepth is returned for malformed Depth headers
+var ErrInvalidDepth = errors.New("invalid depth")
+
+// ParseDepth parses the Depth header, returning def when it is absent
+func ParseDepth(r *http.Request, def int) (int, error) {
+	switch strings.ToLower(strings.TrimSpace(r.Header.Get("Depth"))) {
+	case "":
+		return def, nil
+	case "0":
+		return DepthZero, nil
+	case "1":
+		return DepthOne, nil
+	case "infinity":
+		return DepthInfinity, nil
+	}
+	return 0, ErrInvalidDepth
+}
+
+// ParseTimeout parses the Timeout header ("Second-N" or "Infinite").
+// Zero means the client expressed no preference.
+func ParseTimeout(r *http.Request) time.Duration {
+	for _, part := range strings.Split(r.Header.Get("Timeout"), ",") {
+		part = strings.TrimSpace(part)
+		if strings.EqualFold(part, "Infinite") {
+			return MaxLockTimeout
+		}
+		if strings.HasPrefix(part, "Second-") {
+			if n, err := strconv.ParseInt(strings.TrimPrefix(part, "Second-"), 10, 64); err == nil && n > 0 {
+				return time.Duration(n) * time.Second
+			}
+		}
+	}
+	return 0
+}
+
+// ParseOverwrite parses the Overwrite header (defaults to true)
+func ParseOverwrite(r *http.Request) bool {
+	return !strings.EqualFold(strings.TrimSpace(r.Header.Get("Overwrite")), "F")
+}
+
+// ParseLockToken extracts the token from a Lock-Token header ("<token>")
+func ParseLockToken(r *http.Request) string {
+	token := strings.TrimSpace(r.Header.Get("Lock-Token"))
+	token = strings.TrimPrefix(token, "<")
+	return strings.TrimSuffix(token, ">")
+}
+
+// IfTokens returns every state token submitted in the If header.
+// Tagged resources, entity tags and Not conditions are not evaluated;
+// the tokens are only used to prove lock ownership.
+func IfTokens(r *http.Request) []string {
+	header := r.Header.Get("If")
+	var tokens []string
+	inList := false
+	for i := 0; i < len(header); i++ {
+		switch header[i] {
+		case '(':
+			inList = true
+		case ')':
+			inList = false
+		case '<':
+			end := strings.IndexByte(header[i:], '>')
+			if end < 0 {
+				return tokens
+			}
+			if inList {
+				tokens = append(tokens, header[i+1:i+end])
+			}
+			i += end
+		case '[':
+			end := strings.IndexByte(header[i:], ']')
+			if end < 0 {
+				return tokens
+			}
+			i += end
+		}
+	}
+	return tokens
+}
+
+// ParseDestination extracts the path of the Destination header relative
+// to prefix. The header may be an absolute URL or an absolute path.
+func ParseDestination(r *http.Request, prefix string) (string, error) {
+	dest := r.Header.Get("Destination")
+	if dest == "" {
+		return "", errors.New("missing destination")
+	}
+
+	u, err := url.Parse(dest)
+	if err != nil {
+		return "", err
+	}
+	if u.Host != "" && r.Host != "" && !strings.EqualFold(u.Host, r.Host) {
+		return "", errors.New("destination is on another server")
+	}
+
+	if u.Path != prefix && !strings.HasPrefix(u.Path, prefix+"/") {
+		return "", errors.New("destination is outside the WebDAV root")
+	}
+	return "/" + strings.TrimPrefix(strings.TrimPrefix(u.Path, prefix), "/"), nil
+}
+
+// Href builds the escaped URL for a resource path below prefix
+func Href(prefix, path string, isDir bool) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	href := prefix + "/" + strings.Join(segments, "/")
+	if isDir && !strings.HasSuffix(href, "/") {
+		href += "/"
+	}
+	return href
+}
@@ -0,0 +1,282 @@
+package webdav
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// NS is the DAV: XML namespace
+const NS = "DAV:"
+
+// PropFind is a parsed PROPFIND request body
+type PropFind struct {
+	AllProp  bool
+	PropName bool
+	Props    []xml.Name
+}
+
+// ParsePropFind decodes a PROPFIND body. An empty body means allprop.
+func ParsePropFind(r io.Reader) (*PropFind, error) {
+	var body struct {
+		XMLName  xml.Name  `xml:"DAV: propfind"`
+		AllProp  *struct{} `xml:"DAV: allprop"`
+		PropName *struct{} `xml:"DAV: propname"`
+		Prop     struct {
+			Inner []struct {
+				XMLName xml.Name
+			} `xml:",any"`
+		} `xml:"DAV: prop"`
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return &PropFind{AllProp: true}, nil
+	}
+	if err := xml.Unmarshal(data, &body); err != nil {
+		return nil, err
+	}
+
+	pf := &PropFind{
+		AllProp:  body.AllProp != nil,
+		PropName: body.PropName != nil,
+	}
+	for _, p := range body.Prop.Inner {
+		pf.Props = append(pf.Props, p.XMLName)
+	}
+	if !pf.AllProp && !pf.PropName && len(pf.Props) == 0 {
+		return nil, errors.New("propfind must contain allprop, propname or prop")
+	}
+	return pf, nil
+}
+
+// LockInfo is a parsed LOCK request body
+type LockInfo struct {
+	Exclusive bool
+	Owner     string
+}
+
+// ParseLockInfo decodes a LOCK body. A nil result with no error means the
+// body was empty, i.e. the request is a lock refresh.
+func ParseLockInfo(r io.Reader) (*LockInfo, error) {
+	var body struct {
+		XMLName   xml.Name `xml:"DAV: lockinfo"`
+		LockScope struct {
+			Exclusive *struct{} `xml:"DAV: exclusive"`
+			Shared    *struct{} `xml:"DAV: shared"`
+		} `xml:"DAV: lockscope"`
+		LockType struct {
+			Write *struct{} `xml:"DAV: write"`
+		} `xml:"DAV: locktype"`
+		Owner struct {
+			InnerXML string `xml:",innerxml"`
+		} `xml:"DAV: owner"`
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, nil
+	}
+	if err := xml.Unmarshal(data, &body); err != nil {
+		return nil, err
+	}
+	if body.LockType.Write == nil {
+		return nil, errors.New("only write locks are supported")
+	}
+	if (body.LockScope.Exclusive == nil) == (body.LockScope.Shared == nil) {
+		return nil, errors.New("lockscope must be exclusive or shared")
+	}
+
+	return &LockInfo{
+		Exclusive: body.LockScope.Exclusive != nil,
+		Owner:     strings.TrimSpace(body.Owner.InnerXML),
+	}, nil
+}
+
+// Property is a single property value. Value is raw, already-escaped XML.
+type Property struct {
+	Name  xml.Name
+	Value string
+}
+
+// Response is one <D:response> element of a multistatus body
+type Response struct {
+	Href string
+	// Propstats maps a status code to the properties reported with it
+	Propstats map[int][]Property
+	// Status is used instead of Propstats for plain status responses
+	Status int
+}
+
+// MultiStatus accumulates responses and writes a 207 Multi-Status body
+type MultiStatus struct {
+	buf bytes.Buffer
+}
+
+// NewMultiStatus starts a multistatus document
+func NewMultiStatus() *MultiStatus {
+	ms := &MultiStatus{}
+	ms.buf.WriteString(xml.Header)
+	ms.buf.WriteString(`<D:multistatus xmlns:D="DAV:">`)
+	return ms
+}
+
+// Add appends a response
+func (ms *MultiStatus) Add(resp Response) {
+	ms.buf.WriteString("<D:response><D:href>")
+	xml.EscapeText(&ms.buf, []byte(resp.Href))
+	ms.buf.WriteString("</D:href>")
+
+	if len(resp.Propstats) == 0 {
+		fmt.Fprintf(&ms.buf, "<D:status>%s</D:status>", StatusLine(resp.Status))
+		ms.buf.WriteString("</D:response>")
+		return
+	}
+
+	for _, status := range []int{http.StatusOK, http.StatusNotFound, http.StatusForbidden} {
+		props, ok := resp.Propstats[status]
+		if !ok {
+			continue
+		}
+		ms.buf.WriteString("<D:propstat><D:prop>")
+		for _, p := range props {
+			writeProperty(&ms.buf, p)
+		}
+		fmt.Fprintf(&ms.buf, "</D:prop><D:status>%s</D:status></D:propstat>", StatusLine(status))
+	}
+	ms.buf.WriteString("</D:response>")
+}
+
+// WriteTo writes the document with a 207 status
+func (ms *MultiStatus) WriteTo(w http.ResponseWriter) {
+	ms.buf.WriteString("</D:multistatus>")
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	w.Write(ms.buf.Bytes())
+}
+
+func writeProperty(buf *bytes.Buffer, p Property) {
+	name := p.Name.Local
+	open := "<D:" + name
+	closeTag := "</D:" + name + ">"
+	if p.Name.Space != NS {
+		open = "<R:" + name + ` xmlns:R="` + escapeAttr(p.Name.Space) + `"`
+		closeTag = "</R:" + name + ">"
+	}
+	if p.Value == "" {
+		buf.WriteString(open + "/>")
+		return
+	}
+	buf.WriteString(open + ">")
+	buf.WriteString(p.Value)
+	buf.WriteString(closeTag)
+}
+
+// StatusLine formats an HTTP status line for multistatus bodies
+func StatusLine(code int) string {
+	return fmt.Sprintf("HTTP/1.1 %d %s", code, http.StatusText(code))
+}
+
+// Escape escapes text for inclusion in an XML element
+func Escape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+func escapeAttr(s string) string {
+	return strings.ReplaceAll(Escape(s), `"`, "&quot;")
+}
+
+// ActiveLockXML renders a <D:activelock> element for lock discovery
+func ActiveLockXML(l *Lock) string {
+	scope := "<D:shared/>"
+	if l.Exclusive {
+		scope = "<D:exclusive/>"
+	}
+	depth := "0"
+	if l.Infinite {
+		depth = "infinity"
+	}
+
+	var b strings.Builder
+	b.WriteString("<D:activelock><D:locktype><D:write/></D:locktype>")
+	b.WriteString("<D:lockscope>" + scope + "</D:lockscope>")
+	b.WriteString("<D:depth>" + depth + "</D:depth>")
+	if l.Owner != "" {
+		b.WriteString("<D:owner>" + l.Owner + "</D:owner>")
+	}
+	remaining := time.Until(l.ExpiresAt) / time.Second
+	if remaining < 0 {
+		remaining = 0
+	}
+	fmt.Fprintf(&b, "<D:timeout>Second-%d</D:timeout>", remaining)
+	b.WriteString("<D:locktoken><D:href>" + Escape(l.Token) + "</D:href></D:locktoken>")
+	b.WriteString("<D:lockroot><D:href>" + Escape(l.Href) + "</D:href></D:lockroot>")
+	b.WriteString("</D:activelock>")
+	return b.String()
+}
+
+// WriteLockResponse writes the body of a successful LOCK request
+func WriteLockResponse(w http.ResponseWriter, l *Lock, status int) {
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.Header().Set("Lock-Token", "<"+l.Token+">")
+	w.WriteHeader(status)
+	io.WriteString(w, xml.Header)
+	io.WriteString(w, `<D:prop xmlns:D="DAV:"><D:lockdiscovery>`+ActiveLockXML(l)+`</D:lockdiscovery></D:prop>`)
+}
+
+// WriteError writes a DAV error body with a precondition element
+func WriteError(w http.ResponseWriter, status int, condition string) {
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(status)
+	io.WriteString(w, xml.Header)
+	io.WriteString(w, `<D:error xmlns:D="DAV:"><D:`+condition+`/></D:error>`)
+}
+
+// ParsePropPatch decodes a PROPPATCH body and returns the names of every
+// property the client tried to set or remove
+func ParsePropPatch(r io.Reader) ([]xml.Name, error) {
+	type propList struct {
+		Inner []struct {
+			XMLName xml.Name
+		} `xml:",any"`
+	}
+	var body struct {
+		XMLName xml.Name `xml:"DAV: propertyupdate"`
+		Set     []struct {
+			Prop propList `xml:"DAV: prop"`
+		} `xml:"DAV: set"`
+		Remove []struct {
+			Prop propList `xml:"DAV: prop"`
+		} `xml:"DAV: remove"`
+	}
+
+	if err := xml.NewDecoder(io.LimitReader(r, 1<<20)).Decode(&body); err != nil {
+		return nil, err
+	}
+
+	var names []xml.Name
+	for _, s := range body.Set {
+		for _, p := range s.Prop.Inner {
+			names = append(names, p.XMLName)
+		}
+	}
+	for _, s := range body.Remove {
+		for _, p := range s.Prop.Inner {
+			names = append(names, p.XMLName)
+		}
+	}
+	return names, nil
+}